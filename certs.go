@@ -0,0 +1,145 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the certificate management subcommands of the node executable and
+// the revocation list watcher of running nodes.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Issues a certificate for the node identity in a data directory, creating the
+// identity if needed, signed by the cluster authority.
+func issue(args []string) {
+	flags := flag.NewFlagSet("issue", flag.ExitOnError)
+	caKey := flags.String("ca", "", "path to the RSA private key of the cluster authority")
+	data := flags.String("data", "", "data directory of the node to certify")
+	flags.Parse(args)
+
+	if *caKey == "" || *data == "" {
+		fmt.Fprintf(os.Stderr, "Both the authority key (-ca) and node data directory (-data) are required.\n")
+		os.Exit(-1)
+	}
+	authority, err := loadKey(*caKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v.\n", err)
+		os.Exit(-1)
+	}
+	ident, err := identity.Load(*data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Loading node identity failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	cert, err := identity.Issue(authority, &ident.Key.PublicKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Issuing node certificate failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	if err := identity.SaveCertificate(*data, cert); err != nil {
+		fmt.Fprintf(os.Stderr, "Saving node certificate failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	// Export the authority public key too for the node to verify its peers with
+	if err := identity.SaveAuthority(filepath.Join(*data, "ca.pub"), &authority.PublicKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Saving authority public key failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	fmt.Printf("Certificate issued for node %v.\n", cert.Id)
+}
+
+// Adds node ids to the revocation list of the cluster authority, creating the
+// list if none exists yet.
+func revoke(args []string) {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	caKey := flags.String("ca", "", "path to the RSA private key of the cluster authority")
+	crl := flags.String("crl", "", "path to the revocation list to update")
+	flags.Parse(args)
+
+	if *caKey == "" || *crl == "" || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "The authority key (-ca), revocation list (-crl) and node ids are required.\n")
+		os.Exit(-1)
+	}
+	authority, err := loadKey(*caKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v.\n", err)
+		os.Exit(-1)
+	}
+	// Load any previous list to extend
+	list := new(identity.Revocation)
+	if _, err := os.Stat(*crl); err == nil {
+		if list, err = identity.LoadRevocation(*crl); err != nil {
+			fmt.Fprintf(os.Stderr, "Loading revocation list failed: %v.\n", err)
+			os.Exit(-1)
+		}
+	}
+	ids := list.Ids
+	for _, arg := range flags.Args() {
+		id, ok := new(big.Int).SetString(arg, 10)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid node id: %v.\n", arg)
+			os.Exit(-1)
+		}
+		ids = append(ids, id)
+	}
+	// Sign and save the new list
+	if list, err = identity.Revoke(authority, list.Serial+1, ids); err != nil {
+		fmt.Fprintf(os.Stderr, "Signing revocation list failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	if err := identity.SaveRevocation(*crl, list); err != nil {
+		fmt.Fprintf(os.Stderr, "Saving revocation list failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	fmt.Printf("Revocation list #%d issued with %d nodes.\n", list.Serial, len(list.Ids))
+}
+
+// Periodically checks the revocation list file for updates, applying them to
+// the running overlay.
+func watchRevocations(path string, overlay *iris.Overlay) {
+	var modified time.Time
+	for ; ; time.Sleep(config.IdentityRevocationPeriod) {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().After(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		list, err := identity.LoadRevocation(path)
+		if err != nil {
+			log.Printf("main: failed to load revocation list: %v.", err)
+			continue
+		}
+		if err := overlay.Revoke(list); err != nil {
+			log.Printf("main: failed to apply revocation list: %v.", err)
+			continue
+		}
+		log.Printf("main: applied revocation list #%d.", list.Serial)
+	}
+}
@@ -0,0 +1,189 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package clock abstracts the passing of time, so that timer driven mechanisms
+// (heartbeats, convergence timeouts) can be run on a simulated timeline in tests
+// instead of the wall clock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source of the current time and of timer events.
+type Clock interface {
+	// Returns the current time.
+	Now() time.Time
+
+	// Returns a channel firing once after the given duration.
+	After(d time.Duration) <-chan time.Time
+
+	// Returns a ticker firing periodically with the given period.
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Periodic timer event source. Same as time.Ticker, slow receivers drop ticks.
+type Ticker struct {
+	C <-chan time.Time // Channel on which the ticks are delivered
+
+	stop func() // Releases the resources associated with the ticker
+}
+
+// Turns off the ticker. No more ticks will be sent after it returns.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// Wall clock backed by the time package.
+var System Clock = systemClock{}
+
+// Wall clock implementation.
+type systemClock struct{}
+
+// Implements Clock.Now.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Implements Clock.After.
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Implements Clock.NewTicker.
+func (systemClock) NewTicker(d time.Duration) *Ticker {
+	ticker := time.NewTicker(d)
+	return &Ticker{C: ticker.C, stop: ticker.Stop}
+}
+
+// Manually driven clock: time stands still until advanced explicitly, at which
+// point all the timers that expired are fired in chronological order.
+type Fake struct {
+	now    time.Time    // Current time of the simulated timeline
+	timers []*fakeTimer // Pending timers, sorted by expiration
+	lock   sync.Mutex   // Mutex protecting the timeline
+}
+
+// Timer or ticker registered with a fake clock.
+type fakeTimer struct {
+	when   time.Time      // Next expiration of the timer
+	period time.Duration  // Period of a ticker, zero for one-shot timers
+	sink   chan time.Time // Channel to deliver the events on
+}
+
+// Creates a fake clock, starting at the given time.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Implements Clock.Now.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+// Implements Clock.After.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	sink := make(chan time.Time, 1)
+	f.schedule(&fakeTimer{sink: sink}, d)
+	return sink
+}
+
+// Implements Clock.NewTicker.
+func (f *Fake) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	sink := make(chan time.Time, 1)
+	timer := &fakeTimer{period: d, sink: sink}
+	f.schedule(timer, d)
+
+	return &Ticker{C: sink, stop: func() { f.cancel(timer) }}
+}
+
+// Returns the number of timers waiting to expire.
+func (f *Fake) Pending() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.timers)
+}
+
+// Moves the clock forward by the given duration, firing all the timers expiring
+// in between. While a timer fires, the clock reports its expiration time.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	end := f.now.Add(d)
+	for len(f.timers) > 0 && !f.timers[0].when.After(end) {
+		// Pop the earliest timer and reschedule if periodic
+		timer := f.timers[0]
+		f.timers = f.timers[1:]
+
+		f.now = timer.when
+		if timer.period > 0 {
+			timer.when = timer.when.Add(timer.period)
+			f.insert(timer)
+		}
+		// Fire the event, dropping it if the previous one wasn't consumed yet
+		select {
+		case timer.sink <- f.now:
+		default:
+		}
+	}
+	f.now = end
+	f.lock.Unlock()
+}
+
+// Registers a new timer with the clock, expiring after d. One-shot timers with
+// a non-positive duration fire immediately.
+func (f *Fake) schedule(timer *fakeTimer, d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	timer.when = f.now.Add(d)
+	if d <= 0 {
+		timer.sink <- f.now
+		return
+	}
+	f.insert(timer)
+}
+
+// Inserts a timer into the sorted pending list, after any with the same expiry.
+func (f *Fake) insert(timer *fakeTimer) {
+	idx := sort.Search(len(f.timers), func(i int) bool { return f.timers[i].when.After(timer.when) })
+	f.timers = append(f.timers, nil)
+	copy(f.timers[idx+1:], f.timers[idx:])
+	f.timers[idx] = timer
+}
+
+// Removes a timer from the pending list.
+func (f *Fake) cancel(timer *fakeTimer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, t := range f.timers {
+		if t == timer {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// Checks whether a channel has an event pending, returning it if so.
+func fired(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFake(start)
+
+	late := clock.After(2 * time.Second)
+	early := clock.After(time.Second)
+	if _, ok := fired(clock.After(0)); !ok {
+		t.Fatalf("expired timer didn't fire immediately.")
+	}
+	// Advance partially, ensure only the early timer fires
+	clock.Advance(1500 * time.Millisecond)
+	if at, ok := fired(early); !ok || !at.Equal(start.Add(time.Second)) {
+		t.Fatalf("early timer mismatch: have %v/%v, want %v/%v.", at, ok, start.Add(time.Second), true)
+	}
+	if _, ok := fired(late); ok {
+		t.Fatalf("late timer fired prematurely.")
+	}
+	if now := clock.Now(); !now.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Fatalf("time mismatch: have %v, want %v.", now, start.Add(1500*time.Millisecond))
+	}
+	// Advance past the late timer, ensure it fires and nothing is left
+	clock.Advance(time.Second)
+	if at, ok := fired(late); !ok || !at.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("late timer mismatch: have %v/%v, want %v/%v.", at, ok, start.Add(2*time.Second), true)
+	}
+	if n := clock.Pending(); n != 0 {
+		t.Fatalf("pending timer count mismatch: have %v, want %v.", n, 0)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	clock := NewFake(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+
+	// Consume ticks one by one
+	for i := 1; i <= 3; i++ {
+		clock.Advance(time.Second)
+		if at, ok := fired(ticker.C); !ok || at.Unix() != int64(i) {
+			t.Fatalf("tick %d mismatch: have %v/%v, want %v/%v.", i, at.Unix(), ok, i, true)
+		}
+	}
+	// Skip multiple periods, ensure the unconsumed ticks are dropped
+	clock.Advance(5 * time.Second)
+	if at, ok := fired(ticker.C); !ok || at.Unix() != 4 {
+		t.Fatalf("first skipped tick mismatch: have %v/%v, want %v/%v.", at.Unix(), ok, 4, true)
+	}
+	if _, ok := fired(ticker.C); ok {
+		t.Fatalf("dropped tick delivered.")
+	}
+	// Stop the ticker and ensure no more ticks arrive
+	ticker.Stop()
+	clock.Advance(5 * time.Second)
+	if _, ok := fired(ticker.C); ok {
+		t.Fatalf("stopped ticker fired.")
+	}
+	if n := clock.Pending(); n != 0 {
+		t.Fatalf("pending timer count mismatch: have %v, want %v.", n, 0)
+	}
+}
@@ -20,9 +20,13 @@
 package config
 
 import (
+	"compress/flate"
 	"crypto"
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/md5"
+	_ "crypto/sha256"
 	"math/big"
 	"time"
 )
@@ -131,6 +135,9 @@ var HkdfSalt = []byte("iris.proto.session.hkdf.salt")
 // Info value for the HKDF key expansion.
 var HkdfInfo = []byte("iris.proto.session.hkdf.info")
 
+// Info value for the HKDF expansion of the session channel binding.
+var HkdfBindInfo = []byte("iris.proto.session.hkdf.bind")
+
 // Symmetric cipher to use for session encryption.
 var SessionCipher = aes.NewCipher
 
@@ -140,6 +147,28 @@ var SessionCipherBits = 128
 // Hash creator for the session HMAC.
 var SessionHash = md5.New
 
+// Cryptographic suites accepted for securing sessions ("classic", "modern"), the
+// strongest one supported by both sides being negotiated.
+var SessionSuites = []string{"modern", "classic"}
+
+// Elliptic curve for the modern suite's STS key agreement.
+var ModernStsCurve = ecdh.X25519()
+
+// Hash type for the modern suite's signatures and key derivations.
+var ModernHash = crypto.SHA256
+
+// Key size for the modern suite's symmetric ciphers (bits).
+var ModernCipherBits = 256
+
+// Authenticated cipher for the modern suite's link framing.
+var ModernAEAD = func(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // Maximum allowed time to complete a session connection.
 var SessionDialTimeout = time.Second
 
@@ -155,12 +184,50 @@ var SessionLinkTimeout = time.Second
 // Time allowance to gracefully terminate a session link.
 var SessionGraceTimeout = 3 * time.Second
 
+// Number of bytes a session link may send before rotating its keys.
+var SessionRekeyBytes = uint64(1 << 30)
+
+// Time interval after which a session link rotates its keys when sending.
+var SessionRekeyPeriod = time.Hour
+
+// Header encodings accepted on session links, newest first: 1 is the binary
+// wire format, 0 the legacy gob one (drop it once all nodes are upgraded).
+var WireVersions = []int{1, 0}
+
+// Largest payload buffer recycled by the message buffer pool. Bigger ones are
+// left to the garbage collector.
+var PoolBufferLimit = 1024 * 1024
+
+// Memory retained by each size class of the buffer pool when idle.
+var PoolClassBytes = 4 * 1024 * 1024
+
+// Maximum number of idle buffers retained by each size class of the pool.
+var PoolClassBuffers = 1024
+
+// Payload compression codecs accepted on session links and tunnels, preferred
+// first. An empty list disables compression altogether.
+var CompressCodecs = []string{"deflate"}
+
+// Smallest payload worth compressing (bytes), shorter ones are sent as is.
+var CompressThreshold = 512
+
+// Deflate level used when compressing payloads, trading ratio for throughput.
+var CompressLevel = flate.BestSpeed
+
+// Maximum size of a single gob message accepted from a network stream. Checked
+// before allocation to prevent remote peers from exhausting the local memory.
+var StreamMessageLimit = 32 * 1024 * 1024
+
 // Symmetric cipher for the temporary message encryption.
 var PacketCipher = aes.NewCipher
 
 // Key size for the temporary cipher (bits).
 var PacketCipherBits = 128
 
+// Security model of the message payloads, identical across the cluster: "e2e"
+// encrypts them once end-to-end, "link" on every hop instead, "both" does both.
+var SecurityMode = "e2e"
+
 // Bootstrapping ports to use.
 var BootPorts = []int{14142, 27182, 31415}
 
@@ -194,6 +261,69 @@ var BootCoreOSSleepIncrement = time.Second
 // Maximum sleep time for retrying after a failure.
 var BootCoreOSSleepLimit = time.Minute
 
+// Static bootstrap seeds (IP addresses or host names), possibly across routers.
+var BootSeeds = []string{}
+
+// DNS names to look bootstrap seeds up from (SRV if prefixed by '_', A/AAAA otherwise).
+var BootSeedDomains = []string{}
+
+// Seed file listing bootstrap seeds one per line, watched for changes.
+var BootSeedFile = ""
+
+// Time interval to report the configured seeds again during startup.
+var BootSeedFastRescan = 3 * time.Second
+
+// Time interval to report the configured seeds again during convergence.
+var BootSeedSlowRescan = time.Minute
+
+// Time interval to check the seed file for modifications.
+var BootSeedFilePoll = 5 * time.Second
+
+// Time limit for a single round of seed name resolutions.
+var BootSeedTimeout = 5 * time.Second
+
+// Sleep time increment for retrying after a failure.
+var BootSeedSleepIncrement = time.Second
+
+// Maximum sleep time for retrying after a failure.
+var BootSeedSleepLimit = time.Minute
+
+// Label selector of the Kubernetes endpoints to seed from (empty = disabled).
+var BootKubeSelector = ""
+
+// Kubernetes API server URL (empty = in-cluster service environment).
+var BootKubeAPI = ""
+
+// Kubernetes namespace of the endpoints (empty = namespace of the pod).
+var BootKubeNamespace = ""
+
+// Kubernetes service account folder with the token, CA certificate and namespace.
+var BootKubeAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Number of Kubernetes endpoint objects to retrieve in a single API request.
+var BootKubePageSize = 100
+
+// HTTP endpoint of the seed registry to register in and seed from (empty = disabled).
+var BootRegistryURL = ""
+
+// Protocol of the seed registry: etcd v3 JSON gateway ("etcd") or Consul ("consul").
+var BootRegistryKind = "etcd"
+
+// Key prefix of the seed registrations (cluster name and address appended).
+var BootRegistryPrefix = "iris/bootstrap"
+
+// Lifetime of a seed registration if not refreshed (Consul requires at least 10s).
+var BootRegistryTTL = 30 * time.Second
+
+// Size of the generated node identity keys (bits).
+var IdentityKeyBits = 2048
+
+// Hash type for the node certificate and revocation list signatures.
+var IdentitySigHash = crypto.SHA256
+
+// Period of checking the revocation list file for updates.
+var IdentityRevocationPeriod = time.Minute
+
 // Virtual address space (bits).
 var PastrySpace = 40
 
@@ -218,6 +348,9 @@ var PastryBeatPeriod = 3 * time.Second
 // Number of missed heartbeats after which to consider a node down.
 var PastryKillCount = 3
 
+// Latency reduction needed for a peer to replace a routing table entry (%).
+var PastryProximityGain = 25
+
 // Maximum time to queue an authenticated session connection before dropping it.
 var PastryAcceptTimeout = time.Second
 
@@ -236,6 +369,37 @@ var PastryAuthThreads = 8
 // Maximum number of state exchanges allowed concurrently.
 var PastryExchThreads = 128
 
+// Period of probing remembered peers and seeds to heal network partitions.
+var PastryHealPeriod = 10 * time.Second
+
+// Number of remembered peers to probe in a single healing round.
+var PastryHealProbes = 3
+
+// Time after which an unseen remembered peer is forgotten.
+var PastryHealExpiry = 30 * time.Minute
+
+// Maximum number of peers to remember for partition healing.
+var PastryHealMemory = 1024
+
+// Period of persisting the remembered peers into the peer cache.
+var PastryCachePeriod = time.Minute
+
+// Age after which a persisted peer cache is considered stale and ignored.
+var PastryCacheExpiry = 24 * time.Hour
+
+// Number of cached peers to dial on boot.
+var PastryCacheSeeds = 8
+
+// Maximum number of peers accepted in a single state exchange.
+var PastryStateLimit = 256
+
+// Maximum number of addresses accepted for a single peer.
+var PastryAddrLimit = 16
+
+// Whether routing table slots prefer the candidate closest to the slot's ideal
+// id instead of the lowest latency one (resists routing attacks, slower routes).
+var PastryConstrainedRoutes = false
+
 // Heartbeat period to distribute current CPU load and also check liveliness (ms).
 var ScribeBeatPeriod = time.Second
 
@@ -263,6 +427,21 @@ var IrisTunnelInitTimeout = time.Second
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Maximum permitted size of a cluster broadcast message.
+var IrisBroadcastLimit = 16 * 1024 * 1024
+
+// Maximum permitted size of a cluster request message.
+var IrisRequestLimit = 16 * 1024 * 1024
+
+// Maximum permitted size of a request reply (or failure reason).
+var IrisReplyLimit = 16 * 1024 * 1024
+
+// Maximum permitted size of a topic event.
+var IrisPublishLimit = 16 * 1024 * 1024
+
+// Maximum permitted length of a cluster or topic name.
+var IrisNameLimit = 1024
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
@@ -283,3 +462,18 @@ var RelayTunnelTimeout = 3 * time.Second
 
 // Block time when trying a tunnel read.
 var RelayTunnelPoll = time.Second
+
+// Default time limit for gateway requests lacking an explicit timeout.
+var GatewayRequestTimeout = 10 * time.Second
+
+// Maximum time limit a gateway request is allowed to specify.
+var GatewayRequestTimeoutLimit = time.Minute
+
+// Maximum permitted size for a gateway message body.
+var GatewayBodyLimit = int64(16 * 1024 * 1024)
+
+// Number of topic events to buffer for a gateway subscriber before dropping.
+var GatewayEventBuffer = 128
+
+// Interval for sending keep-alive comments on idle event streams.
+var GatewayKeepAlive = 15 * time.Second
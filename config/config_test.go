@@ -86,6 +86,33 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestModern(t *testing.T) {
+	// Ensure the suites are known ones
+	if len(SessionSuites) == 0 {
+		t.Errorf("config (suite): no session suites enabled.")
+	}
+	for _, suite := range SessionSuites {
+		if suite != "classic" && suite != "modern" {
+			t.Errorf("config (suite): unknown session suite: %v.", suite)
+		}
+	}
+	// Ensure the curve and hash are usable
+	if _, err := ModernStsCurve.GenerateKey(rand.Reader); err != nil {
+		t.Errorf("config (suite): failed to generate curve key: %v.", err)
+	}
+	if !ModernHash.Available() {
+		t.Errorf("config (suite): requested hash not linked into binary.")
+	}
+	// Ensure the authenticated cipher and key size combination is valid
+	key := make([]byte, ModernCipherBits/8)
+	if n, err := io.ReadFull(rand.Reader, key); n != len(key) || err != nil {
+		t.Errorf("config (suite): failed to generate random key: %v.", err)
+	}
+	if _, err := ModernAEAD(key); err != nil {
+		t.Errorf("config (suite): failed to create requested cipher: %v.", err)
+	}
+}
+
 func TestPack(t *testing.T) {
 	// Ensure a valid symmetric cipher
 	key := make([]byte, PacketCipherBits/8)
@@ -22,10 +22,15 @@
 //
 // Although STS is a generic key exchange protocol, some assumptions were hard
 // coded into the implementation:
-//   The asymmetric signature algorithm is RSA
+//   The key agreement is either finite field Diffie-Hellman or elliptic curve
+//   The asymmetric signature algorithm is RSA (PKCS#1 v1.5 or PSS)
 //   The symmetric encryption uses CTR mode
 //   The stream crypto key and IV are expanded with HKDF from the master key
 //
+// The two parties may sign with different RSA keys (e.g. certified individually
+// by a common authority), the authenticity of the foreign public key being the
+// responsibility of the caller.
+//
 // The cryptographic strength of the protocol is based on the analysis of the
 // general number field sieve algorithm, it being the fastest factoring method
 // till now. Matching STS bit sizes to AES (approx!):
@@ -37,6 +42,7 @@ package sts
 import (
 	"crypto"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rsa"
 	"errors"
 	"hash"
@@ -57,6 +63,14 @@ const (
 	finalized
 )
 
+// Signature schemes to authenticate the exchanged exponentials with.
+type Scheme uint8
+
+const (
+	PKCS1v15 Scheme = iota // RSASSA-PKCS1-v1_5 signatures
+	PSS                    // RSASSA-PSS signatures
+)
+
 // Protocol state structure
 type Session struct {
 	state state
@@ -64,12 +78,17 @@ type Session struct {
 	group     *big.Int
 	generator *big.Int
 
+	curve   ecdh.Curve
+	private *ecdh.PrivateKey
+
 	exponent   *big.Int
 	localExp   *big.Int
 	foreignExp *big.Int
-	secret     *big.Int
+	secret     []byte
+	transcript []byte
 
 	hash    crypto.Hash
+	scheme  Scheme
 	crypter func([]byte) (cipher.Block, error)
 	keybits int
 }
@@ -110,27 +129,61 @@ func New(random io.Reader, group, generator *big.Int, cipher func([]byte) (ciphe
 	return ses, nil
 }
 
+// Creates a new STS session operating on an elliptic curve (e.g. X25519) instead of a finite cyclic group. The
+// exponentials are the big endian interpretations of the encoded public points.
+func NewCurve(random io.Reader, curve ecdh.Curve, cipher func([]byte) (cipher.Block, error), bits int,
+	hash crypto.Hash) (*Session, error) {
+	key, err := curve.GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	ses := new(Session)
+	ses.curve = curve
+	ses.private = key
+	ses.hash = hash
+	ses.crypter = cipher
+	ses.keybits = bits
+
+	return ses, nil
+}
+
+// Sets the signature scheme authenticating the exchange (PKCS#1 v1.5 by default). It must be called before initiating
+// or accepting an exchange.
+func (s *Session) SetScheme(scheme Scheme) {
+	s.scheme = scheme
+}
+
+// Sets additional context (e.g. negotiated protocol parameters) to be covered by the signatures of both sides, so
+// that any disagreement fails the exchange. It must be called before accepting or verifying an exchange.
+func (s *Session) SetTranscript(transcript []byte) {
+	s.transcript = transcript
+}
+
 // Initiates an STS exchange session, returning the local exponential to connect with.
 func (s *Session) Initiate() (*big.Int, error) {
 	// Sanity check
 	if s.state != created {
 		return nil, errors.New("only a new session can initiate key exchanges")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	s.localExp = s.exponential()
 	s.state = initiated
 	return s.localExp, nil
 }
 
 // Accepts an incoming STS exchange session, returning the local exponential and the authorization token. The key is
-// used to authenticate the token for teh other side, whilst the exp is the foreign exponential.
+// the local private key used to authenticate the token for teh other side, whilst the exp is the foreign exponential.
 func (s *Session) Accept(random io.Reader, key *rsa.PrivateKey, exp *big.Int) (*big.Int, []byte, error) {
 	// Sanity check
 	if s.state != created {
 		return nil, nil, errors.New("only a new session can accept key exchange requests")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	secret, err := s.agree(exp)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.localExp = s.exponential()
 	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
+	s.secret = secret
 
 	token, err := s.genToken(random, key)
 	if err != nil {
@@ -150,12 +203,15 @@ func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.Publi
 		return nil, errors.New("only an initiated session can verify the acceptor")
 	}
 	// Verify the authorization token
-	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
-	err := s.verToken(pkey, token)
+	secret, err := s.agree(exp)
 	if err != nil {
 		return nil, err
 	}
+	s.foreignExp = exp
+	s.secret = secret
+	if err = s.verToken(pkey, token); err != nil {
+		return nil, err
+	}
 	// Generate this side's authorization token
 	token, err = s.genToken(random, skey)
 	if err != nil {
@@ -165,8 +221,8 @@ func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.Publi
 	return token, nil
 }
 
-// Finalizes an STS key exchange by authenticating the initiator's token with the local public key. Returns nil error
-// if verification succeeded.
+// Finalizes an STS key exchange by authenticating the initiator's token with the initiator's public key. Returns nil
+// error if verification succeeded.
 func (s *Session) Finalize(key *rsa.PublicKey, token []byte) error {
 	// Sanity check
 	if s.state != accepted {
@@ -186,16 +242,56 @@ func (s *Session) Secret() ([]byte, error) {
 	if s.state != verified && s.state != finalized {
 		return nil, errors.New("only a verified or finalized session can return a reliable shared secret")
 	}
-	return s.secret.Bytes(), nil
+	return s.secret, nil
 }
 
-// Calculates the authorization token: the encrypted RSA signature of the two exponentials (local first!)
+// Calculates the local exponential: the public point on curves, g^x otherwise.
+func (s *Session) exponential() *big.Int {
+	if s.curve != nil {
+		return new(big.Int).SetBytes(s.private.PublicKey().Bytes())
+	}
+	return new(big.Int).Exp(s.generator, s.exponent, s.group)
+}
+
+// Calculates the shared secret from the foreign exponential, rejecting values
+// that would degenerate the exchange.
+func (s *Session) agree(exp *big.Int) ([]byte, error) {
+	if exp == nil || exp.Sign() <= 0 {
+		return nil, errors.New("invalid foreign exponential")
+	}
+	if s.curve != nil {
+		size := len(s.private.PublicKey().Bytes())
+		if exp.BitLen() > size*8 {
+			return nil, errors.New("invalid foreign exponential")
+		}
+		pub, err := s.curve.NewPublicKey(exp.FillBytes(make([]byte, size)))
+		if err != nil {
+			return nil, err
+		}
+		return s.private.ECDH(pub)
+	}
+	if exp.Cmp(big.NewInt(1)) <= 0 || exp.Cmp(new(big.Int).Sub(s.group, big.NewInt(1))) >= 0 {
+		return nil, errors.New("invalid foreign exponential")
+	}
+	return new(big.Int).Exp(exp, s.exponent, s.group).Bytes(), nil
+}
+
+// Calculates the authorization token: the encrypted RSA signature of the two exponentials (local first!) and the
+// transcript.
 func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error) {
 	// Calculate the RSA signature
 	hasher := s.hash.New()
 	hasher.Write(append(s.localExp.Bytes(), s.foreignExp.Bytes()...))
+	hasher.Write(s.transcript)
 	hashsum := hasher.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(random, key, s.hash, hashsum)
+
+	var sig []byte
+	var err error
+	if s.scheme == PSS {
+		sig, err = rsa.SignPSS(random, key, s.hash, hashsum, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	} else {
+		sig, err = rsa.SignPKCS1v15(random, key, s.hash, hashsum)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -208,11 +304,13 @@ func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error
 	return sig, nil
 }
 
-// Verify the authorization token: the encrypted RSA signature of the two exponentials (foreign first!)
+// Verify the authorization token: the encrypted RSA signature of the two exponentials (foreign first!) and the
+// transcript.
 func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
 	// Calculate the required hash sum
 	hasher := s.hash.New()
 	hasher.Write(append(s.foreignExp.Bytes(), s.localExp.Bytes()...))
+	hasher.Write(s.transcript)
 	hashsum := hasher.Sum(nil)
 
 	// Create the stream cipher and decrypt the RSA signature
@@ -223,6 +321,9 @@ func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
 	stream.XORKeyStream(token, token)
 
 	// Verify the signature
+	if s.scheme == PSS {
+		return rsa.VerifyPSS(key, s.hash, hashsum, token, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
 	return rsa.VerifyPKCS1v15(key, s.hash, hashsum, token)
 }
 
@@ -231,7 +332,7 @@ func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
 func (s *Session) makeCipher() (cipher.Stream, error) {
 	// Create the key derivation function
 	hasher := func() hash.Hash { return s.hash.New() }
-	hkdf := hkdf.New(hasher, s.secret.Bytes(), hkdfSalt, hkdfInfo)
+	hkdf := hkdf.New(hasher, s.secret, hkdfSalt, hkdfInfo)
 
 	// Extract the symmetric key
 	key := make([]byte, s.keybits/8)
@@ -24,6 +24,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
+	"crypto/ecdh"
 	_ "crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -467,3 +468,77 @@ func TestSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestCurve(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	for i, scheme := range []Scheme{PKCS1v15, PSS} {
+		iniSes, err := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 256, crypto.SHA256)
+		if err != nil {
+			t.Fatalf("test %d: failed to create initiator session: %v", i, err)
+		}
+		accSes, err := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 256, crypto.SHA256)
+		if err != nil {
+			t.Fatalf("test %d: failed to create acceptor session: %v", i, err)
+		}
+		iniSes.SetScheme(scheme)
+		accSes.SetScheme(scheme)
+
+		iniExp, _ := iniSes.Initiate()
+		accExp, accToken, err := accSes.Accept(rand.Reader, accKey, iniExp)
+		if err != nil {
+			t.Fatalf("test %d: failed to accept exchange: %v", i, err)
+		}
+		iniToken, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+		if err != nil {
+			t.Fatalf("test %d: failed to verify acceptor: %v", i, err)
+		}
+		if err := accSes.Finalize(&iniKey.PublicKey, iniToken); err != nil {
+			t.Fatalf("test %d: failed to finalize exchange: %v", i, err)
+		}
+		iniSecret, _ := iniSes.Secret()
+		accSecret, _ := accSes.Secret()
+		if len(iniSecret) != 32 || !bytes.Equal(iniSecret, accSecret) {
+			t.Errorf("test %d: secret mismatch: initiator %v, acceptor %v", i, iniSecret, accSecret)
+		}
+	}
+	// Ensure degenerate exponentials are rejected
+	ses, _ := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 256, crypto.SHA256)
+	for i, exp := range []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 256)} {
+		if _, _, err := ses.Accept(rand.Reader, accKey, exp); err == nil {
+			t.Errorf("test %d: degenerate exponential accepted: %v", i, exp)
+		}
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tests := []struct {
+		ini, acc []byte
+		pass     bool
+	}{
+		{nil, nil, true},
+		{[]byte("modern"), []byte("modern"), true},
+		{[]byte("modern,classic"), []byte("classic"), false},
+		{[]byte("modern"), nil, false},
+	}
+	for i, tt := range tests {
+		iniSes, _ := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 256, crypto.SHA256)
+		accSes, _ := NewCurve(rand.Reader, ecdh.X25519(), aes.NewCipher, 256, crypto.SHA256)
+		iniSes.SetTranscript(tt.ini)
+		accSes.SetTranscript(tt.acc)
+
+		iniExp, _ := iniSes.Initiate()
+		accExp, accToken, err := accSes.Accept(rand.Reader, accKey, iniExp)
+		if err != nil {
+			t.Fatalf("test %d: failed to accept exchange: %v", i, err)
+		}
+		_, err = iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+		if pass := err == nil; pass != tt.pass {
+			t.Errorf("test %d: verification mismatch: have %v, want %v", i, pass, tt.pass)
+		}
+	}
+}
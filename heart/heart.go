@@ -26,6 +26,8 @@ import (
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/project-iris/iris/clock"
 )
 
 // Heartbeat callback interface to get notified of events.
@@ -41,6 +43,8 @@ type Heart struct {
 	beat time.Duration // Time duration of a beat cycle
 	kill int           // Number of missed ticks before and entity is reported dead
 
+	clock clock.Clock // Time source driving the beat cycles
+
 	call Callback // Application callback to notify of events
 
 	quit chan chan error // Quit synchronizer to ensure cleanup
@@ -55,10 +59,18 @@ func New(beat time.Duration, kill int, handler Callback) *Heart {
 		beat: beat,
 		kill: kill,
 		call: handler,
-		quit: make(chan chan error),
+
+		clock: clock.System,
+		quit:  make(chan chan error),
 	}
 }
 
+// Replaces the time source driving the beat cycles (wall clock by default). It
+// must be called before starting the heartbeat.
+func (h *Heart) SetClock(clk clock.Clock) {
+	h.clock = clk
+}
+
 // Starts the beater and event notifier.
 func (h *Heart) Start() {
 	go h.beater()
@@ -122,7 +134,7 @@ func (h *Heart) Ping(id *big.Int) error {
 // monitored entity and report when some fail to respond within alloted time.
 func (h *Heart) beater() {
 	// Create the ticker to fire the beat events
-	beat := time.NewTicker(h.beat)
+	beat := h.clock.NewTicker(h.beat)
 	defer beat.Stop()
 
 	dead := []*big.Int{}
@@ -24,6 +24,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/clock"
 )
 
 // Simple heartbeat callback to gather the events
@@ -126,3 +128,46 @@ func TestHeart(t *testing.T) {
 	}
 	call.assertDead(t, 1)
 }
+
+// Waits until the beat event count reaches k, or fails after a while.
+func (cb *testCallback) awaitBeats(t *testing.T, k int) {
+	for i := 0; int(atomic.LoadInt32(&cb.beat)) < k; i++ {
+		if i == 1000 {
+			t.Fatalf("beat event count mismatch: have %v, want %v", atomic.LoadInt32(&cb.beat), k)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHeartClock(t *testing.T) {
+	alice := big.NewInt(314)
+
+	// Create a heartbeat mechanism driven by a fake clock
+	beat, kill := time.Hour, 2
+	call := &testCallback{dead: []*big.Int{}}
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	heart := New(beat, kill, call)
+	heart.SetClock(clk)
+	if err := heart.Monitor(alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	heart.Start()
+	for clk.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Step the clock beat by beat and check the events
+	for i := 1; i <= kill; i++ {
+		call.assertDead(t, 0)
+		clk.Advance(beat)
+		call.awaitBeats(t, i)
+	}
+	// Terminate the beater (syncing pending events) and check the dead reports
+	if err := heart.Terminate(); err != nil {
+		t.Fatalf("failed to terminate beater: %v.", err)
+	}
+	call.assertDead(t, 1)
+	if n := clk.Pending(); n != 0 {
+		t.Fatalf("pending timer count mismatch: have %v, want %v.", n, 0)
+	}
+}
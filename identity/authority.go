@@ -0,0 +1,225 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Custom authority error messages
+var ErrRevoked = errors.New("identity: certificate revoked")
+var ErrRevokedId = errors.New("identity: revoked id outside the id space")
+
+// Context prefixed to the signed revocation contents, separating them from any
+// other data signed by the authority (e.g. node certificates).
+const revocationContext = "iris-revocation\x00"
+
+// Certificate authority of a cluster, verifying node certificates against the
+// trusted authority keys and the most recent revocation list. Multiple keys can
+// be trusted at the same time to allow rotating the authority key.
+type Authority struct {
+	keys    []*rsa.PublicKey    // Public keys trusted by the cluster authority
+	serial  int64               // Serial number of the applied revocation list
+	revoked map[string]struct{} // Ids of the revoked nodes
+	lock    sync.RWMutex        // Mutex protecting the trust and revocation state
+}
+
+// List of revoked node ids signed by the cluster authority. Lists are cumulative
+// and a higher serial number supersedes all previous lists.
+type Revocation struct {
+	Serial    int64      // Sequence number of the list
+	Ids       []*big.Int // Overlay ids of the revoked nodes
+	Signature []byte     // Authority signature over the serial and ids
+}
+
+// Creates a certificate authority verifier trusting the given public keys.
+func NewAuthority(keys ...*rsa.PublicKey) *Authority {
+	return &Authority{
+		keys:    keys,
+		revoked: make(map[string]struct{}),
+	}
+}
+
+// Loads the public key of a certificate authority from a PEM file.
+func LoadAuthority(path string) (*Authority, error) {
+	key, err := LoadPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthority(key), nil
+}
+
+// Loads an RSA public key from a PEM file.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	blob, err := readPEM(path, "RSA PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PublicKey(blob)
+}
+
+// Saves the public key of a certificate authority into a PEM file.
+func SaveAuthority(path string, key *rsa.PublicKey) error {
+	return writePEM(path, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(key))
+}
+
+// Adds a public key to the set trusted by the authority.
+func (a *Authority) Trust(key *rsa.PublicKey) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, trusted := range a.keys {
+		if trusted.N.Cmp(key.N) == 0 && trusted.E == key.E {
+			return
+		}
+	}
+	a.keys = append(a.keys, key)
+}
+
+// Verifies a node certificate, returning the certified node key if the
+// certificate was signed by a trusted key and was not revoked since.
+func (a *Authority) Verify(cert *Certificate) (*rsa.PublicKey, error) {
+	if cert == nil {
+		return nil, errors.New("identity: missing certificate")
+	}
+	a.lock.RLock()
+	keys := a.keys
+	a.lock.RUnlock()
+
+	err := errors.New("identity: no trusted keys")
+	for _, trusted := range keys {
+		var key *rsa.PublicKey
+		if key, err = cert.Verify(trusted); err == nil {
+			if a.Revoked(cert.Id) {
+				return nil, ErrRevoked
+			}
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// Checks whether a node id was revoked by the authority.
+func (a *Authority) Revoked(id *big.Int) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	_, ok := a.revoked[id.String()]
+	return ok
+}
+
+// Applies a revocation list after verifying its signature with any trusted key.
+// Lists older than the currently applied one are silently ignored.
+func (a *Authority) Apply(list *Revocation) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	digest, err := list.digest()
+	if err != nil {
+		return err
+	}
+	err = errors.New("identity: no trusted keys")
+	for _, trusted := range a.keys {
+		if err = rsa.VerifyPKCS1v15(trusted, config.IdentitySigHash, digest, list.Signature); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if list.Serial <= a.serial {
+		return nil
+	}
+	a.serial = list.Serial
+	a.revoked = make(map[string]struct{})
+	for _, id := range list.Ids {
+		a.revoked[id.String()] = struct{}{}
+	}
+	return nil
+}
+
+// Issues a revocation list with the given serial number, signed with the
+// authority key.
+func Revoke(authority *rsa.PrivateKey, serial int64, ids []*big.Int) (*Revocation, error) {
+	list := &Revocation{
+		Serial: serial,
+		Ids:    ids,
+	}
+	digest, err := list.digest()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, authority, config.IdentitySigHash, digest)
+	if err != nil {
+		return nil, err
+	}
+	list.Signature = sig
+	return list, nil
+}
+
+// Loads a revocation list from a PEM file.
+func LoadRevocation(path string) (*Revocation, error) {
+	blob, err := readPEM(path, "IRIS REVOCATION LIST")
+	if err != nil {
+		return nil, err
+	}
+	list := new(Revocation)
+	if _, err := asn1.Unmarshal(blob, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Saves a revocation list into a PEM file.
+func SaveRevocation(path string, list *Revocation) error {
+	blob, err := asn1.Marshal(*list)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "IRIS REVOCATION LIST", blob)
+}
+
+// Calculates the digest of the revoked contents, failing if any of the ids is
+// outside the overlay id space.
+func (r *Revocation) digest() ([]byte, error) {
+	serial := make([]byte, 8)
+	binary.BigEndian.PutUint64(serial, uint64(r.Serial))
+
+	hasher := config.IdentitySigHash.New()
+	hasher.Write([]byte(revocationContext))
+	hasher.Write(serial)
+	for _, id := range r.Ids {
+		buf := make([]byte, config.PastrySpace/8)
+		if id == nil || id.Sign() < 0 || id.BitLen() > len(buf)*8 {
+			return nil, ErrRevokedId
+		}
+		hasher.Write(id.FillBytes(buf))
+	}
+	return hasher.Sum(nil), nil
+}
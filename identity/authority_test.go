@@ -0,0 +1,132 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestAuthority(t *testing.T) {
+	// Use small keys to speed the test up
+	bits := config.IdentityKeyBits
+	config.IdentityKeyBits = 1024
+	defer func() { config.IdentityKeyBits = bits }()
+
+	old, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	node, err := New()
+	if err != nil {
+		t.Fatalf("failed to create identity: %v.", err)
+	}
+	cert, err := Issue(rotated, &node.Key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v.", err)
+	}
+	// Ensure certificates of untrusted keys are rejected until trusted
+	authority := NewAuthority(&old.PublicKey)
+	if _, err := authority.Verify(cert); err == nil {
+		t.Fatalf("certificate of untrusted key verified.")
+	}
+	authority.Trust(&rotated.PublicKey)
+	if _, err := authority.Verify(cert); err != nil {
+		t.Fatalf("failed to verify certificate of trusted key: %v.", err)
+	}
+	// Revoke the node with the rotated key and ensure it's rejected
+	list, err := Revoke(rotated, 1, []*big.Int{node.Id})
+	if err != nil {
+		t.Fatalf("failed to issue revocation list: %v.", err)
+	}
+	if err := authority.Apply(list); err != nil {
+		t.Fatalf("failed to apply revocation list: %v.", err)
+	}
+	if _, err := authority.Verify(cert); err != ErrRevoked {
+		t.Fatalf("revocation mismatch: have %v, want %v.", err, ErrRevoked)
+	}
+	// Ensure stale and foreign lists are ignored or rejected
+	stale, _ := Revoke(old, 1, nil)
+	if err := authority.Apply(stale); err != nil {
+		t.Fatalf("failed to apply stale revocation list: %v.", err)
+	}
+	if !authority.Revoked(node.Id) {
+		t.Fatalf("stale revocation list applied.")
+	}
+	rogue, _ := rsa.GenerateKey(rand.Reader, 1024)
+	forged, _ := Revoke(rogue, 2, nil)
+	if err := authority.Apply(forged); err == nil {
+		t.Fatalf("foreign revocation list applied.")
+	}
+}
+
+func TestRevocationDomain(t *testing.T) {
+	// Use small keys to speed the test up
+	bits := config.IdentityKeyBits
+	config.IdentityKeyBits = 1024
+	defer func() { config.IdentityKeyBits = bits }()
+
+	cluster, _ := rsa.GenerateKey(rand.Reader, 1024)
+	authority := NewAuthority(&cluster.PublicKey)
+
+	// Pick a node exponent aligning the certified contents to a revocation list
+	node, err := New()
+	if err != nil {
+		t.Fatalf("failed to create identity: %v.", err)
+	}
+	idLen := config.PastrySpace / 8
+	key := node.Key.PublicKey
+	key.E = 3
+	for (idLen+len(x509.MarshalPKCS1PublicKey(&key))-8)%idLen != 0 {
+		key.E = key.E<<8 | 1
+	}
+	cert, err := Issue(cluster, &key)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v.", err)
+	}
+	// Reinterpret the certified contents as a revocation list and ensure it's rejected
+	blob := append(cert.Id.FillBytes(make([]byte, idLen)), cert.Key...)
+	forged := &Revocation{
+		Serial:    int64(binary.BigEndian.Uint64(blob)),
+		Signature: cert.Signature,
+	}
+	for i := 8; i < len(blob); i += idLen {
+		forged.Ids = append(forged.Ids, new(big.Int).SetBytes(blob[i:i+idLen]))
+	}
+	if err := authority.Apply(forged); err == nil {
+		t.Fatalf("certificate signature accepted as revocation list.")
+	}
+	// Ensure ids outside the id space can be neither signed nor applied
+	invalid := []*big.Int{big.NewInt(-1), new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace))}
+	for _, id := range invalid {
+		if _, err := Revoke(cluster, 1, []*big.Int{id}); err != ErrRevokedId {
+			t.Fatalf("invalid id %v: revocation error mismatch: have %v, want %v.", id, err, ErrRevokedId)
+		}
+		list, _ := Revoke(cluster, 1, []*big.Int{big.NewInt(0)})
+		list.Ids[0] = id
+		if err := authority.Apply(list); err != ErrRevokedId {
+			t.Fatalf("invalid id %v: apply error mismatch: have %v, want %v.", id, err, ErrRevokedId)
+		}
+	}
+}
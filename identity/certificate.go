@@ -0,0 +1,115 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"path/filepath"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Custom certificate error messages
+var ErrIdMismatch = errors.New("identity: id not derived from the certified key")
+
+// Context prefixed to the signed certificate contents, separating them from any
+// other data signed by the cluster key (e.g. revocation lists).
+const certificateContext = "iris-node-cert\x00"
+
+// Certificate binding an overlay id to the public key of a node, signed by the
+// cluster key. As the id is derived from the key, nodes cannot pick arbitrary
+// positions in the id space.
+type Certificate struct {
+	Id        *big.Int // Overlay id of the node
+	Key       []byte   // PKCS1 encoded public key of the node
+	Signature []byte   // Cluster key signature over the id and node key
+}
+
+// Issues a certificate for a node key, signed with the cluster key.
+func Issue(cluster *rsa.PrivateKey, node *rsa.PublicKey) (*Certificate, error) {
+	cert := &Certificate{
+		Id:  Derive(node),
+		Key: x509.MarshalPKCS1PublicKey(node),
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, cluster, config.IdentitySigHash, cert.digest())
+	if err != nil {
+		return nil, err
+	}
+	cert.Signature = sig
+	return cert, nil
+}
+
+// Verifies the cluster signature and the id derivation of the certificate,
+// returning the certified node key if valid.
+func (c *Certificate) Verify(cluster *rsa.PublicKey) (*rsa.PublicKey, error) {
+	if c.Id == nil || c.Id.Sign() < 0 {
+		return nil, ErrIdMismatch
+	}
+	if err := rsa.VerifyPKCS1v15(cluster, config.IdentitySigHash, c.digest(), c.Signature); err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PublicKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	if Derive(key).Cmp(c.Id) != 0 {
+		return nil, ErrIdMismatch
+	}
+	return key, nil
+}
+
+// Loads the node certificate from the data directory.
+func LoadCertificate(dir string) (*Certificate, error) {
+	blob, err := readPEM(filepath.Join(dir, certFile), "IRIS NODE CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	cert := new(Certificate)
+	if _, err := asn1.Unmarshal(blob, cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Saves the node certificate into the data directory.
+func SaveCertificate(dir string, cert *Certificate) error {
+	blob, err := asn1.Marshal(*cert)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, certFile), "IRIS NODE CERTIFICATE", blob)
+}
+
+// Calculates the digest of the certified contents.
+func (c *Certificate) digest() []byte {
+	id := make([]byte, config.PastrySpace/8)
+	if c.Id != nil && c.Id.BitLen() <= len(id)*8 {
+		c.Id.FillBytes(id)
+	}
+	hasher := config.IdentitySigHash.New()
+	hasher.Write([]byte(certificateContext))
+	hasher.Write(id)
+	hasher.Write(c.Key)
+	return hasher.Sum(nil)
+}
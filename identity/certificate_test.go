@@ -0,0 +1,75 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestCertificate(t *testing.T) {
+	// Use small keys to speed the test up
+	bits := config.IdentityKeyBits
+	config.IdentityKeyBits = 1024
+	defer func() { config.IdentityKeyBits = bits }()
+
+	cluster, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rogue, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	node, err := New()
+	if err != nil {
+		t.Fatalf("failed to create identity: %v.", err)
+	}
+	// Issue a certificate and verify it
+	cert, err := Issue(cluster, &node.Key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v.", err)
+	}
+	if cert.Id.Cmp(node.Id) != 0 {
+		t.Fatalf("certified id mismatch: have %v, want %v.", cert.Id, node.Id)
+	}
+	key, err := cert.Verify(&cluster.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify certificate: %v.", err)
+	}
+	if key.N.Cmp(node.Key.N) != 0 {
+		t.Fatalf("certified key mismatch.")
+	}
+	// Ensure foreign signers and tampered ids are rejected
+	if _, err := cert.Verify(&rogue.PublicKey); err == nil {
+		t.Fatalf("certificate verified with foreign cluster key.")
+	}
+	forged := *cert
+	forged.Id = new(big.Int).Add(cert.Id, big.NewInt(1))
+	if _, err := forged.Verify(&cluster.PublicKey); err == nil {
+		t.Fatalf("tampered certificate verified.")
+	}
+	// Ensure forged certificates with derived ids still need the cluster key
+	forgery, err := Issue(rogue, &node.Key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to issue rogue certificate: %v.", err)
+	}
+	if _, err := forgery.Verify(&cluster.PublicKey); err == nil {
+		t.Fatalf("rogue certificate verified.")
+	}
+}
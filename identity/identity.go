@@ -0,0 +1,137 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package identity manages the persistent identity of an Iris node: a private
+// key generated on the first start and stored in the node's data directory, and
+// the overlay id derived from it. A restarted node thus retakes its previous
+// position in the id space, keeping topic roots and key ownership stable.
+//
+// Node keys are certified by a cluster certificate authority, which is trusted
+// by all members and can revoke individual nodes through revocation lists.
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Names of the private key and certificate files within the data directory.
+const (
+	keyFile  = "node.key"
+	certFile = "node.crt"
+)
+
+// Persistent identity of a single node.
+type Identity struct {
+	Key *rsa.PrivateKey // Private key of the node
+	Id  *big.Int        // Overlay id derived from the public key
+}
+
+// Generates a new random node identity.
+func New() (*Identity, error) {
+	key, err := rsa.GenerateKey(rand.Reader, config.IdentityKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Key: key,
+		Id:  Derive(&key.PublicKey),
+	}, nil
+}
+
+// Loads the node identity from the data directory, generating and persisting a
+// new one if none exists yet.
+func Load(dir string) (*Identity, error) {
+	// Try to load an existing key first
+	blob, err := readPEM(filepath.Join(dir, keyFile), "RSA PRIVATE KEY")
+	switch {
+	case err == nil:
+		key, err := x509.ParsePKCS1PrivateKey(blob)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{
+			Key: key,
+			Id:  Derive(&key.PublicKey),
+		}, nil
+
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	// No identity yet, generate and save a new one
+	id, err := New()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, keyFile), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(id.Key)); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Reads a single PEM block of the given type from a file.
+func readPEM(path string, kind string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(blob)
+	if block == nil {
+		return nil, fmt.Errorf("identity: no PEM data in %s", path)
+	}
+	if block.Type != kind {
+		return nil, fmt.Errorf("identity: PEM type mismatch in %s: have %s, want %s", path, block.Type, kind)
+	}
+	return block.Bytes, nil
+}
+
+// Atomically writes a single PEM block of the given type into a file, readable
+// only by the owner.
+func writePEM(path string, kind string, data []byte) error {
+	block := &pem.Block{
+		Type:  kind,
+		Bytes: data,
+	}
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Derives the overlay id belonging to a public key by hashing it into the id
+// space of the overlay.
+func Derive(key *rsa.PublicKey) *big.Int {
+	hasher := config.PastryResolver()
+	hasher.Write(x509.MarshalPKCS1PublicKey(key))
+	sum := hasher.Sum(nil)
+
+	return new(big.Int).SetBytes(sum[:config.PastrySpace/8])
+}
@@ -0,0 +1,71 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestLoad(t *testing.T) {
+	// Use small keys to speed the test up
+	bits := config.IdentityKeyBits
+	config.IdentityKeyBits = 1024
+	defer func() { config.IdentityKeyBits = bits }()
+
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Load a fresh identity and make sure it's persisted
+	first, err := Load(dir)
+	if err != nil {
+		t.Fatalf("failed to create identity: %v.", err)
+	}
+	if bits := first.Id.BitLen(); bits > config.PastrySpace {
+		t.Fatalf("node id out of overlay space: have %v bits, want at most %v.", bits, config.PastrySpace)
+	}
+	if id := Derive(&first.Key.PublicKey); id.Cmp(first.Id) != 0 {
+		t.Fatalf("derived id mismatch: have %v, want %v.", id, first.Id)
+	}
+	// Reload the identity and ensure it's the same
+	second, err := Load(dir)
+	if err != nil {
+		t.Fatalf("failed to reload identity: %v.", err)
+	}
+	if second.Id.Cmp(first.Id) != 0 {
+		t.Fatalf("reloaded id mismatch: have %v, want %v.", second.Id, first.Id)
+	}
+	if second.Key.N.Cmp(first.Key.N) != 0 {
+		t.Fatalf("reloaded key mismatch.")
+	}
+	// Ensure a different directory yields a different identity
+	other, err := Load(dir + "/other")
+	if err != nil {
+		t.Fatalf("failed to create second identity: %v.", err)
+	}
+	if other.Id.Cmp(first.Id) == 0 {
+		t.Fatalf("independent identities collide: %v.", other.Id)
+	}
+}
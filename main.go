@@ -30,19 +30,38 @@ import (
 	rng "math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/session"
+	"github.com/project-iris/iris/service/gateway"
 	"github.com/project-iris/iris/service/relay"
 )
 
 // Command line flags
 var devMode = flag.Bool("dev", false, "start in local developer mode (random cluster and key)")
 var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting clients")
+var httpPort = flag.Int("http", 0, "HTTP gateway endpoint for local tools (0 = disabled)")
 var clusterName = flag.String("net", "", "name of the cluster to join or create")
 var rsaKeyPath = flag.String("rsa", "", "path to the RSA private key to use for data security")
+var dataDir = flag.String("data", "", "directory to persist node state into (identity, peer cache)")
+var caKeyPath = flag.String("ca", "", "path to the cluster authority public key (replaces -rsa)")
+var crlPath = flag.String("crl", "", "path to the revocation list of the cluster authority")
+var trustPaths = flag.String("trust", "", "comma separated RSA keys to also accept during key rotation")
+var cryptoSuites = flag.String("suite", strings.Join(config.SessionSuites, ","), "comma separated crypto suites to accept, strongest common used (modern, classic)")
+var securityMode = flag.String("security", config.SecurityMode, "payload encryption, same on all nodes: end-to-end, per link hop or both (e2e, link, both)")
+var seedHosts = flag.String("seeds", "", "comma separated bootstrap seeds (IP addresses or host names), even across routers")
+var seedDomains = flag.String("seeddns", "", "comma separated DNS names to look seeds up from (SRV if prefixed by '_', A/AAAA otherwise)")
+var seedFile = flag.String("seedfile", "", "path to a bootstrap seed file (one seed per line), reloaded on changes")
+var kubeSelector = flag.String("kube", "", "label selector of the Kubernetes endpoints to seed from (in-cluster API)")
+var registryURL = flag.String("registry", "", "HTTP endpoint of a seed registry to register in and seed from")
+var registryKind = flag.String("registrykind", config.BootRegistryKind, "protocol of the seed registry (etcd, consul)")
 
 var cpuProfile = flag.String("cpuprof", "", "path to CPU profiling results")
 var heapProfile = flag.String("heapprof", "", "path to memory heap profiling results")
@@ -52,7 +71,9 @@ var blockProfile = flag.String("blockprof", "", "path to lock contention profili
 func usage() {
 	fmt.Printf("Server node of the Iris decentralized messaging framework.\n\n")
 	fmt.Printf("Usage:\n\n")
-	fmt.Printf("\t%s [options]\n\n", os.Args[0])
+	fmt.Printf("\t%s [options]\n", os.Args[0])
+	fmt.Printf("\t%s issue -ca <authority key> -data <node data dir>\n", os.Args[0])
+	fmt.Printf("\t%s revoke -ca <authority key> -crl <revocation list> <node id>...\n\n", os.Args[0])
 
 	fmt.Printf("The options are:\n\n")
 	flag.VisitAll(func(f *flag.Flag) {
@@ -66,6 +87,11 @@ func usage() {
 	})
 	fmt.Printf("\n")
 
+	fmt.Printf("The cluster (or authority) key can be rotated node by node without an outage:\n\n")
+	fmt.Printf("\t1. Restart each node trusting the new key too (-trust=<new key>)\n")
+	fmt.Printf("\t2. Restart each node signing with the new key (-rsa=<new key> or reissued certificate, -trust=<old key>)\n")
+	fmt.Printf("\t3. Restart each node without trusting the old key (-rsa=<new key>)\n\n")
+
 	fmt.Printf("Profiling options:\n\n")
 	flag.VisitAll(func(f *flag.Flag) {
 		if strings.HasSuffix(f.Name, "prof") {
@@ -88,6 +114,46 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [1-65535].\n", *relayPort)
 		os.Exit(-1)
 	}
+	// Check the gateway port range
+	if *httpPort < 0 || *httpPort >= 65536 {
+		fmt.Fprintf(os.Stderr, "Invalid gateway port: have %v, want [0-65535].\n", *httpPort)
+		os.Exit(-1)
+	}
+	// Check the session suites validity
+	suites := strings.Split(*cryptoSuites, ",")
+	for _, suite := range suites {
+		if _, err := session.LookupSuite(suite); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid session suite: have %v, want modern or classic.\n", suite)
+			os.Exit(-1)
+		}
+	}
+	config.SessionSuites = suites
+
+	// Check the payload security model validity
+	if _, err := proto.LookupSecurity(*securityMode); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid security mode: have %v, want e2e, link or both.\n", *securityMode)
+		os.Exit(-1)
+	}
+	config.SecurityMode = *securityMode
+
+	// Set any configured bootstrap seed sources
+	if *seedHosts != "" {
+		config.BootSeeds = strings.Split(*seedHosts, ",")
+	}
+	if *seedDomains != "" {
+		config.BootSeedDomains = strings.Split(*seedDomains, ",")
+	}
+	config.BootSeedFile = *seedFile
+	config.BootKubeSelector = *kubeSelector
+
+	// Check the seed registry protocol validity
+	if *registryKind != "etcd" && *registryKind != "consul" {
+		fmt.Fprintf(os.Stderr, "Invalid registry kind: have %v, want etcd or consul.\n", *registryKind)
+		os.Exit(-1)
+	}
+	config.BootRegistryURL = strings.TrimSuffix(*registryURL, "/")
+	config.BootRegistryKind = *registryKind
+
 	// User random cluster id and RSA key in developer mode
 	if *devMode {
 		// Generate a secure RSA key
@@ -111,37 +177,75 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 			fmt.Fprintf(os.Stderr, "No cluster specified (-net), did you intend developer mode (-dev)?\n")
 			os.Exit(-1)
 		}
-		if *rsaKeyPath == "" {
-			fmt.Fprintf(os.Stderr, "No RSA key specified (-rsa), did you intend developer mode (-dev)?\n")
-			os.Exit(-1)
-		}
-		if rsaData, err := ioutil.ReadFile(*rsaKeyPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Reading RSA key failed: %v.\n", err)
-			os.Exit(-1)
+		if *caKeyPath != "" {
+			// Authority mode, nodes are authenticated by their certificates
+			if *dataDir == "" {
+				fmt.Fprintf(os.Stderr, "No data directory specified (-data) to load the node certificate from.\n")
+				os.Exit(-1)
+			}
 		} else {
-			// Try processing as PEM format
-			if block, _ := pem.Decode(rsaData); block != nil {
-				if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
-					fmt.Fprintf(os.Stderr, "Parsing RSA key from PEM format failed: %v.\n", err)
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
-			} else {
-				// Give it a shot as simple binary DER
-				if key, err := x509.ParsePKCS1PrivateKey(rsaData); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse RSA key from both PEM and DER format.\n")
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
+			// Shared key mode, every node holds the cluster key
+			if *rsaKeyPath == "" {
+				fmt.Fprintf(os.Stderr, "No RSA key specified (-rsa), did you intend developer mode (-dev)?\n")
+				os.Exit(-1)
+			}
+			key, err := loadKey(*rsaKeyPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v.\n", err)
+				os.Exit(-1)
 			}
+			rsaKey = key
 		}
 	}
 	return *relayPort, *clusterName, rsaKey
 }
 
+// Loads an RSA public key to trust, accepting private keys too.
+func loadTrusted(path string) (*rsa.PublicKey, error) {
+	if key, err := identity.LoadPublicKey(path); err == nil {
+		return key, nil
+	}
+	key, err := loadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return &key.PublicKey, nil
+}
+
+// Loads an RSA private key in either PEM or DER format.
+func loadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading RSA key failed: %v", err)
+	}
+	// Try processing as PEM format
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing RSA key from PEM format failed: %v", err)
+		}
+		return key, nil
+	}
+	// Give it a shot as simple binary DER
+	key, err := x509.ParsePKCS1PrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse RSA key from both PEM and DER format")
+	}
+	return key, nil
+}
+
 func main() {
+	// Execute any certificate management subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "issue":
+			issue(os.Args[2:])
+			return
+		case "revoke":
+			revoke(os.Args[2:])
+			return
+		}
+	}
 	// Extract the command line arguments
 	relayPort, clusterId, rsaKey := parseFlags()
 
@@ -177,11 +281,58 @@ func main() {
 	// Create and boot a new carrier
 	log.Printf("main: booting iris overlay...")
 	overlay := iris.New(clusterId, rsaKey)
+	if *trustPaths != "" {
+		for _, path := range strings.Split(*trustPaths, ",") {
+			key, err := loadTrusted(path)
+			if err != nil {
+				log.Fatalf("main: failed to load trusted key %s: %v.", path, err)
+			}
+			overlay.Trust(key)
+		}
+	}
+	if *dataDir != "" {
+		if err := os.MkdirAll(*dataDir, 0700); err != nil {
+			log.Fatalf("main: failed to create data directory: %v.", err)
+		}
+		ident, err := identity.Load(*dataDir)
+		if err != nil {
+			log.Fatalf("main: failed to load node identity: %v.", err)
+		}
+		log.Printf("main: using persisted node identity %v.", ident.Id)
+		overlay.SetIdentity(ident)
+		overlay.SetCache(filepath.Join(*dataDir, "peers.json"))
+
+		// Load the node certificate and the cluster authority if requested
+		if *caKeyPath != "" {
+			authority, err := identity.LoadAuthority(*caKeyPath)
+			if err != nil {
+				log.Fatalf("main: failed to load cluster authority: %v.", err)
+			}
+			cert, err := identity.LoadCertificate(*dataDir)
+			if err != nil {
+				log.Fatalf("main: failed to load node certificate: %v.", err)
+			}
+			if *crlPath != "" {
+				list, err := identity.LoadRevocation(*crlPath)
+				if err != nil {
+					log.Fatalf("main: failed to load revocation list: %v.", err)
+				}
+				if err := authority.Apply(list); err != nil {
+					log.Fatalf("main: failed to apply revocation list: %v.", err)
+				}
+			}
+			overlay.SetCertificate(cert, authority)
+		}
+	}
 	if peers, err := overlay.Boot(); err != nil {
 		log.Fatalf("main: failed to boot iris overlay: %v.", err)
 	} else {
 		log.Printf("main: iris overlay converged with %v remote connections.", peers)
 	}
+	// Keep the revocation list up to date
+	if *crlPath != "" {
+		go watchRevocations(*crlPath, overlay)
+	}
 	// Create and boot a new relay
 	log.Printf("main: booting relay service...")
 	rel, err := relay.New(relayPort, overlay)
@@ -191,6 +342,18 @@ func main() {
 	if err := rel.Boot(); err != nil {
 		log.Fatalf("main: failed to boot relay: %v.", err)
 	}
+	// Create and boot the HTTP gateway if requested
+	var gate *gateway.Gateway
+	if *httpPort != 0 {
+		log.Printf("main: booting http gateway...")
+		if gate, err = gateway.New(*httpPort, overlay); err != nil {
+			log.Fatalf("main: failed to create http gateway: %v.", err)
+		}
+		if err := gate.Boot(); err != nil {
+			log.Fatalf("main: failed to boot http gateway: %v.", err)
+		}
+		log.Printf("main: http gateway listening on port %d.", *httpPort)
+	}
 
 	// Capture termination signals
 	quit := make(chan os.Signal, 1)
@@ -201,6 +364,12 @@ func main() {
 
 	// Wait for termination request, clean up and exit
 	<-quit
+	if gate != nil {
+		log.Printf("main: terminating http gateway...")
+		if err := gate.Terminate(); err != nil {
+			log.Printf("main: failed to terminate http gateway: %v.", err)
+		}
+	}
 	log.Printf("main: terminating relay service...")
 	if err := rel.Terminate(); err != nil {
 		log.Printf("main: failed to terminate relay service: %v.", err)
@@ -0,0 +1,99 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains a size classed buffer pool recycling the byte slices that
+// carry message payloads, reducing the allocation and garbage collection load
+// of the message path.
+//
+// Buffers are grouped into power of two size classes, each class retaining a
+// bounded number of idle buffers; anything beyond is left to the GC. Ownership
+// of pooled buffers follows a few simple rules:
+//
+//   - A buffer returned by GetBuffer is exclusively owned by the caller.
+//   - Ownership travels with the message carrying the buffer. Whoever forwards
+//     a message to multiple destinations must give each its own copy.
+//   - Only the exclusive owner may PutBuffer it back, after which neither it nor
+//     anybody it shared the buffer with may touch it anymore.
+//   - Dropping a buffer instead of returning it is always safe.
+//
+// Buffers handed to application code are never reclaimed.
+
+package pool
+
+import (
+	"math/bits"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Smallest size class of the pool, tinier buffers are rounded up to it.
+const minClassBits = 6
+
+// Idle buffers of each size class, indexed by the binary logarithm of the size.
+var classes []chan []byte
+
+// Creates the size classes up to the configured buffer limit.
+func init() {
+	maxClassBits := bits.Len(uint(config.PoolBufferLimit - 1))
+	classes = make([]chan []byte, maxClassBits+1)
+	for i := minClassBits; i <= maxClassBits; i++ {
+		idle := config.PoolClassBytes >> uint(i)
+		if idle > config.PoolClassBuffers {
+			idle = config.PoolClassBuffers
+		}
+		if idle < 1 {
+			idle = 1
+		}
+		classes[i] = make(chan []byte, idle)
+	}
+}
+
+// Retrieves a buffer of the given length, reusing an idle one if available. The
+// contents of the buffer are undefined.
+func GetBuffer(size int) []byte {
+	class := 0
+	if size > 0 {
+		class = bits.Len(uint(size - 1))
+	}
+	if class < minClassBits {
+		class = minClassBits
+	}
+	if class >= len(classes) {
+		return make([]byte, size)
+	}
+	select {
+	case buf := <-classes[class]:
+		return buf[:size]
+	default:
+		return make([]byte, size, 1<<uint(class))
+	}
+}
+
+// Returns a buffer into the pool, into the largest size class it can fill. The
+// caller must not retain any references to the buffer afterwards.
+func PutBuffer(buf []byte) {
+	class := bits.Len(uint(cap(buf))) - 1
+	if class < minClassBits || class >= len(classes) {
+		return
+	}
+	limit := 1 << uint(class)
+	select {
+	case classes[class] <- buf[:0:limit]:
+	default:
+	}
+}
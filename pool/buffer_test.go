@@ -0,0 +1,83 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that buffers are sized and classed correctly.
+func TestGetBuffer(t *testing.T) {
+	tests := []struct {
+		size  int
+		class int
+	}{
+		{0, 64}, {1, 64}, {64, 64}, {65, 128}, {1000, 1024}, {1024, 1024},
+		{config.PoolBufferLimit, config.PoolBufferLimit},
+		{config.PoolBufferLimit + 1, config.PoolBufferLimit + 1},
+	}
+	for i, tt := range tests {
+		buf := GetBuffer(tt.size)
+		if len(buf) != tt.size {
+			t.Fatalf("test %d: length mismatch: have %d, want %d.", i, len(buf), tt.size)
+		}
+		if cap(buf) != tt.class {
+			t.Fatalf("test %d: capacity mismatch: have %d, want %d.", i, cap(buf), tt.class)
+		}
+	}
+}
+
+// Tests that returned buffers are reused, filling the largest class possible.
+func TestBufferReuse(t *testing.T) {
+	// Use a class no other test touches
+	buf := make([]byte, 10, 3000)
+	PutBuffer(buf)
+
+	reuse := GetBuffer(2048)
+	if &reuse[0] != &buf[0] {
+		t.Fatalf("buffer not reused.")
+	}
+	if cap(reuse) != 2048 {
+		t.Fatalf("capacity mismatch: have %d, want %d.", cap(reuse), 2048)
+	}
+	// Too small or too large buffers should be dropped
+	PutBuffer(make([]byte, 32))
+	PutBuffer(make([]byte, 2*config.PoolBufferLimit))
+}
+
+// Tests that the idle buffers retained are bounded.
+func TestBufferBounded(t *testing.T) {
+	class := classes[minClassBits+1]
+	for i := 0; i < 2*cap(class); i++ {
+		PutBuffer(make([]byte, 128))
+	}
+	if len(class) != cap(class) {
+		t.Fatalf("idle buffer mismatch: have %d, want %d.", len(class), cap(class))
+	}
+}
+
+// Benchmarks a pooled buffer allocation and release.
+func BenchmarkBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		PutBuffer(GetBuffer(4096))
+	}
+}
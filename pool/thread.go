@@ -43,6 +43,7 @@ type ThreadPool struct {
 	total int // Maximum pool worker capacity
 
 	start bool // Whether the pool was already started
+	stall bool // Whether task execution is suspended
 	quit  bool // Whether the pool was already terminated
 
 	mutex sync.Mutex
@@ -66,11 +67,10 @@ func (t *ThreadPool) Start() {
 	defer t.mutex.Unlock()
 
 	if !t.start {
-		for i := 0; i < t.total && !t.tasks.Empty(); i++ {
-			t.idle--
-			go t.runner(t.tasks.Pop().(Task))
-		}
 		t.start = true
+		if !t.stall {
+			t.spawn()
+		}
 	}
 }
 
@@ -80,10 +80,19 @@ func (t *ThreadPool) Terminate(clear bool) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
+	// Nothing to do if the pool was already torn down
+	if t.tasks == nil {
+		return
+	}
 	t.quit = true
 	if clear {
 		t.tasks.Reset()
 	}
+	// Lift any stall so that the remaining tasks are drained
+	if t.stall {
+		t.stall = false
+		t.spawn()
+	}
 
 	for t.idle < t.total {
 		t.done.Wait()
@@ -102,7 +111,7 @@ func (t *ThreadPool) Schedule(task Task) error {
 		return ErrTerminating
 	}
 
-	if t.start && t.idle > 0 {
+	if t.start && !t.stall && t.idle > 0 {
 		t.idle--
 		go t.runner(task)
 	} else {
@@ -111,12 +120,43 @@ func (t *ThreadPool) Schedule(task Task) error {
 	return nil
 }
 
+// Suspends the execution of tasks: the running ones finish, but new and pending
+// ones are queued until resumed. Meant for simulating stuck handlers in tests.
+func (t *ThreadPool) Stall() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.stall = true
+}
+
+// Resumes the execution of tasks after a stall.
+func (t *ThreadPool) Resume() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stall {
+		t.stall = false
+		t.spawn()
+	}
+}
+
+// Starts idle workers for any pending tasks. The pool lock is assumed held.
+func (t *ThreadPool) spawn() {
+	for t.start && t.tasks != nil && t.idle > 0 && !t.tasks.Empty() {
+		t.idle--
+		go t.runner(t.tasks.Pop().(Task))
+	}
+}
+
 // Dumps the waiting tasks from the pool.
 func (t *ThreadPool) Clear() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	t.tasks.Reset()
+	// Nothing to do if the pool was already torn down
+	if t.tasks != nil {
+		t.tasks.Reset()
+	}
 }
 
 // Runs an initial task, fetching new ones until available.
@@ -128,7 +168,7 @@ func (t *ThreadPool) runner(task Task) {
 		// may be scheduled after a runner has exited its loop but before it's
 		// gotten here to be marked as idle. Do one last check for that case
 		// while we have the lock.
-		if t.tasks.Empty() {
+		if t.stall || t.tasks.Empty() {
 			t.idle++
 		} else {
 			go t.runner(t.tasks.Pop().(Task))
@@ -147,7 +187,7 @@ func (t *ThreadPool) next() Task {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if t.tasks.Empty() { // Note, tasks is reset on termination
+	if t.stall || t.tasks.Empty() { // Note, tasks is reset on termination
 		return nil
 	}
 	return t.tasks.Pop().(Task)
@@ -241,3 +241,38 @@ func TestTerminate(t *testing.T) {
 		}
 	}
 }
+
+func TestStall(t *testing.T) {
+	t.Parallel()
+
+	count := int32(0)
+	pool := NewThreadPool(4)
+	pool.Start()
+
+	// Stall the pool and make sure nothing gets executed
+	pool.Stall()
+	for i := 0; i < 8; i++ {
+		if err := pool.Schedule(func() { atomic.AddInt32(&count, 1) }); err != nil {
+			t.Fatalf("failed to schedule task: %v.", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cnt := int(atomic.LoadInt32(&count)); cnt != 0 {
+		t.Fatalf("stalled pool executed tasks: have %v, want %v.", cnt, 0)
+	}
+	// Resume the pool and make sure all the queued tasks run
+	pool.Resume()
+	time.Sleep(50 * time.Millisecond)
+	if cnt := int(atomic.LoadInt32(&count)); cnt != 8 {
+		t.Fatalf("unexpected finished tasks: have %v, want %v.", cnt, 8)
+	}
+	// Stall again and make sure termination drains the pool
+	pool.Stall()
+	if err := pool.Schedule(func() { atomic.AddInt32(&count, 1) }); err != nil {
+		t.Fatalf("failed to schedule task: %v.", err)
+	}
+	pool.Terminate(false)
+	if cnt := int(atomic.LoadInt32(&count)); cnt != 9 {
+		t.Fatalf("unexpected finished tasks: have %v, want %v.", cnt, 9)
+	}
+}
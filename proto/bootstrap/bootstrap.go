@@ -85,6 +85,10 @@ type Bootstrapper struct {
 	scanSeed, probeSeed, coreOSSeed seeder
 	scanSink, probeSink, coreOSSink chan *net.IPAddr
 
+	// Configured seed sources (static, DNS, file, kube, registry) and their shared address sink
+	seeds    []seeder
+	seedSink chan *net.IPAddr
+
 	gob *gobber.Gobber // Datagram gobber to decode the network messages
 
 	beats chan *Event // Channel on which to report bootstrap events
@@ -133,11 +137,32 @@ func New(ipnet *net.IPNet, magic []byte, owner *big.Int, endpoint int) (*Bootstr
 		scanSink:   make(chan *net.IPAddr, config.BootSeedSinkBuffer),
 		probeSink:  make(chan *net.IPAddr, config.BootSeedSinkBuffer),
 		coreOSSink: make(chan *net.IPAddr, config.BootSeedSinkBuffer),
+		seedSink:   make(chan *net.IPAddr, config.BootSeedSinkBuffer),
 
 		// Maintenance fields
 		quit: make(chan chan error),
 		log:  logger,
 	}
+	// Create the seed generators of any configured seed sources
+	if len(config.BootSeeds) > 0 {
+		b.seeds = append(b.seeds, newStaticSeeder(ipnet, config.BootSeeds, net.DefaultResolver, logger))
+	}
+	if len(config.BootSeedDomains) > 0 {
+		b.seeds = append(b.seeds, newDNSSeeder(ipnet, config.BootSeedDomains, net.DefaultResolver, logger))
+	}
+	if config.BootSeedFile != "" {
+		b.seeds = append(b.seeds, newFileSeeder(ipnet, config.BootSeedFile, net.DefaultResolver, logger))
+	}
+	if config.BootKubeSelector != "" {
+		b.seeds = append(b.seeds, newKubeSeeder(ipnet, logger))
+	}
+	if config.BootRegistryURL != "" {
+		seed, err := newRegistrySeeder(ipnet, magic, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		b.seeds = append(b.seeds, seed)
+	}
 	// Open the server socket
 	var err error
 	for _, port := range config.BootPorts {
@@ -214,6 +239,17 @@ func (b *Bootstrapper) Boot() error {
 		b.scanSeed.Close()
 		return err
 	}
+	for i, seed := range b.seeds {
+		if err := seed.Start(b.seedSink, &b.phase); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				b.seeds[j].Close()
+			}
+			b.coreOSSeed.Close()
+			b.probeSeed.Close()
+			b.scanSeed.Close()
+			return err
+		}
+	}
 	// Start the bootstrap message initiator and acceptor
 	go b.initiator()
 	go b.acceptor()
@@ -240,6 +276,11 @@ func (b *Bootstrapper) Terminate() error {
 		}
 	}
 	// Terminate the seeding algorithms
+	for i := len(b.seeds) - 1; i >= 0; i-- {
+		if err := b.seeds[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if err := b.coreOSSeed.Close(); err != nil {
 		errs = append(errs, err)
 	}
@@ -289,6 +330,7 @@ func (b *Bootstrapper) initiator() {
 			case addr = <-b.scanSink:
 			case addr = <-b.probeSink:
 			case addr = <-b.coreOSSink:
+			case addr = <-b.seedSink:
 			case errc = <-b.quit:
 				continue
 			}
@@ -0,0 +1,73 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the DNS based seed generator. It periodically looks up the configured
+// names, either directly as A/AAAA records, or as SRV records pointing to them.
+
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Creates a new DNS seed generator, resolving names prefixed by an underscore
+// (e.g. _iris._udp.example.com) as SRV records and all others as hosts.
+func newDNSSeeder(ipnet *net.IPNet, names []string, res resolver, logger log15.Logger) seeder {
+	return &sourceSeeder{
+		ipnet: ipnet,
+		fetch: func() ([]*net.IPAddr, error) {
+			return lookupSeeds(res, names)
+		},
+		quit: make(chan chan error),
+		log:  logger.New("algo", "dns"),
+	}
+}
+
+// Looks up the seed hosts of the given DNS names and resolves them. The SRV port
+// numbers are ignored, the bootstrapper probes its configured ports anyway.
+func lookupSeeds(res resolver, names []string) ([]*net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.BootSeedTimeout)
+	defer cancel()
+
+	var fail error
+	hosts := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "_") {
+			hosts = append(hosts, name)
+			continue
+		}
+		_, srvs, err := res.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			fail = err
+			continue
+		}
+		for _, srv := range srvs {
+			hosts = append(hosts, strings.TrimSuffix(srv.Target, "."))
+		}
+	}
+	addrs, err := resolveHosts(res, hosts)
+	if len(addrs) == 0 && err == nil {
+		err = fail
+	}
+	return addrs, err
+}
@@ -0,0 +1,76 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Tests that the DNS seeder resolves both host and SRV records, reporting the
+// union of the found addresses.
+func TestDNSSeeder(t *testing.T) {
+	res := &fakeResolver{
+		hosts: map[string][]string{
+			"a.iris.test": {"10.0.0.1"},
+			"b.iris.test": {"10.0.0.2", "10.0.0.3"},
+			"c.iris.test": {"10.0.0.3", "10.0.0.4"},
+		},
+		srvs: map[string][]*net.SRV{
+			"_iris._udp.iris.test": {
+				{Target: "a.iris.test.", Port: 14142},
+				{Target: "b.iris.test.", Port: 14142},
+				{Target: "x.iris.test.", Port: 14142},
+			},
+		},
+	}
+	ipnet := &net.IPNet{IP: net.IPv4(192, 168, 0, 100), Mask: net.CIDRMask(24, 32)}
+	names := []string{"_iris._udp.iris.test", "_iris._tcp.iris.test", "c.iris.test"}
+
+	seeder := newDNSSeeder(ipnet, names, res, log15.New("ipnet", ipnet))
+	sink, phase := make(chan *net.IPAddr), uint32(0)
+	if err := seeder.Start(sink, &phase); err != nil {
+		t.Fatalf("failed to start seed generator: %v.", err)
+	}
+	have := collectSeeds(t, sink, 4, time.Second)
+	if want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}; fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("seed list mismatch: have %v, want %v.", have, want)
+	}
+	if err := seeder.Close(); err != nil {
+		t.Fatalf("failed to terminate seed generator: %v.", err)
+	}
+}
+
+// Tests that DNS lookup failures are reported if no seeds can be found at all.
+func TestDNSSeederFailure(t *testing.T) {
+	res := &fakeResolver{
+		srvs: map[string][]*net.SRV{
+			"_iris._udp.iris.test": {{Target: "x.iris.test.", Port: 14142}},
+		},
+	}
+	for _, names := range [][]string{{"_iris._tcp.iris.test"}, {"_iris._udp.iris.test"}, {"x.iris.test"}} {
+		if addrs, err := lookupSeeds(res, names); err == nil {
+			t.Fatalf("%v: lookup succeeded: %v.", names, addrs)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the seed file based seed generator. It reads the seeds (IP addresses
+// or host names) from a plain text file, reporting them anew whenever the file
+// is modified.
+
+package bootstrap
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Creates a new seed file based seed generator. The file lists one seed per line,
+// ignoring empty lines and comments started with a '#'.
+func newFileSeeder(ipnet *net.IPNet, path string, res resolver, logger log15.Logger) seeder {
+	// Track the modification time and size of the last loaded seed file
+	var (
+		modtime time.Time
+		size    int64 = -1
+	)
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	return &sourceSeeder{
+		ipnet: ipnet,
+		fetch: func() ([]*net.IPAddr, error) {
+			modtime, size = stat()
+
+			hosts, err := readSeedFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return resolveHosts(res, hosts)
+		},
+		changed: func() bool {
+			newtime, newsize := stat()
+			return !newtime.Equal(modtime) || newsize != size
+		},
+		quit: make(chan chan error),
+		log:  logger.New("algo", "file"),
+	}
+}
+
+// Reads the list of seed hosts from a seed file.
+func readSeedFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hosts := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, scanner.Err()
+}
@@ -0,0 +1,79 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Tests that the seed file is parsed correctly and reloaded on modifications.
+func TestFileSeeder(t *testing.T) {
+	// Speed up the file polling and postpone rescans beyond the test
+	defer func(poll, rescan time.Duration) {
+		config.BootSeedFilePoll, config.BootSeedSlowRescan = poll, rescan
+	}(config.BootSeedFilePoll, config.BootSeedSlowRescan)
+	config.BootSeedFilePoll, config.BootSeedSlowRescan = 10*time.Millisecond, time.Hour
+
+	dir, err := ioutil.TempDir("", "iris-seeds")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seeds")
+
+	if err := ioutil.WriteFile(path, []byte("# Iris seeds\n10.0.0.1\n\n  seed.iris.test  # resolved\n"), 0600); err != nil {
+		t.Fatalf("failed to write seed file: %v.", err)
+	}
+	res := &fakeResolver{
+		hosts: map[string][]string{
+			"seed.iris.test": {"10.0.0.2"},
+		},
+	}
+	ipnet := &net.IPNet{IP: net.IPv4(192, 168, 0, 100), Mask: net.CIDRMask(24, 32)}
+
+	seeder := newFileSeeder(ipnet, path, res, log15.New("ipnet", ipnet))
+	sink, phase := make(chan *net.IPAddr), uint32(1)
+	if err := seeder.Start(sink, &phase); err != nil {
+		t.Fatalf("failed to start seed generator: %v.", err)
+	}
+	have := collectSeeds(t, sink, 2, time.Second)
+	if want := []string{"10.0.0.1", "10.0.0.2"}; fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("initial seed list mismatch: have %v, want %v.", have, want)
+	}
+	// Modify the seed file and ensure the new list is reported
+	if err := ioutil.WriteFile(path, []byte("10.0.0.3\n10.0.0.4\n10.0.0.5\n"), 0600); err != nil {
+		t.Fatalf("failed to update seed file: %v.", err)
+	}
+	have = collectSeeds(t, sink, 3, time.Second)
+	if want := []string{"10.0.0.3", "10.0.0.4", "10.0.0.5"}; fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("updated seed list mismatch: have %v, want %v.", have, want)
+	}
+	if err := seeder.Close(); err != nil {
+		t.Fatalf("failed to terminate seed generator: %v.", err)
+	}
+}
@@ -0,0 +1,230 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the Kubernetes based seed generator. It queries the API server for the
+// EndpointSlices (or legacy Endpoints) matching a label selector, and reports the
+// contained pod addresses, sparing the cluster network from subnet scans.
+
+package bootstrap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Subset of an EndpointSlice list returned by the Kubernetes API.
+type kubeSliceList struct {
+	Metadata kubeListMeta `json:"metadata"`
+	Items    []struct {
+		AddressType string `json:"addressType"`
+		Endpoints   []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Terminating *bool `json:"terminating"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+// Subset of a legacy Endpoints list returned by the Kubernetes API.
+type kubeEndpointsList struct {
+	Metadata kubeListMeta `json:"metadata"`
+	Items    []struct {
+		Subsets []struct {
+			Addresses         []kubeAddress `json:"addresses"`
+			NotReadyAddresses []kubeAddress `json:"notReadyAddresses"`
+		} `json:"subsets"`
+	} `json:"items"`
+}
+
+// Pagination metadata of a Kubernetes list.
+type kubeListMeta struct {
+	Continue string `json:"continue"`
+}
+
+// Single pod address within a legacy Endpoints subset.
+type kubeAddress struct {
+	IP string `json:"ip"`
+}
+
+// Kubernetes API client retrieving the seed pod addresses.
+type kubeSource struct {
+	api       string       // Base URL of the API server
+	namespace string       // Namespace of the endpoints to list
+	selector  string       // Label selector of the endpoints to list
+	client    *http.Client // HTTP client trusting the cluster CA
+}
+
+// Creates a new Kubernetes seed generator, listing the endpoints selected by the
+// configured labels from the API server (in-cluster defaults if not configured).
+func newKubeSeeder(ipnet *net.IPNet, logger log15.Logger) seeder {
+	logger = logger.New("algo", "kube")
+
+	// Trust the cluster authority if available, the system roots otherwise
+	client := &http.Client{Timeout: config.BootSeedTimeout}
+	if pem, err := ioutil.ReadFile(filepath.Join(config.BootKubeAccountDir, "ca.crt")); err == nil {
+		roots := x509.NewCertPool()
+		if roots.AppendCertsFromPEM(pem) {
+			client.Transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}
+		} else {
+			logger.Warn("invalid cluster certificate, using system roots")
+		}
+	}
+	source := &kubeSource{
+		api:       config.BootKubeAPI,
+		namespace: config.BootKubeNamespace,
+		selector:  config.BootKubeSelector,
+		client:    client,
+	}
+	return &sourceSeeder{
+		ipnet: ipnet,
+		fetch: source.fetch,
+		quit:  make(chan chan error),
+		log:   logger,
+	}
+}
+
+// Retrieves the seed addresses from the EndpointSlice API, falling back to the
+// legacy Endpoints API if the former is not served.
+func (s *kubeSource) fetch() ([]*net.IPAddr, error) {
+	// Assemble the API endpoint from the in-cluster environment if needed
+	api := s.api
+	if api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("kubernetes api server unknown")
+		}
+		api = "https://" + net.JoinHostPort(host, port)
+	}
+	namespace := s.namespace
+	if namespace == "" {
+		blob, err := ioutil.ReadFile(filepath.Join(config.BootKubeAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(blob))
+	}
+	// Gather the pod IPs from the endpoint slices if available
+	ips := []string{}
+
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(namespace))
+	found, err := s.list(api+path, func(body []byte) (string, error) {
+		list := new(kubeSliceList)
+		if err := json.Unmarshal(body, list); err != nil {
+			return "", err
+		}
+		for _, slice := range list.Items {
+			if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+				continue
+			}
+			for _, endpoint := range slice.Endpoints {
+				if term := endpoint.Conditions.Terminating; term != nil && *term {
+					continue
+				}
+				ips = append(ips, endpoint.Addresses...)
+			}
+		}
+		return list.Metadata.Continue, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Otherwise fall back to the legacy endpoints
+	if !found {
+		path = fmt.Sprintf("/api/v1/namespaces/%s/endpoints", url.PathEscape(namespace))
+		if _, err := s.list(api+path, func(body []byte) (string, error) {
+			list := new(kubeEndpointsList)
+			if err := json.Unmarshal(body, list); err != nil {
+				return "", err
+			}
+			for _, endpoints := range list.Items {
+				for _, subset := range endpoints.Subsets {
+					for _, addr := range append(subset.Addresses, subset.NotReadyAddresses...) {
+						ips = append(ips, addr.IP)
+					}
+				}
+			}
+			return list.Metadata.Continue, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return parseIPs(ips), nil
+}
+
+// Lists all pages of a Kubernetes resource collection, feeding each to a parser
+// returning the continuation token. A missing collection is not an error, but
+// reported via the found flag.
+func (s *kubeSource) list(endpoint string, parse func(body []byte) (string, error)) (bool, error) {
+	for cont := ""; ; {
+		// Assemble the paginated, filtered query
+		query := url.Values{}
+		query.Set("limit", fmt.Sprintf("%d", config.BootKubePageSize))
+		if s.selector != "" {
+			query.Set("labelSelector", s.selector)
+		}
+		if cont != "" {
+			query.Set("continue", cont)
+		}
+		req, err := http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return false, err
+		}
+		// Authenticate with the (periodically rotated) service account token
+		if token, err := ioutil.ReadFile(filepath.Join(config.BootKubeAccountDir, "token")); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+		res, err := s.client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			return false, nil
+		case res.StatusCode != http.StatusOK:
+			return false, fmt.Errorf("kubernetes api failure: %s", res.Status)
+		}
+		// Parse the page and continue if more are available
+		if cont, err = parse(body); err != nil {
+			return false, err
+		}
+		if cont == "" {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package bootstrap
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Paginated EndpointSlice responses served by the fake API server.
+var kubeSlicePages = map[string]string{
+	"": `{"metadata": {"continue": "page-2"}, "items": [
+		{"addressType": "IPv4", "endpoints": [
+			{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+			{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+			{"addresses": ["10.0.0.3"], "conditions": {"ready": false, "terminating": true}}
+		]},
+		{"addressType": "FQDN", "endpoints": [
+			{"addresses": ["pod.iris.test"]}
+		]}
+	]}`,
+	"page-2": `{"metadata": {}, "items": [
+		{"addressType": "IPv4", "endpoints": [
+			{"addresses": ["10.0.0.1", "10.0.0.4"]}
+		]}
+	]}`,
+}
+
+// Legacy Endpoints response served by the fake API server.
+var kubeEndpoints = `{"metadata": {}, "items": [
+	{"subsets": [{
+		"addresses": [{"ip": "10.0.1.1"}, {"ip": "10.0.1.2"}],
+		"notReadyAddresses": [{"ip": "10.0.1.3"}]
+	}]}
+]}`
+
+// Tests that the Kubernetes seeder lists the endpoint slices of the configured
+// namespace and selector, falling back to the legacy endpoints if needed.
+func TestKubeSeeder(t *testing.T) {
+	testKubeSeeder(t, true, []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"})
+	testKubeSeeder(t, false, []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"})
+}
+
+// Tests the Kubernetes seeder against a fake API server, either serving or not
+// serving the EndpointSlice API.
+func testKubeSeeder(t *testing.T, slices bool, want []string) {
+	// Start a fake API server serving the endpoints
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret-token" {
+			http.Error(w, "unauthorized: "+auth, http.StatusUnauthorized)
+			return
+		}
+		if selector := r.URL.Query().Get("labelSelector"); selector != "app=iris" {
+			http.Error(w, "invalid selector: "+selector, http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/apis/discovery.k8s.io/v1/namespaces/iris-test/endpointslices":
+			if page, ok := kubeSlicePages[r.URL.Query().Get("continue")]; slices && ok {
+				fmt.Fprint(w, page)
+				return
+			}
+		case "/api/v1/namespaces/iris-test/endpoints":
+			fmt.Fprint(w, kubeEndpoints)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	// Create a service account folder trusting the fake server
+	dir, err := ioutil.TempDir("", "iris-kube")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	files := map[string][]byte{
+		"ca.crt":    cert,
+		"token":     []byte("secret-token\n"),
+		"namespace": []byte("iris-test"),
+	}
+	for name, blob := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), blob, 0600); err != nil {
+			t.Fatalf("failed to write %s: %v.", name, err)
+		}
+	}
+	// Point the seeder to the fake API server
+	defer func(api, dir, selector string, page int) {
+		config.BootKubeAPI, config.BootKubeAccountDir, config.BootKubeSelector, config.BootKubePageSize = api, dir, selector, page
+	}(config.BootKubeAPI, config.BootKubeAccountDir, config.BootKubeSelector, config.BootKubePageSize)
+	config.BootKubeAPI, config.BootKubeAccountDir, config.BootKubeSelector, config.BootKubePageSize = server.URL, dir, "app=iris", 2
+
+	ipnet := &net.IPNet{IP: net.IPv4(192, 168, 0, 100), Mask: net.CIDRMask(24, 32)}
+	seeder := newKubeSeeder(ipnet, log15.New("ipnet", ipnet))
+	sink, phase := make(chan *net.IPAddr), uint32(0)
+	if err := seeder.Start(sink, &phase); err != nil {
+		t.Fatalf("failed to start seed generator: %v.", err)
+	}
+	if have := collectSeeds(t, sink, len(want), time.Second); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("seed list mismatch (slices: %v): have %v, want %v.", slices, have, want)
+	}
+	if err := seeder.Close(); err != nil {
+		t.Fatalf("failed to terminate seed generator: %v.", err)
+	}
+}
+
+// Tests that API failures are reported instead of empty seed lists.
+func TestKubeSeederFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	source := &kubeSource{api: server.URL, namespace: "iris-test", client: http.DefaultClient}
+	if addrs, err := source.fetch(); err == nil {
+		t.Fatalf("fetch succeeded: %v.", addrs)
+	}
+}
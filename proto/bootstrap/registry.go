@@ -0,0 +1,284 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the registry based seed generator. It registers the local interface
+// address under a key prefix with a lease (etcd v3) or session (Consul) TTL in a
+// key-value store over HTTP, and reports the addresses of the other registrants,
+// making discovery independent of the network topology.
+
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Key-value store keeping the expiring seed registrations.
+type registry interface {
+	// Registers (or refreshes) a key-value pair expiring after the ttl.
+	register(key, value string, ttl time.Duration) error
+
+	// Lists the values of all live keys under a prefix.
+	list(prefix string) ([]string, error)
+
+	// Revokes the registration before its expiration.
+	deregister() error
+}
+
+// Creates a new registry based seed generator of the configured kind, keeping
+// the registrations of different clusters (magic) separate.
+func newRegistrySeeder(ipnet *net.IPNet, magic []byte, logger log15.Logger) (seeder, error) {
+	logger = logger.New("algo", "registry")
+
+	// Create the registry client of the requested kind
+	var reg registry
+	switch config.BootRegistryKind {
+	case "etcd":
+		reg = &etcdRegistry{endpoint: config.BootRegistryURL, client: &http.Client{Timeout: config.BootSeedTimeout}}
+	case "consul":
+		reg = &consulRegistry{endpoint: config.BootRegistryURL, client: &http.Client{Timeout: config.BootSeedTimeout}}
+	default:
+		return nil, fmt.Errorf("unknown registry kind: %s", config.BootRegistryKind)
+	}
+	// Assemble the registration namespace and key of the local interface
+	prefix := strings.Trim(config.BootRegistryPrefix, "/") + "/" + url.PathEscape(string(magic)) + "/"
+	key := prefix + ipnet.IP.String()
+
+	return &sourceSeeder{
+		ipnet: ipnet,
+		fetch: func() ([]*net.IPAddr, error) {
+			// Loopback interfaces are useless to others, don't advertise them
+			if !ipnet.IP.IsLoopback() {
+				if err := reg.register(key, ipnet.IP.String(), config.BootRegistryTTL); err != nil {
+					logger.Warn("failed to register seed", "key", key, "error", err)
+				}
+			}
+			ips, err := reg.list(prefix)
+			if err != nil {
+				return nil, err
+			}
+			return parseIPs(ips), nil
+		},
+		release: func() {
+			if err := reg.deregister(); err != nil {
+				logger.Warn("failed to deregister seed", "key", key, "error", err)
+			}
+		},
+		refresh: config.BootRegistryTTL / 3,
+		quit:    make(chan chan error),
+		log:     logger,
+	}, nil
+}
+
+// Sends a request with an optional JSON encoded body to a registry, decoding
+// the JSON response into reply if not nil. The status code is returned so the
+// caller can handle missing entities.
+func callRegistry(client *http.Client, method, endpoint string, request interface{}, reply interface{}) (int, error) {
+	var body []byte
+	if blob, ok := request.([]byte); ok {
+		body = blob
+	} else if request != nil {
+		blob, err := json.Marshal(request)
+		if err != nil {
+			return 0, err
+		}
+		body = blob
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	blob, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, fmt.Errorf("registry failure: %s: %s", res.Status, bytes.TrimSpace(blob))
+	}
+	if reply != nil {
+		if err := json.Unmarshal(blob, reply); err != nil {
+			return res.StatusCode, err
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// Registry client for the etcd v3 JSON gateway, binding the registration to a
+// lease kept alive on every refresh.
+type etcdRegistry struct {
+	endpoint string       // Base URL of the etcd gateway
+	client   *http.Client // HTTP client to reach the gateway with
+	lease    json.Number  // Lease currently holding the registration
+}
+
+// Key-value pair within the etcd v3 API (binary fields base64 encoded).
+type etcdKeyValue struct {
+	Key   []byte      `json:"key"`
+	Value []byte      `json:"value,omitempty"`
+	Lease json.Number `json:"lease,omitempty"`
+}
+
+// Refreshes the lease (granting a new one if expired) and writes the key with it.
+func (r *etcdRegistry) register(key, value string, ttl time.Duration) error {
+	// Keep the current lease alive, dropping it if already expired
+	if r.lease != "" {
+		reply := new(struct {
+			Result struct {
+				TTL json.Number `json:"TTL"`
+			} `json:"result"`
+		})
+		if _, err := callRegistry(r.client, "POST", r.endpoint+"/v3/lease/keepalive", map[string]interface{}{"ID": r.lease}, reply); err != nil {
+			return err
+		}
+		if ttl, _ := reply.Result.TTL.Int64(); ttl <= 0 {
+			r.lease = ""
+		}
+	}
+	// Grant a new lease if none is held
+	if r.lease == "" {
+		reply := new(struct {
+			ID json.Number `json:"ID"`
+		})
+		if _, err := callRegistry(r.client, "POST", r.endpoint+"/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl / time.Second)}, reply); err != nil {
+			return err
+		}
+		if reply.ID == "" {
+			return fmt.Errorf("no lease granted")
+		}
+		r.lease = reply.ID
+	}
+	// Write the registration bound to the lease
+	_, err := callRegistry(r.client, "POST", r.endpoint+"/v3/kv/put", &etcdKeyValue{Key: []byte(key), Value: []byte(value), Lease: r.lease}, nil)
+	return err
+}
+
+// Lists the values of the keys with the given prefix via a range request.
+func (r *etcdRegistry) list(prefix string) ([]string, error) {
+	// The range end is the prefix with its last byte incremented
+	end := []byte(prefix)
+	end[len(end)-1]++
+
+	request := map[string][]byte{"key": []byte(prefix), "range_end": end}
+	reply := new(struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	})
+	if _, err := callRegistry(r.client, "POST", r.endpoint+"/v3/kv/range", request, reply); err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(reply.Kvs))
+	for _, kv := range reply.Kvs {
+		values = append(values, string(kv.Value))
+	}
+	return values, nil
+}
+
+// Revokes the lease, deleting the registration along with it.
+func (r *etcdRegistry) deregister() error {
+	if r.lease == "" {
+		return nil
+	}
+	_, err := callRegistry(r.client, "POST", r.endpoint+"/v3/lease/revoke", map[string]interface{}{"ID": r.lease}, nil)
+	r.lease = ""
+	return err
+}
+
+// Registry client for the Consul HTTP API, binding the registration to a session
+// deleting its locked keys when invalidated.
+type consulRegistry struct {
+	endpoint string       // Base URL of the Consul agent
+	client   *http.Client // HTTP client to reach the agent with
+	session  string       // Session currently holding the registration
+}
+
+// Renews the session (creating a new one if expired) and acquires the key with it.
+func (r *consulRegistry) register(key, value string, ttl time.Duration) error {
+	// Renew the current session, dropping it if already expired
+	if r.session != "" {
+		if code, err := callRegistry(r.client, "PUT", r.endpoint+"/v1/session/renew/"+r.session, nil, nil); err != nil {
+			if code != http.StatusNotFound {
+				return err
+			}
+			r.session = ""
+		}
+	}
+	// Create a new session if none is held
+	if r.session == "" {
+		request := map[string]string{
+			"Name":     "iris-bootstrap",
+			"TTL":      ttl.String(),
+			"Behavior": "delete",
+		}
+		reply := new(struct {
+			ID string `json:"ID"`
+		})
+		if _, err := callRegistry(r.client, "PUT", r.endpoint+"/v1/session/create", request, reply); err != nil {
+			return err
+		}
+		if reply.ID == "" {
+			return fmt.Errorf("no session created")
+		}
+		r.session = reply.ID
+	}
+	// Acquire the registration with the session
+	_, err := callRegistry(r.client, "PUT", r.endpoint+"/v1/kv/"+key+"?acquire="+url.QueryEscape(r.session), []byte(value), nil)
+	return err
+}
+
+// Lists the values of the keys with the given prefix via a recursive read.
+func (r *consulRegistry) list(prefix string) ([]string, error) {
+	var reply []struct {
+		Value []byte `json:"Value"`
+	}
+	if code, err := callRegistry(r.client, "GET", r.endpoint+"/v1/kv/"+prefix+"?recurse=true", nil, &reply); err != nil {
+		if code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	values := make([]string, 0, len(reply))
+	for _, kv := range reply {
+		values = append(values, string(kv.Value))
+	}
+	return values, nil
+}
+
+// Destroys the session, deleting the registration along with it.
+func (r *consulRegistry) deregister() error {
+	if r.session == "" {
+		return nil
+	}
+	_, err := callRegistry(r.client, "PUT", r.endpoint+"/v1/session/destroy/"+r.session, nil, nil)
+	r.session = ""
+	return err
+}
@@ -0,0 +1,288 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// In-memory key-value store with expiring owners (leases or sessions), backing
+// the stand-in registry servers.
+type fakeRegistry struct {
+	keys   map[string][2]string // Key to value and owner mappings
+	owners map[string]bool      // Live lease or session ids
+	nonce  int                  // Counter to generate owner ids from
+	lock   sync.Mutex
+}
+
+// Creates a new empty stand-in registry.
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		keys:   make(map[string][2]string),
+		owners: make(map[string]bool),
+	}
+}
+
+// Creates a new live owner.
+func (r *fakeRegistry) grant() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.nonce++
+	id := fmt.Sprintf("%d", r.nonce)
+	r.owners[id] = true
+	return id
+}
+
+// Checks whether an owner is still live.
+func (r *fakeRegistry) live(owner string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.owners[owner]
+}
+
+// Stores a key owned by a live owner.
+func (r *fakeRegistry) put(key, value, owner string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.owners[owner] {
+		return false
+	}
+	r.keys[key] = [2]string{value, owner}
+	return true
+}
+
+// Revokes an owner, or all of them if empty, deleting the owned keys.
+func (r *fakeRegistry) revoke(owner string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id := range r.owners {
+		if owner == "" || owner == id {
+			delete(r.owners, id)
+		}
+	}
+	for key, entry := range r.keys {
+		if !r.owners[entry[1]] {
+			delete(r.keys, key)
+		}
+	}
+}
+
+// Retrieves the sorted keys in the [start, end) range.
+func (r *fakeRegistry) scan(start, end string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	keys := []string{}
+	for key := range r.keys {
+		if start <= key && key < end {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Retrieves the value of a key.
+func (r *fakeRegistry) get(key string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.keys[key][0]
+}
+
+// Creates a stand-in etcd v3 JSON gateway backed by a fake registry.
+func newFakeEtcd(reg *fakeRegistry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID       json.Number `json:"ID"`
+			TTL      json.Number `json:"TTL"`
+			Key      []byte      `json:"key"`
+			Value    []byte      `json:"value"`
+			Lease    json.Number `json:"lease"`
+			RangeEnd []byte      `json:"range_end"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Method != "POST" {
+			http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			fmt.Fprintf(w, `{"ID": "%s", "TTL": "%s"}`, reg.grant(), req.TTL)
+		case "/v3/lease/keepalive":
+			if reg.live(req.ID.String()) {
+				fmt.Fprintf(w, `{"result": {"ID": "%s", "TTL": "1"}}`, req.ID)
+			} else {
+				fmt.Fprintf(w, `{"result": {"ID": "%s"}}`, req.ID)
+			}
+		case "/v3/lease/revoke":
+			reg.revoke(req.ID.String())
+			fmt.Fprint(w, `{}`)
+		case "/v3/kv/put":
+			if !reg.put(string(req.Key), string(req.Value), req.Lease.String()) {
+				http.Error(w, `{"error": "lease not found"}`, http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		case "/v3/kv/range":
+			reply := struct {
+				Kvs []etcdKeyValue `json:"kvs,omitempty"`
+			}{}
+			for _, key := range reg.scan(string(req.Key), string(req.RangeEnd)) {
+				reply.Kvs = append(reply.Kvs, etcdKeyValue{Key: []byte(key), Value: []byte(reg.get(key))})
+			}
+			json.NewEncoder(w).Encode(reply)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// Creates a stand-in Consul agent backed by a fake registry.
+func newFakeConsul(reg *fakeRegistry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case r.Method == "PUT" && path == "/v1/session/create":
+			fmt.Fprintf(w, `{"ID": "%s"}`, reg.grant())
+		case r.Method == "PUT" && strings.HasPrefix(path, "/v1/session/renew/"):
+			if !reg.live(strings.TrimPrefix(path, "/v1/session/renew/")) {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `[]`)
+		case r.Method == "PUT" && strings.HasPrefix(path, "/v1/session/destroy/"):
+			reg.revoke(strings.TrimPrefix(path, "/v1/session/destroy/"))
+			fmt.Fprint(w, `true`)
+		case r.Method == "PUT" && strings.HasPrefix(path, "/v1/kv/"):
+			value, _ := ioutil.ReadAll(r.Body)
+			if !reg.put(strings.TrimPrefix(path, "/v1/kv/"), string(value), r.URL.Query().Get("acquire")) {
+				http.Error(w, "invalid session", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, `true`)
+		case r.Method == "GET" && strings.HasPrefix(path, "/v1/kv/") && r.URL.Query().Get("recurse") != "":
+			prefix := strings.TrimPrefix(path, "/v1/kv/")
+			reply := []map[string]interface{}{}
+			for _, key := range reg.scan(prefix, prefix+"\xff") {
+				reply = append(reply, map[string]interface{}{"Key": key, "Value": []byte(reg.get(key))})
+			}
+			if len(reply) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(reply)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// Tests that the registry seeders register themselves, discover each other
+// within the same cluster, recover from expirations and deregister on close.
+func TestRegistrySeeder(t *testing.T) {
+	for _, kind := range []string{"etcd", "consul"} {
+		reg := newFakeRegistry()
+
+		var server *httptest.Server
+		if kind == "etcd" {
+			server = newFakeEtcd(reg)
+		} else {
+			server = newFakeConsul(reg)
+		}
+		testRegistrySeeder(t, kind, server.URL, reg)
+		server.Close()
+	}
+}
+
+// Tests the registry seeders of a specific kind against a stand-in server.
+func testRegistrySeeder(t *testing.T, kind string, url string, reg *fakeRegistry) {
+	// Point the seeders to the stand-in server with quick refreshes
+	defer func(url, kind string, ttl time.Duration) {
+		config.BootRegistryURL, config.BootRegistryKind, config.BootRegistryTTL = url, kind, ttl
+	}(config.BootRegistryURL, config.BootRegistryKind, config.BootRegistryTTL)
+	config.BootRegistryURL, config.BootRegistryKind, config.BootRegistryTTL = url, kind, 150*time.Millisecond
+
+	// Start a few seeders in two separate clusters
+	names := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	magics := []string{"iris-test", "iris-test", "iris-other"}
+
+	seeders, sinks := make([]seeder, len(names)), make([]chan *net.IPAddr, len(names))
+	for i, name := range names {
+		ipnet := &net.IPNet{IP: net.ParseIP(name), Mask: net.CIDRMask(24, 32)}
+
+		seed, err := newRegistrySeeder(ipnet, []byte(magics[i]), log15.New("ipnet", ipnet))
+		if err != nil {
+			t.Fatalf("%s: failed to create seed generator: %v.", kind, err)
+		}
+		seeders[i], sinks[i] = seed, make(chan *net.IPAddr, 64)
+		phase := uint32(1)
+		if err := seeders[i].Start(sinks[i], &phase); err != nil {
+			t.Fatalf("%s: failed to start seed generator: %v.", kind, err)
+		}
+	}
+	// Ensure the members of the same cluster find each other, but no others
+	for i, want := range [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.1", "10.0.0.2"}, {"10.0.0.3"}} {
+		seen := make(map[string]bool)
+		for timeout := time.After(2 * time.Second); len(seen) < len(want); {
+			select {
+			case addr := <-sinks[i]:
+				seen[addr.String()] = true
+			case <-timeout:
+				t.Fatalf("%s: seeder #%d: timeout, have %v, want %v.", kind, i, seen, want)
+			}
+		}
+		for addr := range seen {
+			if addr != want[0] && (len(want) == 1 || addr != want[1]) {
+				t.Fatalf("%s: seeder #%d: foreign seed reported: %v.", kind, i, addr)
+			}
+		}
+	}
+	// Expire all registrations and ensure they are restored
+	reg.revoke("")
+	for start := time.Now(); len(reg.scan("", "\xff")) != len(names); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("%s: registrations not restored: have %v.", kind, reg.scan("", "\xff"))
+		}
+	}
+	// Terminate the seeders and ensure they deregister
+	for i, seed := range seeders {
+		if err := seed.Close(); err != nil {
+			t.Fatalf("%s: failed to terminate seed generator #%d: %v.", kind, i, err)
+		}
+		if keys := reg.scan("", "\xff"); len(keys) != len(names)-i-1 {
+			t.Fatalf("%s: registration count mismatch: have %v, want %v.", kind, len(keys), len(names)-i-1)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the generic seed generator behind the configured seed sources (static
+// list, DNS records and seed file), which - as opposed to the ad-hoc scanners -
+// may also point to peers outside of the local subnet, across routers.
+
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Name resolver used to look up seed addresses, implemented by net.Resolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Seed generator periodically reporting the addresses retrieved from a source.
+type sourceSeeder struct {
+	ipnet   *net.IPNet                    // IP network assigned to the seed generator
+	fetch   func() ([]*net.IPAddr, error) // Retrieves the current seed addresses
+	changed func() bool                   // Reports source modifications (optional)
+	release func()                        // Releases any source resources on termination (optional)
+	refresh time.Duration                 // Maximum interval between fetches (optional)
+	quit    chan chan error               // Quit channel to synchronize termination
+	log     log15.Logger                  // Contextual logger with injected ipnet and algorithm
+}
+
+// Creates a new static seed generator, reporting the given IP addresses or the
+// resolved addresses of the given host names.
+func newStaticSeeder(ipnet *net.IPNet, seeds []string, res resolver, logger log15.Logger) seeder {
+	return &sourceSeeder{
+		ipnet: ipnet,
+		fetch: func() ([]*net.IPAddr, error) {
+			return resolveHosts(res, seeds)
+		},
+		quit: make(chan chan error),
+		log:  logger.New("algo", "static"),
+	}
+}
+
+// Starts the seed generator.
+func (s *sourceSeeder) Start(sink chan *net.IPAddr, phase *uint32) error {
+	go s.run(sink, phase)
+	return nil
+}
+
+// Terminates the seed generator.
+func (s *sourceSeeder) Close() error {
+	errc := make(chan error, 1)
+	s.quit <- errc
+	return <-errc
+}
+
+// Periodically retrieves the seeds from the source and returns the reachable
+// addresses to the bootstrapper.
+func (s *sourceSeeder) run(sink chan *net.IPAddr, phase *uint32) {
+	s.log.Info("starting seed generator")
+
+	// Loop until closure is requested
+	var errc chan error
+	for trials := 0; errc == nil; {
+		// Retrieve the current seeds and filter out the unreachable ones
+		seeds, err := s.fetch()
+
+		local := []*net.IPAddr{}
+		for _, addr := range seeds {
+			if reachable(s.ipnet, addr.IP) {
+				local = append(local, addr)
+			}
+		}
+		// If no seeds have been found, log a message and retry after a while
+		if len(local) == 0 {
+			trials++
+			sleep := time.Duration(trials) * config.BootSeedSleepIncrement
+			if sleep > config.BootSeedSleepLimit {
+				sleep = config.BootSeedSleepLimit
+			}
+			if s.refresh > 0 && sleep > s.refresh {
+				sleep = s.refresh
+			}
+			s.log.Warn("retrieving seeds failed, sleeping", "error", err, "seeds", seeds, "sleep", sleep)
+			errc = s.wait(sleep)
+			continue
+		}
+		trials = 0
+
+		// Send the seeds upstream and wait
+		s.log.Info("reporting seed list", "seeds", local)
+		for _, addr := range local {
+			select {
+			case sink <- addr:
+			case errc = <-s.quit:
+			}
+			if errc != nil {
+				break
+			}
+		}
+		if errc != nil {
+			break
+		}
+		// Wait until closure, a source change or the next cycle
+		sleep := config.BootSeedFastRescan
+		if atomic.LoadUint32(phase) != 0 {
+			sleep = config.BootSeedSlowRescan
+		}
+		if s.refresh > 0 && sleep > s.refresh {
+			sleep = s.refresh
+		}
+		errc = s.wait(sleep)
+	}
+	// Release the source, log termination status and return
+	if s.release != nil {
+		s.release()
+	}
+	s.log.Info("seeder terminating gracefully")
+	errc <- nil
+}
+
+// Waits until the timeout expires or the source changes, returning any closure
+// request arriving in the mean time.
+func (s *sourceSeeder) wait(timeout time.Duration) chan error {
+	deadline := time.After(timeout)
+	for {
+		var poll <-chan time.Time
+		if s.changed != nil {
+			poll = time.After(config.BootSeedFilePoll)
+		}
+		select {
+		case errc := <-s.quit:
+			return errc
+		case <-deadline:
+			return nil
+		case <-poll:
+			if s.changed() {
+				return nil
+			}
+		}
+	}
+}
+
+// Resolves a list of IP addresses and host names into a deduplicated set of IP
+// addresses. Failures are tolerated as long as at least one host resolves.
+func resolveHosts(res resolver, hosts []string) ([]*net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.BootSeedTimeout)
+	defer cancel()
+
+	var fail error
+	seen, addrs := make(map[string]struct{}), []*net.IPAddr{}
+	for _, host := range hosts {
+		// Skip the lookup if a literal IP address was given
+		var ips []net.IPAddr
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IPAddr{{IP: ip}}
+		} else {
+			var err error
+			if ips, err = res.LookupIPAddr(ctx, host); err != nil {
+				fail = err
+				continue
+			}
+		}
+		// Gather all new addresses
+		for i := 0; i < len(ips); i++ {
+			if _, ok := seen[ips[i].String()]; !ok {
+				seen[ips[i].String()] = struct{}{}
+				addrs = append(addrs, &ips[i])
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fail
+	}
+	return addrs, nil
+}
+
+// Parses a list of textual IP addresses into a deduplicated set, discarding any
+// malformed entries.
+func parseIPs(ips []string) []*net.IPAddr {
+	seen, addrs := make(map[string]struct{}), []*net.IPAddr{}
+	for _, ip := range ips {
+		if addr := net.ParseIP(ip); addr != nil {
+			if _, ok := seen[addr.String()]; !ok {
+				seen[addr.String()] = struct{}{}
+				addrs = append(addrs, &net.IPAddr{IP: addr})
+			}
+		}
+	}
+	return addrs
+}
+
+// Checks whether a remote seed is reachable from the given interface: address
+// families must match and loopback interfaces cannot reach out (nor in).
+func reachable(ipnet *net.IPNet, ip net.IP) bool {
+	if (ipnet.IP.To4() == nil) != (ip.To4() == nil) {
+		return false
+	}
+	return ipnet.IP.IsLoopback() == ip.IsLoopback()
+}
@@ -0,0 +1,133 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Local fake name resolver serving a fixed set of host and SRV records.
+type fakeResolver struct {
+	hosts map[string][]string   // Host name to IP address mappings
+	srvs  map[string][]*net.SRV // Service name to SRV record mappings
+}
+
+// Looks up the IP addresses of a fake host.
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i].IP = net.ParseIP(ip)
+	}
+	return addrs, nil
+}
+
+// Looks up the SRV records of a fake service.
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "" || proto != "" {
+		return "", nil, fmt.Errorf("unsupported service/proto lookup: %s/%s", service, proto)
+	}
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return name, srvs, nil
+}
+
+// Retrieves a batch of seeds from a sink, returning them sorted.
+func collectSeeds(t *testing.T, sink chan *net.IPAddr, count int, timeout time.Duration) []string {
+	seeds := []string{}
+	for i := 0; i < count; i++ {
+		select {
+		case addr := <-sink:
+			seeds = append(seeds, addr.String())
+		case <-time.After(timeout):
+			t.Fatalf("failed to retrieve seed #%d.", i)
+		}
+	}
+	sort.Strings(seeds)
+	return seeds
+}
+
+// Tests that the static seeder reports the configured and resolved addresses,
+// filtering out the ones unreachable from the assigned interface.
+func TestStaticSeeder(t *testing.T) {
+	res := &fakeResolver{
+		hosts: map[string][]string{
+			"seed.iris.test": {"10.0.1.1", "::1", "10.0.1.2"},
+		},
+	}
+	ipnet := &net.IPNet{IP: net.IPv4(192, 168, 0, 100), Mask: net.CIDRMask(24, 32)}
+	seeds := []string{"10.0.0.1", "127.0.0.1", "seed.iris.test", "missing.iris.test", "10.0.0.1"}
+
+	seeder := newStaticSeeder(ipnet, seeds, res, log15.New("ipnet", ipnet))
+	sink, phase := make(chan *net.IPAddr), uint32(0)
+	if err := seeder.Start(sink, &phase); err != nil {
+		t.Fatalf("failed to start seed generator: %v.", err)
+	}
+	have := collectSeeds(t, sink, 3, time.Second)
+	if want := []string{"10.0.0.1", "10.0.1.1", "10.0.1.2"}; fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("seed list mismatch: have %v, want %v.", have, want)
+	}
+	// Ensure nothing else is reported within the rescan period
+	select {
+	case addr := <-sink:
+		t.Fatalf("unexpected seed reported: %v.", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := seeder.Close(); err != nil {
+		t.Fatalf("failed to terminate seed generator: %v.", err)
+	}
+}
+
+// Tests that seed reachability is decided by the address family and loopback
+// status of the assigned interface.
+func TestSeedReachability(t *testing.T) {
+	tests := []struct {
+		ipnet string
+		seed  string
+		ok    bool
+	}{
+		{"192.168.0.100/24", "10.0.0.1", true},
+		{"192.168.0.100/24", "192.168.0.1", true},
+		{"192.168.0.100/24", "127.0.0.1", false},
+		{"192.168.0.100/24", "fd00::1", false},
+		{"127.0.0.1/8", "127.0.0.2", true},
+		{"127.0.0.1/8", "10.0.0.1", false},
+		{"fd00::100/64", "fd01::1", true},
+		{"fd00::100/64", "::1", false},
+	}
+	for i, tt := range tests {
+		ip, ipnet, _ := net.ParseCIDR(tt.ipnet)
+		ipnet.IP = ip
+		if ok := reachable(ipnet, net.ParseIP(tt.seed)); ok != tt.ok {
+			t.Fatalf("test %d: reachability mismatch: have %v, want %v.", i, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package compress implements the payload compression codecs negotiated between
+// the two ends of links and tunnels. Payloads are compressed before encryption
+// and only if that actually shrinks them, so incompressible data is sent as is.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
+)
+
+// Compression codec of a message payload.
+type Codec uint8
+
+const (
+	None    Codec = iota // Payload is not compressed
+	Deflate              // Payload is compressed with raw deflate
+)
+
+// Returned if a payload was compressed with a codec unknown locally.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Returned if a payload decompresses beyond the allowed limit.
+var ErrTooLarge = errors.New("decompressed payload too large")
+
+// Names of the supported codecs, used during negotiation.
+var names = map[Codec]string{
+	Deflate: "deflate",
+}
+
+// Idle deflate compressors and decompressors, both being expensive to create.
+var (
+	writers = sync.Pool{
+		New: func() interface{} {
+			w, err := flate.NewWriter(nil, config.CompressLevel)
+			if err != nil {
+				panic(err)
+			}
+			return w
+		},
+	}
+	readers = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// Returns the negotiation name of the codec.
+func (c Codec) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return "none"
+}
+
+// Collects the locally enabled codecs, preferred first. Unknown names in the
+// configuration are skipped, so newer codecs can be listed ahead of time.
+func Enabled() []Codec {
+	codecs := make([]Codec, 0, len(config.CompressCodecs))
+	for _, name := range config.CompressCodecs {
+		for codec, known := range names {
+			if name == known {
+				codecs = append(codecs, codec)
+			}
+		}
+	}
+	return codecs
+}
+
+// Returns the most preferred locally enabled codec, or None if compression is
+// disabled.
+func Preferred() Codec {
+	for _, name := range config.CompressCodecs {
+		for codec, known := range names {
+			if name == known {
+				return codec
+			}
+		}
+	}
+	return None
+}
+
+// Filters the locally enabled codecs down to the ones offered by the remote side,
+// keeping the local preference order.
+func Negotiate(enabled []Codec, offers []string) []Codec {
+	common := []Codec{}
+	for _, codec := range enabled {
+		for _, offer := range offers {
+			if offer == codec.String() {
+				common = append(common, codec)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// Collects the negotiation names of a list of codecs.
+func Names(codecs []Codec) []string {
+	res := make([]string, len(codecs))
+	for i, codec := range codecs {
+		res[i] = codec.String()
+	}
+	return res
+}
+
+// Compresses data with the given codec into a pooled buffer. If the output would
+// not be smaller than the input, ok is false and the data should be sent as is.
+func Compress(codec Codec, data []byte) (res []byte, ok bool) {
+	if codec != Deflate || len(data) == 0 {
+		return nil, false
+	}
+	out := &boundedWriter{buf: pool.GetBuffer(len(data))[:0], limit: len(data)}
+
+	w := writers.Get().(*flate.Writer)
+	defer writers.Put(w)
+
+	w.Reset(out)
+	if _, err := w.Write(data); err != nil {
+		pool.PutBuffer(out.buf)
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		pool.PutBuffer(out.buf)
+		return nil, false
+	}
+	return out.buf, true
+}
+
+// Decompresses data produced by the given codec, failing if the output would be
+// larger than limit bytes (protection against decompression bombs).
+func Decompress(codec Codec, data []byte, limit int) ([]byte, error) {
+	if codec != Deflate {
+		return nil, ErrUnknownCodec
+	}
+	r := readers.Get().(io.ReadCloser)
+	defer readers.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+	res, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > limit {
+		return nil, ErrTooLarge
+	}
+	return res, nil
+}
+
+// Writer appending into a buffer, failing once the contents would no longer be
+// smaller than the limit.
+type boundedWriter struct {
+	buf   []byte
+	limit int
+}
+
+// Returned internally if compression does not shrink the payload.
+var errNoGain = errors.New("no compression gain")
+
+// Implements io.Writer, appending to the buffer while below the limit.
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if len(w.buf)+len(p) >= w.limit {
+		return 0, errNoGain
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
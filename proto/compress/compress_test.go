@@ -0,0 +1,114 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("iris compressible payload "), 1024)
+
+	packed, ok := Compress(Deflate, data)
+	if !ok {
+		t.Fatalf("failed to compress repetitive data.")
+	}
+	if len(packed) >= len(data) {
+		t.Fatalf("compressed size mismatch: have %v, want < %v.", len(packed), len(data))
+	}
+	unpacked, err := Decompress(Deflate, packed, len(data))
+	if err != nil {
+		t.Fatalf("failed to decompress data: %v.", err)
+	}
+	if !bytes.Equal(unpacked, data) {
+		t.Fatalf("decompressed data mismatch: have %x, want %x.", unpacked, data)
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	data := make([]byte, 4096)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to generate random data: %v.", err)
+	}
+	if _, ok := Compress(Deflate, data); ok {
+		t.Fatalf("random data compressed.")
+	}
+	if _, ok := Compress(None, data); ok {
+		t.Fatalf("data compressed without codec.")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// A small payload expanding to a lot of zeroes must be rejected
+	bomb, ok := Compress(Deflate, make([]byte, 1024*1024))
+	if !ok {
+		t.Fatalf("failed to compress zeroes.")
+	}
+	if _, err := Decompress(Deflate, bomb, 64*1024); err != ErrTooLarge {
+		t.Fatalf("bomb decompression error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if _, err := Decompress(Deflate, bomb[:len(bomb)/2], 1024*1024); err == nil {
+		t.Fatalf("truncated payload decompressed.")
+	}
+	if _, err := Decompress(Codec(255), bomb, 1024*1024); err != ErrUnknownCodec {
+		t.Fatalf("unknown codec error mismatch: have %v, want %v.", err, ErrUnknownCodec)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	// Unknown configured codecs should be skipped
+	defer func(codecs []string) { config.CompressCodecs = codecs }(config.CompressCodecs)
+	config.CompressCodecs = []string{"zstd", "deflate"}
+
+	enabled := Enabled()
+	if len(enabled) != 1 || enabled[0] != Deflate {
+		t.Fatalf("enabled codecs mismatch: have %v, want %v.", enabled, []Codec{Deflate})
+	}
+	tests := []struct {
+		offers []string
+		common []Codec
+	}{
+		{nil, []Codec{}},
+		{[]string{"snappy"}, []Codec{}},
+		{[]string{"snappy", "deflate"}, []Codec{Deflate}},
+	}
+	for i, tt := range tests {
+		common := Negotiate(enabled, tt.offers)
+		if len(common) != len(tt.common) || (len(common) > 0 && common[0] != tt.common[0]) {
+			t.Fatalf("test %d: common codecs mismatch: have %v, want %v.", i, common, tt.common)
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	data := bytes.Repeat([]byte("iris compressible payload "), 256)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := Compress(Deflate, data); !ok {
+			b.Fatalf("failed to compress data.")
+		}
+	}
+}
@@ -34,6 +34,7 @@ var ErrTerminating = errors.New("terminating")
 var ErrTimeout = errors.New("timeout")
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
+var ErrSizeLimit = errors.New("message size limit exceeded")
 
 // Prefixes for multi-clustering.
 var clusterPrefixes []string
@@ -141,6 +142,7 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 			}
 		}
 	}
+	c.iris.Chaos().Track(c.workers)
 	c.workers.Start()
 
 	return c, nil
@@ -149,13 +151,45 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 // Broadcasts asynchronously a message to all members of an iris cluster. No
 // guarantees are made that all nodes receive the message (best effort).
 func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	return c.broadcast(cluster, msg, false)
+}
+
+// Broadcasts a message like Broadcast, but exempt from payload compression (e.g.
+// if it's already compressed).
+func (c *Connection) BroadcastRaw(cluster string, msg []byte) error {
+	return c.broadcast(cluster, msg, true)
+}
+
+// Assembles and broadcasts a message, optionally exempt from compression.
+func (c *Connection) broadcast(cluster string, msg []byte, raw bool) error {
+	if !withinLimit(opBcast, msg) {
+		return ErrSizeLimit
+	}
+	packet := c.assembleBroadcast(msg)
+	if raw {
+		packet.NoCompress()
+	}
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, packet)
 }
 
 // Executes a synchronous request to cluster (load balanced between all active),
 // and returns the received reply, or an error if a timeout is reached.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(cluster, req, timeout, false)
+}
+
+// Executes a request like Request, but exempt from payload compression (e.g. if
+// it's already compressed).
+func (c *Connection) RequestRaw(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(cluster, req, timeout, true)
+}
+
+// Assembles and executes a request, optionally exempt from compression.
+func (c *Connection) request(cluster string, req []byte, timeout time.Duration, raw bool) ([]byte, error) {
+	if !withinLimit(opReq, req) {
+		return nil, ErrSizeLimit
+	}
 	// Create a reply and error channel for the results
 	repc := make(chan []byte, 1)
 	errc := make(chan error, 1)
@@ -177,8 +211,12 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 		c.reqLock.Unlock()
 	}()
 	// Send the request
+	packet := c.assembleRequest(reqId, req, timeout)
+	if raw {
+		packet.NoCompress()
+	}
 	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, packet)
 
 	// Retrieve the results, time out or fail if terminating
 	select {
@@ -225,8 +263,26 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 // Publishes an event asynchronously to topic. No guarantees are made that all
 // subscribers receive the message.
 func (c *Connection) Publish(topic string, msg []byte) error {
+	return c.publish(topic, msg, false)
+}
+
+// Publishes an event like Publish, but exempt from payload compression (e.g. if
+// it's already compressed).
+func (c *Connection) PublishRaw(topic string, msg []byte) error {
+	return c.publish(topic, msg, true)
+}
+
+// Assembles and publishes an event, optionally exempt from compression.
+func (c *Connection) publish(topic string, msg []byte, raw bool) error {
+	if !withinLimit(opPub, msg) {
+		return ErrSizeLimit
+	}
+	packet := c.assemblePublish(msg)
+	if raw {
+		packet.NoCompress()
+	}
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, packet)
 }
 
 // Unsubscribes from topic, receiving no more event notifications for it.
@@ -315,6 +371,7 @@ func (c *Connection) Close() error {
 		return err
 	}
 	// Terminate the worker pool
+	c.iris.Chaos().Untrack(c.workers)
 	c.workers.Terminate(true)
 
 	// Drop the connection from the tracked list
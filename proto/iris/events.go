@@ -27,13 +27,19 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
 // the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
+	if !withinLimit(head.Op, msg.Data) {
+		log.Printf("iris: oversized publish (op %v): %d bytes.", head.Op, len(msg.Data))
+		return
+	}
 
 	// Fetch the message recipients
 	o.lock.RLock()
@@ -49,14 +55,23 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 	}
 	o.lock.RUnlock()
 
+	// Give each subscription its own payload, as handlers may recycle them
+	datas := make([][]byte, len(conns))
+	for i := 1; i < len(conns); i++ {
+		datas[i] = pool.GetBuffer(len(msg.Data))
+		copy(datas[i], msg.Data)
+	}
+	if len(conns) > 0 {
+		datas[0] = msg.Data
+	}
 	// Publish to every live subscription
 	for i := 0; i < len(conns); i++ {
-		conn := conns[i] // Closure
+		conn, data := conns[i], datas[i] // Closure
 		switch head.Op {
 		case opBcast:
-			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
+			conn.workers.Schedule(func() { conn.handleBroadcast(data) })
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			conn.workers.Schedule(func() { conn.handlePublish(topic, data) })
 		default:
 			log.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
@@ -67,6 +82,10 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 // the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
+	if !withinLimit(head.Op, msg.Data) {
+		log.Printf("iris: oversized balance (op %v): %d bytes.", head.Op, len(msg.Data))
+		return
+	}
 
 	// Fetch the possible message recipients and pick one at random
 	o.lock.RLock()
@@ -84,7 +103,9 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 	case opReq:
 		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		conn.workers.Schedule(func() {
+			conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunSuites, head.TunWires, head.TunCodecs, head.TunTime)
+		})
 	default:
 		log.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
@@ -94,6 +115,10 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 // from the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
+	if !withinLimit(head.Op, msg.Data) {
+		log.Printf("iris: oversized direct (op %v): %d bytes.", head.Op, len(msg.Data))
+		return
+	}
 
 	// Fetch the intended recipient
 	o.lock.RLock()
@@ -125,6 +150,9 @@ func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint6
 	if err == ErrTerminating || err == ErrTimeout {
 		return
 	}
+	if err == nil && !withinLimit(opRep, rep) {
+		err = ErrSizeLimit
+	}
 	c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep, err))
 }
 
@@ -162,14 +190,14 @@ func (c *Connection) handlePublish(topic string, msg []byte) {
 
 // Accepts the inbound tunnel, notifies the remote endpoint of the success and
 // starts the local handler.
-func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
+func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, suites []string, wires []wire.Version, codecs []string, timeout time.Duration) {
 	// Validate the remote address list
 	if len(addrs) == 0 {
 		log.Printf("iris: empty address list for tunnel request.")
 		return
 	}
 	// Try to establish the outbound tunnel
-	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
+	if tun, err := c.buildTunnel(conn, id, key, addrs, suites, wires, codecs, timeout); err != nil {
 		log.Printf("iris: failed to accept tunnel: %v.", err)
 	} else {
 		c.handler.HandleTunnel(tun)
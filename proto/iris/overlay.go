@@ -26,7 +26,11 @@ import (
 	"net"
 	"sync"
 
+	"github.com/project-iris/iris/clock"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto/pastry"
 	"github.com/project-iris/iris/proto/scribe"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // The overlay implementation, receiving the overlay events and processing
@@ -40,8 +44,10 @@ type Overlay struct {
 	subLive map[string][]uint64     // Live members of each subscribed topic
 	subLock map[string]sync.RWMutex // Locks protecting the individual topics
 
-	tunAddrs []string          // Listener addresses for the tunnel endpoints
-	tunQuits []chan chan error // Quit channels for the tunnel acceptors
+	trans    transport.Transport // Network transport to carry the tunnels
+	hosts    []string            // Explicit hosts to listen on (interfaces if empty)
+	tunAddrs []string            // Listener addresses for the tunnel endpoints
+	tunQuits []chan chan error   // Quit channels for the tunnel acceptors
 
 	lock sync.RWMutex // Protects the overlay state
 }
@@ -54,11 +60,78 @@ func New(overId string, key *rsa.PrivateKey) *Overlay {
 		conns:   make(map[uint64]*Connection),
 		subLive: make(map[string][]uint64),
 		subLock: make(map[string]sync.RWMutex),
+		trans:   transport.TCP,
 	}
 	o.scribe = scribe.New(overId, key, o)
 	return o
 }
 
+// Replaces the network transport carrying both the overlay sessions and the
+// tunnels (TCP by default). It must be called before booting.
+func (o *Overlay) SetTransport(trans transport.Transport) {
+	o.trans = trans
+	o.scribe.SetTransport(trans)
+}
+
+// Replaces the time source of the overlay heartbeats. It must be called before
+// booting.
+func (o *Overlay) SetClock(clk clock.Clock) {
+	o.scribe.SetClock(clk)
+}
+
+// Sets the overlay addresses to listen on instead of the network interfaces, and
+// the seed peers to join through instead of LAN bootstrapping. The tunnels are
+// accepted on the hosts of the listener addresses. It must be called before
+// booting.
+func (o *Overlay) SetEndpoints(binds []string, seeds []string) error {
+	hosts := make([]string, 0, len(binds))
+	for _, bind := range binds {
+		host, _, err := net.SplitHostPort(bind)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, host)
+	}
+	o.hosts = hosts
+	o.scribe.SetEndpoints(binds, seeds)
+	return nil
+}
+
+// Sets the fixed overlay identity of the node, usually a persisted one. It must
+// be called before booting.
+func (o *Overlay) SetIdentity(ident *identity.Identity) {
+	o.scribe.SetIdentity(ident)
+}
+
+// Sets the node certificate issued by the cluster authority, in which case the
+// shared cluster key may be nil. It must be called before booting.
+func (o *Overlay) SetCertificate(cert *identity.Certificate, authority *identity.Authority) {
+	o.scribe.SetCertificate(cert, authority)
+}
+
+// Adds an extra key to verify remote nodes with, used while rotating the cluster
+// key. It must be called before booting.
+func (o *Overlay) Trust(key *rsa.PublicKey) {
+	o.scribe.Trust(key)
+}
+
+// Applies a revocation list of the cluster authority, evicting revoked nodes.
+func (o *Overlay) Revoke(list *identity.Revocation) error {
+	return o.scribe.Revoke(list)
+}
+
+// Sets the path of the file to persist the known peers into, seeding the next
+// boot from it. It must be called before booting.
+func (o *Overlay) SetCache(path string) {
+	o.scribe.SetCache(path)
+}
+
+// Returns the fault injection handle of the underlying overlay. The handler
+// pools of the client connections are tracked by it, so stalls affect them.
+func (o *Overlay) Chaos() *pastry.Chaos {
+	return o.scribe.Chaos()
+}
+
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
 	// Boot the underlay and wait until it converges
@@ -66,6 +139,18 @@ func (o *Overlay) Boot() (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	// If explicit hosts were set, start a tunnel acceptor on each of them
+	if len(o.hosts) > 0 {
+		for _, host := range o.hosts {
+			quit := make(chan chan error)
+			o.tunQuits = append(o.tunQuits, quit)
+
+			live := make(chan struct{})
+			go o.tunneler(host, live, quit)
+			<-live
+		}
+		return peers, nil
+	}
 	// Start a tunnel acceptor on each network interface
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -91,7 +176,7 @@ func (o *Overlay) Boot() (int, error) {
 
 			// Start and sync the acceptor
 			live := make(chan struct{})
-			go o.tunneler(ip, live, quit)
+			go o.tunneler(ip.String(), live, quit)
 			<-live
 		}
 	}
@@ -24,7 +24,10 @@ import (
 	"encoding/gob"
 	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // Iris operation code.
@@ -50,15 +53,107 @@ type header struct {
 	ReqTime time.Duration // Maximum amount of time spendable on the request
 
 	// Optional fields for tunnels
-	TunId    uint64        // Id of the tunnel being requested
-	TunKey   []byte        // Secret symmetric key of the tunnel
-	TunAddrs []string      // Tunnel listener endpoints
-	TunTime  time.Duration // Maximum time to establish tunnel
+	TunId     uint64         // Id of the tunnel being requested
+	TunKey    []byte         // Secret symmetric key of the tunnel
+	TunAddrs  []string       // Tunnel listener endpoints
+	TunSuites []string       // Cryptographic suites accepted by the tunnel listener
+	TunWires  []wire.Version // Wire versions accepted by the tunnel listener
+	TunCodecs []string       // Compression codecs accepted by the tunnel listener
+	TunTime   time.Duration  // Maximum time to establish tunnel
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and wire.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wireHeader, func() wire.Meta { return new(header) })
+}
+
+// Wire tags of the iris packets.
+const (
+	wireHeader = 32
+	wireInit   = 33
+	wireAuth   = 34
+	wireData   = 35
+)
+
+// Serializes the iris header into the binary wire format.
+func (h *header) MarshalWire(enc *wire.Encoder) {
+	enc.PutUint(uint64(h.Op))
+	enc.PutUint(h.Src)
+	enc.PutUint(h.Dest)
+
+	enc.PutUint(h.ReqId)
+	enc.PutBool(h.ReqFail)
+	enc.PutInt(int64(h.ReqTime))
+
+	enc.PutUint(h.TunId)
+	enc.PutBytes(h.TunKey)
+	enc.PutStrings(h.TunAddrs)
+	enc.PutStrings(h.TunSuites)
+	putVersions(enc, h.TunWires)
+	enc.PutStrings(h.TunCodecs)
+	enc.PutInt(int64(h.TunTime))
+}
+
+// Deserializes the iris header from the binary wire format.
+func (h *header) UnmarshalWire(dec *wire.Decoder) {
+	h.Op = opcode(dec.Uint())
+	h.Src = dec.Uint()
+	h.Dest = dec.Uint()
+
+	h.ReqId = dec.Uint()
+	h.ReqFail = dec.Bool()
+	h.ReqTime = time.Duration(dec.Int())
+
+	h.TunId = dec.Uint()
+	h.TunKey = dec.Bytes()
+	h.TunAddrs = dec.Strings()
+	h.TunSuites = dec.Strings()
+	h.TunWires = versions(dec)
+	h.TunCodecs = dec.Strings()
+	h.TunTime = time.Duration(dec.Int())
+}
+
+// Serializes a list of wire versions, one byte each.
+func putVersions(enc *wire.Encoder, list []wire.Version) {
+	if list == nil {
+		enc.PutBytes(nil)
+		return
+	}
+	raw := make([]byte, len(list))
+	for i, v := range list {
+		raw[i] = byte(v)
+	}
+	enc.PutBytes(raw)
+}
+
+// Deserializes a list of wire versions.
+func versions(dec *wire.Decoder) []wire.Version {
+	raw := dec.Bytes()
+	if raw == nil {
+		return nil
+	}
+	list := make([]wire.Version, len(raw))
+	for i, v := range raw {
+		list[i] = wire.Version(v)
+	}
+	return list
+}
+
+// Checks whether a message payload is within the size limit of its operation.
+func withinLimit(op opcode, data []byte) bool {
+	switch op {
+	case opBcast:
+		return len(data) <= config.IrisBroadcastLimit
+	case opReq:
+		return len(data) <= config.IrisRequestLimit
+	case opRep:
+		return len(data) <= config.IrisReplyLimit
+	case opPub:
+		return len(data) <= config.IrisPublishLimit
+	default:
+		return len(data) == 0
+	}
 }
 
 // Envelopes an Iris header and payload into the generic packet container.
@@ -100,8 +195,8 @@ func (c *Connection) assemblePublish(msg []byte) *proto.Message {
 }
 
 // Assembles a tunneling request message, consisting of the tunneling opcode,
-// local tunnel id, assigned secret key and reachability infos for the reverse
-// stream connection.
+// local tunnel id, assigned secret key, reachability infos and accepted crypto
+// suites, wire versions and compression codecs for the reverse stream connection.
 func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, addrs []string, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout}, nil)
+	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunSuites: config.SessionSuites, TunWires: wire.Enabled(), TunCodecs: compress.Names(compress.Enabled()), TunTime: timeout}, nil)
 }
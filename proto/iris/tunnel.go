@@ -23,7 +23,6 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
 	"net"
@@ -31,22 +30,31 @@ import (
 	"sync"
 	"time"
 
-	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
 	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/session"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // The initialization packet when the tunnel is set up.
 type initPacket struct {
-	ConnId uint64 // Id of the Iris client connection requesting the tunnel
-	TunId  uint64 // Id of the tunnel being built
+	ConnId uint64       // Id of the Iris client connection requesting the tunnel
+	TunId  uint64       // Id of the tunnel being built
+	Suite  string       // Cryptographic suite chosen for the tunnel link
+	Wire   wire.Version // Wire version chosen for the tunnel link
+	Codecs []string     // Compression codecs accepted by both tunnel ends
 }
 
-// Authorization packet to send over the established encrypted tunnels.
+// Authorization packet to send over the established encrypted tunnels. The
+// accepted suites and wire versions are echoed to detect tampering with the
+// plaintext choices.
 type authPacket struct {
-	Id uint64
+	Id     uint64
+	Suites []string
+	Wires  []wire.Version
 }
 
 // Header to attach to data transfer packets.
@@ -54,23 +62,74 @@ type dataHeader struct {
 	SizeOrCont int // Size of the original message, or 0 if not the first chunk
 }
 
-// Make sure the handshake packets are registered with gob.
+// Make sure the handshake packets are registered with gob and wire.
 func init() {
 	gob.Register(&initPacket{})
 	gob.Register(&authPacket{})
 	gob.Register(&dataHeader{})
+
+	wire.Register(wireInit, func() wire.Meta { return new(initPacket) })
+	wire.Register(wireAuth, func() wire.Meta { return new(authPacket) })
+	wire.Register(wireData, func() wire.Meta { return new(dataHeader) })
 }
 
-func (o *Overlay) tunneler(ip net.IP, live chan struct{}, quit chan chan error) {
-	// Listen for incoming streams on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.String(), "0"))
-	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ip, err))
+// Serializes the tunnel init packet into the binary wire format.
+func (p *initPacket) MarshalWire(enc *wire.Encoder) {
+	enc.PutUint(p.ConnId)
+	enc.PutUint(p.TunId)
+	enc.PutString(p.Suite)
+	enc.PutUint(uint64(p.Wire))
+	enc.PutStrings(p.Codecs)
+}
+
+// Deserializes the tunnel init packet from the binary wire format.
+func (p *initPacket) UnmarshalWire(dec *wire.Decoder) {
+	p.ConnId = dec.Uint()
+	p.TunId = dec.Uint()
+	p.Suite = dec.String()
+	p.Wire = wire.Version(dec.Uint())
+	p.Codecs = dec.Strings()
+}
+
+// Serializes the tunnel auth packet into the binary wire format.
+func (p *authPacket) MarshalWire(enc *wire.Encoder) {
+	enc.PutUint(p.Id)
+	enc.PutStrings(p.Suites)
+	putVersions(enc, p.Wires)
+}
+
+// Deserializes the tunnel auth packet from the binary wire format.
+func (p *authPacket) UnmarshalWire(dec *wire.Decoder) {
+	p.Id = dec.Uint()
+	p.Suites = dec.Strings()
+	p.Wires = versions(dec)
+}
+
+// Serializes the tunnel data header into the binary wire format.
+func (h *dataHeader) MarshalWire(enc *wire.Encoder) {
+	enc.PutInt(int64(h.SizeOrCont))
+}
+
+// Deserializes the tunnel data header from the binary wire format.
+func (h *dataHeader) UnmarshalWire(dec *wire.Decoder) {
+	h.SizeOrCont = int(dec.Int())
+}
+
+// Picks the wire version for a tunnel, peers not advertising any speaking gob.
+func negotiateWire(offers []wire.Version) (wire.Version, error) {
+	if len(offers) == 0 {
+		offers = []wire.Version{wire.VersionGob}
 	}
-	sock, err := stream.Listen(addr)
+	return wire.Negotiate(wire.Enabled(), offers)
+}
+
+func (o *Overlay) tunneler(host string, live chan struct{}, quit chan chan error) {
+	// Listen for incoming streams on the given interface and random port.
+	sock, err := stream.ListenTransport(o.trans, net.JoinHostPort(host, "0"))
 	if err != nil {
 		panic(fmt.Sprintf("failed to start stream listener: %v.", err))
 	}
+	addr := sock.Addr()
 	sock.Accept(config.IrisTunnelAcceptTimeout)
 
 	// Save the new listener address into the local (sorted) address list
@@ -191,9 +250,20 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 
 // Accepts an incoming tunneling request from a remote, initializes and stores
 // the new tunnel into the connection state.
-func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, suites []string, wires []wire.Version, codecs []string, timeout time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
 
+	// Pick the strongest crypto suite and wire version accepted by both ends
+	suite, err := session.Negotiate(suites)
+	if err != nil {
+		return nil, err
+	}
+	version, err := negotiateWire(wires)
+	if err != nil {
+		return nil, err
+	}
+	common := compress.Negotiate(compress.Enabled(), codecs)
+
 	// Create the local tunnel endpoint
 	c.tunLock.Lock()
 	tunId := c.tunIdx
@@ -207,10 +277,9 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 	c.tunLock.Unlock()
 
 	// Dial the remote tunnel listener
-	var err error
 	var strm *stream.Stream
 	for _, addr := range addrs {
-		strm, err = stream.Dial(addr, timeout)
+		strm, err = stream.DialTransport(c.iris.trans, addr, timeout)
 		if err == nil {
 			break
 		}
@@ -218,7 +287,7 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 	// If no error occurred, initialize the client endpoint
 	if err == nil {
 		var conn *link.Link
-		conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
+		conn, err = c.initClientTunnel(strm, remote, id, key, suite, version, common, deadline)
 		if err != nil {
 			if err := strm.Close(); err != nil {
 				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
@@ -269,15 +338,26 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	if !ok {
 		return errors.New("tunnel not found")
 	}
-	// Create the encrypted link
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, true)
+	// Create the encrypted link with the requested suite and wire, if acceptable
+	suite, err := session.Negotiate([]string{init.Suite})
+	if err != nil {
+		return err
+	}
+	version, err := wire.Negotiate(wire.Enabled(), []wire.Version{init.Wire})
+	if err != nil {
+		return err
+	}
+	codecs := compress.Negotiate(compress.Enabled(), init.Codecs)
+	if len(codecs) != len(init.Codecs) {
+		return errors.New("unaccepted compression codec")
+	}
+	conn := suite.Link(strm, tun.secret, true, version)
+	conn.SetCodecs(codecs)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: tun.id},
+			Meta: &authPacket{Id: tun.id, Suites: config.SessionSuites, Wires: wire.Enabled()},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
@@ -287,6 +367,10 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 		return err
 	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != tun.id {
 		return errors.New("protocol violation")
+	} else if best, err := session.Negotiate(auth.Suites); err != nil || best != suite {
+		return errors.New("suite downgrade detected")
+	} else if best, err := negotiateWire(auth.Wires); err != nil || best != version {
+		return errors.New("wire downgrade detected")
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
@@ -303,25 +387,24 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 }
 
 // Initializes a stream into an encrypted tunnel link.
-func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, deadline time.Time) (*link.Link, error) {
+func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, suite *session.Suite, version wire.Version, codecs []compress.Codec, deadline time.Time) (*link.Link, error) {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(deadline)
 	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Send the unencrypted tunnel id to associate with the remote tunnel
-	init := &initPacket{ConnId: remote, TunId: id}
+	init := &initPacket{ConnId: remote, TunId: id, Suite: suite.Name, Wire: version, Codecs: compress.Names(codecs)}
 	if err := strm.Send(init); err != nil {
 		return nil, err
 	}
 	// Create the encrypted link and authorize it
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, key, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, false)
+	conn := suite.Link(strm, key, false, version)
+	conn.SetCodecs(codecs)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: id},
+			Meta: &authPacket{Id: id, Suites: config.SessionSuites, Wires: wire.Enabled()},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
@@ -331,6 +414,10 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 		return nil, err
 	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != id {
 		return nil, errors.New("protocol violation")
+	} else if best, err := session.Negotiate(auth.Suites); err != nil || best != suite {
+		return nil, errors.New("suite downgrade detected")
+	} else if best, err := negotiateWire(auth.Wires); err != nil || best != version {
+		return nil, errors.New("wire downgrade detected")
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
@@ -357,6 +444,17 @@ func (t *Tunnel) Close() error {
 
 // Sends an asynchronous message to the remote pair. Not reentrant (order).
 func (t *Tunnel) Send(size int, chunk []byte) error {
+	return t.send(size, chunk, false)
+}
+
+// Sends a message like Send, but exempt from payload compression (e.g. if it's
+// already compressed).
+func (t *Tunnel) SendRaw(size int, chunk []byte) error {
+	return t.send(size, chunk, true)
+}
+
+// Encrypts and queues a chunk for sending, optionally exempt from compression.
+func (t *Tunnel) send(size int, chunk []byte, raw bool) error {
 	// Create and encrypt the message
 	packet := &proto.Message{
 		Head: proto.Header{
@@ -364,6 +462,9 @@ func (t *Tunnel) Send(size int, chunk []byte) error {
 		},
 		Data: chunk,
 	}
+	if raw {
+		packet.NoCompress()
+	}
 	if err := packet.Encrypt(); err != nil {
 		return err
 	}
@@ -27,7 +27,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/project-iris/iris/clock"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // Connection handler for the tunnel tests.
@@ -188,3 +190,144 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 		}
 	}
 }
+
+// Tests that compressible and opted out payloads both pass through tunnels.
+func TestTunnelCompression(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "tunnel-test"
+	cluster := "tunnel-test-compression"
+
+	node := New(overlay, key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect(cluster, &tunneler{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	tun, err := conn.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	defer func() {
+		if err := tun.Close(); err != nil {
+			t.Fatalf("failed to tear down tunnel: %v.", err)
+		}
+	}()
+	// Send compressible data both ways and make sure it arrives intact
+	orig := bytes.Repeat([]byte{0, 1, 2, 3}, 4096)
+	for i, send := range []func(int, []byte) error{tun.Send, tun.SendRaw} {
+		msg := append([]byte{}, orig...)
+		if err := send(len(msg), msg); err != nil {
+			t.Fatalf("test %d: failed to send message: %v.", i, err)
+		}
+		if chunk, msg, err := tun.Recv(3 * time.Second); err != nil {
+			t.Fatalf("test %d: failed to receive message: %v.", i, err)
+		} else if chunk != len(orig) {
+			t.Fatalf("test %d: send/recv chunk mismatch: have %v, want %v.", i, chunk, len(orig))
+		} else if !bytes.Equal(orig, msg) {
+			t.Fatalf("test %d: send/recv data mismatch: have %v, want %v.", i, msg, orig)
+		}
+	}
+}
+
+// Tests that tunnels are unaffected by overlay faults and stalled handlers only
+// delay their construction.
+func TestTunnelChaos(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+	cluster := "tunnel-chaos-test"
+
+	// Boot two iris overlays on an in-process network
+	liveNodes := make([]*Overlay, 2)
+	seeds := []string{}
+	for i := 0; i < len(liveNodes); i++ {
+		host := fmt.Sprintf("10.0.0.%d", i+1)
+
+		liveNodes[i] = New("tunnel-chaos", key)
+		liveNodes[i].SetTransport(network.Host(host))
+		if err := liveNodes[i].SetEndpoints([]string{host + ":4000"}, seeds); err != nil {
+			t.Fatalf("failed to set iris endpoints: %v.", err)
+		}
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+
+		seeds = append(seeds, host+":4000")
+	}
+	// Register a service on the second node and a client on the first
+	server, err := liveNodes[1].Connect(cluster, &tunneler{1, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	client, err := liveNodes[0].Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	time.Sleep(time.Second)
+
+	// Stall the service handlers and ensure tunnels cannot be built
+	liveNodes[1].Chaos().Stall()
+	if tun, err := client.Tunnel(cluster, 250*time.Millisecond); err == nil {
+		tun.Close()
+		t.Fatalf("tunnel established with stalled handlers.")
+	}
+	liveNodes[1].Chaos().Resume()
+
+	tun, err := client.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	defer tun.Close()
+
+	// Passes a message through the tunnel and verifies the echo
+	check := func(i int) {
+		orig := []byte{byte(0), byte(i)}
+		if err := tun.Send(len(orig), append([]byte{}, orig...)); err != nil {
+			t.Fatalf("failed to send message: %v.", err)
+		}
+		if chunk, msg, err := tun.Recv(3 * time.Second); err != nil {
+			t.Fatalf("failed to receive message: %v.", err)
+		} else if chunk != len(orig) {
+			t.Fatalf("send/recv chunk mismatch: have %v, want %v.", chunk, len(orig))
+		} else if bytes.Compare(orig, msg) != 0 {
+			t.Fatalf("send/recv data mismatch: have %v, want %v.", msg, orig)
+		}
+	}
+	check(0)
+
+	// Tear down all overlay sessions and ensure the tunnel keeps working
+	if killed := liveNodes[0].Chaos().KillAll(); killed == 0 {
+		t.Fatalf("no overlay sessions killed.")
+	}
+	for i := 1; i <= 10; i++ {
+		check(i)
+	}
+}
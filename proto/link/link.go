@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -32,25 +33,73 @@ import (
 	"net"
 	"time"
 
+	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
+)
+
+// Framing mode of a link, deciding how the message headers are protected.
+type Mode uint8
+
+const (
+	ModeCTR  Mode = iota // Counter mode encrypted headers, HMAC over the whole frame
+	ModeAEAD             // Authenticated encryption of the headers, bound to the payload
 )
 
 // Link termination message for graceful tear-down.
 type closePacket struct {
 }
 
-// Make sure the close packet is registered with gob.
+// Key rotation message, after which the sender switches to its next keys.
+type rekeyPacket struct {
+}
+
+// Make sure the link control packets are registered with gob and the wire codec.
 func init() {
 	gob.Register(&closePacket{})
+	gob.Register(&rekeyPacket{})
+
+	wire.Register(wireClose, func() wire.Meta { return new(closePacket) })
+	wire.Register(wireRekey, func() wire.Meta { return new(rekeyPacket) })
 }
 
-// Accomplishes secure and authenticated full duplex communication. Note, only
-// the headers are encrypted and decrypted. It is the responsibility of the
-// caller to call proto.Message.Encrypt/Decrypt (link would bottleneck).
+// Wire tags of the link control packets.
+const (
+	wireClose = 3
+	wireRekey = 4
+)
+
+// Implements wire.Meta, the close packet having no fields.
+func (p *closePacket) MarshalWire(enc *wire.Encoder) {}
+
+// Implements wire.Meta, the close packet having no fields.
+func (p *closePacket) UnmarshalWire(dec *wire.Decoder) {}
+
+// Implements wire.Meta, the rekey packet having no fields.
+func (p *rekeyPacket) MarshalWire(enc *wire.Encoder) {}
+
+// Implements wire.Meta, the rekey packet having no fields.
+func (p *rekeyPacket) UnmarshalWire(dec *wire.Decoder) {}
+
+// Ensure unique key expansion for the key rotations.
+var rekeyInfo = []byte("iris.proto.link.rekey")
+
+// Accomplishes secure and authenticated full duplex communication. Note, unless
+// the security model requires hop-by-hop payload encryption, only the headers
+// are encrypted and decrypted. It is the responsibility of the caller to call
+// proto.Message.Encrypt/Decrypt (link would bottleneck).
 type Link struct {
-	socket *stream.Stream
+	socket  *stream.Stream
+	mode    Mode
+	version wire.Version
+	hasher  func() hash.Hash // Hash creator for the key rotation ratchet
+	codecs  []compress.Codec // Payload compressions accepted by the remote side
+
+	security proto.Security // Payload security model enforced by the link
 
 	inCipher  cipher.Stream
 	outCipher cipher.Stream
@@ -58,14 +107,38 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
+	inAEAD   cipher.AEAD
+	outAEAD  cipher.AEAD
+	inNonce  uint64
+	outNonce uint64
+
+	inSeed  []byte // Ratchet secret to derive the next inbound keys from
+	outSeed []byte // Ratchet secret to derive the next outbound keys from
+
+	inEpoch  uint64    // Number of inbound key rotations
+	outEpoch uint64    // Number of outbound key rotations
+	outBytes uint64    // Bytes sent since the last outbound key rotation
+	outTime  time.Time // Time of the last outbound key rotation
+
+	rekeyBytes  uint64        // Bytes to send before rotating the outbound keys
+	rekeyPeriod time.Duration // Time to pass before rotating the outbound keys
+
 	inBuffer  bytes.Buffer
 	outBuffer bytes.Buffer
 
 	inCoder  *gob.Decoder
 	outCoder *gob.Encoder
 
-	inHeadBuf []byte
-	inMacBuf  []byte
+	inDecoder  wire.Decoder // Reused binary header decoder
+	outEncoder wire.Encoder // Reused binary header encoder
+
+	inHeadBuf  []byte
+	inMacBuf   []byte
+	inNonceBuf []byte
+
+	outHeadBuf  []byte
+	outSealBuf  []byte
+	outNonceBuf []byte
 
 	Send     chan *proto.Message
 	Recv     chan *proto.Message
@@ -75,18 +148,48 @@ type Link struct {
 
 // Creates a new, full-duplex encrypted link from the negotiated secret. The
 // client is used to decide the key derivation order for the two half-duplex
-// channels (server keys first, client key second).
-func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
+// channels (server keys first, client key second), whilst the version decides
+// the header encoding on the wire.
+func New(conn *stream.Stream, hkdf io.Reader, server bool, mode Mode, version wire.Version) *Link {
 	l := &Link{
-		socket: conn,
+		socket:      conn,
+		mode:        mode,
+		version:     version,
+		security:    proto.ActiveSecurity(),
+		outTime:     time.Now(),
+		rekeyBytes:  config.SessionRekeyBytes,
+		rekeyPeriod: config.SessionRekeyPeriod,
 	}
 	// Create the duplex channel
-	sc, sm := makeHalfDuplex(hkdf)
-	cc, cm := makeHalfDuplex(hkdf)
+	switch mode {
+	case ModeCTR:
+		l.hasher = config.SessionHash
+		sc, sm := makeHalfDuplex(hkdf)
+		cc, cm := makeHalfDuplex(hkdf)
+		if server {
+			l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+		} else {
+			l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		}
+	case ModeAEAD:
+		l.hasher = config.ModernHash.New
+		sa, ca := makeHalfDuplexAEAD(hkdf), makeHalfDuplexAEAD(hkdf)
+		if server {
+			l.inAEAD, l.outAEAD = ca, sa
+		} else {
+			l.inAEAD, l.outAEAD = sa, ca
+		}
+		l.inNonceBuf = make([]byte, l.inAEAD.NonceSize())
+		l.outNonceBuf = make([]byte, l.outAEAD.NonceSize())
+	default:
+		panic(fmt.Sprintf("Unknown link mode: %v", mode))
+	}
+	// Extract the ratchet seeds for rotating the keys later
+	ss, cs := l.makeSeed(hkdf), l.makeSeed(hkdf)
 	if server {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+		l.inSeed, l.outSeed = cs, ss
 	} else {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		l.inSeed, l.outSeed = ss, cs
 	}
 	// Create the gob coders
 	l.inCoder = gob.NewDecoder(&l.inBuffer)
@@ -127,6 +230,69 @@ func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
 	return stream, mac
 }
 
+// Assembles the authenticated cipher needed for a one way communication channel.
+// Nonces are message counters, so a key must never be reused across links.
+func makeHalfDuplexAEAD(hkdf io.Reader) cipher.AEAD {
+	key := make([]byte, config.ModernCipherBits/8)
+	n, err := io.ReadFull(hkdf, key)
+	if n != len(key) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session key: %v", err))
+	}
+	aead, err := config.ModernAEAD(key)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create session cipher: %v", err))
+	}
+	return aead
+}
+
+// Extracts a ratchet seed from a key derivation function.
+func (l *Link) makeSeed(hkdf io.Reader) []byte {
+	seed := make([]byte, l.hasher().Size())
+	n, err := io.ReadFull(hkdf, seed)
+	if n != len(seed) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session ratchet seed: %v", err))
+	}
+	return seed
+}
+
+// Advances a ratchet seed, returning the key derivation function for the next
+// generation of keys. The seed is replaced, so old keys cannot be recovered.
+func (l *Link) ratchet(seed *[]byte) io.Reader {
+	kdf := hkdf.New(l.hasher, *seed, nil, rekeyInfo)
+	*seed = l.makeSeed(kdf)
+	return kdf
+}
+
+// Switches the outbound direction to the next generation of keys.
+func (l *Link) rekeyOut() {
+	kdf := l.ratchet(&l.outSeed)
+	if l.mode == ModeAEAD {
+		l.outAEAD, l.outNonce = makeHalfDuplexAEAD(kdf), 0
+	} else {
+		l.outCipher, l.outMacer = makeHalfDuplex(kdf)
+	}
+	l.outBytes, l.outTime = 0, time.Now()
+	l.outEpoch++
+}
+
+// Switches the inbound direction to the next generation of keys.
+func (l *Link) rekeyIn() {
+	kdf := l.ratchet(&l.inSeed)
+	if l.mode == ModeAEAD {
+		l.inAEAD, l.inNonce = makeHalfDuplexAEAD(kdf), 0
+	} else {
+		l.inCipher, l.inMacer = makeHalfDuplex(kdf)
+	}
+	l.inEpoch++
+}
+
+// Sets the payload compression codecs accepted by the remote side. Messages
+// compressed otherwise are transcoded before sending. Must be called before
+// starting the link.
+func (l *Link) SetCodecs(codecs []compress.Codec) {
+	l.codecs = codecs
+}
+
 // Creates the buffer channels and starts the transfer processes.
 func (l *Link) Start(cap int) {
 	// Create the data and quit channels
@@ -173,53 +339,235 @@ func (l *Link) Close() error {
 // The actual message sending logic. Calculates the payload MAC, encrypts the
 // headers and sends it down to the stream. Direct send is public for handshake
 // simplifications. After that is done, the link should switch to channel mode.
+//
+// If the outbound keys were used long enough, a rotation is signalled in-band
+// before the message, after which the next generation of keys is used. Messages
+// marked for recycling have their payload returned into the buffer pool, whilst
+// ones compressed with a codec unknown to the remote side are sent uncompressed.
+//
+// Payloads not encrypted end-to-end are refused unless the security model has
+// the links encrypt them instead.
 func (l *Link) SendDirect(msg *proto.Message) error {
-	var err error
-
 	// Sanity check for message data security
-	if !msg.Secure() && len(msg.Data) > 0 {
+	if l.security.EndToEnd() && !msg.Secure() && len(msg.Data) > 0 {
 		log.Printf("link: unsecured data, send denied.")
 		return errors.New("unsecured data, send denied")
 	}
-	// Flatten and encrypt the headers
-	if err = l.outCoder.Encode(msg.Head); err != nil {
+	// Transcode the payload if the remote side cannot decompress it
+	out := msg
+	if msg.Head.Codec != compress.None && !l.accepts(msg.Head.Codec) {
+		var err error
+		if out, err = transcode(msg); err != nil {
+			return err
+		}
+	}
+	// Rotate the outbound keys if needed
+	if l.outBytes >= l.rekeyBytes || time.Since(l.outTime) >= l.rekeyPeriod {
+		rekey := &proto.Message{
+			Head: proto.Header{
+				Meta: &rekeyPacket{},
+			},
+		}
+		if err := l.send(rekey); err != nil {
+			return err
+		}
+		l.rekeyOut()
+	}
+	err := l.send(out)
+	if out != msg {
+		pool.PutBuffer(out.Data)
+	}
+	if msg.Recyclable() {
+		pool.PutBuffer(msg.Data)
+		msg.Data = nil
+	}
+	return err
+}
+
+// Checks whether the remote side accepts payloads compressed with codec.
+func (l *Link) accepts(codec compress.Codec) bool {
+	for _, c := range l.codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates an uncompressed, re-encrypted copy of a message. The original is left
+// untouched as it may be shared with other links.
+func transcode(msg *proto.Message) (*proto.Message, error) {
+	cpy := &proto.Message{
+		Head: msg.Head,
+		Data: pool.GetBuffer(len(msg.Data)),
+	}
+	copy(cpy.Data, msg.Data)
+
+	packed := cpy.Data
+	if err := cpy.Decrypt(); err != nil {
+		return nil, err
+	}
+	pool.PutBuffer(packed)
+
+	cpy.NoCompress()
+	if err := cpy.Encrypt(); err != nil {
+		return nil, err
+	}
+	return cpy, nil
+}
+
+// Encrypts and authenticates a single message with the current outbound keys
+// and sends it down to the stream.
+func (l *Link) send(msg *proto.Message) error {
+	// Flatten the headers
+	head, err := l.encode(&msg.Head)
+	if err != nil {
 		return err
 	}
-	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
 	defer l.outBuffer.Reset()
 
+	l.outBytes += uint64(len(head) + len(msg.Data))
+	if l.outAEAD != nil {
+		return l.sendAEAD(head, msg.Data)
+	}
+	// Encrypt the headers, and the payload too if required on every hop (into a
+	// copy, the message may be shared)
+	l.outCipher.XORKeyStream(head, head)
+
+	data := msg.Data
+	if l.security.Hop() && len(data) > 0 {
+		data = pool.GetBuffer(len(msg.Data))
+		defer pool.PutBuffer(data)
+		l.outCipher.XORKeyStream(data, msg.Data)
+	}
 	// Generate the MAC of the encrypted payload and headers
-	l.outMacer.Write(l.outBuffer.Bytes())
-	l.outMacer.Write(msg.Data)
+	l.outMacer.Write(head)
+	l.outMacer.Write(data)
 
 	// Send the multi-part message (headers + payload + MAC)
-	if err = l.socket.Send(l.outBuffer.Bytes()); err != nil {
+	if err = l.sendPart(head); err != nil {
 		return err
 	}
-	if err = l.socket.Send(msg.Data); err != nil {
+	if err = l.sendPart(data); err != nil {
 		return err
 	}
-	if err = l.socket.Send(l.outMacer.Sum(nil)); err != nil {
+	if err = l.sendPart(l.outMacer.Sum(nil)); err != nil {
 		return err
 	}
 	return l.socket.Flush()
 }
 
+// Seals the flattened headers, authenticating the payload along with them, and
+// sends the two part message (sealed headers + payload) down to the stream. If
+// the payload must be encrypted on every hop, it's sealed on its own instead.
+func (l *Link) sendAEAD(head []byte, data []byte) error {
+	if !l.security.Hop() {
+		l.outSealBuf = l.seal(l.outSealBuf[:0], head, data)
+	} else {
+		l.outSealBuf = l.seal(l.outSealBuf[:0], head, nil)
+
+		sealed := pool.GetBuffer(len(data) + l.outAEAD.Overhead())
+		defer pool.PutBuffer(sealed)
+		data = l.seal(sealed[:0], data, nil)
+	}
+	if err := l.sendPart(l.outSealBuf); err != nil {
+		return err
+	}
+	if err := l.sendPart(data); err != nil {
+		return err
+	}
+	return l.socket.Flush()
+}
+
+// Seals a plaintext with the next outbound nonce, appending it to dst.
+func (l *Link) seal(dst, plain, extra []byte) []byte {
+	binary.BigEndian.PutUint64(l.outNonceBuf[len(l.outNonceBuf)-8:], l.outNonce)
+	l.outNonce++
+	return l.outAEAD.Seal(dst, l.outNonceBuf, plain, extra)
+}
+
+// Opens a sealed message with the next inbound nonce, appending it to dst.
+func (l *Link) open(dst, sealed, extra []byte) ([]byte, error) {
+	binary.BigEndian.PutUint64(l.inNonceBuf[len(l.inNonceBuf)-8:], l.inNonce)
+	l.inNonce++
+	return l.inAEAD.Open(dst, l.inNonceBuf, sealed, extra)
+}
+
+// Flattens the message headers with the negotiated wire encoding. The returned
+// slice is only valid until the next call.
+func (l *Link) encode(head *proto.Header) ([]byte, error) {
+	if l.version == wire.VersionGob {
+		if err := l.outCoder.Encode(head); err != nil {
+			return nil, err
+		}
+		return l.outBuffer.Bytes(), nil
+	}
+	var err error
+	l.outHeadBuf, err = l.outEncoder.AppendHeader(l.outHeadBuf[:0], head)
+	return l.outHeadBuf, err
+}
+
+// Decodes the message headers with the negotiated wire encoding.
+func (l *Link) decode(data []byte, head *proto.Header) error {
+	if l.version == wire.VersionGob {
+		l.inBuffer.Write(data)
+		return l.inCoder.Decode(head)
+	}
+	return l.inDecoder.ParseHeader(data, head)
+}
+
+// Sends a single part of a message, gob wrapped or as a raw frame.
+func (l *Link) sendPart(data []byte) error {
+	if l.version == wire.VersionGob {
+		return l.socket.Send(data)
+	}
+	return l.socket.SendFrame(data)
+}
+
+// Receives a single part of a message, gob wrapped or as a raw frame.
+func (l *Link) recvPart(buf *[]byte) error {
+	if l.version == wire.VersionGob {
+		return l.socket.Recv(buf)
+	}
+	return l.socket.RecvFrame(buf)
+}
+
 // The actual message receiving logic. Reads a message from the stream, verifies
 // its mac, decodes the headers and send it upwards. Direct receive is public for
 // handshake simplifications, after which the link should switch to channel mode.
+//
+// Key rotations signalled by the remote side are executed transparently.
 func (l *Link) RecvDirect() (*proto.Message, error) {
+	for {
+		msg, err := l.recv()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := msg.Head.Meta.(*rekeyPacket); ok {
+			l.rekeyIn()
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Retrieves, verifies and decrypts a single message with the current inbound
+// keys.
+func (l *Link) recv() (*proto.Message, error) {
 	var msg proto.Message
 	var err error
 
 	// Retrieve a new package
-	if err = l.socket.Recv(&l.inHeadBuf); err != nil {
+	if err = l.recvPart(&l.inHeadBuf); err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&msg.Data); err != nil {
+	if err = l.recvPart(&msg.Data); err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&l.inMacBuf); err != nil {
+	if l.inAEAD != nil {
+		return l.recvAEAD(&msg)
+	}
+	if err = l.recvPart(&l.inMacBuf); err != nil {
 		return nil, err
 	}
 	// Verify the message contents (payload + header)
@@ -231,8 +579,10 @@ func (l *Link) RecvDirect() (*proto.Message, error) {
 	}
 	// Extract the package contents
 	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
-	if err = l.inCoder.Decode(&msg.Head); err != nil {
+	if l.security.Hop() {
+		l.inCipher.XORKeyStream(msg.Data, msg.Data)
+	}
+	if err = l.decode(l.inHeadBuf, &msg.Head); err != nil {
 		return nil, err
 	}
 	// Set the message security knowingly to true
@@ -240,6 +590,28 @@ func (l *Link) RecvDirect() (*proto.Message, error) {
 	return &msg, nil
 }
 
+// Opens the sealed headers of an already retrieved message, verifying both them
+// and the payload, and decodes the contents. Payloads encrypted on every hop are
+// opened separately.
+func (l *Link) recvAEAD(msg *proto.Message) (*proto.Message, error) {
+	var head []byte
+	var err error
+
+	if !l.security.Hop() {
+		head, err = l.open(l.inHeadBuf[:0], l.inHeadBuf, msg.Data)
+	} else if head, err = l.open(l.inHeadBuf[:0], l.inHeadBuf, nil); err == nil {
+		msg.Data, err = l.open(msg.Data[:0], msg.Data, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = l.decode(head, &msg.Head); err != nil {
+		return nil, err
+	}
+	msg.KnownSecure()
+	return msg, nil
+}
+
 // Sends messages from the upper layers into the encrypted link.
 func (l *Link) sender() {
 	var errc chan error
@@ -320,6 +692,6 @@ func (l *Link) receiver() {
 }
 
 // Retrieves the raw connection object if special manipulations are needed.
-func (l *Link) Sock() *net.TCPConn {
+func (l *Link) Sock() net.Conn {
 	return l.socket.Sock()
 }
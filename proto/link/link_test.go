@@ -22,15 +22,20 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // Tests whether link ciphers are initializes correctly.
@@ -45,8 +50,8 @@ func TestCiphers(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	client := New(nil, clientHKDF, false)
-	server := New(nil, serverHKDF, true)
+	client := New(nil, clientHKDF, false, ModeCTR, wire.VersionBinary)
+	server := New(nil, serverHKDF, true, ModeCTR, wire.VersionBinary)
 
 	// Create some random data to operate on
 	clientData := make([]byte, 4096)
@@ -87,7 +92,19 @@ func TestCiphers(t *testing.T) {
 // Tests the low level send and receive methods.
 func TestDirectSendRecv(t *testing.T) {
 	t.Parallel()
+	for _, version := range []wire.Version{wire.VersionGob, wire.VersionBinary} {
+		testDirectSendRecv(t, ModeCTR, version)
+	}
+}
 
+func TestDirectSendRecvAEAD(t *testing.T) {
+	t.Parallel()
+	for _, version := range []wire.Version{wire.VersionGob, wire.VersionBinary} {
+		testDirectSendRecv(t, ModeAEAD, version)
+	}
+}
+
+func testDirectSendRecv(t *testing.T, mode Mode, version wire.Version) {
 	// Start a stream listener
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -118,8 +135,8 @@ func TestDirectSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, false, mode, version)
+	serverLink := New(serverStrm, serverHKDF, true, mode, version)
 
 	// Generate some random messages and pass around both ways
 	for i := 0; i < 1000; i++ {
@@ -158,7 +175,19 @@ func TestDirectSendRecv(t *testing.T) {
 // Tests the high level send and receive mechanisms.
 func TestSendRecv(t *testing.T) {
 	t.Parallel()
+	for _, version := range []wire.Version{wire.VersionGob, wire.VersionBinary} {
+		testSendRecv(t, ModeCTR, version)
+	}
+}
+
+func TestSendRecvAEAD(t *testing.T) {
+	t.Parallel()
+	for _, version := range []wire.Version{wire.VersionGob, wire.VersionBinary} {
+		testSendRecv(t, ModeAEAD, version)
+	}
+}
 
+func testSendRecv(t *testing.T, mode Mode, version wire.Version) {
 	// Start a stream listener
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -186,8 +215,8 @@ func TestSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, false, mode, version)
+	serverLink := New(serverStrm, serverHKDF, true, mode, version)
 
 	clientLink.Start(32)
 	serverLink.Start(32)
@@ -252,3 +281,437 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Tests that authenticated links detect tampering with the payload.
+func TestAEADTamper(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the stream based authenticated links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false, ModeAEAD, wire.VersionBinary)
+	serverLink := New(serverStrm, serverHKDF, true, ModeAEAD, wire.VersionBinary)
+
+	// Send a valid message, followed by one with a forged payload
+	send := &proto.Message{
+		Head: proto.Header{
+			Meta: []byte("meta"),
+		},
+		Data: []byte("data"),
+	}
+	send.Encrypt()
+	if err := clientLink.SendDirect(send); err != nil {
+		t.Fatalf("failed to send message to server: %v.", err)
+	}
+	if _, err := serverLink.RecvDirect(); err != nil {
+		t.Fatalf("failed to receive message from client: %v.", err)
+	}
+	binary.BigEndian.PutUint64(clientLink.outNonceBuf[len(clientLink.outNonceBuf)-8:], clientLink.outNonce)
+	seal := clientLink.outAEAD.Seal(nil, clientLink.outNonceBuf, []byte{0x00}, []byte("data"))
+	if err := clientStrm.Send(seal); err != nil {
+		t.Fatalf("failed to send forged headers: %v.", err)
+	}
+	if err := clientStrm.Send([]byte("dat4")); err != nil {
+		t.Fatalf("failed to send forged payload: %v.", err)
+	}
+	if err := clientStrm.Flush(); err != nil {
+		t.Fatalf("failed to flush forged message: %v.", err)
+	}
+	if _, err := serverLink.RecvDirect(); err == nil {
+		t.Fatalf("forged payload accepted.")
+	}
+}
+
+// Tests that keys are rotated in-band under load without losing messages.
+func TestRekey(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []Mode{ModeCTR, ModeAEAD} {
+		for _, version := range []wire.Version{wire.VersionGob, wire.VersionBinary} {
+			testRekey(t, mode, version)
+		}
+	}
+}
+
+func testRekey(t *testing.T, mode Mode, version wire.Version) {
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the links, rotating the keys after every few messages
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false, mode, version)
+	serverLink := New(serverStrm, serverHKDF, true, mode, version)
+
+	clientLink.rekeyBytes = 1024
+	serverLink.rekeyPeriod = 0
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Stream messages concurrently in both directions, verifying the ordering
+	messages := 5000
+	errc := make(chan error, 2)
+	for _, pair := range [][2]*Link{{clientLink, serverLink}, {serverLink, clientLink}} {
+		go func(src, dst *Link) {
+			go func() {
+				for i := 0; i < messages; i++ {
+					send := &proto.Message{
+						Head: proto.Header{
+							Meta: strconv.Itoa(i),
+						},
+						Data: make([]byte, 64),
+					}
+					send.Encrypt()
+					src.Send <- send
+				}
+			}()
+			for i := 0; i < messages; i++ {
+				select {
+				case recv, ok := <-dst.Recv:
+					if !ok {
+						errc <- fmt.Errorf("link closed prematurely at message %d", i)
+						return
+					}
+					if idx := recv.Head.Meta.(string); idx != strconv.Itoa(i) {
+						errc <- fmt.Errorf("message index mismatch: have %s, want %d", idx, i)
+						return
+					}
+				case <-time.After(time.Second):
+					errc <- fmt.Errorf("receive timed out at message %d", i)
+					return
+				}
+			}
+			errc <- nil
+		}(pair[0], pair[1])
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("mode %v, wire %v: %v.", mode, version, err)
+		}
+	}
+	// Tear down the links and ensure enough rotations happened
+	go func() { errc <- clientLink.Close() }()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("mode %v, wire %v: failed to close server link: %v.", mode, version, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("mode %v, wire %v: failed to close client link: %v.", mode, version, err)
+	}
+	if clientLink.outEpoch < 100 || clientLink.outEpoch != serverLink.inEpoch {
+		t.Fatalf("mode %v, wire %v: client rotation mismatch: have %d/%d, want >= 100.", mode, version, clientLink.outEpoch, serverLink.inEpoch)
+	}
+	if serverLink.outEpoch < uint64(messages) || serverLink.outEpoch != clientLink.inEpoch {
+		t.Fatalf("mode %v, wire %v: server rotation mismatch: have %d/%d, want >= %d.", mode, version, serverLink.outEpoch, clientLink.inEpoch, messages)
+	}
+}
+
+// Benchmarks the header encodings over a live link.
+// Tests that compressed messages are transcoded for remote sides not accepting
+// the codec, leaving the original message intact.
+func TestTranscode(t *testing.T) {
+	t.Parallel()
+
+	client, server, done := makeLinks(t, ModeAEAD)
+	defer done()
+
+	data := bytes.Repeat([]byte("compressible "), 1024)
+	for i, codecs := range [][]compress.Codec{{compress.Deflate}, nil} {
+		client.SetCodecs(codecs)
+
+		send := &proto.Message{Head: proto.Header{Meta: []byte{byte(i)}}, Data: append([]byte{}, data...)}
+		if err := send.Encrypt(); err != nil {
+			t.Fatalf("test %d: failed to encrypt message: %v.", i, err)
+		}
+		if send.Head.Codec != compress.Deflate {
+			t.Fatalf("test %d: message not compressed.", i)
+		}
+		sent := append([]byte{}, send.Data...)
+		if err := client.SendDirect(send); err != nil {
+			t.Fatalf("test %d: failed to send message: %v.", i, err)
+		}
+		if !bytes.Equal(send.Data, sent) || send.Head.Codec != compress.Deflate {
+			t.Fatalf("test %d: original message modified.", i)
+		}
+		recv, err := server.RecvDirect()
+		if err != nil {
+			t.Fatalf("test %d: failed to receive message: %v.", i, err)
+		}
+		want := compress.Deflate
+		if len(codecs) == 0 {
+			want = compress.None
+		}
+		if recv.Head.Codec != want {
+			t.Fatalf("test %d: codec mismatch: have %v, want %v.", i, recv.Head.Codec, want)
+		}
+		if err := recv.Decrypt(); err != nil {
+			t.Fatalf("test %d: failed to decrypt message: %v.", i, err)
+		}
+		if !bytes.Equal(recv.Data, data) {
+			t.Fatalf("test %d: data mismatch: have %x, want %x.", i, recv.Data, data)
+		}
+	}
+}
+
+// Tests that the security model decides whether plain payloads may be sent, and
+// that payloads encrypted by the links arrive intact.
+func TestSecurity(t *testing.T) {
+	defer func(mode string) { config.SecurityMode = mode }(config.SecurityMode)
+
+	for _, mode := range []Mode{ModeCTR, ModeAEAD} {
+		for _, security := range []string{"e2e", "link", "both"} {
+			config.SecurityMode = security
+			client, server, done := makeLinks(t, mode)
+
+			// Plain payloads are only allowed without end-to-end encryption
+			data := []byte("plain payload")
+			send := &proto.Message{Head: proto.Header{Meta: "plain"}, Data: append([]byte{}, data...)}
+			if err := client.SendDirect(send); (err == nil) != (security == "link") {
+				t.Fatalf("%v/%s: plain payload send mismatch: have %v.", mode, security, err)
+			}
+			// Encrypted payloads pass with all models, leaving the original intact
+			send = &proto.Message{Head: proto.Header{Meta: "secure"}, Data: append([]byte{}, data...)}
+			if err := send.Encrypt(); err != nil {
+				t.Fatalf("%v/%s: failed to encrypt message: %v.", mode, security, err)
+			}
+			sent := append([]byte{}, send.Data...)
+			if err := client.SendDirect(send); err != nil {
+				t.Fatalf("%v/%s: failed to send message: %v.", mode, security, err)
+			}
+			if !bytes.Equal(send.Data, sent) {
+				t.Fatalf("%v/%s: original message modified.", mode, security)
+			}
+			if security == "link" {
+				if msg, err := server.RecvDirect(); err != nil || msg.Head.Meta != "plain" || !bytes.Equal(msg.Data, data) {
+					t.Fatalf("%v/%s: plain message mismatch: have %v/%v, want %s.", mode, security, msg, err, data)
+				}
+			}
+			msg, err := server.RecvDirect()
+			if err != nil {
+				t.Fatalf("%v/%s: failed to receive message: %v.", mode, security, err)
+			}
+			if err := msg.Decrypt(); err != nil {
+				t.Fatalf("%v/%s: failed to decrypt message: %v.", mode, security, err)
+			}
+			if msg.Head.Meta != "secure" || !bytes.Equal(msg.Data, data) {
+				t.Fatalf("%v/%s: message mismatch: have %v/%s, want %s/%s.", mode, security, msg.Head.Meta, msg.Data, "secure", data)
+			}
+			done()
+		}
+	}
+}
+
+func BenchmarkSendRecvGob(b *testing.B) {
+	benchmarkSendRecv(b, wire.VersionGob)
+}
+
+func BenchmarkSendRecvBinary(b *testing.B) {
+	benchmarkSendRecv(b, wire.VersionBinary)
+}
+
+func benchmarkSendRecv(b *testing.B, version wire.Version) {
+	// Establish a stream connection through a local listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		b.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	clientStrm, err := stream.Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Millisecond)
+	if err != nil {
+		b.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the encrypted links with the requested encoding
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false, ModeAEAD, version)
+	serverLink := New(serverStrm, serverHKDF, true, ModeAEAD, version)
+
+	// Consume the messages concurrently and stream them through
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := serverLink.RecvDirect(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := &proto.Message{
+			Head: proto.Header{
+				Meta: "benchmark",
+			},
+			Data: make([]byte, 64),
+		}
+		msg.Encrypt()
+		if err := clientLink.SendDirect(msg); err != nil {
+			b.Fatalf("failed to send message: %v.", err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatalf("failed to receive message: %v.", err)
+	}
+}
+
+// Benchmarks routing messages through an intermediate node, with and without
+// recycling the payloads of the forwarded messages.
+func BenchmarkForward(b *testing.B) {
+	benchmarkForward(b, false)
+}
+
+func BenchmarkForwardRecycled(b *testing.B) {
+	benchmarkForward(b, true)
+}
+
+func benchmarkForward(b *testing.B, recycle bool) {
+	// Create a source -> relay -> sink link chain
+	srcLink, inLink, closeIn := makeLinks(b, ModeAEAD)
+	outLink, dstLink, closeOut := makeLinks(b, ModeAEAD)
+	defer closeIn()
+	defer closeOut()
+
+	// Forward everything on the relay node and consume on the sink
+	go func() {
+		for i := 0; i < b.N; i++ {
+			msg, err := inLink.RecvDirect()
+			if err != nil {
+				return
+			}
+			if recycle {
+				msg.Recycle()
+			}
+			if err := outLink.SendDirect(msg); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := dstLink.RecvDirect(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	// Send a stream of messages through the relay
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: "benchmark",
+		},
+		Data: make([]byte, 1024),
+	}
+	msg.Encrypt()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := srcLink.SendDirect(msg); err != nil {
+			b.Fatalf("failed to send message: %v.", err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatalf("failed to receive message: %v.", err)
+	}
+}
+
+// Creates a connected pair of binary encoded links for testing and benchmarking.
+func makeLinks(tb testing.TB, mode Mode) (*Link, *Link, func()) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		tb.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		tb.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	clientStrm, err := stream.Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Millisecond)
+	if err != nil {
+		tb.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	client := New(clientStrm, clientHKDF, false, mode, wire.VersionBinary)
+	server := New(serverStrm, serverHKDF, true, mode, wire.VersionBinary)
+
+	return client, server, func() {
+		clientStrm.Close()
+		serverStrm.Close()
+	}
+}
@@ -0,0 +1,122 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the persistent peer cache: the remembered peers are saved into a
+// local file periodically and on shutdown, and on the next boot a few of them
+// are dialed as the first seeds, beside the usual discovery mechanisms. A cache
+// older than the configured expiry is ignored, as the peers have likely moved.
+
+package pastry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Persisted form of the remembered peers.
+type peerCache struct {
+	Saved time.Time           // Time when the cache was written
+	Peers map[string][]string // Node ids mapped to their listener addresses
+}
+
+// Loads the peer cache, if any, remembering the peers and scheduling dials to a
+// random few of them. Stale or broken caches are discarded.
+func (o *Overlay) loadCache() {
+	if o.cache == "" {
+		return
+	}
+	blob, err := ioutil.ReadFile(o.cache)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("pastry: failed to read peer cache: %v.", err)
+		}
+		return
+	}
+	cache := new(peerCache)
+	if err := json.Unmarshal(blob, cache); err != nil {
+		log.Printf("pastry: failed to parse peer cache: %v.", err)
+		return
+	}
+	if age := o.clock.Now().Sub(cache.Saved); age > config.PastryCacheExpiry {
+		log.Printf("pastry: peer cache stale (%v old), discarding.", age)
+		return
+	}
+	delete(cache.Peers, o.nodeId.String())
+	o.remember(cache.Peers)
+
+	// Dial a random subset of the cached peers
+	seeds := make([][]string, 0, len(cache.Peers))
+	for _, addrs := range cache.Peers {
+		seeds = append(seeds, addrs)
+	}
+	for i := len(seeds) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		seeds[i], seeds[j] = seeds[j], seeds[i]
+	}
+	if len(seeds) > config.PastryCacheSeeds {
+		seeds = seeds[:config.PastryCacheSeeds]
+	}
+	log.Printf("pastry: seeding from %d of %d cached peers.", len(seeds), len(cache.Peers))
+	for _, addrs := range seeds {
+		peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+		for _, address := range addrs {
+			if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+				log.Printf("pastry: failed to resolve address %v: %v.", address, err)
+			} else {
+				peerAddrs = append(peerAddrs, addr)
+			}
+		}
+		o.authInit.Schedule(func() { o.dial(peerAddrs) })
+	}
+}
+
+// Persists the remembered peers into the peer cache file. The file is replaced
+// atomically to never leave a truncated cache behind.
+func (o *Overlay) saveCache() error {
+	if o.cache == "" {
+		return nil
+	}
+	cache := &peerCache{
+		Saved: o.clock.Now(),
+		Peers: make(map[string][]string),
+	}
+	o.knownLock.Lock()
+	for sid, c := range o.known {
+		if cache.Saved.Sub(c.seen) <= config.PastryHealExpiry {
+			cache.Peers[sid] = c.addrs
+		}
+	}
+	o.knownLock.Unlock()
+
+	blob, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	temp := o.cache + ".tmp"
+	if err := ioutil.WriteFile(temp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, o.cache)
+}
@@ -0,0 +1,105 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-iris/iris/clock"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/transport"
+)
+
+func TestCache(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+
+	dir, err := ioutil.TempDir("", "pastry-cache")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	// Creates an overlay node on the given host of the simulated network
+	create := func(host string, seeds []string) *Overlay {
+		node := New(appId, key, new(nopCallback))
+		node.SetTransport(network.Host(host))
+		node.SetEndpoints([]string{host + ":4000"}, seeds)
+		node.SetCache(path)
+		return node
+	}
+	// Boot a seed node and a cached node joining through it
+	seed := create("10.0.0.1", nil)
+	seed.SetCache("")
+	if _, err := seed.Boot(); err != nil {
+		t.Fatalf("failed to boot seed node: %v.", err)
+	}
+	defer seed.Shutdown()
+
+	node := create("10.0.0.2", []string{"10.0.0.1:4000"})
+	if peers, err := node.Boot(); err != nil || peers != 1 {
+		t.Fatalf("failed to boot cached node: %v, %v peers.", err, peers)
+	}
+	if err := node.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down cached node: %v.", err)
+	}
+	// Ensure the seed was persisted into the cache
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read peer cache: %v.", err)
+	}
+	cache := new(peerCache)
+	if err := json.Unmarshal(blob, cache); err != nil {
+		t.Fatalf("failed to parse peer cache: %v.", err)
+	}
+	if addrs, ok := cache.Peers[seed.Self().String()]; !ok || len(addrs) != 1 || addrs[0] != "10.0.0.1:4000" {
+		t.Fatalf("cached seed mismatch: have %v, want %v.", addrs, []string{"10.0.0.1:4000"})
+	}
+	// Boot a new node without explicit seeds and check that it joins via the cache
+	node = create("10.0.0.3", nil)
+	if peers, err := node.Boot(); err != nil || peers != 1 {
+		t.Fatalf("failed to boot from cache: %v, %v peers.", err, peers)
+	}
+	if err := node.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down cache booted node: %v.", err)
+	}
+	// Age the cache and ensure it's discarded
+	cache.Saved = cache.Saved.Add(-2 * config.PastryCacheExpiry)
+	if blob, err = json.Marshal(cache); err != nil {
+		t.Fatalf("failed to encode peer cache: %v.", err)
+	}
+	if err := ioutil.WriteFile(path, blob, 0600); err != nil {
+		t.Fatalf("failed to write peer cache: %v.", err)
+	}
+	node = create("10.0.0.4", nil)
+	if peers, err := node.Boot(); err != nil || peers != 0 {
+		t.Fatalf("stale cache used: %v, %v peers.", err, peers)
+	}
+	node.Shutdown()
+}
@@ -0,0 +1,339 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the fault injection hooks of the overlay, meant for chaos testing the
+// upper layers: messages passing through the router or being sent to a peer can
+// be dropped, delayed, duplicated or reordered by a test supplied injector, peer
+// sessions can be killed and the tracked handler pools stalled. The hooks are
+// inert until explicitly enabled through the Chaos handle of an overlay.
+
+package pastry
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto"
+)
+
+// Fault to inflict on an intercepted message.
+type Fault int
+
+// Fault types supported by the injection hooks.
+const (
+	FaultNone      Fault = iota // Pass the message through unaltered
+	FaultDrop                   // Silently discard the message
+	FaultDelay                  // Hold the message back for the requested duration
+	FaultDuplicate              // Pass the message through twice
+	FaultReorder                // Hold the message until the next one passes
+)
+
+// Message intercepted by the fault injection hooks.
+type Packet struct {
+	Peer   *big.Int       // Remote peer the message arrived from or is sent to
+	Dest   *big.Int       // Overlay destination of the message
+	System bool           // Whether the message is internal to the overlay
+	Meta   interface{}    // Upper layer headers of the message
+	Msg    *proto.Message // Raw message, not to be modified
+}
+
+// Test supplied decision maker for the faults to inject. The returned duration
+// is only used by delay faults.
+type Injector interface {
+	// Decides the fate of a message entering the router.
+	Route(pkt *Packet) (Fault, time.Duration)
+
+	// Decides the fate of a message about to be sent to a peer.
+	Send(pkt *Packet) (Fault, time.Duration)
+}
+
+// Fault injection handle of an overlay.
+type Chaos struct {
+	owner  *Overlay
+	inject atomic.Value // Active fault injector, boxed to allow lock free reads
+
+	routeHeld *routed                       // Inbound message held back for reordering
+	sendHeld  map[*peer]*proto.Message      // Outbound messages held back for reordering
+	pools     map[*pool.ThreadPool]struct{} // Handler pools affected by stalls
+	stalled   bool                          // Whether the tracked pools are stalled
+
+	lock sync.Mutex
+}
+
+// Wrapper around an injector, as atomic values cannot hold nil interfaces.
+type injectorBox struct {
+	inj Injector
+}
+
+// Message held back by the router, along with its source.
+type routed struct {
+	src *peer
+	msg *proto.Message
+}
+
+// Creates a new, disabled fault injector for an overlay.
+func newChaos(o *Overlay) *Chaos {
+	c := &Chaos{
+		owner:    o,
+		sendHeld: make(map[*peer]*proto.Message),
+		pools:    make(map[*pool.ThreadPool]struct{}),
+	}
+	c.inject.Store(injectorBox{})
+	return c
+}
+
+// Returns the fault injection handle of the overlay.
+func (o *Overlay) Chaos() *Chaos {
+	return o.chaos
+}
+
+// Sets the fault injector deciding the fate of routed and sent messages. A nil
+// injector disables message faults, releasing any held back message.
+func (c *Chaos) Inject(inj Injector) {
+	c.lock.Lock()
+	c.inject.Store(injectorBox{inj})
+
+	var route *routed
+	var sends map[*peer]*proto.Message
+	if inj == nil {
+		route, c.routeHeld = c.routeHeld, nil
+		sends, c.sendHeld = c.sendHeld, make(map[*peer]*proto.Message)
+	}
+	c.lock.Unlock()
+
+	if route != nil {
+		c.owner.dispatch(route.src, route.msg)
+	}
+	for p, msg := range sends {
+		if err := p.transmit(msg); err != nil {
+			c.owner.drop(p)
+		}
+	}
+}
+
+// Returns the ids of the currently connected peers.
+func (c *Chaos) Peers() []*big.Int {
+	c.owner.lock.RLock()
+	defer c.owner.lock.RUnlock()
+
+	ids := make([]*big.Int, 0, len(c.owner.livePeers))
+	for _, p := range c.owner.livePeers {
+		ids = append(ids, new(big.Int).Set(p.nodeId))
+	}
+	return ids
+}
+
+// Abruptly tears down the session to a peer, without the graceful close. The
+// overlay will notice the failure and react as with any network fault.
+func (c *Chaos) Kill(id *big.Int) bool {
+	c.owner.lock.RLock()
+	p, ok := c.owner.livePeers[id.String()]
+	c.owner.lock.RUnlock()
+
+	if ok {
+		kill(p)
+	}
+	return ok
+}
+
+// Abruptly tears down all peer sessions, returning the number of killed ones.
+func (c *Chaos) KillAll() int {
+	c.owner.lock.RLock()
+	peers := make([]*peer, 0, len(c.owner.livePeers))
+	for _, p := range c.owner.livePeers {
+		peers = append(peers, p)
+	}
+	c.owner.lock.RUnlock()
+
+	for _, p := range peers {
+		kill(p)
+	}
+	return len(peers)
+}
+
+// Closes the network connections beneath a peer session.
+func kill(p *peer) {
+	p.conn.CtrlLink.Sock().Close()
+	p.conn.DataLink.Sock().Close()
+}
+
+// Adds a handler pool to the set affected by stalls.
+func (c *Chaos) Track(workers *pool.ThreadPool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pools[workers] = struct{}{}
+	if c.stalled {
+		workers.Stall()
+	}
+}
+
+// Removes a handler pool from the set affected by stalls, resuming it if needed.
+func (c *Chaos) Untrack(workers *pool.ThreadPool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.pools[workers]; ok {
+		delete(c.pools, workers)
+		if c.stalled {
+			workers.Resume()
+		}
+	}
+}
+
+// Suspends task execution in all the tracked handler pools.
+func (c *Chaos) Stall() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stalled = true
+	for workers := range c.pools {
+		workers.Stall()
+	}
+}
+
+// Resumes task execution in all the tracked handler pools.
+func (c *Chaos) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stalled = false
+	for workers := range c.pools {
+		workers.Resume()
+	}
+}
+
+// Retrieves the active injector, if any. The lookup is lock free, so disabled
+// hooks don't burden the message path.
+func (c *Chaos) injector() Injector {
+	return c.inject.Load().(injectorBox).inj
+}
+
+// Assembles the packet view of an overlay message.
+func packet(p *peer, msg *proto.Message) *Packet {
+	pkt := &Packet{Msg: msg}
+	if p != nil && p.nodeId != nil {
+		pkt.Peer = new(big.Int).Set(p.nodeId)
+	}
+	if head, ok := msg.Head.Meta.(*header); ok {
+		pkt.Dest = head.Dest
+		pkt.System = head.Op != opNop
+		pkt.Meta = head.Meta
+	}
+	return pkt
+}
+
+// Creates a copy of an overlay message, so duplicates don't share headers nor
+// the payload (which might be recycled by either).
+func clone(msg *proto.Message) *proto.Message {
+	dup := *msg
+	if msg.Data != nil {
+		dup.Data = pool.GetBuffer(len(msg.Data))
+		copy(dup.Data, msg.Data)
+	}
+	if head, ok := msg.Head.Meta.(*header); ok {
+		h := *head
+		dup.Head.Meta = &h
+	}
+	return &dup
+}
+
+// Routes an inbound message according to the decision of the injector.
+func (c *Chaos) route(inj Injector, src *peer, msg *proto.Message) {
+	fault, delay := inj.Route(packet(src, msg))
+	switch fault {
+	case FaultDrop:
+		return
+	case FaultDelay:
+		go func() {
+			<-c.owner.clock.After(delay)
+			c.owner.dispatch(src, msg)
+		}()
+		return
+	case FaultDuplicate:
+		c.owner.dispatch(src, clone(msg))
+	case FaultReorder:
+		c.lock.Lock()
+		held := c.routeHeld
+		c.routeHeld = &routed{src, msg}
+		c.lock.Unlock()
+
+		if held != nil {
+			c.owner.dispatch(held.src, held.msg)
+		}
+		return
+	}
+	c.owner.dispatch(src, msg)
+
+	// Release any message held back for reordering
+	c.lock.Lock()
+	held := c.routeHeld
+	c.routeHeld = nil
+	c.lock.Unlock()
+
+	if held != nil {
+		c.owner.dispatch(held.src, held.msg)
+	}
+}
+
+// Sends an outbound message according to the decision of the injector.
+func (c *Chaos) send(inj Injector, p *peer, msg *proto.Message) error {
+	fault, delay := inj.Send(packet(p, msg))
+	switch fault {
+	case FaultDrop:
+		return nil
+	case FaultDelay:
+		go func() {
+			<-c.owner.clock.After(delay)
+			if err := p.transmit(msg); err != nil {
+				c.owner.drop(p)
+			}
+		}()
+		return nil
+	case FaultDuplicate:
+		if err := p.transmit(clone(msg)); err != nil {
+			return err
+		}
+	case FaultReorder:
+		c.lock.Lock()
+		held := c.sendHeld[p]
+		c.sendHeld[p] = msg
+		c.lock.Unlock()
+
+		if held != nil {
+			return p.transmit(held)
+		}
+		return nil
+	}
+	if err := p.transmit(msg); err != nil {
+		return err
+	}
+	// Release any message held back for reordering
+	c.lock.Lock()
+	held, ok := c.sendHeld[p]
+	delete(c.sendHeld, p)
+	c.lock.Unlock()
+
+	if ok {
+		return p.transmit(held)
+	}
+	return nil
+}
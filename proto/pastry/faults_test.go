@@ -0,0 +1,185 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/clock"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/transport"
+)
+
+// Injector inflicting a fixed fault on application messages sent by a node.
+type sendInjector struct {
+	fault Fault
+	delay time.Duration
+	lock  sync.Mutex
+}
+
+func (i *sendInjector) Route(pkt *Packet) (Fault, time.Duration) {
+	return FaultNone, 0
+}
+
+func (i *sendInjector) Send(pkt *Packet) (Fault, time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if pkt.System {
+		return FaultNone, 0
+	}
+	fault := i.fault
+	i.fault = FaultNone
+	return fault, i.delay
+}
+
+func (i *sendInjector) arm(fault Fault, delay time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.fault, i.delay = fault, delay
+}
+
+// Boots a pair of overlay nodes on an in-process network.
+func bootPair(t *testing.T) ([]*Overlay, []*collector) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+
+	nodes := []*Overlay{}
+	apps := []*collector{}
+	seeds := []string{}
+	for i := 0; i < 2; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:4000", i+1)
+
+		apps = append(apps, &collector{delivs: []*proto.Message{}})
+		nodes = append(nodes, New(appId, key, apps[i]))
+		nodes[i].SetTransport(network.Host(fmt.Sprintf("10.0.0.%d", i+1)))
+		nodes[i].SetEndpoints([]string{addr}, seeds)
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		seeds = append(seeds, addr)
+	}
+	return nodes, apps
+}
+
+// Waits until a collector receives the requested number of messages.
+func awaitDelivs(c *collector, count int, timeout time.Duration) []*proto.Message {
+	for end := time.Now().Add(timeout); ; {
+		c.lock.RLock()
+		delivs := append([]*proto.Message{}, c.delivs...)
+		c.lock.RUnlock()
+
+		if len(delivs) >= count || time.Now().After(end) {
+			return delivs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFaultMessages(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes, apps := bootPair(t)
+	for _, node := range nodes {
+		defer node.Shutdown()
+	}
+	inj := new(sendInjector)
+	nodes[0].Chaos().Inject(inj)
+
+	send := func(label string) {
+		msg := &proto.Message{
+			Head: proto.Header{Meta: label},
+			Data: []byte{0x99, 0x98, 0x97, 0x96},
+		}
+		msg.Encrypt()
+		nodes[0].Send(nodes[1].Self(), msg)
+	}
+	// Drop a message and make sure the next one still arrives
+	inj.arm(FaultDrop, 0)
+	send("dropped")
+	send("first")
+	if delivs := awaitDelivs(apps[1], 1, time.Second); len(delivs) != 1 || delivs[0].Head.Meta != "first" {
+		t.Fatalf("drop fault mismatch: have %v, want %v.", delivs, []string{"first"})
+	}
+	// Duplicate a message and check both copies arriving
+	inj.arm(FaultDuplicate, 0)
+	send("twice")
+	if delivs := awaitDelivs(apps[1], 3, time.Second); len(delivs) != 3 {
+		t.Fatalf("duplicate fault delivery count mismatch: have %v, want %v.", len(delivs), 3)
+	} else if delivs[1].Head.Meta != "twice" || delivs[2].Head.Meta != "twice" {
+		t.Fatalf("duplicate label mismatch: have %v, %v, want %v.", delivs[1].Head.Meta, delivs[2].Head.Meta, "twice")
+	}
+	// Reorder a message with the next one
+	inj.arm(FaultReorder, 0)
+	send("late")
+	send("early")
+	if delivs := awaitDelivs(apps[1], 5, time.Second); len(delivs) != 5 {
+		t.Fatalf("reorder fault delivery count mismatch: have %v, want %v.", len(delivs), 5)
+	} else if delivs[3].Head.Meta != "early" || delivs[4].Head.Meta != "late" {
+		t.Fatalf("reorder fault order mismatch: have %v, %v, want %v, %v.", delivs[3].Head.Meta, delivs[4].Head.Meta, "early", "late")
+	}
+	// Delay a message and make sure it doesn't arrive prematurely
+	inj.arm(FaultDelay, 250*time.Millisecond)
+	send("delayed")
+	if delivs := awaitDelivs(apps[1], 6, 100*time.Millisecond); len(delivs) != 5 {
+		t.Fatalf("delayed message arrived early: have %v, want %v.", len(delivs), 5)
+	}
+	if delivs := awaitDelivs(apps[1], 6, time.Second); len(delivs) != 6 {
+		t.Fatalf("delayed message lost: have %v, want %v.", len(delivs), 6)
+	}
+}
+
+func TestFaultKill(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes, _ := bootPair(t)
+	for _, node := range nodes {
+		defer node.Shutdown()
+	}
+	chaos := nodes[0].Chaos()
+	if peers := chaos.Peers(); len(peers) != 1 || peers[0].Cmp(nodes[1].Self()) != 0 {
+		t.Fatalf("peer set mismatch: have %v, want %v.", peers, []*big.Int{nodes[1].Self()})
+	}
+	if chaos.Kill(nodes[0].Self()) {
+		t.Fatalf("killed non-connected peer.")
+	}
+	if !chaos.Kill(nodes[1].Self()) {
+		t.Fatalf("failed to kill connected peer.")
+	}
+	// Both sides should notice the failure and drop the peer
+	for _, node := range nodes {
+		end := time.Now().Add(time.Second)
+		for len(node.Chaos().Peers()) != 0 && time.Now().Before(end) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if peers := node.Chaos().Peers(); len(peers) != 0 {
+			t.Fatalf("killed peer not dropped: have %v, want %v.", peers, []*big.Int{})
+		}
+	}
+}
@@ -18,7 +18,8 @@
 
 // This file contains the pastry session listener and negotiation. For every
 // network interface a separate bootstrapper and session acceptor is started,
-// each conencting nodes and executing the pastry handshake.
+// each conencting nodes and executing the pastry handshake. If explicit listener
+// addresses are set, only the acceptors are started, joining through seed peers.
 
 package pastry
 
@@ -35,6 +36,7 @@ import (
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/bootstrap"
 	"github.com/project-iris/iris/proto/session"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // The initialization packet when the connection is set up.
@@ -43,22 +45,36 @@ type initPacket struct {
 	Addrs []string
 }
 
-// Make sure the init packet is registered with gob.
+// Make sure the init packet is registered with gob and wire.
 func init() {
 	gob.Register(&initPacket{})
+	wire.Register(wireInit, func() wire.Meta { return new(initPacket) })
 }
 
-// Starts up the overlay networking on a specified interface and fans in all the
-// inbound connections into the overlay-global channels.
-func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
-	// Listen for incoming session on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
+// Serializes the init packet into the binary wire format.
+func (p *initPacket) MarshalWire(enc *wire.Encoder) {
+	enc.PutBigInt(p.Id)
+	enc.PutStrings(p.Addrs)
+}
+
+// Deserializes the init packet from the binary wire format.
+func (p *initPacket) UnmarshalWire(dec *wire.Decoder) {
+	p.Id = dec.BigInt()
+	p.Addrs = dec.Strings()
+}
+
+// Starts up the overlay networking on a specified address and fans in all the
+// inbound connections into the overlay-global channels. If an interface network
+// is given, a bootstrapper is also started to discover peers on it.
+func (o *Overlay) acceptor(bind string, ipnet *net.IPNet, live chan struct{}, quit chan chan error) {
+	// Listen for incoming session on the given address
+	sock, err := session.ListenTransport(o.trans, bind, o.creds)
 	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
+		panic(fmt.Sprintf("failed to start session listener: %v.", err))
 	}
-	sock, err := session.Listen(addr, o.authKey)
+	addr, err := net.ResolveTCPAddr("tcp", sock.Addr().String())
 	if err != nil {
-		panic(fmt.Sprintf("failed to start session listener: %v.", err))
+		panic(fmt.Sprintf("failed to resolve listener address (%v): %v.", sock.Addr(), err))
 	}
 	sock.Accept(config.PastryAcceptTimeout)
 
@@ -68,13 +84,20 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 	sort.Strings(o.addrs)
 	o.lock.Unlock()
 
-	// Start the bootstrapper on the specified interface
-	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
-	}
-	if err := boot.Boot(); err != nil {
-		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+	// Notify the overlay of the successful listen
+	live <- struct{}{}
+
+	// Start the bootstrapper on the specified interface, if any
+	var boot *bootstrap.Bootstrapper
+	var discover chan *bootstrap.Event
+	if ipnet != nil {
+		boot, discover, err = bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+		}
+		if err := boot.Boot(); err != nil {
+			panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+		}
 	}
 	// Process incoming connection until termination is requested
 	var errc chan error
@@ -103,9 +126,11 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 		}
 	}
 	// Terminate the bootstrapper and peer listener
-	errv := boot.Terminate()
-	if errv != nil {
-		log.Printf("pastry: failed to terminate bootstrapper: %v.", errv)
+	var errv error
+	if boot != nil {
+		if errv = boot.Terminate(); errv != nil {
+			log.Printf("pastry: failed to terminate bootstrapper: %v.", errv)
+		}
 	}
 	if err := sock.Close(); err != nil {
 		log.Printf("pastry: failed to terminate session listener: %v.", err)
@@ -167,7 +192,7 @@ func (o *Overlay) dial(addrs []*net.TCPAddr) {
 	}
 	// Dial away, trying interfaces one after the other until connection succeeds
 	for _, addr := range addrs {
-		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.authKey); err == nil {
+		if ses, err := session.DialTransport(o.trans, addr.String(), o.creds); err == nil {
 			o.shake(ses)
 			return
 		} else {
@@ -212,7 +237,15 @@ func (o *Overlay) shake(ses *session.Session) {
 		}
 	case msg, ok := <-p.conn.CtrlLink.Recv:
 		if ok {
-			pkt = msg.Head.Meta.(*initPacket)
+			// Verify the claimed identity before accepting the peer
+			pkt, _ = msg.Head.Meta.(*initPacket)
+			if err := o.authenticate(ses, pkt); err != nil {
+				log.Printf("pastry: remote peer authentication failed: %v.", err)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close unauthenticated session: %v.", err)
+				}
+				return
+			}
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
 
@@ -293,6 +326,8 @@ func (o *Overlay) dedup(p *peer) {
 		if old == nil {
 			o.heart.heart.Monitor(p.nodeId)
 		}
+		// Remember the peer in case of a later network partition
+		o.remember(map[string][]string{p.nodeId.String(): p.addrs})
 	}
 	// Terminate the duplicate if any
 	if dump != nil {
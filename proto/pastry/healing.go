@@ -0,0 +1,154 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the partition healing logic: every peer seen (either connected or
+// advertised in a state exchange) is remembered for a while, and the ones that
+// would fit into the local routing table yet aren't connected are periodically
+// probed. Such peers are either gone, or live in a disjoint ring that formed
+// while the network was split, in which case a successful dial merges the two
+// rings through the usual state exchanges. Isolated nodes also retry the seeds.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Remembered peer, a candidate for probing when partitions are suspected.
+type contact struct {
+	addrs []string  // Listener addresses of the peer
+	seen  time.Time // Last time the peer was connected or advertised
+}
+
+// Inserts or refreshes a batch of peers in the remembered set, evicting the
+// stalest ones if the memory limit is reached.
+func (o *Overlay) remember(addrs map[string][]string) {
+	now := o.clock.Now()
+
+	o.knownLock.Lock()
+	defer o.knownLock.Unlock()
+
+	for sid, peerAddrs := range addrs {
+		if len(peerAddrs) == 0 {
+			continue
+		}
+		if c, ok := o.known[sid]; ok {
+			c.addrs, c.seen = peerAddrs, now
+			continue
+		}
+		if len(o.known) >= config.PastryHealMemory {
+			stale, oldest := "", now
+			for id, c := range o.known {
+				if stale == "" || c.seen.Before(oldest) {
+					stale, oldest = id, c.seen
+				}
+			}
+			delete(o.known, stale)
+		}
+		o.known[sid] = &contact{addrs: peerAddrs, seen: now}
+	}
+}
+
+// Periodically probes the remembered peers and persists them into the peer
+// cache until termination is requested.
+func (o *Overlay) healer() {
+	ticker := o.clock.NewTicker(config.PastryHealPeriod)
+	defer ticker.Stop()
+
+	saver := o.clock.NewTicker(config.PastryCachePeriod)
+	defer saver.Stop()
+
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-o.healQuit:
+			continue
+		case <-ticker.C:
+			o.heal()
+		case <-saver.C:
+			if err := o.saveCache(); err != nil {
+				log.Printf("pastry: failed to save peer cache: %v.", err)
+			}
+		}
+	}
+	errc <- nil
+}
+
+// Executes a healing round: remembered peers missing from the local routing
+// table (and the seeds, if isolated) are collected and a few random ones dialed.
+func (o *Overlay) heal() {
+	// Forget expired peers and collect the rest
+	now := o.clock.Now()
+	known := make(map[string][]string)
+
+	o.knownLock.Lock()
+	for sid, c := range o.known {
+		if now.Sub(c.seen) > config.PastryHealExpiry {
+			delete(o.known, sid)
+		} else {
+			known[sid] = c.addrs
+		}
+	}
+	o.knownLock.Unlock()
+
+	// Keep only the ones the routing table would accept (disjoint ring or dead)
+	probes := [][]string{}
+	for sid, addrs := range known {
+		if id, ok := new(big.Int).SetString(sid, 10); ok && !o.filter(id) {
+			probes = append(probes, addrs)
+		}
+	}
+	if len(probes) > 0 {
+		log.Printf("pastry: %d remembered peers missing from the overlay, probing for partitions.", len(probes))
+	}
+	// If the node is isolated, retry the seeds too
+	o.lock.RLock()
+	isolated := len(o.livePeers) == 0
+	o.lock.RUnlock()
+
+	if isolated {
+		for _, seed := range o.seeds {
+			probes = append(probes, []string{seed})
+		}
+	}
+	// Dial a random subset of the candidates
+	for i := len(probes) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		probes[i], probes[j] = probes[j], probes[i]
+	}
+	if len(probes) > config.PastryHealProbes {
+		probes = probes[:config.PastryHealProbes]
+	}
+	for _, addrs := range probes {
+		peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+		for _, address := range addrs {
+			if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+				log.Printf("pastry: failed to resolve address %v: %v.", address, err)
+			} else {
+				peerAddrs = append(peerAddrs, addr)
+			}
+		}
+		o.authInit.Schedule(func() { o.dial(peerAddrs) })
+	}
+}
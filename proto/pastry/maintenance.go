@@ -50,10 +50,11 @@ func (o *Overlay) manager() {
 	addrs := make(map[string][]string)
 	exchs := make(map[*peer]*state)
 	drops := make(map[*peer]struct{})
+	tune := false
 
-	// Mark the overlay as unstable
+	// Mark the overlay as unstable (timer survives stale events, only updates reset it)
 	stable := false
-	stableTime := config.PastryBootTimeout
+	stableTimer := o.clock.After(config.PastryBootTimeout)
 
 	var errc chan error
 	for errc == nil {
@@ -83,33 +84,39 @@ func (o *Overlay) manager() {
 			o.eventLock.Lock()
 			o.exchSet, exchs = exchs, o.exchSet
 			o.dropSet, drops = drops, o.dropSet
+			o.tuneSet, tune = false, o.tuneSet
 			o.eventLock.Unlock()
 
-			// If stale notification, loop
+			// If stale notification, loop (latency updates only if they swap an entry)
 			if len(exchs) == 0 && len(drops) == 0 {
-				continue
-			}
-		case <-time.After(stableTime):
-			// No update arrived for a while, consider stable
-			if !stable {
-				stable = true
-				o.stable.Done()
+				if !tune || !o.tune(routes) {
+					continue
+				}
+				tune = false // Already tuned, nothing merged to retune for
 			}
+		case <-stableTimer:
+			// No update arrived for a while, consider stable and signal boot
+			stable, stableTimer = true, nil
+			close(o.stable)
 			continue
 		}
-		// Mark overlay as unstable and set a reduced convergence time
-		if stable {
-			stable = false
-			o.stable.Add(1)
+		// Restart the convergence timer with a reduced timeout if not yet stable
+		if !stable {
+			stableTimer = o.clock.After(config.PastryConvTimeout)
 		}
-		stableTime = config.PastryConvTimeout
 
 		// Merge all state exchanges into the temporary routing table and drop unneeded nodes
 		for _, s := range exchs {
 			o.merge(routes, addrs, s)
 		}
+		o.remember(addrs)
 		o.dropAll(drops, &pending)
 
+		// Swap out routing entries for closer candidates if new latencies arrived
+		if tune {
+			o.tune(routes)
+		}
+
 		// Check the new table for discovered peers and dial each
 		if peers := o.discover(routes); len(peers) > 0 {
 			for _, id := range peers {
@@ -263,8 +270,9 @@ func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
 }
 
 // Merges the received state into the provided routing table according to the
-// reduced pastry specs (no neighborhood sets). Also each peers network addresses
-// are collected to connect later if needed.
+// reduced pastry specs (no neighborhood sets). Occupied routing table slots are
+// only replaced if the proximity model deems the new candidate closer. Also each
+// peers network addresses are collected to connect later if needed.
 func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 	// Extract the ids from the state exchange
 	ids := make([]*big.Int, 0, len(s.Addrs))
@@ -290,7 +298,10 @@ func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 		case old == nil:
 			t.routes[row][col] = id
 		case old.Cmp(id) != 0:
-			// Discard new entry (less disruptive)
+			// Swap if better, otherwise discard new entry (less disruptive)
+			if o.better(row, col, id, old) {
+				t.routes[row][col] = id
+			}
 		}
 	}
 }
@@ -373,13 +384,22 @@ func (o *Overlay) revoke(t *table, down []*big.Int) {
 					// Try and fix routing entry from connection pool
 					t.routes[r][c] = nil
 					o.lock.RLock()
+					cands := []*big.Int{}
 					for _, p := range o.livePeers {
 						if pre, dig := prefix(o.nodeId, p.nodeId); pre == r && dig == c {
-							t.routes[r][c] = p.nodeId
-							break
+							cands = append(cands, p.nodeId)
 						}
 					}
 					o.lock.RUnlock()
+
+					// Pick the closest candidate (unknown latencies rank last)
+					best := time.Duration(0)
+					for _, cand := range cands {
+						lat := o.prox.latency(cand)
+						if t.routes[r][c] == nil || (lat != 0 && (best == 0 || lat < best)) {
+							t.routes[r][c], best = cand, lat
+						}
+					}
 				}
 			}
 		}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/ext/mathext"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 func checkRoutes(t *testing.T, nodes []*Overlay) {
@@ -149,6 +150,36 @@ func TestMaintenance(t *testing.T) {
 	checkRoutes(t, nodes)
 }
 
+func TestMaintenanceMux(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < 3; i++ {
+		config.BootPorts = append(config.BootPorts, 65520+i)
+	}
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes, all multiplexing their links over single connections
+	nodes := []*Overlay{}
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, New(appId, key, new(nopCallback)))
+		nodes[i].SetTransport(transport.NewMux(transport.TCP))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot nodes: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	// Wait a while for state updates to propagate and check the routing table
+	time.Sleep(100 * time.Millisecond)
+	checkRoutes(t, nodes)
+}
+
 /*
 func TestMaintenanceDOS(t *testing.T) {
 	// Override the overlay configuration
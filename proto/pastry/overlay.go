@@ -17,22 +17,27 @@
 // between you and the author(s).
 
 // Package pastry contains a simplified version of Pastry, where proximity is
-// not taken into consideration (i.e. no neighbor set).
+// only taken into consideration when choosing between candidates for the same
+// routing table slot (i.e. no explicit neighbor set).
 package pastry
 
 import (
-	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/project-iris/iris/clock"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
 	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/session"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // Different status types in which the node can be.
@@ -55,13 +60,25 @@ type Overlay struct {
 	app Callback // Upstream application callback
 
 	authId  string          // Iris network id
-	authKey *rsa.PrivateKey // Iris authentication key
+	authKey *rsa.PrivateKey // Iris authentication key (nil if certified by an authority)
 
-	nodeId *big.Int // Pastry peer id
-	addrs  []string // Listener addresses
+	ident   *identity.Identity   // Node identity the id is derived from
+	creds   *session.Credentials // Certified identity to authenticate sessions with
+	trusted []*rsa.PublicKey     // Extra keys to verify remote nodes with (key rotation)
+
+	nodeId *big.Int            // Pastry peer id
+	addrs  []string            // Listener addresses
+	trans  transport.Transport // Network transport to carry the sessions
+	clock  clock.Clock         // Time source of the beats and convergence timers
+
+	binds []string // Explicit addresses to listen on (interfaces if empty)
+	seeds []string // Explicit peer addresses to join through
+	cache string   // Path of the persistent peer cache (disabled if empty)
 
 	livePeers map[string]*peer // Active connection pool
 	heart     *heartbeat       // Beater for the active peers
+	prox      proximity        // Latency model ranking the routing candidates
+	epoch     time.Time        // Creation time, base of the round trip stamps
 
 	routes *table
 	time   uint64
@@ -74,59 +91,173 @@ type Overlay struct {
 	authAccept *pool.ThreadPool // Remotely initiated authentication pool
 	stateExch  *pool.ThreadPool // Pool for limiting active state exchanges
 
+	known     map[string]*contact // Peers seen recently, probed to heal partitions
+	knownLock sync.Mutex          // Lock protecting the remembered peers
+	healQuit  chan chan error     // Quit sync channel for the partition healer
+
+	chaos *Chaos // Fault injection hooks for chaos testing
+
 	exchSet map[*peer]*state   // State exchanges pending merging
 	dropSet map[*peer]struct{} // Peers pending dropping
+	tuneSet bool               // Latency changes pending table tuning
 
 	eventLock   sync.Mutex    // Lock protecting overlay events
 	eventNotify chan struct{} // Notifier for event changes
 
-	stable sync.WaitGroup // Syncer for reaching convergence
-	lock   sync.RWMutex   // Syncer for state mods after booting
+	stable chan struct{} // Channel closed when convergence is first reached
+	lock   sync.RWMutex  // Syncer for state mods after booting
 }
 
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted.
 func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
-	// Generate the random node id for this overlay peer
-	peerId := make([]byte, config.PastrySpace/8)
-	if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
-		panic(fmt.Sprintf("failed to generate node id: %v", err))
-	}
-	nodeId := new(big.Int).SetBytes(peerId)
-
-	// Assemble and return the overlay instance
+	// Assemble and return the overlay instance, the identity being generated
+	// on boot unless explicitly set
 	o := &Overlay{
 		app: app,
 
 		authId:  id,
 		authKey: key,
 
-		nodeId: nodeId,
-		addrs:  []string{},
+		addrs: []string{},
+		trans: transport.TCP,
+		clock: clock.System,
 
 		livePeers: make(map[string]*peer),
-		routes:    newRoutingTable(nodeId),
+		epoch:     time.Now(),
 		time:      1,
 
 		acceptQuit: []chan chan error{},
 		maintQuit:  make(chan chan error),
+		healQuit:   make(chan chan error),
 
 		authInit:   pool.NewThreadPool(config.PastryAuthThreads),
 		authAccept: pool.NewThreadPool(config.PastryAuthThreads),
 		stateExch:  pool.NewThreadPool(config.PastryExchThreads),
 
+		known: make(map[string]*contact),
+
 		exchSet:     make(map[*peer]*state),
 		dropSet:     make(map[*peer]struct{}),
 		eventNotify: make(chan struct{}, 1), // Buffer one notification
+		stable:      make(chan struct{}),
 	}
 	o.heart = newHeart(o)
+	o.prox = &rttModel{o}
+	o.chaos = newChaos(o)
+	o.chaos.Track(o.stateExch)
 	return o
 }
 
+// Replaces the network transport carrying the peer sessions (TCP by default).
+// It must be called before booting the overlay.
+func (o *Overlay) SetTransport(trans transport.Transport) {
+	o.trans = trans
+}
+
+// Replaces the time source driving the heartbeats, convergence detection and
+// round trip measurements (wall clock by default). The timeouts guarding the
+// network operations remain on the wall clock. It must be called before booting
+// the overlay.
+func (o *Overlay) SetClock(clk clock.Clock) {
+	o.clock, o.epoch = clk, clk.Now()
+	o.heart.heart.SetClock(clk)
+}
+
+// Sets the addresses to accept sessions on (port zero picks a free one) and the
+// addresses of some existing peers to join the overlay through. If any listener
+// addresses are given, the network interfaces are not enumerated and the LAN
+// bootstrappers are not started. It must be called before booting the overlay.
+func (o *Overlay) SetEndpoints(binds []string, seeds []string) {
+	o.binds, o.seeds = binds, seeds
+}
+
+// Sets a fixed node identity instead of a randomly generated one, so that a
+// restarted node retakes its previous position in the id space. It must be
+// called before booting the overlay.
+func (o *Overlay) SetIdentity(ident *identity.Identity) {
+	o.ident, o.nodeId = ident, ident.Id
+	o.routes = newRoutingTable(o.nodeId)
+}
+
+// Sets the certificate of the node identity and the cluster authority it was
+// issued by, replacing the shared cluster key for session authentication. It
+// must be called before booting the overlay.
+func (o *Overlay) SetCertificate(cert *identity.Certificate, authority *identity.Authority) {
+	o.creds = &session.Credentials{
+		Cert:      cert,
+		Authority: authority,
+	}
+}
+
+// Adds an extra key to verify remote node certificates with besides the cluster
+// (or authority) key, allowing it to be rotated node by node: trust the new key
+// everywhere, switch the signing keys, then stop trusting the old one. It must
+// be called before booting the overlay.
+func (o *Overlay) Trust(key *rsa.PublicKey) {
+	o.trusted = append(o.trusted, key)
+}
+
+// Applies a revocation list of the cluster authority, dropping connections to
+// any revoked nodes. It must be called after booting the overlay.
+func (o *Overlay) Revoke(list *identity.Revocation) error {
+	if o.creds == nil || o.creds.Authority == nil {
+		return errors.New("pastry: no certificate authority to revoke with")
+	}
+	if err := o.creds.Authority.Apply(list); err != nil {
+		return err
+	}
+	o.evict()
+	return nil
+}
+
+// Sets the path of the file to persist the known peers into, periodically and on
+// shutdown, and to seed the next boot from. It must be called before booting the
+// overlay.
+func (o *Overlay) SetCache(path string) {
+	o.cache = path
+}
+
 // Boots the overlay network: it starts up boostrappers and connection acceptors
-// on all local IPv4 interfaces, after which the overlay management is booted.
-// The method returns the number of remote peers after convergence is reached.
+// on all local IPv4 interfaces (or the explicitly set addresses, joining through
+// the seed peers), after which the overlay management is booted. The method returns
+// the number of remote peers after convergence is reached.
 func (o *Overlay) Boot() (int, error) {
+	// Generate a random node identity if none was set explicitly
+	if o.ident == nil {
+		ident, err := identity.New()
+		if err != nil {
+			return 0, fmt.Errorf("pastry: failed to generate node identity: %v", err)
+		}
+		o.SetIdentity(ident)
+	}
+	// Certify the node identity with the cluster key, unless done by an authority
+	if o.creds == nil {
+		if o.authKey == nil {
+			return 0, errors.New("pastry: neither cluster key nor certificate set")
+		}
+		creds, err := session.Certify(o.authKey, o.ident, o.trusted...)
+		if err != nil {
+			return 0, err
+		}
+		o.creds = creds
+	} else {
+		for _, key := range o.trusted {
+			o.creds.Authority.Trust(key)
+		}
+		key, err := o.creds.Authority.Verify(o.creds.Cert)
+		if err != nil {
+			return 0, fmt.Errorf("pastry: invalid node certificate: %v", err)
+		}
+		if key.N.Cmp(o.ident.Key.N) != 0 || key.E != o.ident.Key.E {
+			return 0, errors.New("pastry: certificate not issued for the node identity")
+		}
+		o.creds.Key = o.ident.Key
+	}
+
+	if len(o.binds) > 0 {
+		return o.boot(o.binds)
+	}
 	// Start the individual acceptors
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -153,12 +284,46 @@ func (o *Overlay) Boot() (int, error) {
 			// Create a quit channel and start the acceptor
 			quit := make(chan chan error)
 			o.acceptQuit = append(o.acceptQuit, quit)
-			go o.acceptor(ipnet, quit)
+			live := make(chan struct{})
+			go o.acceptor(net.JoinHostPort(ipnet.IP.String(), "0"), ipnet, live, quit)
+			<-live
 		}
 	}
+	return o.converge()
+}
+
+// Boots the overlay on a set of explicit addresses without LAN bootstrapping,
+// then dials the seed peers to join an existing network.
+func (o *Overlay) boot(binds []string) (int, error) {
+	// Start and sync the acceptors (addresses are needed for self dial filtering)
+	for _, bind := range binds {
+		quit := make(chan chan error)
+		o.acceptQuit = append(o.acceptQuit, quit)
+
+		live := make(chan struct{})
+		go o.acceptor(bind, nil, live, quit)
+		<-live
+	}
+	// Schedule the seed dials and converge
+	for _, seed := range o.seeds {
+		addr, err := net.ResolveTCPAddr("tcp", seed)
+		if err != nil {
+			return 0, err
+		}
+		o.authInit.Schedule(func() { o.dial([]*net.TCPAddr{addr}) })
+	}
+	return o.converge()
+}
+
+// Starts the overlay processes, waits for convergence and reports the number of
+// remote connections.
+func (o *Overlay) converge() (int, error) {
+	// Seed the boot with the cached peers, if any
+	o.loadCache()
+
 	// Start the overlay processes
-	o.stable.Add(1)
 	go o.manager()
+	go o.healer()
 	o.heart.start()
 
 	o.authInit.Start()
@@ -166,7 +331,7 @@ func (o *Overlay) Boot() (int, error) {
 	o.stateExch.Start()
 
 	// Wait for convergence and report remote connections
-	o.stable.Wait()
+	<-o.stable
 
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -194,6 +359,15 @@ func (o *Overlay) Shutdown() error {
 			errs = append(errs, err)
 		}
 	}
+	// Stop probing for partitions
+	o.healQuit <- errc
+	if err := <-errc; err != nil {
+		errs = append(errs, err)
+	}
+	// Persist the known peers for the next boot
+	if err := o.saveCache(); err != nil {
+		log.Printf("pastry: failed to save peer cache: %v.", err)
+	}
 	// Wait for all pending handshakes to finish
 	o.authAccept.Terminate(false)
 	o.authInit.Terminate(false)
@@ -221,7 +395,8 @@ func (o *Overlay) Shutdown() error {
 	}
 }
 
-// Returns the overlay node's identifier.
+// Returns the overlay node's identifier (nil until booted, unless the identity
+// was set explicitly).
 func (o *Overlay) Self() *big.Int {
 	return o.nodeId
 }
@@ -19,12 +19,17 @@
 package pastry
 
 import (
+	"crypto/x509"
 	"log"
 	"math/big"
+	"testing"
 	"time"
 
+	"github.com/project-iris/iris/clock"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // 512 bit RSA key in DER format
@@ -96,3 +101,44 @@ func (cb *nopCallback) Deliver(msg *proto.Message, key *big.Int) {
 func (cb *nopCallback) Forward(msg *proto.Message, key *big.Int) bool {
 	return true
 }
+
+func TestIdentity(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+
+	// Boot two nodes, one with a fixed identity
+	seed := New(appId, key, new(nopCallback))
+	seed.SetTransport(network.Host("10.0.0.1"))
+	seed.SetEndpoints([]string{"10.0.0.1:4000"}, nil)
+	if _, err := seed.Boot(); err != nil {
+		t.Fatalf("failed to boot seed node: %v.", err)
+	}
+	defer seed.Shutdown()
+
+	ident, err := identity.New()
+	if err != nil {
+		t.Fatalf("failed to generate node identity: %v.", err)
+	}
+	id := ident.Id
+
+	node := New(appId, key, new(nopCallback))
+	node.SetIdentity(ident)
+	node.SetTransport(network.Host("10.0.0.2"))
+	node.SetEndpoints([]string{"10.0.0.2:4000"}, []string{"10.0.0.1:4000"})
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot fixed identity node: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Ensure the fixed id is used both locally and remotely
+	if self := node.Self(); self.Cmp(id) != 0 {
+		t.Fatalf("local id mismatch: have %v, want %v.", self, id)
+	}
+	if peers := seed.Chaos().Peers(); len(peers) != 1 || peers[0].Cmp(id) != 0 {
+		t.Fatalf("remote id mismatch: have %v, want %v.", peers, []*big.Int{id})
+	}
+}
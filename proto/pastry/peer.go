@@ -54,6 +54,13 @@ type peer struct {
 	time    uint64
 	passive bool
 
+	// Proximity infos
+	rtt      time.Duration // Smoothed round trip time (zero if not yet measured)
+	tuned    time.Duration // Round trip time last reported to the manager
+	echo     int64         // Last heartbeat stamp received from the remote peer
+	echoTime int64         // Local time when the last remote stamp arrived
+	proxLock sync.Mutex    // Lock protecting the proximity infos
+
 	// Maintenance fields
 	quit chan chan error // Synchronizes peer termination
 	drop chan struct{}   // Channel sync for remote drop on graceful tear-down
@@ -70,8 +77,8 @@ func (o *Overlay) newPeer(ses *session.Session) *peer {
 		// Connection details
 		laddr: ses.CtrlLink.Sock().LocalAddr().String(),
 		raddr: ses.CtrlLink.Sock().RemoteAddr().String(),
-		lhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
-		rhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
+		lhost: hostOf(ses.CtrlLink.Sock().LocalAddr()),
+		rhost: hostOf(ses.CtrlLink.Sock().RemoteAddr()),
 
 		// Transport and maintenance channels
 		quit: make(chan chan error),
@@ -79,6 +86,15 @@ func (o *Overlay) newPeer(ses *session.Session) *peer {
 	}
 }
 
+// Extracts the host part of a network address, flattened.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 // Starts the inbound message processor and router.
 func (p *peer) Start() {
 	go p.processor(p.conn.CtrlLink)
@@ -110,8 +126,19 @@ func (p *peer) Close() error {
 	return res
 }
 
-// Sends a message to the remote peer.
+// Sends a message to the remote peer, passing overlay messages through the
+// fault injector if one is active.
 func (p *peer) send(msg *proto.Message) error {
+	if _, ok := msg.Head.Meta.(*header); ok {
+		if inj := p.owner.chaos.injector(); inj != nil {
+			return p.owner.chaos.send(inj, p, msg)
+		}
+	}
+	return p.transmit(msg)
+}
+
+// Transmits a message to the remote peer.
+func (p *peer) transmit(msg *proto.Message) error {
 	// Select the outbound channel based on message contents
 	link := p.conn.DataLink
 	if len(msg.Data) == 0 {
@@ -25,6 +25,7 @@ import (
 	"math/big"
 
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // Pastry operation code type.
@@ -53,11 +54,71 @@ type header struct {
 	Op    opcode      // The operation to execute
 	Dest  *big.Int    // Destination id
 	State *state      // Routing table state exchange
+	Beat  *beat       // Round trip measurement of heartbeats
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and wire.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wireHeader, func() wire.Meta { return new(header) })
+}
+
+// Wire tags of the pastry packets.
+const (
+	wireHeader = 16
+	wireInit   = 17
+)
+
+// Serializes the overlay header into the binary wire format.
+func (h *header) MarshalWire(enc *wire.Encoder) {
+	enc.PutMeta(h.Meta)
+	enc.PutUint(uint64(h.Op))
+	enc.PutBigInt(h.Dest)
+
+	enc.PutBool(h.State != nil)
+	if h.State != nil {
+		enc.PutUint(h.State.Version)
+		if h.State.Addrs == nil {
+			enc.PutUint(0)
+		} else {
+			enc.PutUint(uint64(len(h.State.Addrs)) + 1)
+			for id, addrs := range h.State.Addrs {
+				enc.PutString(id)
+				enc.PutStrings(addrs)
+			}
+		}
+	}
+	enc.PutBool(h.Beat != nil)
+	if h.Beat != nil {
+		enc.PutInt(h.Beat.Stamp)
+		enc.PutInt(h.Beat.Echo)
+		enc.PutInt(h.Beat.Hold)
+	}
+}
+
+// Deserializes the overlay header from the binary wire format.
+func (h *header) UnmarshalWire(dec *wire.Decoder) {
+	h.Meta = dec.Meta()
+	h.Op = opcode(dec.Uint())
+	h.Dest = dec.BigInt()
+
+	if dec.Bool() {
+		h.State = &state{Version: dec.Uint()}
+		if count := dec.Count(); count >= 0 {
+			h.State.Addrs = make(map[string][]string, count)
+			for i := 0; i < count; i++ {
+				id := dec.String()
+				h.State.Addrs[id] = dec.Strings()
+			}
+		}
+	}
+	if dec.Bool() {
+		h.Beat = &beat{
+			Stamp: dec.Int(),
+			Echo:  dec.Int(),
+			Hold:  dec.Int(),
+		}
+	}
 }
 
 // Simple wrapper around the peer send method, to handle errors by dropping.
@@ -97,13 +158,14 @@ func (o *Overlay) sendRepair(dest *peer) {
 }
 
 // Assembles an overlay heartbeat message, consisting of the beat opcode and
-// tagged whether the connection is an active route entry or not, sending it
-// towards the destination node.
+// tagged whether the connection is an active route entry or not, along with the
+// round trip measurement stamps, sending it towards the destination node.
 func (o *Overlay) sendBeat(dest *peer, passive bool) {
+	stamp := dest.stamp(o.uptime())
 	if passive {
-		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId})
+		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId, Beat: stamp})
 	} else {
-		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId})
+		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId, Beat: stamp})
 	}
 }
 
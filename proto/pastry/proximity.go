@@ -0,0 +1,175 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the proximity metric of the overlay: round trip times are measured
+// by piggybacking timestamps on the heartbeats, each beat echoing the last one
+// received from the remote side. The measurements are used to pick the closest
+// candidate for each routing table slot, so multi-hop routes prefer low latency
+// links.
+
+package pastry
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Network proximity model ranking the candidates competing for a routing table
+// slot. The default one uses the round trip times measured on the heartbeats,
+// whereas tests can inject synthetic latencies.
+type proximity interface {
+	// Returns the estimated round trip time to a node, or zero if unknown.
+	latency(id *big.Int) time.Duration
+}
+
+// Round trip time measurement piggybacked on the heartbeats.
+type beat struct {
+	Stamp int64 // Local time of the sender when the beat was sent
+	Echo  int64 // Last stamp received from the destination (zero if none)
+	Hold  int64 // Time elapsed at the sender since the echoed stamp arrived
+}
+
+// Proximity model based on the measured round trip times of live connections.
+type rttModel struct {
+	owner *Overlay
+}
+
+// Implements proximity.latency, returning the smoothed round trip time to a
+// connected peer. Take care, this locks the overlay (don't double lock).
+func (m *rttModel) latency(id *big.Int) time.Duration {
+	m.owner.lock.RLock()
+	p, ok := m.owner.livePeers[id.String()]
+	m.owner.lock.RUnlock()
+
+	if !ok {
+		return 0
+	}
+	p.proxLock.Lock()
+	defer p.proxLock.Unlock()
+
+	return p.rtt
+}
+
+// Returns the time elapsed since the overlay was created, used as the local
+// clock of the round trip measurements.
+func (o *Overlay) uptime() time.Duration {
+	return o.clock.Now().Sub(o.epoch)
+}
+
+// Assembles the round trip measurement fields for an outbound heartbeat.
+func (p *peer) stamp(now time.Duration) *beat {
+	p.proxLock.Lock()
+	defer p.proxLock.Unlock()
+
+	b := &beat{Stamp: int64(now)}
+	if p.echo != 0 {
+		b.Echo, b.Hold = p.echo, int64(now)-p.echoTime
+	}
+	return b
+}
+
+// Processes the round trip measurement fields of an inbound heartbeat, updating
+// the smoothed round trip time estimate. Returns whether the estimate changed
+// enough since the last report to warrant revisiting the routing table.
+func (p *peer) measure(b *beat, now time.Duration) bool {
+	p.proxLock.Lock()
+	defer p.proxLock.Unlock()
+
+	// Store the remote stamp to echo back with the next beat
+	if b.Stamp != 0 {
+		p.echo, p.echoTime = b.Stamp, int64(now)
+	}
+	// Discard missing or bogus echoes
+	if b.Echo == 0 {
+		return false
+	}
+	sample := time.Duration(int64(now) - b.Echo - b.Hold)
+	if sample <= 0 || b.Hold < 0 {
+		return false
+	}
+	// Smoothen the estimate (same weights as the TCP retransmission timer)
+	if p.rtt == 0 {
+		p.rtt = sample
+	} else {
+		p.rtt += (sample - p.rtt) / 8
+	}
+	// Report the first sample and any significant deviations
+	if p.tuned == 0 || !within(p.rtt, p.tuned) {
+		p.tuned = p.rtt
+		return true
+	}
+	return false
+}
+
+// Checks whether two latencies are within the proximity gain of each other.
+func within(a, b time.Duration) bool {
+	return !closer(a, b) && !closer(b, a)
+}
+
+// Checks whether latency a is sufficiently lower than b to justify swapping a
+// routing table entry. Unknown (zero) latencies are never considered closer.
+func closer(a, b time.Duration) bool {
+	if a == 0 || b == 0 {
+		return false
+	}
+	return a*100 < b*time.Duration(100-config.PastryProximityGain)
+}
+
+// Checks all the live connections and swaps any routing table entries that have
+// a sufficiently closer candidate. Returns whether anything was replaced.
+func (o *Overlay) tune(t *table) bool {
+	// Collect the live peers (don't hold the lock, latency queries might need it)
+	o.lock.RLock()
+	ids := make([]*big.Int, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		ids = append(ids, p.nodeId)
+	}
+	o.lock.RUnlock()
+
+	// Replace any slot having a closer candidate
+	change := false
+	for _, id := range ids {
+		if o.nodeId.Cmp(id) == 0 {
+			continue
+		}
+		row, col := prefix(o.nodeId, id)
+		if old := t.routes[row][col]; old != nil && old.Cmp(id) != 0 {
+			if o.better(row, col, id, old) {
+				t.routes[row][col], change = id, true
+			}
+		}
+	}
+	return change
+}
+
+// Requests the manager to revisit the routing table based on new measurements.
+func (o *Overlay) retune() {
+	o.eventLock.Lock()
+	o.tuneSet = true
+	o.eventLock.Unlock()
+
+	// Wake the manager if blocking
+	select {
+	case o.eventNotify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
@@ -0,0 +1,198 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Synthetic latency model, mapping node ids to fixed round trip times.
+type latencyModel map[string]time.Duration
+
+func (m latencyModel) latency(id *big.Int) time.Duration {
+	return m[id.String()]
+}
+
+// Creates an unbooted overlay rooted at the zero id with an injected latency
+// model, along with a few ids all competing for the same routing table slot.
+func newProximityOverlay(model latencyModel) (*Overlay, []*big.Int) {
+	o := New(appId, nil, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+	o.prox = model
+
+	ids := make([]*big.Int, 4)
+	for i := 0; i < len(ids); i++ {
+		ids[i] = new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-1))
+		ids[i].Add(ids[i], big.NewInt(int64(i+1)))
+	}
+	return o, ids
+}
+
+func TestProximityMeasure(t *testing.T) {
+	a, b := new(peer), new(peer)
+	ms := time.Millisecond
+
+	// Exchange a beat pair: 10ms one way delay, 40ms hold at the remote side
+	if b.measure(a.stamp(1*ms), 11*ms) {
+		t.Fatalf("estimate reported without echo.")
+	}
+	if !a.measure(b.stamp(51*ms), 61*ms) {
+		t.Fatalf("first estimate not reported.")
+	}
+	if a.rtt != 20*ms {
+		t.Fatalf("round trip mismatch: have %v, want %v.", a.rtt, 20*ms)
+	}
+	// Repeat with the same delays, estimate should be stable and not reported
+	if b.measure(a.stamp(101*ms), 111*ms); a.measure(b.stamp(151*ms), 161*ms) {
+		t.Fatalf("unchanged estimate reported.")
+	}
+	if a.rtt != 20*ms {
+		t.Fatalf("round trip mismatch: have %v, want %v.", a.rtt, 20*ms)
+	}
+	// Increase the delay considerably and ensure the change is eventually reported
+	reported := false
+	for i := 0; i < 16 && !reported; i++ {
+		base := time.Duration(i+2) * time.Second
+		b.measure(a.stamp(base), base+100*ms)
+		reported = a.measure(b.stamp(base+500*ms), base+600*ms)
+	}
+	if !reported {
+		t.Fatalf("significant latency change not reported: estimate %v.", a.rtt)
+	}
+	// Bogus echoes should be discarded
+	rtt := a.rtt
+	if a.measure(&beat{Stamp: 1, Echo: int64(time.Hour), Hold: 0}, time.Minute); a.rtt != rtt {
+		t.Fatalf("negative sample accepted: have %v, want %v.", a.rtt, rtt)
+	}
+	if a.measure(&beat{Stamp: 1, Echo: 1, Hold: -1}, time.Minute); a.rtt != rtt {
+		t.Fatalf("negative hold accepted: have %v, want %v.", a.rtt, rtt)
+	}
+}
+
+func TestProximityMerge(t *testing.T) {
+	model := make(latencyModel)
+	o, ids := newProximityOverlay(model)
+
+	model[ids[0].String()] = 100 * time.Millisecond
+	model[ids[1].String()] = 90 * time.Millisecond
+	model[ids[2].String()] = 10 * time.Millisecond
+
+	row, col := prefix(o.nodeId, ids[0])
+	routes := o.routes.copy()
+	addrs := make(map[string][]string)
+
+	merge := func(id *big.Int) {
+		o.merge(routes, addrs, &state{Addrs: map[string][]string{id.String(): []string{}}})
+	}
+	// Empty slot should be filled, irrelevant of latency
+	if merge(ids[0]); routes.routes[row][col].Cmp(ids[0]) != 0 {
+		t.Fatalf("empty slot not filled: have %v, want %v.", routes.routes[row][col], ids[0])
+	}
+	// Marginally closer or unknown candidates should not displace the entry
+	if merge(ids[1]); routes.routes[row][col].Cmp(ids[0]) != 0 {
+		t.Fatalf("marginal candidate accepted: have %v, want %v.", routes.routes[row][col], ids[0])
+	}
+	if merge(ids[3]); routes.routes[row][col].Cmp(ids[0]) != 0 {
+		t.Fatalf("unmeasured candidate accepted: have %v, want %v.", routes.routes[row][col], ids[0])
+	}
+	// Considerably closer candidate should replace the entry
+	if merge(ids[2]); routes.routes[row][col].Cmp(ids[2]) != 0 {
+		t.Fatalf("closer candidate rejected: have %v, want %v.", routes.routes[row][col], ids[2])
+	}
+}
+
+func TestProximityTune(t *testing.T) {
+	model := make(latencyModel)
+	o, ids := newProximityOverlay(model)
+
+	// Connect all candidates, but route through the first one
+	for _, id := range ids {
+		o.livePeers[id.String()] = &peer{nodeId: id}
+	}
+	row, col := prefix(o.nodeId, ids[0])
+	routes := o.routes.copy()
+	routes.routes[row][col] = ids[0]
+
+	// Without latencies, nothing should change
+	if o.tune(routes) || routes.routes[row][col].Cmp(ids[0]) != 0 {
+		t.Fatalf("unmeasured table tuned: have %v, want %v.", routes.routes[row][col], ids[0])
+	}
+	// Measure latencies, ensure the closest is picked
+	model[ids[0].String()] = 50 * time.Millisecond
+	model[ids[1].String()] = 30 * time.Millisecond
+	model[ids[2].String()] = 20 * time.Millisecond
+	model[ids[3].String()] = 45 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		o.tune(routes)
+	}
+	if routes.routes[row][col].Cmp(ids[2]) != 0 {
+		t.Fatalf("closest candidate not picked: have %v, want %v.", routes.routes[row][col], ids[2])
+	}
+	// Revoke the chosen entry and ensure the next closest live one takes its place
+	delete(o.livePeers, ids[2].String())
+	if o.revoke(routes, []*big.Int{ids[2]}); routes.routes[row][col].Cmp(ids[1]) != 0 {
+		t.Fatalf("closest repair not picked: have %v, want %v.", routes.routes[row][col], ids[1])
+	}
+}
+
+func TestProximityHeartbeat(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	beat := config.PastryBeatPeriod
+	config.PastryBeatPeriod = 50 * time.Millisecond
+	defer func() { config.PastryBeatPeriod = beat }()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65520+i)
+	}
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two nodes and wait for a few heartbeats
+	nodes := []*Overlay{}
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, New(appId, key, new(nopCallback)))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot nodes: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(10 * config.PastryBeatPeriod)
+
+	// Ensure both sides measured the round trip time
+	for i, o := range nodes {
+		remote := nodes[1-i].nodeId
+		if rtt := o.prox.latency(remote); rtt <= 0 || rtt > config.PastryBeatPeriod {
+			t.Fatalf("node %d: round trip estimate invalid: %v.", i, rtt)
+		}
+	}
+}
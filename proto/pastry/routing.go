@@ -18,7 +18,7 @@
 
 // This file contains the routing logic in the overlay network, which currently
 // is a simplified version of Pastry: the leafset and routing table is the same,
-// but no proximity metric is taken into consideration.
+// but proximity is only considered when populating the routing table slots.
 //
 // Beside the above, it also contains the system event processing logic.
 
@@ -32,8 +32,18 @@ import (
 	"github.com/project-iris/iris/proto"
 )
 
-// Pastry routing algorithm.
+// Routes a message through the fault injector if one is active, or directly
+// otherwise.
 func (o *Overlay) route(src *peer, msg *proto.Message) {
+	if inj := o.chaos.injector(); inj != nil {
+		o.chaos.route(inj, src, msg)
+	} else {
+		o.dispatch(src, msg)
+	}
+}
+
+// Pastry routing algorithm.
+func (o *Overlay) dispatch(src *peer, msg *proto.Message) {
 	// Sync the routing table
 	o.lock.RLock() // Note, unlock is in deliver and forward!!!
 
@@ -131,6 +141,11 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 		if ok {
 			head.Meta = msg.Head.Meta
 			msg.Head.Meta = head
+
+			// Payloads of relayed messages are solely owned by the overlay, recycle
+			if src != nil {
+				msg.Recycle()
+			}
 			o.send(msg, p)
 		}
 	}
@@ -147,12 +162,23 @@ func (o *Overlay) process(src *peer, head *header) {
 	// Extract the remote id and state
 	remId, remState := head.Dest.String(), head.State
 
+	// Update the round trip estimate if the message was a heartbeat
+	if head.Beat != nil && (head.Op == opActive || head.Op == opPassive) {
+		if src.measure(head.Beat, o.uptime()) {
+			o.retune()
+		}
+	}
+
 	switch head.Op {
 	case opJoin:
-		// Discard self joins (rare race condition during update)
+		// Discard self joins (rare race condition during update) and insane states
 		if o.nodeId.Cmp(head.Dest) == 0 {
 			return
 		}
+		if err := o.sanitize(src, remState, false); err != nil {
+			log.Printf("pastry: discarding invalid join from %v: %v.", src.nodeId, err)
+			return
+		}
 		// Node joining into currents responsibility list
 		if p, ok := o.livePeers[remId]; !ok {
 			// Connect new peers and let the handshake do the state exchange
@@ -188,7 +214,11 @@ func (o *Overlay) process(src *peer, head *header) {
 			o.lock.RLock()
 		}
 	case opExchage:
-		// State update, merge into local if new
+		// Discard insane states, otherwise merge into local if new
+		if err := o.sanitize(src, remState, true); err != nil {
+			log.Printf("pastry: discarding invalid state from %v: %v.", src.nodeId, err)
+			return
+		}
 		if remState.Version > src.time {
 			src.time = remState.Version
 
@@ -272,7 +272,7 @@ func benchmarkLatency(b *testing.B, block int) {
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
 	// Generate a batch of messages to send around
-	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}}
+	head := proto.Header{Meta: []byte{0x99, 0x98, 0x97, 0x96}, Key: []byte{0x00, 0x01}, Iv: []byte{0x02, 0x03}}
 	msgs := make([]proto.Message, b.N)
 	for i := 0; i < b.N; i++ {
 		msgs[i].Head = head
@@ -360,7 +360,7 @@ func benchmarkThroughput(b *testing.B, block int) {
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
 	// Generate a bach of messages to send around
-	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}}
+	head := proto.Header{Meta: []byte{0x99, 0x98, 0x97, 0x96}, Key: []byte{0x00, 0x01}, Iv: []byte{0x02, 0x03}}
 	msgs := make([]proto.Message, b.N)
 	for i := 0; i < b.N; i++ {
 		msgs[i].Head = head
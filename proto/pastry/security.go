@@ -0,0 +1,141 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the defenses of the overlay against malicious peers: node ids are
+// bound to authority certified keys and verified during the handshake, received
+// routing states are sanity checked before merging, and routing table slots can
+// be constrained to the candidates closest to the slot's ideal point, so that a
+// compromised node cannot steer itself into the tables of others.
+
+package pastry
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Verifies that the remote side of a session owns the node id it claims: the
+// session authenticated the remote key with the authority, so the claimed id
+// must match the one certified for that key.
+func (o *Overlay) authenticate(ses *session.Session, pkt *initPacket) error {
+	if pkt == nil || pkt.Id == nil {
+		return errors.New("missing identity")
+	}
+	if cert := ses.Peer(); cert == nil || cert.Id.Cmp(pkt.Id) != 0 {
+		return fmt.Errorf("claimed id %v not certified", pkt.Id)
+	}
+	if pkt.Id.Cmp(o.nodeId) == 0 {
+		return errors.New("self connection")
+	}
+	return checkAddrs(pkt.Addrs)
+}
+
+// Drops all live peers revoked by the authority since their connection.
+func (o *Overlay) evict() {
+	o.lock.RLock()
+	revoked := []*peer{}
+	for _, p := range o.livePeers {
+		if o.creds.Authority.Revoked(p.nodeId) {
+			revoked = append(revoked, p)
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, p := range revoked {
+		log.Printf("pastry: dropping revoked peer %v.", p.nodeId)
+		o.drop(p)
+	}
+}
+
+// Sanity checks a routing state received from a peer: the number of entries,
+// the ids and the addresses must all be within limits. The sender's own entry
+// is replaced with the addresses verified during the handshake.
+func (o *Overlay) sanitize(src *peer, s *state, direct bool) error {
+	if s == nil {
+		return errors.New("missing state")
+	}
+	if len(s.Addrs) > config.PastryStateLimit {
+		return fmt.Errorf("too many peers: %d > %d", len(s.Addrs), config.PastryStateLimit)
+	}
+	for sid, addrs := range s.Addrs {
+		id, ok := new(big.Int).SetString(sid, 10)
+		if !ok || id.Sign() < 0 || id.BitLen() > config.PastrySpace {
+			return fmt.Errorf("invalid node id: %v", sid)
+		}
+		if err := checkAddrs(addrs); err != nil {
+			return fmt.Errorf("node %v: %v", sid, err)
+		}
+	}
+	if direct {
+		s.Addrs[src.nodeId.String()] = src.addrs
+	}
+	return nil
+}
+
+// Checks that a peer advertises a sane number of well formed addresses.
+func checkAddrs(addrs []string) error {
+	if len(addrs) == 0 || len(addrs) > config.PastryAddrLimit {
+		return fmt.Errorf("invalid address count: %d", len(addrs))
+	}
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if zone := strings.LastIndex(host, "%"); zone >= 0 {
+			host = host[:zone]
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid host: %v", host)
+		}
+		if num, err := strconv.Atoi(port); err != nil || num <= 0 || num > 65535 {
+			return fmt.Errorf("invalid port: %v", port)
+		}
+	}
+	return nil
+}
+
+// Checks whether a routing table candidate should replace the current entry of
+// a slot: in constrained mode the one closer to the slot's ideal point wins,
+// otherwise the one with a sufficiently lower latency.
+func (o *Overlay) better(row, col int, id, old *big.Int) bool {
+	if config.PastryConstrainedRoutes {
+		point := slotPoint(o.nodeId, row, col)
+		return Distance(id, point).Cmp(Distance(old, point)) < 0
+	}
+	return closer(o.prox.latency(id), o.prox.latency(old))
+}
+
+// Calculates the ideal id of a routing table slot: the local id with the digit
+// of the slot's row replaced by the slot's column.
+func slotPoint(self *big.Int, row, col int) *big.Int {
+	point := new(big.Int).Set(self)
+	base := config.PastrySpace - (row+1)*config.PastryBase
+	for bit := 0; bit < config.PastryBase; bit++ {
+		point.SetBit(point, base+bit, uint(col>>uint(bit))&1)
+	}
+	return point
+}
@@ -0,0 +1,214 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/clock"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto/transport"
+)
+
+func TestAuthentication(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+
+	// Boot a victim node to impersonate
+	victim := New(appId, key, new(nopCallback))
+	victim.SetTransport(network.Host("10.0.0.1"))
+	victim.SetEndpoints([]string{"10.0.0.1:4000"}, nil)
+	if _, err := victim.Boot(); err != nil {
+		t.Fatalf("failed to boot victim node: %v.", err)
+	}
+	defer victim.Shutdown()
+
+	// Boot a rogue node claiming an id not derived from its own key
+	ident, err := identity.New()
+	if err != nil {
+		t.Fatalf("failed to generate node identity: %v.", err)
+	}
+	ident.Id = new(big.Int).Add(victim.Self(), big.NewInt(1))
+
+	rogue := New(appId, key, new(nopCallback))
+	rogue.SetIdentity(ident)
+	rogue.SetTransport(network.Host("10.0.0.2"))
+	rogue.SetEndpoints([]string{"10.0.0.2:4000"}, []string{"10.0.0.1:4000"})
+	rogue.Boot()
+	defer rogue.Shutdown()
+
+	// Ensure the victim refused the rogue peer
+	time.Sleep(100 * time.Millisecond)
+	if peers := victim.Chaos().Peers(); len(peers) != 0 {
+		t.Fatalf("rogue peer accepted: %v.", peers)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	authority, _ := rsa.GenerateKey(rand.Reader, 1024)
+	network := transport.NewNetwork(clock.System, 1)
+
+	// Ensure revocations are rejected before an authority is set
+	list, err := identity.Revoke(authority, 1, nil)
+	if err != nil {
+		t.Fatalf("failed to issue revocation list: %v.", err)
+	}
+	if err := New(appId, nil, new(nopCallback)).Revoke(list); err == nil {
+		t.Fatalf("revocation accepted without authority.")
+	}
+	// Boot two nodes certified by the authority, without a cluster key
+	nodes := make([]*Overlay, 2)
+	for i := 0; i < len(nodes); i++ {
+		ident, err := identity.New()
+		if err != nil {
+			t.Fatalf("failed to generate node identity: %v.", err)
+		}
+		cert, err := identity.Issue(authority, &ident.Key.PublicKey)
+		if err != nil {
+			t.Fatalf("failed to issue node certificate: %v.", err)
+		}
+		host := fmt.Sprintf("10.0.0.%d", i+1)
+		seeds := []string{}
+		if i > 0 {
+			seeds = append(seeds, "10.0.0.1:4000")
+		}
+		nodes[i] = New(appId, nil, new(nopCallback))
+		nodes[i].SetIdentity(ident)
+		nodes[i].SetCertificate(cert, identity.NewAuthority(&authority.PublicKey))
+		nodes[i].SetTransport(network.Host(host))
+		nodes[i].SetEndpoints([]string{host + ":4000"}, seeds)
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node #%d: %v.", i, err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	if peers := nodes[0].Chaos().Peers(); len(peers) != 1 {
+		t.Fatalf("peer count mismatch: have %v, want %v.", len(peers), 1)
+	}
+	// Revoke the second node and ensure it's evicted
+	list, err = identity.Revoke(authority, 1, []*big.Int{nodes[1].Self()})
+	if err != nil {
+		t.Fatalf("failed to issue revocation list: %v.", err)
+	}
+	if err := nodes[0].Revoke(list); err != nil {
+		t.Fatalf("failed to apply revocation list: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if peers := nodes[0].Chaos().Peers(); len(peers) != 0 {
+		t.Fatalf("revoked peer not evicted: %v.", peers)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	src := &peer{nodeId: big.NewInt(1), addrs: []string{"10.0.0.1:4000"}}
+
+	// Valid states should pass, with the sender's addresses enforced
+	s := &state{Addrs: map[string][]string{
+		"1": {"10.0.0.66:4000"},
+		"2": {"10.0.0.2:4000", "[fe80::1%eth0]:4000"},
+	}}
+	if err := o.sanitize(src, s, true); err != nil {
+		t.Fatalf("valid state rejected: %v.", err)
+	}
+	if addrs := s.Addrs["1"]; len(addrs) != 1 || addrs[0] != src.addrs[0] {
+		t.Fatalf("sender address mismatch: have %v, want %v.", addrs, src.addrs)
+	}
+	// Insane states should be rejected
+	huge := &state{Addrs: make(map[string][]string)}
+	for i := 0; i <= config.PastryStateLimit; i++ {
+		huge.Addrs[fmt.Sprint(i)] = []string{"10.0.0.1:4000"}
+	}
+	wide := make([]string, config.PastryAddrLimit+1)
+	for i := 0; i < len(wide); i++ {
+		wide[i] = fmt.Sprintf("10.0.0.%d:4000", i)
+	}
+	invalid := []*state{
+		nil,
+		huge,
+		{Addrs: map[string][]string{"x": {"10.0.0.1:4000"}}},
+		{Addrs: map[string][]string{"-1": {"10.0.0.1:4000"}}},
+		{Addrs: map[string][]string{new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace)).String(): {"10.0.0.1:4000"}}},
+		{Addrs: map[string][]string{"2": nil}},
+		{Addrs: map[string][]string{"2": wide}},
+		{Addrs: map[string][]string{"2": {"10.0.0.1"}}},
+		{Addrs: map[string][]string{"2": {"example.com:4000"}}},
+		{Addrs: map[string][]string{"2": {"10.0.0.1:0"}}},
+		{Addrs: map[string][]string{"2": {"10.0.0.1:65536"}}},
+	}
+	for i, s := range invalid {
+		if err := o.sanitize(src, s, false); err == nil {
+			t.Fatalf("test %d: invalid state accepted: %v.", i, s)
+		}
+	}
+}
+
+func TestConstrainedRoutes(t *testing.T) {
+	enabled := config.PastryConstrainedRoutes
+	config.PastryConstrainedRoutes = true
+	defer func() { config.PastryConstrainedRoutes = enabled }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	ident, err := identity.New()
+	if err != nil {
+		t.Fatalf("failed to generate node identity: %v.", err)
+	}
+	o.SetIdentity(ident)
+
+	// Verify that the ideal slot points are routed into their own slots
+	for row := 0; row < config.PastrySpace/config.PastryBase; row++ {
+		for col := 0; col < 1<<uint(config.PastryBase); col++ {
+			point := slotPoint(o.nodeId, row, col)
+			if point.Cmp(o.nodeId) == 0 {
+				continue
+			}
+			if r, c := prefix(o.nodeId, point); r != row || c != col {
+				t.Fatalf("slot {%d, %d}: point mismatch: have {%d, %d}.", row, col, r, c)
+			}
+			// Ensure candidates closer to the ideal point win
+			near := new(big.Int).Add(point, big.NewInt(1))
+			far := new(big.Int).Sub(point, big.NewInt(2))
+			if !o.better(row, col, near, far) {
+				t.Fatalf("slot {%d, %d}: farther candidate preferred.", row, col)
+			}
+			if o.better(row, col, far, near) {
+				t.Fatalf("slot {%d, %d}: farther candidate admitted.", row, col)
+			}
+		}
+	}
+}
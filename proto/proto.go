@@ -23,9 +23,11 @@ package proto
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/compress"
 )
 
 // Baseline message headers.
@@ -33,6 +35,8 @@ type Header struct {
 	Meta interface{} // Metadata usable by upper network layers
 	Key  []byte      // AES key if the payload is encrypted (nil otherwise)
 	Iv   []byte      // Counter mode nonce if the payload is encrypted (nil otherwise)
+
+	Codec compress.Codec // Compression codec of the payload (None if uncompressed)
 }
 
 // Iris message consisting of the payload and attached headers.
@@ -40,11 +44,26 @@ type Message struct {
 	Head Header // Baseline headers
 	Data []byte // Payload in plain or ciphertext form
 
-	secure bool // Flag specifying whether the data segment was encrypted or not
+	secure  bool // Flag specifying whether the data segment was encrypted or not
+	recycle bool // Flag specifying whether the data segment is pooled after sending
+	raw     bool // Flag specifying whether the data segment is exempt from compression
 }
 
-// Encrypts a plaintext message with a temporary key and IV.
+// Encrypts a plaintext message with a temporary key and IV, compressing it first
+// if worthwhile. If the security model leaves payload encryption to the links,
+// the message is only compressed.
 func (m *Message) Encrypt() error {
+	// Compress the payload unless opted out or too small to matter
+	if !m.raw && len(m.Data) >= config.CompressThreshold {
+		if codec := compress.Preferred(); codec != compress.None {
+			if data, ok := compress.Compress(codec, m.Data); ok {
+				m.Data, m.Head.Codec = data, codec
+			}
+		}
+	}
+	if !ActiveSecurity().EndToEnd() {
+		return nil
+	}
 	// Generate a new temporary key and the associated block cipher
 	key := make([]byte, config.PacketCipherBits/8)
 	if n, err := io.ReadFull(rand.Reader, key); n != len(key) || err != nil {
@@ -70,19 +89,34 @@ func (m *Message) Encrypt() error {
 	return nil
 }
 
-// Decrypts a ciphertext message using the given key and IV.
+// Decrypts a ciphertext message using the given key and IV, decompressing it
+// afterwards if needed. Messages without a key are accepted only if the security
+// model leaves payload encryption to the links.
 func (m *Message) Decrypt() error {
-	// Create the stream cipher for decryption
-	block, err := config.PacketCipher(m.Head.Key)
-	if err != nil {
-		return err
+	if m.Head.Key != nil {
+		// Create the stream cipher for decryption
+		block, err := config.PacketCipher(m.Head.Key)
+		if err != nil {
+			return err
+		}
+		stream := cipher.NewCTR(block, m.Head.Iv)
+
+		// Decrypt the message and clear out the crypto headers
+		stream.XORKeyStream(m.Data, m.Data)
+		m.Head.Key = nil
+		m.Head.Iv = nil
+	} else if ActiveSecurity().EndToEnd() {
+		return errors.New("payload not encrypted end-to-end")
 	}
-	stream := cipher.NewCTR(block, m.Head.Iv)
 
-	// Decrypt the message, clear out the crypto headers and return
-	stream.XORKeyStream(m.Data, m.Data)
-	m.Head.Key = nil
-	m.Head.Iv = nil
+	// Restore the original payload if it was compressed
+	if m.Head.Codec != compress.None {
+		data, err := compress.Decompress(m.Head.Codec, m.Data, config.StreamMessageLimit)
+		if err != nil {
+			return err
+		}
+		m.Data, m.Head.Codec = data, compress.None
+	}
 	return nil
 }
 
@@ -95,3 +129,19 @@ func (m *Message) Secure() bool {
 func (m *Message) KnownSecure() {
 	m.secure = true
 }
+
+// Marks the data segment to be returned into the buffer pool once the message is
+// sent. Only the exclusive owner of the data may request it.
+func (m *Message) Recycle() {
+	m.recycle = true
+}
+
+// Internal, used by the link package to release the sent data segments.
+func (m *Message) Recyclable() bool {
+	return m.recycle
+}
+
+// Exempts the data segment from compression, e.g. if it's compressed already.
+func (m *Message) NoCompress() {
+	m.raw = true
+}
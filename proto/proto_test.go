@@ -23,6 +23,9 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/compress"
 )
 
 func TestCrypto(t *testing.T) {
@@ -64,6 +67,76 @@ func TestCrypto(t *testing.T) {
 	}
 }
 
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 1024)
+
+	tests := []struct {
+		data  []byte
+		raw   bool
+		codec compress.Codec
+	}{
+		{data, false, compress.Deflate},
+		{data, true, compress.None},
+		{data[:config.CompressThreshold-1], false, compress.None},
+	}
+	for i, tt := range tests {
+		msg := &Message{Data: append([]byte{}, tt.data...)}
+		if tt.raw {
+			msg.NoCompress()
+		}
+		if err := msg.Encrypt(); err != nil {
+			t.Fatalf("test %d: failed to encrypt message: %v.", i, err)
+		}
+		if msg.Head.Codec != tt.codec {
+			t.Fatalf("test %d: codec mismatch: have %v, want %v.", i, msg.Head.Codec, tt.codec)
+		}
+		if tt.codec != compress.None && len(msg.Data) >= len(tt.data) {
+			t.Fatalf("test %d: compressed size mismatch: have %v, want < %v.", i, len(msg.Data), len(tt.data))
+		}
+		if err := msg.Decrypt(); err != nil {
+			t.Fatalf("test %d: failed to decrypt message: %v.", i, err)
+		}
+		if !bytes.Equal(msg.Data, tt.data) || msg.Head.Codec != compress.None {
+			t.Fatalf("test %d: message mismatch: have %v/%x, want %v/%x.", i, msg.Head.Codec, msg.Data, compress.None, tt.data)
+		}
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	defer func(mode string) { config.SecurityMode = mode }(config.SecurityMode)
+
+	data := []byte("payload")
+	for _, mode := range []string{"e2e", "link", "both"} {
+		config.SecurityMode = mode
+		security, err := LookupSecurity(mode)
+		if err != nil {
+			t.Fatalf("%s: failed to look up security mode: %v.", mode, err)
+		}
+		msg := &Message{Data: append([]byte{}, data...)}
+		if err := msg.Encrypt(); err != nil {
+			t.Fatalf("%s: failed to encrypt message: %v.", mode, err)
+		}
+		// Only end-to-end models should encrypt the payload
+		if msg.Secure() != security.EndToEnd() || (msg.Head.Key != nil) != security.EndToEnd() {
+			t.Fatalf("%s: encryption mismatch: have %v, want %v.", mode, msg.Secure(), security.EndToEnd())
+		}
+		if err := msg.Decrypt(); err != nil {
+			t.Fatalf("%s: failed to decrypt message: %v.", mode, err)
+		}
+		if !bytes.Equal(msg.Data, data) {
+			t.Fatalf("%s: data mismatch: have %s, want %s.", mode, msg.Data, data)
+		}
+		// Unencrypted payloads must be refused by end-to-end models
+		plain := &Message{Data: append([]byte{}, data...)}
+		if err := plain.Decrypt(); (err == nil) == security.EndToEnd() {
+			t.Fatalf("%s: plain payload decryption mismatch: have %v.", mode, err)
+		}
+	}
+	if _, err := LookupSecurity("none"); err == nil {
+		t.Fatalf("unknown security mode accepted.")
+	}
+}
+
 func BenchmarkEncrypt1Byte(b *testing.B) {
 	benchmarkEncrypt(b, 1)
 }
@@ -26,6 +26,10 @@
 //    caught by the relaying node, and a subscription to it is made, after which
 //    this middle node initiates a brand new subscription. If it is delivered,
 //    hopefully the topic root was reached and subscription cascading stops.
+//    Relays farther from the topic than the subscriber don't catch it, as the
+//    subscriber would refuse them as parents anyway. Since the topic roots are
+//    regularly resubscribing, this lets separate trees of the same topic (e.g.
+//    after a healed network partition) find and merge into each other.
 //
 //  - Subscription removal:
 //    If all children nodes removed their subscription, and no local clients are
@@ -65,6 +69,7 @@ import (
 	"log"
 	"math/big"
 
+	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/pastry"
 	"github.com/project-iris/iris/proto/scribe/topic"
@@ -145,6 +150,12 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 		if head.Sender.Cmp(o.pastry.Self()) == 0 {
 			return true
 		}
+		// Only nodes closer to the topic than the sender may become its parent. This
+		// also passes root rediscoveries through the root's own subtree, allowing
+		// them to reach (and merge with) other trees of the same topic.
+		if pastry.Distance(o.pastry.Self(), key).Cmp(pastry.Distance(head.Sender, key)) > 0 {
+			return true
+		}
 		// Integrate the subscription locally
 		if err := o.handleSubscribe(head.Sender, key); err != nil {
 			// A failure most probably means double subscription caused by a race
@@ -161,6 +172,10 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	if head.Op == opPublish && head.Prev == nil {
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding publish: %v %v.", hand, err)
+			if hand {
+				// Partially handled (payload maybe shared by copies), don't forward
+				return false
+			}
 		} else {
 			return !hand
 		}
@@ -169,6 +184,10 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	if head.Op == opBalance && head.Prev == nil {
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding balance: %v %v.", hand, err)
+			if hand {
+				// Partially handled (payload maybe shared by copies), don't forward
+				return false
+			}
 		} else {
 			return !hand
 		}
@@ -282,7 +301,7 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 		// Assemble a fresh copy for decryption
 		plain := &proto.Message{
 			Head: msg.Head,
-			Data: make([]byte, len(msg.Data)),
+			Data: pool.GetBuffer(len(msg.Data)),
 		}
 		plain.Head.Meta = msg.Head.Meta.(*header).Meta
 		copy(plain.Data, msg.Data)
@@ -55,7 +55,7 @@ func (o *Overlay) ping(topic *big.Int, node *big.Int) error {
 // Implements the heart.Callback.Beat method. At each heartbeat, the load stats
 // of all the topics are gathered, mapped to destination nodes and sent out. In
 // addition, each root topic sends a subscription message to discover newly
-// added roots.
+// added roots, which also merges the trees split by a healed network partition.
 func (o *Overlay) Beat() {
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -27,11 +27,14 @@ import (
 	"math/big"
 	"sync"
 
+	"github.com/project-iris/iris/clock"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/heart"
+	"github.com/project-iris/iris/identity"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/pastry"
 	"github.com/project-iris/iris/proto/scribe/topic"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // Custom topic error messages
@@ -71,10 +74,61 @@ func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
 	return o
 }
 
+// Replaces the network transport of the underlying pastry overlay. It must be
+// called before booting.
+func (o *Overlay) SetTransport(trans transport.Transport) {
+	o.pastry.SetTransport(trans)
+}
+
+// Replaces the time source of the heartbeats, both of the scribe and pastry
+// layers. It must be called before booting.
+func (o *Overlay) SetClock(clk clock.Clock) {
+	o.pastry.SetClock(clk)
+	o.heart.SetClock(clk)
+}
+
+// Sets the explicit listener addresses and seed peers of the underlying pastry
+// overlay. It must be called before booting.
+func (o *Overlay) SetEndpoints(binds []string, seeds []string) {
+	o.pastry.SetEndpoints(binds, seeds)
+}
+
+// Sets the fixed node identity of the underlying pastry overlay. It must be
+// called before booting.
+func (o *Overlay) SetIdentity(ident *identity.Identity) {
+	o.pastry.SetIdentity(ident)
+}
+
+// Sets the authority issued certificate of the underlying pastry overlay. It
+// must be called before booting.
+func (o *Overlay) SetCertificate(cert *identity.Certificate, authority *identity.Authority) {
+	o.pastry.SetCertificate(cert, authority)
+}
+
+// Adds an extra key to verify remote nodes with in the pastry overlay. It must
+// be called before booting.
+func (o *Overlay) Trust(key *rsa.PublicKey) {
+	o.pastry.Trust(key)
+}
+
+// Applies a revocation list of the cluster authority to the pastry overlay.
+func (o *Overlay) Revoke(list *identity.Revocation) error {
+	return o.pastry.Revoke(list)
+}
+
+// Sets the path of the peer cache file of the underlying pastry overlay. It must
+// be called before booting.
+func (o *Overlay) SetCache(path string) {
+	o.pastry.SetCache(path)
+}
+
+// Returns the fault injection handle of the underlying pastry overlay.
+func (o *Overlay) Chaos() *pastry.Chaos {
+	return o.pastry.Chaos()
+}
+
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
-	log.Printf("scribe: booting with id %v.", o.pastry.Self())
-
 	// Start the heartbeat first since convergence can last long
 	o.heart.Start()
 
@@ -83,6 +137,7 @@ func (o *Overlay) Boot() (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	log.Printf("scribe: booted with id %v.", o.pastry.Self())
 	return peers, nil
 }
 
@@ -20,13 +20,16 @@ package scribe
 
 import (
 	"crypto/x509"
+	"fmt"
 	"math/big"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/project-iris/iris/clock"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 type collector struct {
@@ -355,3 +358,78 @@ func TestDirect(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+// Tests whether the topic tree recovers from a member's sessions being killed.
+func TestPublishChurn(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+	pubs := 10
+
+	// Start up a handful of scribe nodes on an in-process network
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	network := transport.NewNetwork(clock.System, 1)
+
+	colls := make([]*collector, nodes)
+	live := make([]*Overlay, 0, nodes)
+	seeds := []string{}
+	for i := 0; i < nodes; i++ {
+		host := fmt.Sprintf("10.0.0.%d", i+1)
+
+		colls[i] = &collector{publish: []*proto.Message{}}
+		node := New(overId, key, colls[i])
+		node.SetTransport(network.Host(host))
+		node.SetEndpoints([]string{host + ":4000"}, seeds)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+
+		live = append(live, node)
+		seeds = append(seeds, host+":4000")
+	}
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publishes a batch of messages and counts the arrivals on each node
+	publish := func() []int {
+		for i := 0; i < pubs; i++ {
+			if err := live[0].Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			}
+		}
+		time.Sleep(time.Second)
+
+		counts := make([]int, nodes)
+		for i, coll := range colls {
+			coll.lock.Lock()
+			counts[i] = len(coll.publish)
+			coll.publish = coll.publish[:0]
+			coll.lock.Unlock()
+		}
+		return counts
+	}
+	for i, n := range publish() {
+		if n != pubs {
+			t.Fatalf("node #%d: arrive event mismatch: have %v, want %v.", i, n, pubs)
+		}
+	}
+	// Kill all sessions of the last node, wait for the death reports and reown
+	if killed := live[nodes-1].Chaos().KillAll(); killed == 0 {
+		t.Fatalf("no sessions killed.")
+	}
+	time.Sleep(time.Duration(config.ScribeKillCount+2) * config.ScribeBeatPeriod)
+
+	// Ensure the remaining members still receive every publish
+	for i, n := range publish()[:nodes-1] {
+		if n != pubs {
+			t.Fatalf("node #%d: arrive event mismatch after churn: have %v, want %v.", i, n, pubs)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"math/big"
 
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/wire"
 )
 
 // Scribe operation code type.
@@ -60,9 +61,67 @@ func (h *header) copy() *header {
 	return cpy
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and wire.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wireHeader, func() wire.Meta { return new(header) })
+}
+
+// Wire tag of the scribe header.
+const wireHeader = 24
+
+// Serializes the scribe header into the binary wire format.
+func (h *header) MarshalWire(enc *wire.Encoder) {
+	enc.PutMeta(h.Meta)
+	enc.PutUint(uint64(h.Op))
+	enc.PutBigInt(h.Sender)
+	enc.PutBigInt(h.Topic)
+	enc.PutBigInt(h.Prev)
+
+	enc.PutBool(h.Report != nil)
+	if h.Report != nil {
+		if h.Report.Tops == nil {
+			enc.PutUint(0)
+		} else {
+			enc.PutUint(uint64(len(h.Report.Tops)) + 1)
+			for _, top := range h.Report.Tops {
+				enc.PutBigInt(top)
+			}
+		}
+		if h.Report.Caps == nil {
+			enc.PutUint(0)
+		} else {
+			enc.PutUint(uint64(len(h.Report.Caps)) + 1)
+			for _, cap := range h.Report.Caps {
+				enc.PutInt(int64(cap))
+			}
+		}
+	}
+}
+
+// Deserializes the scribe header from the binary wire format.
+func (h *header) UnmarshalWire(dec *wire.Decoder) {
+	h.Meta = dec.Meta()
+	h.Op = opcode(dec.Uint())
+	h.Sender = dec.BigInt()
+	h.Topic = dec.BigInt()
+	h.Prev = dec.BigInt()
+
+	if dec.Bool() {
+		h.Report = new(report)
+		if count := dec.Count(); count >= 0 {
+			h.Report.Tops = make([]*big.Int, count)
+			for i := range h.Report.Tops {
+				h.Report.Tops[i] = dec.BigInt()
+			}
+		}
+		if count := dec.Count(); count >= 0 {
+			h.Report.Caps = make([]int, count)
+			for i := range h.Report.Caps {
+				h.Report.Caps[i] = int(dec.Int())
+			}
+		}
+	}
 }
 
 // Envelopes a scribe header into the generic packet container and sends it to
@@ -0,0 +1,76 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package proto
+
+import (
+	"fmt"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Security model of the message payloads, trading CPU for the threat model.
+type Security uint8
+
+const (
+	SecurityEndToEnd Security = iota // Payloads encrypted by the sender, links protecting the headers only
+	SecurityLink                     // Payloads encrypted by every link hop, not end-to-end
+	SecurityBoth                     // Payloads encrypted end-to-end and by every link hop
+)
+
+// Configuration names of the security models.
+var securityNames = map[Security]string{
+	SecurityEndToEnd: "e2e",
+	SecurityLink:     "link",
+	SecurityBoth:     "both",
+}
+
+// Looks up a security model by its configuration name.
+func LookupSecurity(name string) (Security, error) {
+	for mode, known := range securityNames {
+		if name == known {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown security mode: %s", name)
+}
+
+// Returns the configured security model, falling back to end-to-end encryption
+// if the configuration is invalid.
+func ActiveSecurity() Security {
+	mode, err := LookupSecurity(config.SecurityMode)
+	if err != nil {
+		return SecurityEndToEnd
+	}
+	return mode
+}
+
+// Returns the configuration name of the security model.
+func (s Security) String() string {
+	return securityNames[s]
+}
+
+// Whether payloads are encrypted end-to-end by their sender.
+func (s Security) EndToEnd() bool {
+	return s == SecurityEndToEnd || s == SecurityBoth
+}
+
+// Whether payloads are encrypted by the links on every hop.
+func (s Security) Hop() bool {
+	return s == SecurityLink || s == SecurityBoth
+}
@@ -33,10 +33,38 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/crypto/sts"
+	"github.com/project-iris/iris/identity"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/transport"
+	"github.com/project-iris/iris/proto/wire"
 )
 
+// Credentials authenticating the local end of sessions and verifying the remote
+// ends against the cluster certificate authority.
+type Credentials struct {
+	Key       *rsa.PrivateKey       // Private key of the local node
+	Cert      *identity.Certificate // Authority signed certificate of the local key
+	Authority *identity.Authority   // Certificate authority to verify remote nodes with
+}
+
+// Creates credentials for the shared cluster key mode, where every node holds
+// the cluster key and certifies its own identity with it. Any additional keys
+// are trusted too for verifying remote nodes, allowing the cluster key to be
+// rotated without an outage.
+func Certify(cluster *rsa.PrivateKey, ident *identity.Identity, trusted ...*rsa.PublicKey) (*Credentials, error) {
+	cert, err := identity.Issue(cluster, &ident.Key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		Key:       ident.Key,
+		Cert:      cert,
+		Authority: identity.NewAuthority(append([]*rsa.PublicKey{&cluster.PublicKey}, trusted...)...),
+	}, nil
+}
+
 // Session handshake request multiplexer to choose between the authenticated
 // control channel handshake or the secondary data channel handshake.
 type initRequest struct {
@@ -44,24 +72,52 @@ type initRequest struct {
 	Link *linkRequest
 }
 
-// Authenticated connection request message. Contains the originators ID for
-// key lookup and the client exponential.
+// Authenticated connection request message. Contains the suites supported by
+// the client, each with its own exponential, the accepted wire versions, the
+// accepted payload compression codecs and the payload security model in use.
 type authRequest struct {
-	Exp *big.Int
+	Offers   []*authOffer
+	Wires    []wire.Version
+	Codecs   []string
+	Security string
 }
 
-// Authentication challenge message. Contains the server exponential and the
-// server side auth token (both verification and challenge at the same time).
-type authChallenge struct {
+// Suite offered by the client, along with the exponential to use if chosen.
+type authOffer struct {
+	Suite string
 	Exp   *big.Int
-	Token []byte
 }
 
-// Authentication challenge response message. Contains the client side token.
+// Authentication challenge message. Contains the chosen suite and wire version,
+// the compression codecs accepted by both sides, the payload security model,
+// the server exponential, the server certificate and the server side auth token
+// (both verification and challenge at the same time).
+type authChallenge struct {
+	Suite    string
+	Wire     wire.Version
+	Codecs   []string
+	Security string
+	Exp      *big.Int
+	Cert     *identity.Certificate
+	Token    []byte
+}
+
+// Authentication challenge response message. Contains the client certificate
+// and the client side token.
 type authResponse struct {
+	Cert  *identity.Certificate
 	Token []byte
 }
 
+// Session parameters agreed on by a successful authentication handshake.
+type negotiated struct {
+	suite   *Suite                // Cryptographic suite securing the session
+	version wire.Version          // Header encoding used on the links
+	codecs  []compress.Codec      // Payload compressions accepted by both sides
+	secret  []byte                // Master secret agreed through the key exchange
+	peer    *identity.Certificate // Verified certificate of the remote node
+}
+
 // Data channel linking request message. Used both to init, reply and verify.
 type linkRequest struct {
 	Id int64
@@ -70,6 +126,20 @@ type linkRequest struct {
 // Make sure the link request packet is registered with gob.
 func init() {
 	gob.Register(&linkRequest{})
+	wire.Register(wireLinkRequest, func() wire.Meta { return new(linkRequest) })
+}
+
+// Wire tag of the data channel linking request.
+const wireLinkRequest = 8
+
+// Serializes the link request into the binary wire format.
+func (r *linkRequest) MarshalWire(enc *wire.Encoder) {
+	enc.PutInt(r.Id)
+}
+
+// Deserializes the link request from the binary wire format.
+func (r *linkRequest) UnmarshalWire(dec *wire.Decoder) {
+	r.Id = dec.Int()
 }
 
 // Session listener to accept inbound authenticated sessions.
@@ -80,26 +150,50 @@ type Listener struct {
 	pendLock sync.RWMutex                  // Lock to protect the pending map
 	pendWait sync.WaitGroup                // Counter to prevent closing the session sink prematurely
 
-	socket *stream.Listener // Stream listener socket to accept connections on
-	key    *rsa.PrivateKey  // Private RSA key to authenticate with
-	quit   chan chan error  // Termination synchronization channel
+	socket   *stream.Listener // Stream listener socket to accept connections on
+	creds    *Credentials     // Credentials to authenticate with
+	suites   []*Suite         // Cryptographic suites accepted, strongest first
+	wires    []wire.Version   // Wire versions accepted, newest first
+	codecs   []compress.Codec // Compression codecs accepted, preferred first
+	security proto.Security   // Payload security model required from clients
+	quit     chan chan error  // Termination synchronization channel
 }
 
 // Starts a TCP listener to accept incoming sessions, returning the socket ready
 // to accept. If an auto-port (0) is requested, the port is updated in the arg.
-func Listen(addr *net.TCPAddr, key *rsa.PrivateKey) (*Listener, error) {
+func Listen(addr *net.TCPAddr, creds *Credentials) (*Listener, error) {
+	sock, err := ListenTransport(transport.TCP, addr.String(), creds)
+	if err != nil {
+		return nil, err
+	}
+	addr.Port = sock.Addr().(*net.TCPAddr).Port
+	return sock, nil
+}
+
+// Starts a listener on an arbitrary transport to accept incoming sessions. The
+// assigned address can be retrieved from the returned listener.
+func ListenTransport(trans transport.Transport, addr string, creds *Credentials) (*Listener, error) {
+	// Resolve the suites to accept
+	suites, err := enabledSuites()
+	if err != nil {
+		return nil, err
+	}
 	// Open the stream listener socket
-	sock, err := stream.Listen(addr)
+	sock, err := stream.ListenTransport(trans, addr)
 	if err != nil {
 		return nil, err
 	}
 	// Assemble and return the session listener
 	return &Listener{
-		Sink:   make(chan *Session),
-		pends:  make(map[int64]chan *stream.Stream),
-		socket: sock,
-		key:    key,
-		quit:   make(chan chan error),
+		Sink:     make(chan *Session),
+		pends:    make(map[int64]chan *stream.Stream),
+		socket:   sock,
+		creds:    creds,
+		suites:   suites,
+		wires:    wire.Enabled(),
+		codecs:   compress.Enabled(),
+		security: proto.ActiveSecurity(),
+		quit:     make(chan chan error),
 	}, nil
 }
 
@@ -110,6 +204,11 @@ func (l *Listener) Accept(timeout time.Duration) {
 	go l.accepter(timeout)
 }
 
+// Returns the network address the listener is accepting sessions on.
+func (l *Listener) Addr() net.Addr {
+	return l.socket.Addr()
+}
+
 // Terminates the acceptor and returns any encountered errors.
 func (l *Listener) Close() error {
 	errc := make(chan error)
@@ -174,7 +273,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	switch {
 	case req.Auth != nil:
 		// Authenticate and clean up if unsuccessful
-		secret, err := l.serverAuth(strm, req.Auth)
+		neg, err := l.serverAuth(strm, req.Auth)
 		if err != nil {
 			log.Printf("session: failed to authenticate remote stream: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -183,7 +282,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 			return
 		}
 		// Create the session and link a data channel to it
-		sess := newSession(strm, secret, true)
+		sess := newSession(strm, neg, true)
 		if err = l.serverLink(sess); err != nil {
 			log.Printf("session: failed to retrieve data link: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -217,29 +316,40 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 					log.Printf("session: failed to close established data stream: %v.", err)
 				}
 			}
+		} else {
+			// Session timed out or unknown, drop the stream so the client doesn't hang
+			if err := strm.Close(); err != nil {
+				log.Printf("session: failed to close orphaned data stream: %v.", err)
+			}
 		}
 	}
 }
 
 // Connects to a remote node and negotiates a session.
-func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
+func Dial(host string, port int, creds *Credentials) (*Session, error) {
+	return DialTransport(transport.TCP, net.JoinHostPort(host, fmt.Sprintf("%d", port)), creds)
+}
+
+// Connects to a remote node through an arbitrary transport and negotiates a
+// session. Both the control and data links are dialed on the same transport.
+func DialTransport(trans transport.Transport, addr string, creds *Credentials) (*Session, error) {
 	// Open the stream connection
-	addr := fmt.Sprintf("%s:%d", host, port)
-	strm, err := stream.Dial(addr, config.SessionDialTimeout)
+	strm, err := stream.DialTransport(trans, addr, config.SessionDialTimeout)
 	if err != nil {
 		return nil, err
 	}
 	// Set up the authenticated session
-	secret, err := clientAuth(strm, key)
+	neg, err := clientAuth(strm, creds)
 	if err != nil {
 		log.Printf("session: failed to authenticate connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unauthenticated connection: %v.", err)
 		}
+		return nil, err
 	}
 	// Link a new data connection to it
-	sess := newSession(strm, secret, false)
-	if err = clientLink(sess); err != nil {
+	sess := newSession(strm, neg, false)
+	if err = clientLink(sess, trans); err != nil {
 		log.Printf("session: failed to link data connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unlinked connection: %v.", err)
@@ -249,24 +359,38 @@ func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
 	return sess, nil
 }
 
-// Client side of the STS session negotiation.
-func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
+// Client side of the STS session negotiation, returning the agreed parameters:
+// the suite, wire version and compression codecs in use, the agreed secret and
+// the verified certificate of the server.
+func clientAuth(strm *stream.Stream, creds *Credentials) (*negotiated, error) {
 	// Set an overall time limit for the handshake to complete
 	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
 
-	// Create a new empty session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	// Create a new empty session for each enabled suite
+	suites, err := enabledSuites()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new session: %v", err)
+		return nil, err
 	}
-	// Initiate a key exchange, send the exponential
-	exp, err := stsSess.Initiate()
-	if err != nil {
-		return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+	names := make([]string, len(suites))
+	exchanges := make([]*sts.Session, len(suites))
+	offers := make([]*authOffer, len(suites))
+	for i, suite := range suites {
+		if exchanges[i], err = suite.exchange(); err != nil {
+			return nil, fmt.Errorf("failed to create new session: %v", err)
+		}
+		// Initiate a key exchange, offering the suite with the exponential
+		exp, err := exchanges[i].Initiate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+		}
+		names[i], offers[i] = suite.Name, &authOffer{suite.Name, exp}
 	}
+	versions := wire.Enabled()
+	codecs := compress.Enabled()
+	security := proto.ActiveSecurity().String()
 	req := &initRequest{
-		Auth: &authRequest{exp},
+		Auth: &authRequest{offers, versions, compress.Names(codecs), security},
 	}
 	if err = strm.Send(req); err != nil {
 		return nil, fmt.Errorf("failed to send auth request: %v", err)
@@ -279,34 +403,117 @@ func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
 	if err = strm.Recv(chall); err != nil {
 		return nil, fmt.Errorf("failed to receive auth challenge: %v", err)
 	}
-	token, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token)
+	// Ensure the chosen suite was offered and bind the negotiation into the exchange
+	var suite *Suite
+	var stsSess *sts.Session
+	for i, name := range names {
+		if name == chall.Suite {
+			suite, stsSess = suites[i], exchanges[i]
+		}
+	}
+	if suite == nil {
+		return nil, fmt.Errorf("acceptor chose unoffered suite: %s", chall.Suite)
+	}
+	offered := false
+	for _, v := range versions {
+		offered = offered || v == chall.Wire
+	}
+	if !offered {
+		return nil, fmt.Errorf("acceptor chose unoffered wire version: %d", chall.Wire)
+	}
+	common := compress.Negotiate(codecs, chall.Codecs)
+	if len(common) != len(chall.Codecs) {
+		return nil, fmt.Errorf("acceptor chose unoffered codecs: %v", chall.Codecs)
+	}
+	if chall.Security != security {
+		return nil, fmt.Errorf("security mode mismatch: have %s, want %s", chall.Security, security)
+	}
+	stsSess.SetTranscript(transcript(names, suite.Name, versions, chall.Wire, req.Auth.Codecs, chall.Codecs, security))
+
+	key, err := creds.Authority.Verify(chall.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify acceptor certificate: %v", err)
+	}
+	token, err := stsSess.Verify(rand.Reader, creds.Key, key, chall.Exp, chall.Token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
 	}
-	if err = strm.Send(authResponse{token}); err != nil {
+	if err = strm.Send(authResponse{creds.Cert, token}); err != nil {
 		return nil, fmt.Errorf("failed to send auth response: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
 		return nil, fmt.Errorf("failed to flush auth response: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	if err != nil {
+		return nil, err
+	}
+	return &negotiated{
+		suite:   suite,
+		version: chall.Wire,
+		codecs:  common,
+		secret:  secret,
+		peer:    chall.Cert,
+	}, nil
 }
 
-// Executes the server side authentication and returns either the agreed secret
-// session key or the a failure reason.
-func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, error) {
+// Executes the server side authentication and returns either the agreed session
+// parameters (suite, wire version and compression codecs in use, secret session
+// key and verified client certificate) or the failure reason.
+func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) (*negotiated, error) {
+	// Pick the strongest common suite, binding the negotiation into the exchange
+	names := make([]string, 0, len(req.Offers))
+	for _, offer := range req.Offers {
+		if offer == nil {
+			return nil, errors.New("invalid suite offer")
+		}
+		names = append(names, offer.Suite)
+	}
+	suite, err := negotiate(l.suites, names)
+	if err != nil {
+		return nil, err
+	}
+	// Clients predating the binary codec don't advertise versions, speak gob
+	versions := req.Wires
+	if len(versions) == 0 {
+		versions = []wire.Version{wire.VersionGob}
+	}
+	version, err := wire.Negotiate(l.wires, versions)
+	if err != nil {
+		return nil, err
+	}
+	// Accept the compression codecs supported by both sides (none for old clients)
+	codecs := compress.Negotiate(l.codecs, req.Codecs)
+	chosen := compress.Names(codecs)
+
+	// Ensure the payload security models match (old clients encrypt end-to-end)
+	security := req.Security
+	if security == "" {
+		security = proto.SecurityEndToEnd.String()
+	}
+	if security != l.security.String() {
+		return nil, fmt.Errorf("security mode mismatch: have %s, want %s", security, l.security)
+	}
+
+	var offer *authOffer
+	for _, offer = range req.Offers {
+		if offer.Suite == suite.Name {
+			break
+		}
+	}
 	// Create a new STS session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator,
-		config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	stsSess, err := suite.exchange()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create STS session: %v", err)
 	}
+	stsSess.SetTranscript(transcript(names, suite.Name, req.Wires, version, req.Codecs, chosen, req.Security))
+
 	// Accept the incoming key exchange request and send back own exp + auth token
-	exp, token, err := stsSess.Accept(rand.Reader, l.key, req.Exp)
+	exp, token, err := stsSess.Accept(rand.Reader, l.creds.Key, offer.Exp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
 	}
-	if err = strm.Send(authChallenge{exp, token}); err != nil {
+	if err = strm.Send(authChallenge{suite.Name, version, chosen, l.security.String(), exp, l.creds.Cert, token}); err != nil {
 		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
@@ -317,10 +524,24 @@ func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, er
 	if err = strm.Recv(resp); err != nil {
 		return nil, fmt.Errorf("failed to decode auth response: %v", err)
 	}
-	if err = stsSess.Finalize(&l.key.PublicKey, resp.Token); err != nil {
+	key, err := l.creds.Authority.Verify(resp.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify initiator certificate: %v", err)
+	}
+	if err = stsSess.Finalize(key, resp.Token); err != nil {
 		return nil, fmt.Errorf("failed to finalize exchange: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	if err != nil {
+		return nil, err
+	}
+	return &negotiated{
+		suite:   suite,
+		version: version,
+		codecs:  codecs,
+		secret:  secret,
+		peer:    resp.Cert,
+	}, nil
 }
 
 // Initializes a data channel linking process, waiting for the data stream to be
@@ -377,7 +598,7 @@ func (l *Listener) serverLink(sess *Session) error {
 }
 
 // Initiates a data channel link to the specified control channel.
-func clientLink(sess *Session) error {
+func clientLink(sess *Session, trans transport.Transport) error {
 	// Wait for the server to specify the session id
 	msg, err := sess.CtrlLink.RecvDirect()
 	if err != nil {
@@ -385,7 +606,7 @@ func clientLink(sess *Session) error {
 	}
 	// Initiate a new stream connection to the server
 	addr := sess.CtrlLink.Sock().RemoteAddr().String()
-	strm, err := stream.Dial(addr, config.SessionDialTimeout)
+	strm, err := stream.DialTransport(trans, addr, config.SessionDialTimeout)
 	if err != nil {
 		return fmt.Errorf("failed to establish data link: %v", err)
 	}
@@ -402,6 +623,9 @@ func clientLink(sess *Session) error {
 		return fmt.Errorf("failed to flush link request: %v", err)
 	}
 	// Finalize the session with the data stream
+	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+	defer strm.Sock().SetDeadline(time.Time{})
+
 	sess.init(strm, false)
 
 	// Send the data link authentication
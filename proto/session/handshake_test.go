@@ -19,22 +19,44 @@
 package session
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"math/big"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
+	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
 )
 
+// Creates a random certificate authority and a node certified by it.
+func newCredentials(bits int) *Credentials {
+	ca, _ := rsa.GenerateKey(rand.Reader, bits)
+	return newNodeCredentials(ca, bits)
+}
+
+// Creates a random node certified by an existing authority.
+func newNodeCredentials(ca *rsa.PrivateKey, bits int) *Credentials {
+	key, _ := rsa.GenerateKey(rand.Reader, bits)
+	creds, _ := Certify(ca, &identity.Identity{Key: key, Id: identity.Derive(&key.PublicKey)})
+	return creds
+}
+
 // Tests whether the session handshake works.
 func TestHandshake(t *testing.T) {
 	t.Parallel()
 
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	creds := newCredentials(2048)
 
 	// Start the server
-	sock, err := Listen(addr, key)
+	sock, err := Listen(addr, creds)
 	if err != nil {
 		t.Fatalf("failed to start the session listener: %v.", err)
 	}
@@ -42,7 +64,7 @@ func TestHandshake(t *testing.T) {
 
 	// Connect with a few clients, verifying the crypto primitives
 	for i := 0; i < 3; i++ {
-		client, err := Dial("localhost", addr.Port, key)
+		client, err := Dial("localhost", addr.Port, creds)
 		if err != nil {
 			t.Fatalf("failed to connect to the server: %v.", err)
 		}
@@ -67,12 +89,109 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// Tests that only nodes certified by the authority can connect, and that single
+// nodes can be evicted through revocation lists.
+func TestHandshakeAuthority(t *testing.T) {
+	t.Parallel()
+
+	ca, _ := rsa.GenerateKey(rand.Reader, 1024)
+	server := newNodeCredentials(ca, 1024)
+
+	// Start the server
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, server)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Ensure a certified client can connect and the identities are exchanged
+	client := newNodeCredentials(ca, 1024)
+	ses, err := Dial("localhost", addr.Port, client)
+	if err != nil {
+		t.Fatalf("failed to connect certified client: %v.", err)
+	}
+	if id := ses.Peer().Id; id.Cmp(server.Cert.Id) != 0 {
+		t.Fatalf("server id mismatch: have %v, want %v.", id, server.Cert.Id)
+	}
+	select {
+	case remote := <-sock.Sink:
+		if id := remote.Peer().Id; id.Cmp(client.Cert.Id) != 0 {
+			t.Fatalf("client id mismatch: have %v, want %v.", id, client.Cert.Id)
+		}
+		remote.Close()
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("server-side handshake timed out.")
+	}
+	ses.Close()
+
+	// Ensure clients of foreign authorities are rejected
+	if ses, err := Dial("localhost", addr.Port, newCredentials(1024)); err == nil {
+		ses.Close()
+		t.Fatalf("foreign client connected.")
+	}
+	// Revoke the client and ensure it's rejected
+	list, err := identity.Revoke(ca, 1, []*big.Int{client.Cert.Id})
+	if err != nil {
+		t.Fatalf("failed to issue revocation list: %v.", err)
+	}
+	if err := server.Authority.Apply(list); err != nil {
+		t.Fatalf("failed to apply revocation list: %v.", err)
+	}
+	if ses, err := Dial("localhost", addr.Port, client); err == nil {
+		ses.Close()
+		t.Fatalf("revoked client connected.")
+	}
+}
+
+// Tests that the cluster key can be rotated by trusting multiple keys.
+func TestHandshakeRotation(t *testing.T) {
+	t.Parallel()
+
+	old, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	// Start a server still signing with the old key, but trusting the new too
+	ident, _ := identity.New()
+	server, _ := Certify(old, ident, &rotated.PublicKey)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, server)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	go func() {
+		for ses := range sock.Sink {
+			ses.Close()
+		}
+	}()
+	// Ensure rotated clients trusting the old key too can connect
+	ident, _ = identity.New()
+	client, _ := Certify(rotated, ident, &old.PublicKey)
+	ses, err := Dial("localhost", addr.Port, client)
+	if err != nil {
+		t.Fatalf("failed to connect rotated client: %v.", err)
+	}
+	ses.Close()
+
+	// Ensure clients not trusting the old key anymore reject the server
+	client, _ = Certify(rotated, ident)
+	if ses, err := Dial("localhost", addr.Port, client); err == nil {
+		ses.Close()
+		t.Fatalf("untrusted server accepted.")
+	}
+}
+
 // Benchmarks the session setup performance.
 func BenchmarkHandshake(b *testing.B) {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	creds := newCredentials(2048)
 
-	sock, err := Listen(addr, key)
+	sock, err := Listen(addr, creds)
 	if err != nil {
 		b.Fatalf("failed to start the session listener: %v.", err)
 	}
@@ -87,7 +206,7 @@ func BenchmarkHandshake(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		// Start a dialer on a new thread
 		go func() {
-			sess, err := Dial("localhost", addr.Port, key)
+			sess, err := Dial("localhost", addr.Port, creds)
 			if err != nil {
 				b.Fatalf("failed to connect to the server: %v.", err)
 				close(sink)
@@ -122,3 +241,367 @@ func BenchmarkHandshake(b *testing.B) {
 		b.Fatalf("failed to terminate session listener: %v.", err)
 	}
 }
+
+// Tests that the strongest suite supported by both sides is negotiated.
+func TestHandshakeNegotiation(t *testing.T) {
+	defer func(suites []string) { config.SessionSuites = suites }(config.SessionSuites)
+
+	creds := newCredentials(1024)
+	tests := []struct {
+		server []string
+		client []string
+		suite  string // Empty if the negotiation should fail
+	}{
+		{[]string{"modern", "classic"}, []string{"modern", "classic"}, "modern"},
+		{[]string{"classic", "modern"}, []string{"modern"}, "modern"},
+		{[]string{"classic"}, []string{"modern", "classic"}, "classic"},
+		{[]string{"modern", "classic"}, []string{"classic"}, "classic"},
+		{[]string{"modern"}, []string{"classic"}, ""},
+	}
+	for i, tt := range tests {
+		// Start a server accepting only the requested suites
+		config.SessionSuites = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, creds)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		// Connect with a client offering its own suites
+		config.SessionSuites = tt.client
+
+		client, err := Dial("localhost", addr.Port, creds)
+		if tt.suite == "" {
+			if err == nil {
+				client.Close()
+				t.Fatalf("test %d: session established without common suite.", i)
+			}
+			sock.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		if name := client.Suite().Name; name != tt.suite {
+			t.Fatalf("test %d: client suite mismatch: have %v, want %v.", i, name, tt.suite)
+		}
+		select {
+		case server := <-sock.Sink:
+			if name := server.Suite().Name; name != tt.suite {
+				t.Fatalf("test %d: server suite mismatch: have %v, want %v.", i, name, tt.suite)
+			}
+			server.Close()
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: server-side handshake timed out.", i)
+		}
+		client.Close()
+		sock.Close()
+	}
+}
+
+// Tests that the wire encoding is negotiated during the handshake.
+func TestHandshakeWire(t *testing.T) {
+	defer func(versions []int) { config.WireVersions = versions }(config.WireVersions)
+
+	creds := newCredentials(1024)
+	tests := []struct {
+		server []int
+		client []int
+		wire   wire.Version
+		fail   bool
+	}{
+		{[]int{1, 0}, []int{1, 0}, wire.VersionBinary, false},
+		{[]int{1, 0}, []int{0}, wire.VersionGob, false},
+		{[]int{0, 1}, []int{1, 0}, wire.VersionGob, false},
+		{[]int{1}, []int{0}, 0, true},
+	}
+	for i, tt := range tests {
+		// Start a server accepting only the requested versions
+		config.WireVersions = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, creds)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		// Connect with a client offering its own versions
+		config.WireVersions = tt.client
+
+		client, err := Dial("localhost", addr.Port, creds)
+		if tt.fail {
+			if err == nil {
+				client.Close()
+				t.Fatalf("test %d: session established without common wire version.", i)
+			}
+			sock.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		if have := client.Wire(); have != tt.wire {
+			t.Fatalf("test %d: client wire mismatch: have %v, want %v.", i, have, tt.wire)
+		}
+		select {
+		case server := <-sock.Sink:
+			if have := server.Wire(); have != tt.wire {
+				t.Fatalf("test %d: server wire mismatch: have %v, want %v.", i, have, tt.wire)
+			}
+			// Make sure data flows with the chosen encoding
+			server.Start(1)
+			client.Start(1)
+
+			send := &proto.Message{Head: proto.Header{Meta: "hello"}, Data: []byte{}}
+			send.Encrypt()
+			client.CtrlLink.Send <- send
+			select {
+			case msg := <-server.CtrlLink.Recv:
+				if msg.Head.Meta != "hello" {
+					t.Fatalf("test %d: meta mismatch: have %v, want %v.", i, msg.Head.Meta, "hello")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("test %d: message delivery timed out.", i)
+			}
+			// Started sessions wait for the remote side to close too
+			errc := make(chan error, 2)
+			go func() { errc <- client.Close() }()
+			go func() { errc <- server.Close() }()
+			for j := 0; j < 2; j++ {
+				if err := <-errc; err != nil {
+					t.Fatalf("test %d: failed to close session: %v.", i, err)
+				}
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: server-side handshake timed out.", i)
+		}
+		sock.Close()
+	}
+}
+
+// Tests that the compression codecs accepted by both sides are negotiated, and
+// that payloads compressed otherwise are transcoded by the links.
+func TestHandshakeCodecs(t *testing.T) {
+	defer func(codecs []string) { config.CompressCodecs = codecs }(config.CompressCodecs)
+
+	creds := newCredentials(1024)
+	tests := []struct {
+		server []string
+		client []string
+		codec  compress.Codec
+	}{
+		{[]string{"deflate"}, []string{"deflate"}, compress.Deflate},
+		{[]string{"deflate"}, []string{}, compress.None},
+		{[]string{}, []string{"zstd", "deflate"}, compress.None},
+	}
+	data := bytes.Repeat([]byte("compressible "), 1024)
+	for i, tt := range tests {
+		// Start a server accepting only the requested codecs
+		config.CompressCodecs = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, creds)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		// Connect with a client offering its own codecs
+		config.CompressCodecs = tt.client
+
+		client, err := Dial("localhost", addr.Port, creds)
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		select {
+		case server := <-sock.Sink:
+			if have := len(client.Codecs()); have != len(server.Codecs()) || (tt.codec != compress.None) != (have > 0) {
+				t.Fatalf("test %d: codecs mismatch: client %v, server %v, want %v.", i, client.Codecs(), server.Codecs(), tt.codec)
+			}
+			server.Start(1)
+			client.Start(1)
+
+			// Send a compressed message and make sure it arrives decodable
+			config.CompressCodecs = []string{"deflate"}
+
+			send := &proto.Message{Head: proto.Header{Meta: "hello"}, Data: append([]byte{}, data...)}
+			send.Encrypt()
+			client.DataLink.Send <- send
+			select {
+			case msg := <-server.DataLink.Recv:
+				if msg.Head.Codec != tt.codec {
+					t.Fatalf("test %d: codec mismatch: have %v, want %v.", i, msg.Head.Codec, tt.codec)
+				}
+				if err := msg.Decrypt(); err != nil {
+					t.Fatalf("test %d: failed to decrypt message: %v.", i, err)
+				}
+				if !bytes.Equal(msg.Data, data) {
+					t.Fatalf("test %d: data mismatch: have %x, want %x.", i, msg.Data, data)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("test %d: message delivery timed out.", i)
+			}
+			// Started sessions wait for the remote side to close too
+			errc := make(chan error, 2)
+			go func() { errc <- client.Close() }()
+			go func() { errc <- server.Close() }()
+			for j := 0; j < 2; j++ {
+				if err := <-errc; err != nil {
+					t.Fatalf("test %d: failed to close session: %v.", i, err)
+				}
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: server-side handshake timed out.", i)
+		}
+		sock.Close()
+	}
+}
+
+// Tests that sessions are only established between nodes using the same payload
+// security model, and that payloads flow in all of them.
+func TestHandshakeSecurity(t *testing.T) {
+	defer func(mode string) { config.SecurityMode = mode }(config.SecurityMode)
+
+	creds := newCredentials(1024)
+	tests := []struct {
+		server string
+		client string
+		fail   bool
+	}{
+		{"e2e", "e2e", false},
+		{"link", "link", false},
+		{"both", "both", false},
+		{"e2e", "link", true},
+		{"both", "e2e", true},
+	}
+	for i, tt := range tests {
+		// Start a server with the requested security model
+		config.SecurityMode = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, creds)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		// Connect with a client using its own model
+		config.SecurityMode = tt.client
+
+		client, err := Dial("localhost", addr.Port, creds)
+		if tt.fail {
+			if err == nil {
+				client.Close()
+				t.Fatalf("test %d: session established with mismatching security modes.", i)
+			}
+			sock.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		select {
+		case server := <-sock.Sink:
+			server.Start(1)
+			client.Start(1)
+
+			send := &proto.Message{Head: proto.Header{Meta: "hello"}, Data: []byte("payload")}
+			if err := send.Encrypt(); err != nil {
+				t.Fatalf("test %d: failed to encrypt message: %v.", i, err)
+			}
+			client.DataLink.Send <- send
+			select {
+			case msg := <-server.DataLink.Recv:
+				if err := msg.Decrypt(); err != nil {
+					t.Fatalf("test %d: failed to decrypt message: %v.", i, err)
+				}
+				if string(msg.Data) != "payload" {
+					t.Fatalf("test %d: data mismatch: have %s, want %s.", i, msg.Data, "payload")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("test %d: message delivery timed out.", i)
+			}
+			// Started sessions wait for the remote side to close too
+			errc := make(chan error, 2)
+			go func() { errc <- client.Close() }()
+			go func() { errc <- server.Close() }()
+			for j := 0; j < 2; j++ {
+				if err := <-errc; err != nil {
+					t.Fatalf("test %d: failed to close session: %v.", i, err)
+				}
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: server-side handshake timed out.", i)
+		}
+		sock.Close()
+	}
+}
+
+// Tests that stripping the strongest suite from the offers is detected.
+func TestHandshakeDowngrade(t *testing.T) {
+	t.Parallel()
+
+	creds := newCredentials(1024)
+
+	// Start the server
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, creds)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Start a man-in-the-middle relaying the handshake sans the strongest offer
+	proxyAddr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	proxy, err := stream.Listen(proxyAddr)
+	if err != nil {
+		t.Fatalf("failed to start the proxy listener: %v.", err)
+	}
+	proxy.Accept(10 * time.Millisecond)
+	defer proxy.Close()
+
+	go func() {
+		client, ok := <-proxy.Sink
+		if !ok {
+			return
+		}
+		defer client.Close()
+
+		server, err := stream.Dial(addr.String(), time.Second)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+
+		req := new(initRequest)
+		if err := client.Recv(req); err != nil || req.Auth == nil || len(req.Auth.Offers) < 2 {
+			return
+		}
+		req.Auth.Offers = req.Auth.Offers[1:]
+		server.Send(req)
+		server.Flush()
+
+		chall := new(authChallenge)
+		if err := server.Recv(chall); err != nil {
+			return
+		}
+		client.Send(chall)
+		client.Flush()
+
+		resp := new(authResponse)
+		if err := client.Recv(resp); err != nil {
+			return
+		}
+		server.Send(resp)
+		server.Flush()
+	}()
+	// Ensure the client detects the tampering
+	if ses, err := Dial("localhost", proxyAddr.Port, creds); err == nil {
+		ses.Close()
+		t.Fatalf("downgraded session established.")
+	}
+}
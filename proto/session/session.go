@@ -21,18 +21,27 @@
 package session
 
 import (
-	"hash"
 	"io"
 
-	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/identity"
+	"github.com/project-iris/iris/proto/compress"
 	"github.com/project-iris/iris/proto/link"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
 )
 
+// Size of the session channel binding value (bytes).
+const bindSize = 32
+
 // Accomplishes secure and authenticated full duplex communication.
 type Session struct {
-	kdf io.Reader // Key derivation function to expand the master key
+	kdf     io.Reader             // Key derivation function to expand the master key
+	suite   *Suite                // Cryptographic suite securing the session
+	version wire.Version          // Header encoding used on the links
+	codecs  []compress.Codec      // Payload compressions accepted by the peer
+	bind    []byte                // Channel binding value unique to the session
+	peer    *identity.Certificate // Verified certificate of the remote node
 
 	CtrlLink *link.Link // Network connection for high priority control messages
 	DataLink *link.Link // Network connection for low priority data messages
@@ -40,21 +49,59 @@ type Session struct {
 
 // Creates a new, double link session for authenticated data transfer. The
 // initiator is used to decide the key derivation order for the channels.
-func newSession(conn *stream.Stream, secret []byte, server bool) *Session {
+func newSession(conn *stream.Stream, neg *negotiated, server bool) *Session {
 	// Create the key derivation function
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
+	kdf := neg.suite.derive(neg.secret, config.HkdfInfo)
 
+	// Derive the channel binding independently of the link keys
+	bind := make([]byte, bindSize)
+	if _, err := io.ReadFull(neg.suite.derive(neg.secret, config.HkdfBindInfo), bind); err != nil {
+		panic(err)
+	}
 	// Create the encrypted control link
-	return &Session{
-		kdf:      hkdf,
-		CtrlLink: link.New(conn, hkdf, server),
+	sess := &Session{
+		kdf:      kdf,
+		suite:    neg.suite,
+		version:  neg.version,
+		codecs:   neg.codecs,
+		bind:     bind,
+		peer:     neg.peer,
+		CtrlLink: link.New(conn, kdf, server, neg.suite.mode, neg.version),
 	}
+	sess.CtrlLink.SetCodecs(neg.codecs)
+	return sess
+}
+
+// Returns a value unique to the session and known only to its two endpoints,
+// suitable for binding higher level authentication proofs to it.
+func (s *Session) Binding() []byte {
+	return s.bind
+}
+
+// Returns the cryptographic suite negotiated for the session.
+func (s *Session) Suite() *Suite {
+	return s.suite
+}
+
+// Returns the header encoding negotiated for the session links.
+func (s *Session) Wire() wire.Version {
+	return s.version
+}
+
+// Returns the payload compression codecs accepted by both ends of the session.
+func (s *Session) Codecs() []compress.Codec {
+	return s.codecs
+}
+
+// Returns the authority verified certificate of the remote node.
+func (s *Session) Peer() *identity.Certificate {
+	return s.peer
 }
 
 // Finalizes a session by creating the secondary data link.
 func (s *Session) init(conn *stream.Stream, server bool) {
-	s.DataLink = link.New(conn, s.kdf, server)
+	s.DataLink = link.New(conn, s.kdf, server, s.suite.mode, s.version)
+	s.DataLink.SetCodecs(s.codecs)
 }
 
 // Starts the session data transfers on the control and data channels.
@@ -21,7 +21,6 @@ package session
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/rsa"
 	"io"
 	"net"
 	"sync"
@@ -29,22 +28,23 @@ import (
 	"time"
 
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 func TestForward(t *testing.T) {
 	t.Parallel()
 
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	creds := newCredentials(2048)
 
 	// Start the server and connect with a client
-	sock, err := Listen(addr, key)
+	sock, err := Listen(addr, creds)
 	if err != nil {
 		t.Fatalf("failed to start the session listener: %v.", err)
 	}
 	sock.Accept(100 * time.Millisecond)
 
-	client, err := Dial("localhost", addr.Port, key)
+	client, err := Dial("localhost", addr.Port, creds)
 	if err != nil {
 		t.Fatalf("failed to connect to the server: %v.", err)
 	}
@@ -131,6 +131,90 @@ func TestForward(t *testing.T) {
 	}
 }
 
+func TestTransports(t *testing.T) {
+	t.Parallel()
+
+	creds := newCredentials(1024)
+	tests := []struct {
+		name  string
+		trans transport.Transport
+		addr  string
+	}{
+		{"memory", transport.NewMemory(), "10.0.0.1:0"},
+		{"mux-memory", transport.NewMux(transport.NewMemory()), "10.0.0.1:0"},
+		{"mux-tcp", transport.NewMux(transport.TCP), "127.0.0.1:0"},
+	}
+	binds := [][]byte{}
+	for _, tt := range tests {
+		// Start the server and connect with a client
+		sock, err := ListenTransport(tt.trans, tt.addr, creds)
+		if err != nil {
+			t.Fatalf("%s: failed to start the session listener: %v.", tt.name, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		client, err := DialTransport(tt.trans, sock.Addr().String(), creds)
+		if err != nil {
+			t.Fatalf("%s: failed to connect to the server: %v.", tt.name, err)
+		}
+		server := <-sock.Sink
+
+		// Ensure both sides share a session unique channel binding
+		if !bytes.Equal(client.Binding(), server.Binding()) {
+			t.Fatalf("%s: channel binding mismatch: have %x, want %x.", tt.name, server.Binding(), client.Binding())
+		}
+		if len(client.Binding()) != bindSize {
+			t.Fatalf("%s: channel binding size mismatch: have %v, want %v.", tt.name, len(client.Binding()), bindSize)
+		}
+		for _, prev := range binds {
+			if bytes.Equal(prev, client.Binding()) {
+				t.Fatalf("%s: channel binding reused across sessions: %x.", tt.name, prev)
+			}
+		}
+		binds = append(binds, client.Binding())
+
+		client.Start(2)
+		server.Start(2)
+
+		// Send a message through both the control and data links
+		for i, pair := range [][2]*Session{{client, server}, {server, client}} {
+			msg := &proto.Message{Head: proto.Header{Meta: []byte("meta")}, Data: []byte{byte(i)}}
+			msg.Encrypt()
+
+			pair[0].CtrlLink.Send <- msg
+			pair[0].DataLink.Send <- msg
+			for _, recv := range []chan *proto.Message{pair[1].CtrlLink.Recv, pair[1].DataLink.Recv} {
+				select {
+				case have := <-recv:
+					if !bytes.Equal(have.Data, msg.Data) {
+						t.Fatalf("%s: send/receive mismatch: have %v, want %v.", tt.name, have.Data, msg.Data)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("%s: receive timed out.", tt.name)
+				}
+			}
+		}
+		// Close the client and server sessions (concurrently, as they depend on each other)
+		errc := make(chan error)
+		go func() { errc <- client.Close() }()
+		go func() { errc <- server.Close() }()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Fatalf("%s: failed to close a session: %v.", tt.name, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: session tear-down timeout.", tt.name)
+			}
+		}
+		if err := sock.Close(); err != nil {
+			t.Fatalf("%s: failed to terminate session listener: %v.", tt.name, err)
+		}
+	}
+}
+
 func BenchmarkLatency1Byte(b *testing.B) {
 	benchmarkLatency(b, 1)
 }
@@ -177,16 +261,16 @@ func BenchmarkLatency1MByte(b *testing.B) {
 
 func benchmarkLatency(b *testing.B, block int) {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	creds := newCredentials(2048)
 
 	// Start the server
-	sock, err := Listen(addr, key)
+	sock, err := Listen(addr, creds)
 	if err != nil {
 		b.Fatalf("failed to start the session listener: %v.", err)
 	}
 	sock.Accept(100 * time.Millisecond)
 
-	client, err := Dial("localhost", addr.Port, key)
+	client, err := Dial("localhost", addr.Port, creds)
 	if err != nil {
 		b.Fatalf("failed to connect to the server: %v.", err)
 	}
@@ -306,16 +390,16 @@ func BenchmarkThroughput1MByte(b *testing.B) {
 
 func benchmarkThroughput(b *testing.B, block int) {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	creds := newCredentials(2048)
 
 	// Start the server
-	sock, err := Listen(addr, key)
+	sock, err := Listen(addr, creds)
 	if err != nil {
 		b.Fatalf("failed to start the session listener: %v.", err)
 	}
 	sock.Accept(100 * time.Millisecond)
 
-	client, err := Dial("localhost", addr.Port, key)
+	client, err := Dial("localhost", addr.Port, creds)
 	if err != nil {
 		b.Fatalf("failed to connect to the server: %v.", err)
 	}
@@ -0,0 +1,178 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package session
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/sts"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
+)
+
+// Cryptographic suite securing a session: the STS key agreement and signature
+// scheme, the key derivation hash and the framing mode of the links.
+type Suite struct {
+	Name string // Cluster wide identifier of the suite
+
+	exchange func() (*sts.Session, error) // Creates a new STS key exchange
+	hash     func() crypto.Hash           // Hash type for the key derivation
+	mode     link.Mode                    // Framing mode of the encrypted links
+}
+
+// Original suite: finite field STS with RSA PKCS#1 v1.5 signatures, MD5 based
+// key derivation and AES-CTR links authenticated by HMAC-MD5.
+var Classic = &Suite{
+	Name: "classic",
+	exchange: func() (*sts.Session, error) {
+		return sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	},
+	hash: func() crypto.Hash { return config.HkdfHash },
+	mode: link.ModeCTR,
+}
+
+// Current suite: X25519 STS with RSA-PSS signatures, SHA-256 based key
+// derivation and AES-GCM authenticated links.
+var Modern = &Suite{
+	Name: "modern",
+	exchange: func() (*sts.Session, error) {
+		ses, err := sts.NewCurve(rand.Reader, config.ModernStsCurve, config.StsCipher, config.ModernCipherBits, config.ModernHash)
+		if err != nil {
+			return nil, err
+		}
+		ses.SetScheme(sts.PSS)
+		return ses, nil
+	},
+	hash: func() crypto.Hash { return config.ModernHash },
+	mode: link.ModeAEAD,
+}
+
+// Suites known to the session layer, strongest first.
+var suites = []*Suite{Modern, Classic}
+
+// Returned if the two sides of a negotiation have no suite in common.
+var ErrNoSuite = errors.New("no common session suite")
+
+// Retrieves a cryptographic suite by its name.
+func LookupSuite(name string) (*Suite, error) {
+	for _, suite := range suites {
+		if suite.Name == name {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown session suite: %s", name)
+}
+
+// Collects the locally enabled suites, strongest first.
+func enabledSuites() ([]*Suite, error) {
+	enabled := make(map[*Suite]bool)
+	for _, name := range config.SessionSuites {
+		suite, err := LookupSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		enabled[suite] = true
+	}
+	ordered := []*Suite{}
+	for _, suite := range suites {
+		if enabled[suite] {
+			ordered = append(ordered, suite)
+		}
+	}
+	if len(ordered) == 0 {
+		return nil, ErrNoSuite
+	}
+	return ordered, nil
+}
+
+// Picks the strongest locally enabled suite out of the ones offered by a remote
+// peer. Since the strength order is global, both sides reach the same choice.
+func Negotiate(offers []string) (*Suite, error) {
+	enabled, err := enabledSuites()
+	if err != nil {
+		return nil, err
+	}
+	return negotiate(enabled, offers)
+}
+
+// Picks the strongest suite out of the enabled ones that was also offered.
+func negotiate(enabled []*Suite, offers []string) (*Suite, error) {
+	for _, suite := range enabled {
+		for _, name := range offers {
+			if suite.Name == name {
+				return suite, nil
+			}
+		}
+	}
+	return nil, ErrNoSuite
+}
+
+// Serializes the offered suites, wire versions and compression codecs along with
+// the chosen ones and the payload security model for signing, binding the
+// negotiation into the handshake to prevent downgrades.
+func transcript(offers []string, chosen string, versions []wire.Version, version wire.Version, codecs []string, accepted []string, security string) []byte {
+	buf := new(bytes.Buffer)
+	for _, name := range offers {
+		buf.WriteString(name)
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0)
+	buf.WriteString(chosen)
+	buf.WriteByte(0)
+	for _, v := range versions {
+		buf.WriteByte(byte(v))
+	}
+	buf.WriteByte(0xff)
+	buf.WriteByte(byte(version))
+	for _, list := range [][]string{codecs, accepted} {
+		for _, name := range list {
+			buf.WriteString(name)
+			buf.WriteByte(0)
+		}
+		buf.WriteByte(0)
+	}
+	buf.WriteString(security)
+	return buf.Bytes()
+}
+
+// Returns the name of the suite, for logging.
+func (s *Suite) String() string {
+	return s.Name
+}
+
+// Creates a key derivation function expanding the secret for a given purpose.
+func (s *Suite) derive(secret []byte, info []byte) io.Reader {
+	hasher := func() hash.Hash { return s.hash().New() }
+	return hkdf.New(hasher, secret, config.HkdfSalt, info)
+}
+
+// Creates a standalone encrypted link from a shared secret (e.g. for tunnels),
+// the server deciding the key derivation order of the two directions.
+func (s *Suite) Link(conn *stream.Stream, secret []byte, server bool, version wire.Version) *link.Link {
+	return link.New(conn, s.derive(secret, config.HkdfInfo), server, s.mode, version)
+}
@@ -0,0 +1,111 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/proto/wire"
+)
+
+// Tests that each suite agrees on a secret and builds matching links from it.
+func TestSuites(t *testing.T) {
+	t.Parallel()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	for _, name := range []string{"classic", "modern"} {
+		suite, err := LookupSuite(name)
+		if err != nil {
+			t.Fatalf("%s: failed to look up suite: %v.", name, err)
+		}
+		// Run a key exchange between two parties
+		client, err := suite.exchange()
+		if err != nil {
+			t.Fatalf("%s: failed to create client exchange: %v.", name, err)
+		}
+		server, err := suite.exchange()
+		if err != nil {
+			t.Fatalf("%s: failed to create server exchange: %v.", name, err)
+		}
+		cexp, _ := client.Initiate()
+		sexp, stoken, err := server.Accept(rand.Reader, key, cexp)
+		if err != nil {
+			t.Fatalf("%s: failed to accept exchange: %v.", name, err)
+		}
+		ctoken, err := client.Verify(rand.Reader, key, &key.PublicKey, sexp, stoken)
+		if err != nil {
+			t.Fatalf("%s: failed to verify acceptor: %v.", name, err)
+		}
+		if err := server.Finalize(&key.PublicKey, ctoken); err != nil {
+			t.Fatalf("%s: failed to finalize exchange: %v.", name, err)
+		}
+		csecret, _ := client.Secret()
+		ssecret, _ := server.Secret()
+		if !bytes.Equal(csecret, ssecret) {
+			t.Fatalf("%s: secret mismatch: have %x, want %x.", name, csecret, ssecret)
+		}
+		// Connect two links with the secret and pass a message through
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		listener, err := stream.Listen(addr)
+		if err != nil {
+			t.Fatalf("%s: failed to listen for incoming streams: %v.", name, err)
+		}
+		listener.Accept(10 * time.Millisecond)
+
+		clientStrm, err := stream.Dial(fmt.Sprintf("localhost:%d", addr.Port), time.Second)
+		if err != nil {
+			t.Fatalf("%s: failed to connect to stream listener: %v.", name, err)
+		}
+		serverStrm := <-listener.Sink
+
+		clientLink := suite.Link(clientStrm, csecret, false, wire.VersionBinary)
+		serverLink := suite.Link(serverStrm, ssecret, true, wire.VersionBinary)
+
+		send := &proto.Message{
+			Head: proto.Header{
+				Meta: []byte("meta"),
+			},
+			Data: []byte("data"),
+		}
+		send.Encrypt()
+		if err := clientLink.SendDirect(send); err != nil {
+			t.Fatalf("%s: failed to send message: %v.", name, err)
+		}
+		if recv, err := serverLink.RecvDirect(); err != nil {
+			t.Fatalf("%s: failed to receive message: %v.", name, err)
+		} else if !bytes.Equal(recv.Data, send.Data) {
+			t.Fatalf("%s: data mismatch: have %x, want %x.", name, recv.Data, send.Data)
+		}
+		clientStrm.Close()
+		serverStrm.Close()
+		listener.Close()
+	}
+	// Ensure unknown suites are rejected
+	if _, err := LookupSuite("unknown"); err == nil {
+		t.Fatalf("unknown suite found.")
+	}
+}
@@ -16,7 +16,8 @@
 // conditions contained in an individually negotiated signed written agreement
 // between you and the author(s).
 
-// Package stream wraps a TCP/IP network connection with the Go gob en/decoder.
+// Package stream wraps a network connection with the Go gob en/decoder. By default
+// TCP/IP is used, but any implementation of the transport interface will do.
 //
 // Note, in case of a serialization error (encoding or decoding failure), it is
 // assumed that there is either a protocol mismatch between the parties, or an
@@ -26,10 +27,17 @@ package stream
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto/transport"
 )
 
 // Constants for the protocol TCP/IP layer
@@ -39,28 +47,39 @@ const acceptBlockTimeout = 250 * time.Millisecond
 type Listener struct {
 	Sink chan *Stream // Channel receiving the accepted connections
 
-	socket *net.TCPListener // Network socket to accept connections on
-	quit   chan chan error  // Termination synchronization channel
+	socket transport.Listener // Network socket to accept connections on
+	quit   chan chan error    // Termination synchronization channel
 }
 
-// TCP/IP based stream with a gob encoder on top.
+// Network stream with a gob encoder on top.
 type Stream struct {
-	socket  *net.TCPConn      // Network connection to the remote endpoint
+	socket  net.Conn          // Network connection to the remote endpoint
 	buffers *bufio.ReadWriter // Buffered access to the network socket
 	encoder *gob.Encoder      // Gob encoder for data serialization
 	decoder *gob.Decoder      // Gob decoder for data deserialization
+
+	frame [binary.MaxVarintLen64]byte // Scratch space for the frame length prefixes
 }
 
 // Opens a TCP server socket and returns a stream listener, ready to accept. If
 // an auto-port (0) is requested, the port is updated in the argument.
 func Listen(addr *net.TCPAddr) (*Listener, error) {
-	// Open the server socket
-	sock, err := net.ListenTCP("tcp", addr)
+	sock, err := ListenTransport(transport.TCP, addr.String())
 	if err != nil {
 		return nil, err
 	}
 	addr.Port = sock.Addr().(*net.TCPAddr).Port
+	return sock, nil
+}
 
+// Opens a server socket on an arbitrary transport and returns a stream listener,
+// ready to accept. The assigned address can be retrieved from the listener.
+func ListenTransport(trans transport.Transport, addr string) (*Listener, error) {
+	// Open the server socket
+	sock, err := trans.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
 	// Initialize and return the listener
 	return &Listener{
 		socket: sock,
@@ -75,6 +94,11 @@ func (l *Listener) Accept(timeout time.Duration) {
 	go l.accepter(timeout)
 }
 
+// Returns the network address the listener is accepting connections on.
+func (l *Listener) Addr() net.Addr {
+	return l.socket.Addr()
+}
+
 // Terminates the acceptor and returns any encountered errors.
 func (l *Listener) Close() error {
 	errc := make(chan error)
@@ -82,7 +106,7 @@ func (l *Listener) Close() error {
 	return <-errc
 }
 
-// Accepts incoming connection requests, converts them info a TCP/IP gob stream
+// Accepts incoming connection requests, converts them info a gob stream
 // and send them back on the sink channel.
 func (l *Listener) accepter(timeout time.Duration) {
 	var errc chan error
@@ -96,7 +120,7 @@ func (l *Listener) accepter(timeout time.Duration) {
 		default:
 			// Accept an incoming connection but without blocking for too long
 			l.socket.SetDeadline(time.Now().Add(acceptBlockTimeout))
-			if conn, err := l.socket.AcceptTCP(); err == nil {
+			if conn, err := l.socket.Accept(); err == nil {
 				strm := newStream(conn)
 				select {
 				case l.Sink <- strm:
@@ -123,8 +147,8 @@ func (l *Listener) accepter(timeout time.Duration) {
 	errc <- errv
 }
 
-// Creates a new, gob backed network stream based on a live TCP/IP connection.
-func newStream(sock *net.TCPConn) *Stream {
+// Creates a new, gob backed network stream based on a live connection.
+func newStream(sock net.Conn) *Stream {
 	reader := bufio.NewReader(sock)
 	writer := bufio.NewWriter(sock)
 
@@ -132,21 +156,27 @@ func newStream(sock *net.TCPConn) *Stream {
 		socket:  sock,
 		buffers: bufio.NewReadWriter(reader, writer),
 		encoder: gob.NewEncoder(writer),
-		decoder: gob.NewDecoder(reader),
+		decoder: gob.NewDecoder(&limiter{reader: reader}),
 	}
 }
 
 // Connects to a remote host and returns the connection stream.
 func Dial(address string, timeout time.Duration) (*Stream, error) {
-	if sock, err := net.DialTimeout("tcp", address, timeout); err != nil {
+	return DialTransport(transport.TCP, address, timeout)
+}
+
+// Connects to a remote host through an arbitrary transport and returns the
+// connection stream.
+func DialTransport(trans transport.Transport, address string, timeout time.Duration) (*Stream, error) {
+	if sock, err := trans.Dial(address, timeout); err != nil {
 		return nil, err
 	} else {
-		return newStream(sock.(*net.TCPConn)), nil
+		return newStream(sock), nil
 	}
 }
 
 // Retrieves the raw connection object if special manipulations are needed.
-func (s *Stream) Sock() *net.TCPConn {
+func (s *Stream) Sock() net.Conn {
 	return s.socket
 }
 
@@ -180,7 +210,114 @@ func (s *Stream) Recv(data interface{}) error {
 	return nil
 }
 
+// Sends a raw, length prefixed binary frame over the wire, bypassing gob. Both
+// sides must agree beforehand to switch to frames. In case of an error, the
+// connection is torn down.
+func (s *Stream) SendFrame(data []byte) error {
+	n := binary.PutUvarint(s.frame[:], uint64(len(data)))
+	if _, err := s.buffers.Write(s.frame[:n]); err != nil {
+		s.socket.Close()
+		return err
+	}
+	if _, err := s.buffers.Write(data); err != nil {
+		s.socket.Close()
+		return err
+	}
+	return nil
+}
+
+// Receives a raw binary frame into the buffer, reusing its capacity if large
+// enough, or retrieving a new one from the buffer pool otherwise. If an error
+// occurs, the network stream is torn down.
+func (s *Stream) RecvFrame(buf *[]byte) error {
+	size, err := binary.ReadUvarint(s.buffers)
+	if err != nil {
+		s.socket.Close()
+		return err
+	}
+	if size > uint64(config.StreamMessageLimit) {
+		s.socket.Close()
+		return fmt.Errorf("message size limit exceeded: %d > %d", size, config.StreamMessageLimit)
+	}
+	if uint64(cap(*buf)) < size {
+		*buf = pool.GetBuffer(int(size))
+	}
+	*buf = (*buf)[:size]
+	if _, err := io.ReadFull(s.buffers, *buf); err != nil {
+		s.socket.Close()
+		return err
+	}
+	return nil
+}
+
 // Closes the underlying network connection of a stream.
 func (s *Stream) Close() error {
 	return s.socket.Close()
 }
+
+// Reader inspecting the gob message framing of an inbound data stream, failing
+// if a message would exceed the permitted size before the decoder allocates the
+// memory for it.
+type limiter struct {
+	reader *bufio.Reader // Buffered network stream to read from
+	head   []byte        // Message length header not yet consumed by the decoder
+	left   uint64        // Bytes remaining from the current message body
+}
+
+// Implements io.Reader, passing through the data read from the network, whilst
+// validating each message length header.
+func (l *limiter) Read(p []byte) (int, error) {
+	// If a new message is starting, read and validate its length header
+	if len(l.head) == 0 && l.left == 0 {
+		if err := l.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	// Pass through any pending header bytes first
+	if len(l.head) > 0 {
+		n := copy(p, l.head)
+		l.head = l.head[n:]
+		return n, nil
+	}
+	// Read the message body, but never past its end
+	if uint64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= uint64(n)
+	return n, err
+}
+
+// Reads a gob encoded unsigned integer message length and checks it against the
+// configured limit.
+func (l *limiter) readHeader() error {
+	b, err := l.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	l.head = append(l.head[:0], b)
+
+	size := uint64(b)
+	if b > 0x7f {
+		// Multi-byte length: negated byte count followed by a big endian number
+		count := -int(int8(b))
+		if count > 8 {
+			return fmt.Errorf("invalid message length header: %#x", b)
+		}
+		buf := make([]byte, count)
+		if _, err := io.ReadFull(l.reader, buf); err != nil {
+			return err
+		}
+		l.head = append(l.head, buf...)
+
+		size = 0
+		for _, b := range buf {
+			size = size<<8 | uint64(b)
+		}
+	}
+	if size > uint64(config.StreamMessageLimit) {
+		return fmt.Errorf("message size limit exceeded: %d > %d", size, config.StreamMessageLimit)
+	}
+	l.left = size
+	return nil
+}
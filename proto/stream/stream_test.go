@@ -19,6 +19,10 @@
 package stream
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -26,6 +30,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/config"
 )
 
 // Tests whether the stream listener can be set up and torn down correctly.
@@ -181,3 +187,97 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close listener: %v.", err)
 	}
 }
+
+// Tests that oversized inbound messages are rejected before being decoded.
+func TestMessageLimit(t *testing.T) {
+	limit := config.StreamMessageLimit
+	config.StreamMessageLimit = 1024
+	defer func() { config.StreamMessageLimit = limit }()
+
+	// Encode a few messages of various sizes into a single stream
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for _, size := range []int{0, 1, 128, 1000, 1025} {
+		if err := enc.Encode(make([]byte, size)); err != nil {
+			t.Fatalf("failed to encode %d byte message: %v.", size, err)
+		}
+	}
+	// Decode them through a limiter and ensure only the oversized one fails
+	dec := gob.NewDecoder(&limiter{reader: bufio.NewReader(buf)})
+	for _, size := range []int{0, 1, 128, 1000} {
+		var data []byte
+		if err := dec.Decode(&data); err != nil {
+			t.Fatalf("failed to decode %d byte message: %v.", size, err)
+		}
+		if len(data) != size {
+			t.Fatalf("message size mismatch: have %d, want %d.", len(data), size)
+		}
+	}
+	var data []byte
+	if err := dec.Decode(&data); err == nil {
+		t.Fatalf("oversized message accepted: %d bytes.", len(data))
+	}
+}
+
+// Tests that raw frames can follow gob messages on the same stream.
+func TestFrames(t *testing.T) {
+	t.Parallel()
+
+	// Resolve a random local port and listen on it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	sock, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	client, err := Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	server := <-sock.Sink
+
+	defer client.Close()
+	defer server.Close()
+
+	// Send a gob handshake followed by a batch of frames
+	if err := client.Send(struct{ A int }{42}); err != nil {
+		t.Fatalf("failed to send handshake: %v.", err)
+	}
+	frames := [][]byte{{}, {0x01}, bytes.Repeat([]byte{0x02}, 300), bytes.Repeat([]byte{0x03}, 70000)}
+	for _, frame := range frames {
+		if err := client.SendFrame(frame); err != nil {
+			t.Fatalf("failed to send frame: %v.", err)
+		}
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatalf("failed to flush client: %v.", err)
+	}
+	// Retrieve and verify everything, reusing the frame buffer
+	recv := struct{ A int }{}
+	if err := server.Recv(&recv); err != nil || recv.A != 42 {
+		t.Fatalf("handshake mismatch: have %v/%v, want %v.", recv.A, err, 42)
+	}
+	var buf []byte
+	for i, frame := range frames {
+		if err := server.RecvFrame(&buf); err != nil {
+			t.Fatalf("frame %d: failed to receive: %v.", i, err)
+		}
+		if !bytes.Equal(buf, frame) {
+			t.Fatalf("frame %d: data mismatch: have %d bytes, want %d.", i, len(buf), len(frame))
+		}
+	}
+	// Ensure oversized frames are rejected before allocation
+	var head [binary.MaxVarintLen64]byte
+	client.buffers.Write(head[:binary.PutUvarint(head[:], uint64(config.StreamMessageLimit)+1)])
+	client.Flush()
+	if err := server.RecvFrame(&buf); err == nil {
+		t.Fatalf("oversized frame accepted.")
+	}
+}
@@ -0,0 +1,385 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the in-memory transport: a virtual network living inside a single
+// process, where listeners are registered under IP:port style addresses and
+// dialed connections are pairs of bounded buffers (mimicking socket buffers).
+
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of dialed connections queued for a memory listener to accept.
+const memoryBacklog = 16
+
+// First port assigned to auto-port listeners and dialers.
+const memoryPortBase = 10000
+
+// Bytes buffered in a single direction of a memory connection.
+const memoryBuffer = 256 * 1024
+
+// In-memory network transport. Only listeners and dialers of the same instance
+// can reach each other.
+type Memory struct {
+	listeners map[string]*memoryListener // Listeners keyed by their address
+	nextPort  int                        // Next port to assign automatically
+	lock      sync.Mutex                 // Mutex protecting the network state
+}
+
+// One direction of an in-memory connection.
+type memoryPipe struct {
+	buf      bytes.Buffer  // Data written but not yet read
+	closed   bool          // Whether either endpoint closed the connection
+	readable chan struct{} // Notification of data arrival or closure
+	writable chan struct{} // Notification of freed space or closure
+	lock     sync.Mutex    // Mutex protecting the buffer and closure
+}
+
+// Network connection within the in-memory transport.
+type memoryConn struct {
+	local  net.Addr    // Address of the local endpoint
+	remote net.Addr    // Address of the remote endpoint
+	in     *memoryPipe // Pipe carrying the inbound data
+	out    *memoryPipe // Pipe carrying the outbound data
+
+	readDeadline  time.Time  // Deadline for the read operations
+	writeDeadline time.Time  // Deadline for the write operations
+	closed        bool       // Whether the connection was closed locally
+	lock          sync.Mutex // Mutex protecting the deadlines and closure
+}
+
+// Listener of the in-memory transport.
+type memoryListener struct {
+	owner *Memory
+	addr  *net.TCPAddr
+
+	sink chan net.Conn // Queue of connections pending acceptance
+	quit chan struct{} // Channel closed when the listener is terminated
+
+	deadline time.Time  // Deadline for the accept operations
+	lock     sync.Mutex // Mutex protecting the deadline and the closure
+}
+
+// Creates a new, empty in-memory network.
+func NewMemory() *Memory {
+	return &Memory{
+		listeners: make(map[string]*memoryListener),
+		nextPort:  memoryPortBase,
+	}
+}
+
+// Parses a host:port address into its virtual network counterpart.
+func parseMemoryAddr(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid virtual host: %s", host)
+	}
+	num, err := strconv.Atoi(port)
+	if err != nil || num < 0 || num > 65535 {
+		return nil, fmt.Errorf("invalid virtual port: %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: num}, nil
+}
+
+// Implements Transport.Listen, registering a listener in the virtual network.
+func (m *Memory) Listen(addr string) (Listener, error) {
+	laddr, err := parseMemoryAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Assign a free port if requested, otherwise ensure availability
+	if laddr.Port == 0 {
+		for {
+			laddr.Port = m.nextPort
+			m.nextPort++
+			if _, ok := m.listeners[laddr.String()]; !ok {
+				break
+			}
+		}
+	} else if _, ok := m.listeners[laddr.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: laddr, Err: errors.New("address already in use")}
+	}
+	l := &memoryListener{
+		owner: m,
+		addr:  laddr,
+		sink:  make(chan net.Conn, memoryBacklog),
+		quit:  make(chan struct{}),
+	}
+	m.listeners[laddr.String()] = l
+	return l, nil
+}
+
+// Implements Transport.Dial, connecting to a listener in the virtual network.
+func (m *Memory) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return m.dial(net.IPv4zero, addr, timeout)
+}
+
+// Connects to a listener in the virtual network, originating the connection
+// from the given local host.
+func (m *Memory) dial(host net.IP, addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := parseMemoryAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	l, ok := m.listeners[raddr.String()]
+	laddr := &net.TCPAddr{IP: host, Port: m.nextPort}
+	m.nextPort++
+	m.lock.Unlock()
+
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr, Err: errors.New("connection refused")}
+	}
+	// Create the pipe and queue the server side for acceptance
+	client, server := newMemoryConns(laddr, l.addr)
+
+	var expire <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expire = timer.C
+	}
+	select {
+	case l.sink <- server:
+		// Make sure the listener wasn't closed concurrently, orphaning the queued end
+		select {
+		case <-l.quit:
+			client.Close()
+			server.Close()
+			return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr, Err: errors.New("connection refused")}
+		default:
+			return client, nil
+		}
+	case <-l.quit:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr, Err: errors.New("connection refused")}
+	case <-expire:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr, Err: timeoutError{}}
+	}
+}
+
+// Creates the two endpoints of an in-memory connection.
+func newMemoryConns(client, server net.Addr) (*memoryConn, *memoryConn) {
+	up := &memoryPipe{readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+	down := &memoryPipe{readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+
+	return &memoryConn{local: client, remote: server, in: down, out: up},
+		&memoryConn{local: server, remote: client, in: up, out: down}
+}
+
+// Marks the pipe closed, waking up any blocked operations.
+func (p *memoryPipe) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	notify(p.readable)
+	notify(p.writable)
+}
+
+// Implements net.Conn.Read, waiting for data to arrive. After the remote side
+// closes, the buffered data is still delivered before reporting EOF.
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.lock.Unlock()
+
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		c.in.lock.Lock()
+		switch {
+		case c.in.buf.Len() > 0:
+			n, _ := c.in.buf.Read(b)
+			notify(c.in.writable)
+			c.in.lock.Unlock()
+			return n, nil
+
+		case c.in.closed:
+			c.in.lock.Unlock()
+			return 0, io.EOF
+		}
+		c.in.lock.Unlock()
+
+		if !wait(c.in.readable, deadline) {
+			return 0, &net.OpError{Op: "read", Net: "mem", Addr: c.remote, Err: timeoutError{}}
+		}
+	}
+}
+
+// Implements net.Conn.Write, blocking while the outbound buffer is full.
+func (c *memoryConn) Write(b []byte) (int, error) {
+	sent := 0
+	for len(b) > 0 {
+		c.lock.Lock()
+		deadline := c.writeDeadline
+		c.lock.Unlock()
+
+		c.out.lock.Lock()
+		if c.out.closed {
+			c.out.lock.Unlock()
+			return sent, io.ErrClosedPipe
+		}
+		if space := memoryBuffer - c.out.buf.Len(); space > 0 {
+			n := len(b)
+			if n > space {
+				n = space
+			}
+			c.out.buf.Write(b[:n])
+			notify(c.out.readable)
+			c.out.lock.Unlock()
+
+			sent, b = sent+n, b[n:]
+			continue
+		}
+		c.out.lock.Unlock()
+
+		if !wait(c.out.writable, deadline) {
+			return sent, &net.OpError{Op: "write", Net: "mem", Addr: c.remote, Err: timeoutError{}}
+		}
+	}
+	return sent, nil
+}
+
+// Implements net.Conn.Close, tearing down both directions.
+func (c *memoryConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return io.ErrClosedPipe
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+// Implements net.Conn.LocalAddr.
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Implements net.Conn.RemoteAddr.
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Implements net.Conn.SetDeadline.
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// Implements net.Conn.SetReadDeadline, waking any blocked reader to re-evaluate.
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+
+	notify(c.in.readable)
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline, waking any blocked writer to re-evaluate.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+
+	notify(c.out.writable)
+	return nil
+}
+
+// Implements net.Listener.Accept, waiting for the next dialed connection.
+func (l *memoryListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	expire, stop := deadlineTimer(l.deadline)
+	l.lock.Unlock()
+	defer stop()
+
+	select {
+	case conn := <-l.sink:
+		return conn, nil
+	case <-l.quit:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr, Err: errors.New("listener closed")}
+	case <-expire:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr, Err: timeoutError{}}
+	}
+}
+
+// Implements Listener.SetDeadline.
+func (l *memoryListener) SetDeadline(t time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.deadline = t
+	return nil
+}
+
+// Implements net.Listener.Close, unregistering the listener and refusing any
+// connections not yet accepted.
+func (l *memoryListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.quit:
+		return errors.New("listener already closed")
+	default:
+	}
+	l.owner.lock.Lock()
+	delete(l.owner.listeners, l.addr.String())
+	l.owner.lock.Unlock()
+
+	close(l.quit)
+	for {
+		select {
+		case conn := <-l.sink:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Implements net.Listener.Addr.
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,583 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the multiplexing transport: all connections dialed towards the same
+// remote address share a single connection of an underlying transport, with a
+// credit based flow control per logical stream so a stalled reader cannot block
+// the others.
+//
+// Wire format of a frame: [type: 1 byte][stream id: 4 bytes][length: 2 bytes]
+// followed by the payload. Only the dialing side opens streams, each with an
+// increasing id. Data frames carry the stream contents, window frames return a
+// 4 byte credit to the sender and close frames tear a stream down.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexer frame types.
+const (
+	frameOpen   byte = iota // Opens a new logical stream
+	frameData               // Stream data chunk
+	frameWindow             // Grants additional send credit
+	frameClose              // Closes a logical stream
+)
+
+// Maximum payload size of a single data frame.
+const muxFrameLimit = 16 * 1024
+
+// Inbound buffer allowance of a single logical stream.
+const muxWindow = 256 * 1024
+
+// Returned when operating on a closed logical stream.
+var errStreamClosed = errors.New("use of closed stream")
+
+// Multiplexing transport, carrying all connections towards the same remote
+// address over a single connection of the base transport.
+type Mux struct {
+	base     Transport              // Underlying transport to carry the streams
+	sessions map[string]*muxSession // Outbound sessions keyed by remote address
+	lock     sync.Mutex             // Mutex protecting the session map
+}
+
+// Single connection of the base transport, carrying many logical streams.
+type muxSession struct {
+	owner *Mux         // Transport owning the session if dialed (nil otherwise)
+	sink  *muxListener // Listener receiving the inbound streams (nil if dialed)
+	addr  string       // Remote address the session was dialed to
+
+	conn     net.Conn              // Underlying connection
+	reader   *bufio.Reader         // Buffered reader of the underlying connection
+	sendLock sync.Mutex            // Mutex to atomize frame sending
+	sendBuf  [7]byte               // Frame header buffer, used under the send lock
+	streams  map[uint32]*muxStream // Live logical streams
+	nextId   uint32                // Id to assign to the next opened stream
+	fail     error                 // Failure that terminated the session
+	lock     sync.Mutex            // Mutex protecting the stream map and failure
+}
+
+// Logical stream within a multiplexed session.
+type muxStream struct {
+	sess *muxSession
+	id   uint32
+
+	inBuf    bytes.Buffer  // Data arrived but not yet read
+	inAck    int           // Bytes read but not yet credited back to the sender
+	inSignal chan struct{} // Notification of read state changes
+
+	outWindow int           // Bytes allowed to send without further credit
+	outSignal chan struct{} // Notification of write state changes
+
+	readDeadline  time.Time // Deadline for the read operations
+	writeDeadline time.Time // Deadline for the write operations
+
+	localClosed  bool       // Whether the stream was closed locally
+	remoteClosed bool       // Whether the stream was closed remotely
+	lock         sync.Mutex // Mutex protecting the stream state
+}
+
+// Listener of the multiplexing transport.
+type muxListener struct {
+	base Listener
+	sink chan net.Conn
+	quit chan struct{}
+
+	deadline time.Time
+	lock     sync.Mutex
+}
+
+// Creates a multiplexing transport on top of a base one.
+func NewMux(base Transport) *Mux {
+	return &Mux{
+		base:     base,
+		sessions: make(map[string]*muxSession),
+	}
+}
+
+// Implements Transport.Listen, accepting base connections and demultiplexing
+// the logical streams arriving on them.
+func (m *Mux) Listen(addr string) (Listener, error) {
+	base, err := m.base.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &muxListener{
+		base: base,
+		sink: make(chan net.Conn),
+		quit: make(chan struct{}),
+	}
+	go l.accepter()
+	return l, nil
+}
+
+// Implements Transport.Dial, opening a new logical stream on the session to the
+// remote address, dialing a new one if none is live.
+func (m *Mux) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m.lock.Lock()
+	sess, ok := m.sessions[addr]
+	m.lock.Unlock()
+
+	if ok {
+		if strm, err := sess.open(); err == nil {
+			return strm, nil
+		}
+	}
+	conn, err := m.base.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	sess = newMuxSession(conn)
+	sess.owner, sess.addr = m, addr
+
+	m.lock.Lock()
+	m.sessions[addr] = sess
+	m.lock.Unlock()
+
+	go sess.process()
+	return sess.open()
+}
+
+// Removes a terminated session from the outbound map.
+func (m *Mux) remove(sess *muxSession) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sessions[sess.addr] == sess {
+		delete(m.sessions, sess.addr)
+	}
+}
+
+// Accepts base connections and starts demultiplexing them.
+func (l *muxListener) accepter() {
+	for {
+		conn, err := l.base.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+		sess := newMuxSession(conn)
+		sess.sink = l
+		go sess.process()
+	}
+}
+
+// Hands an inbound stream over to the acceptor, closing it if the listener is
+// already down.
+func (l *muxListener) deliver(strm *muxStream) {
+	select {
+	case l.sink <- strm:
+	case <-l.quit:
+		strm.Close()
+	}
+}
+
+// Implements net.Listener.Accept, waiting for the next inbound stream.
+func (l *muxListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	expire, stop := deadlineTimer(l.deadline)
+	l.lock.Unlock()
+	defer stop()
+
+	select {
+	case conn := <-l.sink:
+		return conn, nil
+	case <-l.quit:
+		return nil, &net.OpError{Op: "accept", Net: "mux", Addr: l.base.Addr(), Err: errors.New("listener closed")}
+	case <-expire:
+		return nil, &net.OpError{Op: "accept", Net: "mux", Addr: l.base.Addr(), Err: timeoutError{}}
+	}
+}
+
+// Implements Listener.SetDeadline.
+func (l *muxListener) SetDeadline(t time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.deadline = t
+	return nil
+}
+
+// Implements net.Listener.Close. Already established sessions are not affected,
+// but any further inbound streams are refused.
+func (l *muxListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.quit:
+		return errors.New("listener already closed")
+	default:
+	}
+	close(l.quit)
+	return l.base.Close()
+}
+
+// Implements net.Listener.Addr.
+func (l *muxListener) Addr() net.Addr {
+	return l.base.Addr()
+}
+
+// Creates a new multiplexed session on top of a base connection.
+func newMuxSession(conn net.Conn) *muxSession {
+	return &muxSession{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		streams: make(map[uint32]*muxStream),
+		nextId:  1,
+	}
+}
+
+// Opens a new logical stream on an outbound session.
+func (s *muxSession) open() (*muxStream, error) {
+	s.lock.Lock()
+	if s.fail != nil {
+		s.lock.Unlock()
+		return nil, s.fail
+	}
+	strm := s.newStream(s.nextId)
+	s.streams[strm.id] = strm
+	s.nextId++
+	s.lock.Unlock()
+
+	if err := s.sendFrame(frameOpen, strm.id, nil); err != nil {
+		return nil, err
+	}
+	return strm, nil
+}
+
+// Creates a new logical stream with the default windows.
+func (s *muxSession) newStream(id uint32) *muxStream {
+	return &muxStream{
+		sess:      s,
+		id:        id,
+		inSignal:  make(chan struct{}, 1),
+		outWindow: muxWindow,
+		outSignal: make(chan struct{}, 1),
+	}
+}
+
+// Sends a single frame over the base connection.
+func (s *muxSession) sendFrame(kind byte, id uint32, payload []byte) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	s.sendBuf[0] = kind
+	binary.BigEndian.PutUint32(s.sendBuf[1:5], id)
+	binary.BigEndian.PutUint16(s.sendBuf[5:7], uint16(len(payload)))
+	if _, err := s.conn.Write(s.sendBuf[:]); err != nil {
+		s.terminate(err)
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.terminate(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the inbound frames and dispatches them to the logical streams until the
+// base connection fails.
+func (s *muxSession) process() {
+	var head [7]byte
+	for {
+		if _, err := io.ReadFull(s.reader, head[:]); err != nil {
+			s.terminate(err)
+			return
+		}
+		kind, id := head[0], binary.BigEndian.Uint32(head[1:5])
+		size := int(binary.BigEndian.Uint16(head[5:7]))
+		if size > muxFrameLimit {
+			s.terminate(fmt.Errorf("frame size limit exceeded: %d", size))
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			s.terminate(err)
+			return
+		}
+		if err := s.dispatch(kind, id, payload); err != nil {
+			s.terminate(err)
+			return
+		}
+	}
+}
+
+// Processes a single inbound frame.
+func (s *muxSession) dispatch(kind byte, id uint32, payload []byte) error {
+	s.lock.Lock()
+	strm, live := s.streams[id]
+	s.lock.Unlock()
+
+	switch kind {
+	case frameOpen:
+		if s.sink == nil || live {
+			return fmt.Errorf("protocol violation: unexpected open of stream %d", id)
+		}
+		strm = s.newStream(id)
+		s.lock.Lock()
+		s.streams[id] = strm
+		s.lock.Unlock()
+		go s.sink.deliver(strm)
+
+	case frameData:
+		if live {
+			return strm.push(payload)
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return errors.New("protocol violation: malformed window frame")
+		}
+		if live {
+			strm.grant(int(binary.BigEndian.Uint32(payload)))
+		}
+	case frameClose:
+		if live && strm.shutdown(false) {
+			s.release(id)
+		}
+	default:
+		return fmt.Errorf("protocol violation: unknown frame type %d", kind)
+	}
+	return nil
+}
+
+// Tears down the session after a failure, notifying all live streams.
+func (s *muxSession) terminate(err error) {
+	s.lock.Lock()
+	if s.fail != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.fail = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.lock.Unlock()
+
+	s.conn.Close()
+	if s.owner != nil {
+		s.owner.remove(s)
+	}
+	for _, strm := range streams {
+		strm.shutdown(false)
+	}
+}
+
+// Unregisters a stream closed by both sides, closing idle outbound sessions.
+func (s *muxSession) release(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	idle := s.owner != nil && len(s.streams) == 0
+	if idle {
+		s.fail = errors.New("session idle")
+	}
+	s.lock.Unlock()
+
+	if idle {
+		s.conn.Close()
+		s.owner.remove(s)
+	}
+}
+
+// Appends an inbound data chunk to the stream buffer.
+func (s *muxStream) push(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.inBuf.Len()+s.inAck+len(data) > muxWindow {
+		return fmt.Errorf("protocol violation: stream %d window exceeded", s.id)
+	}
+	if !s.localClosed {
+		s.inBuf.Write(data)
+	}
+	notify(s.inSignal)
+	return nil
+}
+
+// Grants additional send credit to the stream.
+func (s *muxStream) grant(credit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.outWindow += credit
+	notify(s.outSignal)
+}
+
+// Marks the stream closed from one side, waking up any blocked operations. The
+// return value reports whether both sides are done with the stream.
+func (s *muxStream) shutdown(local bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if local {
+		s.localClosed = true
+	} else {
+		s.remoteClosed = true
+	}
+	notify(s.inSignal)
+	notify(s.outSignal)
+
+	return s.localClosed && s.remoteClosed
+}
+
+// Implements net.Conn.Read, waiting for data to arrive and crediting the sender
+// once half the window was consumed.
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		switch {
+		case s.localClosed:
+			s.lock.Unlock()
+			return 0, errStreamClosed
+
+		case s.inBuf.Len() > 0:
+			n, _ := s.inBuf.Read(p)
+			s.inAck += n
+
+			credit := 0
+			if s.inAck >= muxWindow/2 {
+				credit, s.inAck = s.inAck, 0
+			}
+			s.lock.Unlock()
+
+			if credit > 0 {
+				var buf [4]byte
+				binary.BigEndian.PutUint32(buf[:], uint32(credit))
+				s.sess.sendFrame(frameWindow, s.id, buf[:])
+			}
+			return n, nil
+
+		case s.remoteClosed:
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.lock.Unlock()
+
+		if !wait(s.inSignal, deadline) {
+			return 0, &net.OpError{Op: "read", Net: "mux", Addr: s.RemoteAddr(), Err: timeoutError{}}
+		}
+	}
+}
+
+// Implements net.Conn.Write, chunking the data into frames within the credit
+// granted by the remote side.
+func (s *muxStream) Write(p []byte) (int, error) {
+	sent := 0
+	for len(p) > 0 {
+		s.lock.Lock()
+		switch {
+		case s.localClosed:
+			s.lock.Unlock()
+			return sent, errStreamClosed
+
+		case s.remoteClosed:
+			s.lock.Unlock()
+			return sent, io.ErrClosedPipe
+
+		case s.outWindow > 0:
+			n := len(p)
+			if n > s.outWindow {
+				n = s.outWindow
+			}
+			if n > muxFrameLimit {
+				n = muxFrameLimit
+			}
+			s.outWindow -= n
+			s.lock.Unlock()
+
+			if err := s.sess.sendFrame(frameData, s.id, p[:n]); err != nil {
+				return sent, err
+			}
+			sent, p = sent+n, p[n:]
+			continue
+		}
+		deadline := s.writeDeadline
+		s.lock.Unlock()
+
+		if !wait(s.outSignal, deadline) {
+			return sent, &net.OpError{Op: "write", Net: "mux", Addr: s.RemoteAddr(), Err: timeoutError{}}
+		}
+	}
+	return sent, nil
+}
+
+// Implements net.Conn.Close, tearing down the logical stream.
+func (s *muxStream) Close() error {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return errStreamClosed
+	}
+	s.lock.Unlock()
+
+	done := s.shutdown(true)
+	err := s.sess.sendFrame(frameClose, s.id, nil)
+	if done {
+		s.sess.release(s.id)
+	}
+	return err
+}
+
+// Implements net.Conn.LocalAddr, returning the base connection's address.
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.sess.conn.LocalAddr()
+}
+
+// Implements net.Conn.RemoteAddr, returning the base connection's address.
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.sess.conn.RemoteAddr()
+}
+
+// Implements net.Conn.SetDeadline.
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// Implements net.Conn.SetReadDeadline, waking any blocked reader to re-evaluate.
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readDeadline = t
+	notify(s.inSignal)
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline, waking any blocked writer to re-evaluate.
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.writeDeadline = t
+	notify(s.outSignal)
+	return nil
+}
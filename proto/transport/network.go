@@ -0,0 +1,451 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the simulated network: an in-memory transport shared by many virtual
+// hosts, where the data written into a connection arrives only after the delay
+// of the link between the two endpoints elapsed on a (possibly fake) clock. The
+// links may also lose data (delivered after a retransmission penalty, as with a
+// real TCP stream) and the hosts may be partitioned from each other, severing
+// the connections crossing a partition and failing any dials across it.
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/clock"
+)
+
+// Extra delay of a lost write on top of a round trip, before it's retransmitted.
+const networkRetransmit = 200 * time.Millisecond
+
+// Characteristics of a virtual link between two hosts.
+type Link struct {
+	Latency time.Duration // One way delay of the written data
+	Jitter  time.Duration // Maximum random delay added to the latency
+	Loss    float64       // Probability of a write being lost and retransmitted
+}
+
+// Simulated network of virtual hosts with configurable links and partitions.
+type Network struct {
+	memory *Memory     // In-memory transport carrying the data
+	clock  clock.Clock // Time source to delay the data with
+	random *rand.Rand  // Source of the jitter and loss events
+
+	link  Link                      // Default characteristics of the links
+	links map[[2]string]Link        // Link overrides between specific hosts
+	zones map[string]int            // Partition of each host (zero if unlisted)
+	conns map[*networkConn]struct{} // Live connections to sever on partitioning
+
+	lock sync.Mutex // Mutex protecting the network state
+}
+
+// Transport view of the simulated network from a single virtual host.
+type networkHost struct {
+	owner *Network
+	host  net.IP
+}
+
+// Listener of a virtual host, delaying the accepted connections.
+type networkListener struct {
+	Listener
+	owner *Network
+	host  string
+}
+
+// Data written into a simulated connection, in flight to the remote side.
+type segment struct {
+	data   []byte    // Data contents of the write
+	arrive time.Time // Time at which the data becomes readable remotely
+}
+
+// Network connection within the simulated network, delaying the outbound data.
+type networkConn struct {
+	net.Conn // Underlying in-memory connection
+
+	owner  *Network
+	local  string // Host of the local endpoint
+	remote string // Host of the remote endpoint
+
+	queue   []*segment    // Outbound data in flight
+	pending int           // Number of bytes in flight
+	last    time.Time     // Arrival time of the last queued segment
+	pumping bool          // Whether a pump is delivering the queue
+	closed  bool          // Whether the connection was closed locally
+	severed bool          // Whether the connection was severed by a partition
+	dead    chan struct{} // Channel closed when the connection is severed
+
+	writable      chan struct{} // Notification of freed buffer space or closure
+	writeDeadline time.Time     // Deadline for the write operations
+	lock          sync.Mutex    // Mutex protecting the connection state
+}
+
+// Creates a new simulated network with perfect links and no partitions, using
+// the given clock to delay the data and the seed to generate link events.
+func NewNetwork(clk clock.Clock, seed int64) *Network {
+	return &Network{
+		memory: NewMemory(),
+		clock:  clk,
+		random: rand.New(rand.NewSource(seed)),
+		links:  make(map[[2]string]Link),
+		zones:  make(map[string]int),
+		conns:  make(map[*networkConn]struct{}),
+	}
+}
+
+// Normalizes a textual host into its canonical form, panicking if invalid.
+func hostKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		panic("invalid virtual host: " + host)
+	}
+	return ip.String()
+}
+
+// Orders a host pair so that links are symmetric.
+func linkKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Sets the default characteristics of the links between hosts.
+func (n *Network) SetDefaultLink(link Link) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.link = link
+}
+
+// Sets the characteristics of the link between two specific hosts, overriding
+// the default one. Links are symmetric.
+func (n *Network) SetLink(a, b string, link Link) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.links[linkKey(hostKey(a), hostKey(b))] = link
+}
+
+// Splits the network into isolated groups of hosts; all unlisted hosts form an
+// additional group of their own. Connections crossing the new boundaries are
+// severed and dials across them time out.
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	n.zones = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.zones[hostKey(host)] = i + 1
+		}
+	}
+	severed := []*networkConn{}
+	for c := range n.conns {
+		if n.zones[c.local] != n.zones[c.remote] {
+			severed = append(severed, c)
+			delete(n.conns, c)
+		}
+	}
+	n.lock.Unlock()
+
+	// Sever the connections outside the network lock (they lock themselves)
+	for _, c := range severed {
+		c.sever()
+	}
+}
+
+// Removes all partitions, allowing any host to reach any other one again.
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.zones = make(map[string]int)
+}
+
+// Returns a transport through which the given virtual host can listen on its
+// own address and dial any other host of the network.
+func (n *Network) Host(host string) Transport {
+	return &networkHost{owner: n, host: net.ParseIP(hostKey(host))}
+}
+
+// Checks whether two hosts are within the same partition.
+func (n *Network) reachable(a, b string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.zones[a] == n.zones[b]
+}
+
+// Generates the delay of a single write between two hosts.
+func (n *Network) delay(a, b string) time.Duration {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	link, ok := n.links[linkKey(a, b)]
+	if !ok {
+		link = n.link
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(n.random.Int63n(int64(link.Jitter) + 1))
+	}
+	if link.Loss > 0 && n.random.Float64() < link.Loss {
+		delay += 2*link.Latency + networkRetransmit
+	}
+	return delay
+}
+
+// Wraps an in-memory connection into a simulated one and tracks it. If the two
+// hosts got partitioned in the mean time, the connection is severed instead.
+func (n *Network) track(conn net.Conn, local, remote string) (*networkConn, error) {
+	c := &networkConn{
+		Conn:     conn,
+		owner:    n,
+		local:    local,
+		remote:   remote,
+		dead:     make(chan struct{}),
+		writable: make(chan struct{}, 1),
+	}
+	n.lock.Lock()
+	if n.zones[local] != n.zones[remote] {
+		n.lock.Unlock()
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: conn.RemoteAddr(), Err: timeoutError{}}
+	}
+	n.conns[c] = struct{}{}
+	n.lock.Unlock()
+
+	return c, nil
+}
+
+// Stops tracking a closed connection.
+func (n *Network) forget(c *networkConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.conns, c)
+}
+
+// Implements Transport.Listen, opening a listener on the host's own address.
+func (h *networkHost) Listen(addr string) (Listener, error) {
+	laddr, err := parseMemoryAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !laddr.IP.Equal(h.host) {
+		return nil, &net.OpError{Op: "listen", Net: "sim", Addr: laddr, Err: errors.New("cannot assign requested address")}
+	}
+	sock, err := h.owner.memory.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &networkListener{Listener: sock, owner: h.owner, host: h.host.String()}, nil
+}
+
+// Implements Transport.Dial, connecting to a remote host unless partitioned.
+func (h *networkHost) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := parseMemoryAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !h.owner.reachable(h.host.String(), raddr.IP.String()) {
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: raddr, Err: timeoutError{}}
+	}
+	conn, err := h.owner.memory.dial(h.host, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return h.owner.track(conn, h.host.String(), raddr.IP.String())
+}
+
+// Implements net.Listener.Accept, wrapping the connection into a simulated one.
+func (l *networkListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if c, err := l.owner.track(conn, l.host, conn.RemoteAddr().(*net.TCPAddr).IP.String()); err == nil {
+			return c, nil
+		}
+	}
+}
+
+// Implements net.Conn.Read, converting the failures after a local close.
+func (c *networkConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.lock.Lock()
+		closed := c.closed
+		c.lock.Unlock()
+
+		if closed {
+			return n, io.ErrClosedPipe
+		}
+	}
+	return n, err
+}
+
+// Implements net.Conn.Write, queuing the data for delayed delivery. The call
+// blocks while too much data is in flight.
+func (c *networkConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		if c.closed || c.severed {
+			return 0, io.ErrClosedPipe
+		}
+		if c.pending < memoryBuffer {
+			break
+		}
+		deadline := c.writeDeadline
+		c.lock.Unlock()
+		ok := wait(c.writable, deadline)
+		c.lock.Lock()
+
+		if !ok {
+			return 0, &net.OpError{Op: "write", Net: "sim", Addr: c.RemoteAddr(), Err: timeoutError{}}
+		}
+	}
+	// Calculate the arrival time, keeping the stream ordered
+	arrive := c.owner.clock.Now().Add(c.owner.delay(c.local, c.remote))
+	if arrive.Before(c.last) {
+		arrive = c.last
+	}
+	c.last = arrive
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.queue = append(c.queue, &segment{data: data, arrive: arrive})
+	c.pending += len(data)
+
+	if !c.pumping {
+		c.pumping = true
+		go c.pump()
+	}
+	return len(b), nil
+}
+
+// Delivers the queued segments into the underlying connection as they arrive.
+// If the connection was closed locally, it's torn down after the last segment.
+func (c *networkConn) pump() {
+	for {
+		c.lock.Lock()
+		if len(c.queue) == 0 || c.severed {
+			c.pumping = false
+			if c.closed && !c.severed {
+				c.Conn.Close()
+			}
+			c.lock.Unlock()
+			return
+		}
+		seg := c.queue[0]
+		c.lock.Unlock()
+
+		// Wait for the segment to arrive and deliver it
+		if wait := seg.arrive.Sub(c.owner.clock.Now()); wait > 0 {
+			select {
+			case <-c.owner.clock.After(wait):
+			case <-c.dead:
+				continue
+			}
+		}
+		_, err := c.Conn.Write(seg.data)
+
+		c.lock.Lock()
+		if err != nil {
+			c.queue, c.pending = nil, 0
+		} else {
+			c.queue, c.pending = c.queue[1:], c.pending-len(seg.data)
+		}
+		c.lock.Unlock()
+		notify(c.writable)
+	}
+}
+
+// Implements net.Conn.Close. Any data still in flight is delivered before the
+// remote side is notified of the closure.
+func (c *networkConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return io.ErrClosedPipe
+	}
+	c.closed = true
+	flush := c.pumping && !c.severed
+	c.lock.Unlock()
+
+	c.owner.forget(c)
+	notify(c.writable)
+
+	// If data is still in flight, wake up the local readers and leave the rest to the pump
+	if flush {
+		return c.Conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	c.Conn.Close()
+	return nil
+}
+
+// Tears down the connection abruptly, dropping any data in flight.
+func (c *networkConn) sever() {
+	c.lock.Lock()
+	if c.severed {
+		c.lock.Unlock()
+		return
+	}
+	c.severed = true
+	c.queue, c.pending = nil, 0
+	close(c.dead)
+	c.lock.Unlock()
+
+	notify(c.writable)
+	c.Conn.Close()
+}
+
+// Implements net.Conn.SetDeadline.
+func (c *networkConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// Implements net.Conn.SetReadDeadline, ignored after a local close.
+func (c *networkConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Implements net.Conn.SetWriteDeadline. The deadline only limits the wait for
+// buffer space, data already accepted is always delivered.
+func (c *networkConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+
+	notify(c.writable)
+	return nil
+}
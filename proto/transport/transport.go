@@ -0,0 +1,119 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package transport abstracts the raw network connections beneath the stream
+// and session layers, so that the overlay can run on top of alternatives to the
+// plain one-socket-per-link TCP/IP model.
+//
+// Three implementations are provided: TCP (the default), an in-memory network
+// for deterministic tests and a multiplexer carrying any number of logical
+// connections over a single one of another transport.
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// Listener accepting inbound connections of a transport. Besides the standard
+// interface, the accept operation must support deadlines, failing with a net
+// error reporting a timeout when reached.
+type Listener interface {
+	net.Listener
+
+	// Sets the deadline for future Accept calls. Zero means no timeout.
+	SetDeadline(t time.Time) error
+}
+
+// Network transport able to open listeners and dial remote endpoints. The
+// addresses are in host:port form; listening on port 0 assigns a free one,
+// which can be retrieved from the listener.
+type Transport interface {
+	// Opens a listener on the given local address.
+	Listen(addr string) (Listener, error)
+
+	// Connects to a remote listener, failing if not established in time.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// Plain TCP/IP transport, each connection mapping to a separate socket.
+var TCP Transport = tcpTransport{}
+
+// TCP/IP transport implementation.
+type tcpTransport struct{}
+
+// Implements Transport.Listen, opening a TCP server socket.
+func (tcpTransport) Listen(addr string) (Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// Implements Transport.Dial, connecting a TCP socket.
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Error returned by the non-TCP transports when a deadline is reached.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Creates a channel firing when the deadline is reached, or never if zero. The
+// returned stop function releases the associated timer.
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	return timer.C, func() { timer.Stop() }
+}
+
+// Non-blocking notification of a state change.
+func notify(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for a state change notification or the deadline to expire. Returns
+// false on timeout.
+func wait(signal chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-signal
+		return true
+	}
+	left := deadline.Sub(time.Now())
+	if left <= 0 {
+		return false
+	}
+	timer := time.NewTimer(left)
+	defer timer.Stop()
+
+	select {
+	case <-signal:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
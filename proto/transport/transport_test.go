@@ -0,0 +1,329 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/clock"
+)
+
+// Transport implementations to run the generic tests against.
+var transports = []struct {
+	name string
+	make func() Transport
+	addr string
+}{
+	{"tcp", func() Transport { return TCP }, "127.0.0.1:0"},
+	{"memory", func() Transport { return NewMemory() }, "10.0.0.1:0"},
+	{"mux-tcp", func() Transport { return NewMux(TCP) }, "127.0.0.1:0"},
+	{"mux-memory", func() Transport { return NewMux(NewMemory()) }, "10.0.0.1:0"},
+	{"network", func() Transport { return NewNetwork(clock.System, 0).Host("10.0.0.1") }, "10.0.0.1:0"},
+}
+
+// Opens a listener and connects to it, returning both ends of the connection.
+func connect(t *testing.T, tr Transport, addr string) (Listener, net.Conn, net.Conn) {
+	sock, err := tr.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v.", err)
+	}
+	client, err := tr.Dial(sock.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v.", err)
+	}
+	sock.SetDeadline(time.Now().Add(time.Second))
+	server, err := sock.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v.", err)
+	}
+	return sock, client, server
+}
+
+func TestTransfer(t *testing.T) {
+	for _, tt := range transports {
+		sock, client, server := connect(t, tt.make(), tt.addr)
+
+		// Transfer a large blob in both directions concurrently
+		blob := make([]byte, 1024*1024+17)
+		for i := range blob {
+			blob[i] = byte(i)
+		}
+		errc := make(chan error, 2)
+		for _, conn := range []net.Conn{client, server} {
+			go func(conn net.Conn) {
+				_, err := conn.Write(blob)
+				errc <- err
+			}(conn)
+		}
+		for i, conn := range []net.Conn{client, server} {
+			data := make([]byte, len(blob))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				t.Fatalf("%s: side %d: failed to read: %v.", tt.name, i, err)
+			}
+			if !bytes.Equal(data, blob) {
+				t.Fatalf("%s: side %d: data mismatch.", tt.name, i)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := <-errc; err != nil {
+				t.Fatalf("%s: failed to write: %v.", tt.name, err)
+			}
+		}
+		// Close one side and ensure the other notices
+		client.Close()
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%s: close mismatch: have %v, want %v.", tt.name, err, io.EOF)
+		}
+		server.Close()
+		sock.Close()
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	for _, tt := range transports {
+		sock, client, server := connect(t, tt.make(), tt.addr)
+
+		// Accept should time out with no pending connections
+		sock.SetDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := sock.Accept(); err == nil {
+			t.Fatalf("%s: accept succeeded without dial.", tt.name)
+		} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("%s: accept error mismatch: have %v, want timeout.", tt.name, err)
+		}
+		// Reads should time out with no pending data
+		client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("%s: read succeeded without data.", tt.name)
+		} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("%s: read error mismatch: have %v, want timeout.", tt.name, err)
+		}
+		// Clearing the deadline should allow reads again
+		client.SetReadDeadline(time.Time{})
+		go server.Write([]byte{0x42})
+		if buf := make([]byte, 1); true {
+			if _, err := client.Read(buf); err != nil || buf[0] != 0x42 {
+				t.Fatalf("%s: read after deadline reset failed: %v, %x.", tt.name, err, buf)
+			}
+		}
+		client.Close()
+		server.Close()
+		sock.Close()
+	}
+}
+
+func TestRefused(t *testing.T) {
+	for _, tt := range transports[1:] {
+		tr := tt.make()
+		sock, err := tr.Listen(tt.addr)
+		if err != nil {
+			t.Fatalf("%s: failed to listen: %v.", tt.name, err)
+		}
+		addr := sock.Addr().String()
+		sock.Close()
+
+		if conn, err := tr.Dial(addr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			t.Fatalf("%s: dial succeeded to closed listener.", tt.name)
+		}
+	}
+}
+
+func TestMuxSharing(t *testing.T) {
+	base := NewMemory()
+	tr := NewMux(base)
+
+	sock, err := tr.Listen("10.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v.", err)
+	}
+	defer sock.Close()
+
+	// Open a handful of streams, ensure they share a single base connection
+	clients, servers := []net.Conn{}, []net.Conn{}
+	for i := 0; i < 4; i++ {
+		client, err := tr.Dial(sock.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("stream %d: failed to dial: %v.", i, err)
+		}
+		sock.SetDeadline(time.Now().Add(time.Second))
+		server, err := sock.Accept()
+		if err != nil {
+			t.Fatalf("stream %d: failed to accept: %v.", i, err)
+		}
+		clients, servers = append(clients, client), append(servers, server)
+	}
+	tr.lock.Lock()
+	n := len(tr.sessions)
+	tr.lock.Unlock()
+	if n != 1 {
+		t.Fatalf("session count mismatch: have %d, want %d.", n, 1)
+	}
+	// Fill up the first stream without reading it, others should still work
+	clients[0].SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := clients[0].Write(make([]byte, 2*muxWindow)); err == nil {
+		t.Fatalf("stalled stream accepted data beyond its window.")
+	}
+	for i := 1; i < len(clients); i++ {
+		if _, err := clients[i].Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("stream %d: failed to write: %v.", i, err)
+		}
+		buf := make([]byte, 1)
+		servers[i].SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := servers[i].Read(buf); err != nil || buf[0] != byte(i) {
+			t.Fatalf("stream %d: failed to read: %v, %x.", i, err, buf)
+		}
+	}
+	// Close all the streams, ensure the idle session is torn down
+	for i := range clients {
+		clients[i].Close()
+		servers[i].Close()
+	}
+	for i := 0; ; i++ {
+		tr.lock.Lock()
+		n := len(tr.sessions)
+		tr.lock.Unlock()
+
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("idle session not torn down: have %d, want %d.", n, 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Reads from a connection with a short deadline, returning the data or nil.
+func poll(conn net.Conn) []byte {
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestNetworkLatency(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	network := NewNetwork(clk, 0)
+	network.SetLink("10.0.0.1", "10.0.0.2", Link{Latency: 100 * time.Millisecond})
+
+	sock, err := network.Host("10.0.0.2").Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v.", err)
+	}
+	defer sock.Close()
+
+	client, err := network.Host("10.0.0.1").Dial(sock.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v.", err)
+	}
+	sock.SetDeadline(time.Now().Add(time.Second))
+	server, err := sock.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v.", err)
+	}
+	if host := server.RemoteAddr().(*net.TCPAddr).IP.String(); host != "10.0.0.1" {
+		t.Fatalf("remote host mismatch: have %v, want %v.", host, "10.0.0.1")
+	}
+	// Send a message and ensure it arrives only after the link latency
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v.", err)
+	}
+	if data := poll(server); data != nil {
+		t.Fatalf("data arrived before latency elapsed: %q.", data)
+	}
+	clk.Advance(50 * time.Millisecond)
+	if data := poll(server); data != nil {
+		t.Fatalf("data arrived before latency elapsed: %q.", data)
+	}
+	clk.Advance(50 * time.Millisecond)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("failed to read delayed data: %v, %q.", err, buf)
+	}
+	// Close with data in flight, ensure it's delivered before the closure
+	client.Write([]byte("bye"))
+	client.Close()
+	if data := poll(server); data != nil {
+		t.Fatalf("data arrived before latency elapsed: %q.", data)
+	}
+	clk.Advance(100 * time.Millisecond)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if data, err := io.ReadAll(server); err != nil || string(data) != "bye" {
+		t.Fatalf("failed to read flushed data: %v, %q.", err, data)
+	}
+	server.Close()
+}
+
+func TestNetworkPartition(t *testing.T) {
+	network := NewNetwork(clock.System, 0)
+	alice, bob := network.Host("10.0.0.1"), network.Host("10.0.0.2")
+
+	sock, err := bob.Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v.", err)
+	}
+	defer sock.Close()
+
+	if _, err := alice.Listen("10.0.0.2:0"); err == nil {
+		t.Fatalf("listened on a foreign host.")
+	}
+	client, err := alice.Dial(sock.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v.", err)
+	}
+	sock.SetDeadline(time.Now().Add(time.Second))
+	server, err := sock.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v.", err)
+	}
+	// Partition the two hosts, ensure the connection is severed and dials fail
+	network.Partition([]string{"10.0.0.1"})
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read succeeded on severed connection.")
+	}
+	if _, err := client.Write([]byte{0x00}); err == nil {
+		t.Fatalf("write succeeded on severed connection.")
+	}
+	if _, err := alice.Dial(sock.Addr().String(), time.Second); err == nil {
+		t.Fatalf("dial succeeded across partition.")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("dial error mismatch: have %v, want timeout.", err)
+	}
+	client.Close()
+	server.Close()
+
+	// Heal the network and ensure connectivity is restored
+	network.Heal()
+	client, err = alice.Dial(sock.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial after healing: %v.", err)
+	}
+	client.Close()
+}
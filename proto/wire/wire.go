@@ -0,0 +1,427 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package wire implements the versioned binary encoding of the message headers
+// exchanged over links. Contrary to gob, it needs neither reflection nor Go type
+// registration, so it's fast and implementable in any language.
+//
+// An encoded header consists of the encoding version, the metadata, the key and
+// IV of the payload and its compression codec, omitted if uncompressed. Metadata
+// starts with the type tag (0 for nil), which is followed by the fields of the
+// type, nested metadata encoded recursively:
+//
+//	header = version:u8 meta key:bytes iv:bytes [codec:uint]
+//	meta   = tag:uint [fields]
+//
+// Integers are varints and strings are prefixed with their length, while byte
+// slices and lists with their length plus one, zero standing for nil.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
+)
+
+// Encoding version of the link headers.
+type Version uint8
+
+const (
+	VersionGob    Version = iota // Legacy gob encoding, kept for mixed cluster migrations
+	VersionBinary                // Binary encoding implemented by this package
+)
+
+// Builtin metadata type tags, registered ones must be above these.
+const (
+	tagNil uint64 = iota
+	tagBytes
+	tagString
+)
+
+// Returned if an encoded header is truncated or otherwise malformed.
+var ErrCorrupt = errors.New("corrupt wire data")
+
+// Returned if the two sides of a negotiation have no encoding in common.
+var ErrNoVersion = errors.New("no common wire version")
+
+// Metadata type that can be transferred by the binary encoding.
+type Meta interface {
+	MarshalWire(enc *Encoder)
+	UnmarshalWire(dec *Decoder)
+}
+
+// Registered metadata types, indexed both ways.
+var (
+	tags      = make(map[reflect.Type]uint64)
+	factories = make(map[uint64]func() Meta)
+)
+
+// Registers a metadata type with a tag unique across the whole protocol stack.
+// It must be called during package initialization. Tags currently allocated:
+//
+//	3-7:   link control packets
+//	8-15:  session handshake packets
+//	16-23: pastry headers
+//	24-31: scribe headers
+//	32-39: iris headers and tunnel packets
+func Register(tag uint64, factory func() Meta) {
+	if tag <= tagString {
+		panic(fmt.Sprintf("wire: reserved tag %d", tag))
+	}
+	if _, ok := factories[tag]; ok {
+		panic(fmt.Sprintf("wire: duplicate tag %d", tag))
+	}
+	factories[tag] = factory
+	tags[reflect.TypeOf(factory())] = tag
+}
+
+// Collects the locally enabled encoding versions, newest first.
+func Enabled() []Version {
+	versions := make([]Version, 0, len(config.WireVersions))
+	for _, v := range config.WireVersions {
+		versions = append(versions, Version(v))
+	}
+	return versions
+}
+
+// Picks the first locally enabled version that was also offered by the remote
+// side. Both sides enabling the same set reach the same choice.
+func Negotiate(enabled, offers []Version) (Version, error) {
+	for _, v := range enabled {
+		for _, offer := range offers {
+			if v == offer {
+				return v, nil
+			}
+		}
+	}
+	return 0, ErrNoVersion
+}
+
+// Appends the binary encoding of a message header to the buffer.
+func AppendHeader(buf []byte, head *proto.Header) ([]byte, error) {
+	return new(Encoder).AppendHeader(buf, head)
+}
+
+// Parses a binary encoded message header.
+func ParseHeader(data []byte, head *proto.Header) error {
+	return new(Decoder).ParseHeader(data, head)
+}
+
+// Binary encoder accumulating the fields of a header.
+type Encoder struct {
+	buf []byte
+	err error
+}
+
+// Appends the binary encoding of a message header to the buffer, reusing the
+// encoder to spare an allocation on hot paths.
+func (e *Encoder) AppendHeader(buf []byte, head *proto.Header) ([]byte, error) {
+	e.buf, e.err = append(buf, byte(VersionBinary)), nil
+	e.PutMeta(head.Meta)
+	e.PutBytes(head.Key)
+	e.PutBytes(head.Iv)
+	if head.Codec != compress.None {
+		e.PutUint(uint64(head.Codec))
+	}
+	buf, e.buf = e.buf, nil
+	return buf, e.err
+}
+
+// Appends an unsigned integer.
+func (e *Encoder) PutUint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// Appends a signed integer.
+func (e *Encoder) PutInt(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// Appends a boolean flag.
+func (e *Encoder) PutBool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// Appends a byte slice, keeping nil and empty apart.
+func (e *Encoder) PutBytes(v []byte) {
+	if v == nil {
+		e.PutUint(0)
+		return
+	}
+	e.PutUint(uint64(len(v)) + 1)
+	e.buf = append(e.buf, v...)
+}
+
+// Appends a string.
+func (e *Encoder) PutString(v string) {
+	e.PutUint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// Appends a list of strings, keeping nil and empty apart.
+func (e *Encoder) PutStrings(v []string) {
+	if v == nil {
+		e.PutUint(0)
+		return
+	}
+	e.PutUint(uint64(len(v)) + 1)
+	for _, s := range v {
+		e.PutString(s)
+	}
+}
+
+// Appends a non-negative big integer (e.g. an overlay id), or nil.
+func (e *Encoder) PutBigInt(v *big.Int) {
+	if v == nil {
+		e.PutUint(0)
+		return
+	}
+	if v.Sign() < 0 {
+		e.fail(errors.New("negative big integer"))
+		return
+	}
+	e.PutBytes(v.Bytes())
+}
+
+// Appends a tagged metadata value, which must be nil, a byte slice, a string or
+// a registered type.
+func (e *Encoder) PutMeta(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		e.PutUint(tagNil)
+	case []byte:
+		e.PutUint(tagBytes)
+		e.PutBytes(v)
+	case string:
+		e.PutUint(tagString)
+		e.PutString(v)
+	case Meta:
+		tag, ok := tags[reflect.TypeOf(v)]
+		if !ok {
+			e.fail(fmt.Errorf("unregistered meta type: %T", v))
+			return
+		}
+		e.PutUint(tag)
+		v.MarshalWire(e)
+	default:
+		e.fail(fmt.Errorf("unsupported meta type: %T", v))
+	}
+}
+
+// Records the first encoding failure.
+func (e *Encoder) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// Binary decoder consuming the fields of a header. Errors are sticky, causing
+// all later reads to return zero values, so callers need to check only once.
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+// Parses a binary encoded message header, reusing the decoder to spare an
+// allocation on hot paths.
+func (d *Decoder) ParseHeader(data []byte, head *proto.Header) error {
+	if len(data) == 0 {
+		return ErrCorrupt
+	}
+	if v := Version(data[0]); v != VersionBinary {
+		return fmt.Errorf("unsupported wire version: %d", v)
+	}
+	d.buf, d.err = data[1:], nil
+	head.Meta = d.Meta()
+	head.Key = d.Bytes()
+	head.Iv = d.Bytes()
+	head.Codec = compress.None
+	if d.err == nil && len(d.buf) > 0 {
+		if codec := d.Uint(); codec == uint64(compress.None) || codec > 255 {
+			d.err = ErrCorrupt
+		} else {
+			head.Codec = compress.Codec(codec)
+		}
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = ErrCorrupt
+	}
+	d.buf = nil
+	return d.err
+}
+
+// Returns the first decoding failure, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Consumes an unsigned integer.
+func (d *Decoder) Uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(ErrCorrupt)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Consumes a signed integer.
+func (d *Decoder) Int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(ErrCorrupt)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Consumes a boolean flag.
+func (d *Decoder) Bool() bool {
+	switch d.Uint() {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		d.fail(ErrCorrupt)
+		return false
+	}
+}
+
+// Consumes a byte slice. The result is copied, so it's safe to retain after the
+// source buffer is reused.
+func (d *Decoder) Bytes() []byte {
+	size := d.Uint()
+	if size == 0 {
+		return nil
+	}
+	raw := d.raw(size - 1)
+	if raw == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(raw)), raw...)
+}
+
+// Consumes a string.
+func (d *Decoder) String() string {
+	return string(d.raw(d.Uint()))
+}
+
+// Consumes a list of strings.
+func (d *Decoder) Strings() []string {
+	count := d.Count()
+	if count < 0 {
+		return nil
+	}
+	list := make([]string, count)
+	for i := range list {
+		list[i] = d.String()
+	}
+	return list
+}
+
+// Consumes a non-negative big integer, or nil.
+func (d *Decoder) BigInt() *big.Int {
+	size := d.Uint()
+	if size == 0 {
+		return nil
+	}
+	raw := d.raw(size - 1)
+	if raw == nil {
+		return nil
+	}
+	return new(big.Int).SetBytes(raw)
+}
+
+// Consumes the element count of a list, returning -1 for nil. The count is
+// sanity checked against the remaining data (each element takes at least one
+// byte), preventing huge allocations from forged counts.
+func (d *Decoder) Count() int {
+	count := d.Uint()
+	if count == 0 {
+		return -1
+	}
+	if count-1 > uint64(len(d.buf)) {
+		d.fail(ErrCorrupt)
+		return -1
+	}
+	return int(count - 1)
+}
+
+// Consumes a tagged metadata value.
+func (d *Decoder) Meta() interface{} {
+	tag := d.Uint()
+	if d.err != nil {
+		return nil
+	}
+	switch tag {
+	case tagNil:
+		return nil
+	case tagBytes:
+		return d.Bytes()
+	case tagString:
+		return d.String()
+	}
+	factory, ok := factories[tag]
+	if !ok {
+		d.fail(fmt.Errorf("unknown meta tag: %d", tag))
+		return nil
+	}
+	meta := factory()
+	meta.UnmarshalWire(d)
+	return meta
+}
+
+// Consumes a number of raw bytes without copying.
+func (d *Decoder) raw(size uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if size > uint64(len(d.buf)) {
+		d.fail(ErrCorrupt)
+		return nil
+	}
+	raw := d.buf[:size:size]
+	d.buf = d.buf[size:]
+	return raw
+}
+
+// Records the first decoding failure.
+func (d *Decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
@@ -0,0 +1,258 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package wire
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/compress"
+)
+
+// Nested metadata exercising all the field encoders.
+type testMeta struct {
+	Meta  interface{}
+	Num   uint64
+	Sign  int64
+	Flag  bool
+	Blob  []byte
+	Name  string
+	Names []string
+	Id    *big.Int
+}
+
+func (m *testMeta) MarshalWire(enc *Encoder) {
+	enc.PutMeta(m.Meta)
+	enc.PutUint(m.Num)
+	enc.PutInt(m.Sign)
+	enc.PutBool(m.Flag)
+	enc.PutBytes(m.Blob)
+	enc.PutString(m.Name)
+	enc.PutStrings(m.Names)
+	enc.PutBigInt(m.Id)
+}
+
+func (m *testMeta) UnmarshalWire(dec *Decoder) {
+	m.Meta = dec.Meta()
+	m.Num = dec.Uint()
+	m.Sign = dec.Int()
+	m.Flag = dec.Bool()
+	m.Blob = dec.Bytes()
+	m.Name = dec.String()
+	m.Names = dec.Strings()
+	m.Id = dec.BigInt()
+}
+
+func init() {
+	gob.Register(&testMeta{})
+	Register(255, func() Meta { return new(testMeta) })
+}
+
+// Creates a header resembling an overlay message wrapping an upper layer one.
+func testHeader() *proto.Header {
+	id, _ := new(big.Int).SetString("123456789012345678901234567890123456789", 10)
+	return &proto.Header{
+		Meta: &testMeta{
+			Meta: &testMeta{
+				Meta:  "upper",
+				Num:   1 << 40,
+				Sign:  -42,
+				Names: []string{},
+			},
+			Flag:  true,
+			Blob:  []byte{1, 2, 3},
+			Name:  "overlay",
+			Names: []string{"10.0.0.1:14142", "10.0.0.2:14142"},
+			Id:    id,
+		},
+		Key: bytes.Repeat([]byte{0xaa}, 16),
+		Iv:  bytes.Repeat([]byte{0xbb}, 16),
+	}
+}
+
+// Tests that headers survive an encoding roundtrip.
+func TestRoundtrip(t *testing.T) {
+	heads := []*proto.Header{
+		{},
+		{Meta: []byte{}, Key: []byte{}},
+		{Meta: "meta"},
+		{Key: []byte{1}, Iv: []byte{2}, Codec: compress.Deflate},
+		testHeader(),
+	}
+	for i, head := range heads {
+		data, err := AppendHeader(nil, head)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode header: %v.", i, err)
+		}
+		have := new(proto.Header)
+		if err := ParseHeader(data, have); err != nil {
+			t.Fatalf("test %d: failed to decode header: %v.", i, err)
+		}
+		if !reflect.DeepEqual(have, head) {
+			t.Fatalf("test %d: header mismatch: have %+v, want %+v.", i, have, head)
+		}
+	}
+}
+
+// Tests that unsupported metadata is refused by the encoder.
+func TestUnsupported(t *testing.T) {
+	type unregistered struct{}
+
+	for i, meta := range []interface{}{42, &unregistered{}, &testMeta{Id: big.NewInt(-1)}} {
+		if _, err := AppendHeader(nil, &proto.Header{Meta: meta}); err == nil {
+			t.Fatalf("test %d: unsupported meta %v encoded.", i, meta)
+		}
+	}
+}
+
+// Tests that truncated, extended or otherwise malformed data is rejected.
+func TestCorrupt(t *testing.T) {
+	data, err := AppendHeader(nil, testHeader())
+	if err != nil {
+		t.Fatalf("failed to encode header: %v.", err)
+	}
+	// Every strict prefix must fail
+	for i := 0; i < len(data); i++ {
+		if err := ParseHeader(data[:i], new(proto.Header)); err == nil {
+			t.Fatalf("truncated header (%d/%d bytes) accepted.", i, len(data))
+		}
+	}
+	// Trailing garbage must fail
+	if err := ParseHeader(append(data, 0), new(proto.Header)); err != ErrCorrupt {
+		t.Fatalf("trailing data error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	if err := ParseHeader(append(data, byte(compress.Deflate), 0), new(proto.Header)); err != ErrCorrupt {
+		t.Fatalf("trailing codec data error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	// Unknown versions and tags must fail
+	bad := append([]byte{}, data...)
+	bad[0] = byte(VersionGob)
+	if err := ParseHeader(bad, new(proto.Header)); err == nil {
+		t.Fatalf("unsupported version accepted.")
+	}
+	if err := ParseHeader([]byte{byte(VersionBinary), 100, 0, 0}, new(proto.Header)); err == nil {
+		t.Fatalf("unknown meta tag accepted.")
+	}
+	// Forged list lengths must fail without allocating
+	forged := []byte{byte(VersionBinary), 255, 1, 0, 0, 0, 0, 0, 1, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}
+	if err := ParseHeader(forged, new(proto.Header)); err != ErrCorrupt {
+		t.Fatalf("forged count error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+}
+
+// Tests that the version negotiation picks the preferred common encoding.
+func TestNegotiate(t *testing.T) {
+	defer func(versions []int) { config.WireVersions = versions }(config.WireVersions)
+
+	tests := []struct {
+		local  []int
+		offers []Version
+		want   Version
+		err    error
+	}{
+		{[]int{1, 0}, []Version{VersionGob, VersionBinary}, VersionBinary, nil},
+		{[]int{1, 0}, []Version{VersionGob}, VersionGob, nil},
+		{[]int{0, 1}, []Version{VersionBinary, VersionGob}, VersionGob, nil},
+		{[]int{1}, []Version{VersionGob}, 0, ErrNoVersion},
+		{[]int{1}, nil, 0, ErrNoVersion},
+	}
+	for i, tt := range tests {
+		config.WireVersions = tt.local
+		have, err := Negotiate(Enabled(), tt.offers)
+		if err != tt.err {
+			t.Fatalf("test %d: error mismatch: have %v, want %v.", i, err, tt.err)
+		}
+		if err == nil && have != tt.want {
+			t.Fatalf("test %d: version mismatch: have %v, want %v.", i, have, tt.want)
+		}
+	}
+}
+
+// Benchmarks the gob encoding of a header.
+func BenchmarkGobEncode(b *testing.B) {
+	head := testHeader()
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := enc.Encode(head); err != nil {
+			b.Fatalf("failed to encode header: %v.", err)
+		}
+	}
+}
+
+// Benchmarks the gob decoding of a header.
+func BenchmarkGobDecode(b *testing.B) {
+	// Gob streams are stateful, pre-encode all the headers into one
+	head := testHeader()
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(head); err != nil {
+			b.Fatalf("failed to encode header: %v.", err)
+		}
+	}
+	dec := gob.NewDecoder(buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dec.Decode(new(proto.Header)); err != nil {
+			b.Fatalf("failed to decode header: %v.", err)
+		}
+	}
+}
+
+// Benchmarks the binary encoding of a header.
+func BenchmarkBinaryEncode(b *testing.B) {
+	head := testHeader()
+	buf := make([]byte, 0, 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendHeader(buf[:0], head); err != nil {
+			b.Fatalf("failed to encode header: %v.", err)
+		}
+	}
+}
+
+// Benchmarks the binary decoding of a header.
+func BenchmarkBinaryDecode(b *testing.B) {
+	data, err := AppendHeader(nil, testHeader())
+	if err != nil {
+		b.Fatalf("failed to encode header: %v.", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ParseHeader(data, new(proto.Header)); err != nil {
+			b.Fatalf("failed to decode header: %v.", err)
+		}
+	}
+}
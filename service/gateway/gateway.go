@@ -0,0 +1,135 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package gateway implements an HTTP entry point into the Iris network for
+// locally running tools that cannot embed a language binding:
+//
+//	POST /request/{cluster}   - request/reply, timeout in the X-Iris-Timeout header (ms)
+//	POST /broadcast/{cluster} - broadcast the body to all members of a cluster
+//	POST /publish/{topic}     - publish the body as an event into a topic
+//	GET  /subscribe/{topic}   - stream topic events as server-sent events
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// HTTP gateway service, listening on a local TCP port and translating HTTP calls
+// into Iris operations.
+type Gateway struct {
+	endpoint  int            // Local port on which to listen on
+	listeners []net.Listener // Listener sockets for the local HTTP clients
+
+	iris *iris.Overlay    // Overlay through which the calls are relayed
+	conn *iris.Connection // Shared client connection for the one-shot calls
+
+	streams sync.WaitGroup // Active event streams to wait for during termination
+	term    chan struct{}  // Channel to signal termination to the event streams
+	lock    sync.Mutex     // Lock serializing stream registration and termination
+}
+
+// Creates a new HTTP gateway attached to an Iris overlay, ready to listen on the
+// specified local port.
+func New(port int, overlay *iris.Overlay) (*Gateway, error) {
+	return &Gateway{
+		endpoint:  port,
+		listeners: []net.Listener{},
+		iris:      overlay,
+		term:      make(chan struct{}),
+	}, nil
+}
+
+// Connects to the Iris overlay and starts accepting local HTTP requests.
+func (g *Gateway) Boot() error {
+	// Create the shared client connection
+	conn, err := g.iris.Connect("", nil)
+	if err != nil {
+		return err
+	}
+	g.conn = conn
+
+	// Open the two (IPv4 and IPv6) listener sockets
+	errs := []error{}
+	for _, addr := range []string{"127.0.0.1", "[::1]"} {
+		if sock, err := net.Listen("tcp", fmt.Sprintf("%s:%d", addr, g.endpoint)); err != nil {
+			log.Printf("gateway: failed to listen on %s:%d: %v", addr, g.endpoint, err)
+			errs = append(errs, err)
+		} else {
+			g.listeners = append(g.listeners, sock)
+		}
+	}
+	if len(errs) == 2 {
+		g.conn.Close()
+		return fmt.Errorf("boot failed: %v (IPv4), %v (IPv6)", errs[0], errs[1])
+	}
+	// Start serving the HTTP requests
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request/", g.serveRequest)
+	mux.HandleFunc("/broadcast/", g.serveBroadcast)
+	mux.HandleFunc("/publish/", g.servePublish)
+	mux.HandleFunc("/subscribe/", g.serveSubscribe)
+
+	for _, sock := range g.listeners {
+		go func(sock net.Listener) {
+			// Serve always fails on termination, only report if unexpected
+			if err := http.Serve(sock, mux); err != nil {
+				select {
+				case <-g.term:
+				default:
+					log.Printf("gateway: serving on %v failed: %v.", sock.Addr(), err)
+				}
+			}
+		}(sock)
+	}
+	return nil
+}
+
+// Closes the listener sockets, terminates all active event streams and drops
+// the connection to the Iris overlay.
+func (g *Gateway) Terminate() error {
+	errs := []error{}
+
+	// Signal the termination (no new streams after) and stop accepting connections
+	g.lock.Lock()
+	close(g.term)
+	g.lock.Unlock()
+	for _, sock := range g.listeners {
+		if err := sock.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Wait for the event streams to tear down and close the shared connection
+	g.streams.Wait()
+	if err := g.conn.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%v", errs)
+	}
+}
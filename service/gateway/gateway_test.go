@@ -0,0 +1,210 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Echo service handler for the request tests.
+type echoer struct{}
+
+func (e *echoer) HandleBroadcast(msg []byte) {}
+
+func (e *echoer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	if string(req) == "fail" {
+		return nil, fmt.Errorf("requested failure")
+	}
+	return req, nil
+}
+
+func (e *echoer) HandleTunnel(tun *iris.Tunnel) {
+	tun.Close()
+}
+
+// Boots a single node Iris overlay with a gateway attached.
+func boot(t *testing.T) (*iris.Overlay, *Gateway, string) {
+	bootTimeout := config.PastryBootTimeout
+	config.PastryBootTimeout = 500 * time.Millisecond
+	defer func() { config.PastryBootTimeout = bootTimeout }()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v.", err)
+	}
+	overlay := iris.New("gateway-test", key)
+	if _, err := overlay.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	gate, err := New(0, overlay)
+	if err != nil {
+		t.Fatalf("failed to create gateway: %v.", err)
+	}
+	if err := gate.Boot(); err != nil {
+		t.Fatalf("failed to boot gateway: %v.", err)
+	}
+	return overlay, gate, "http://" + gate.listeners[0].Addr().String()
+}
+
+// Tears down a gateway and its overlay.
+func shutdown(t *testing.T, overlay *iris.Overlay, gate *Gateway) {
+	if err := gate.Terminate(); err != nil {
+		t.Fatalf("failed to terminate gateway: %v.", err)
+	}
+	if err := overlay.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate iris overlay: %v.", err)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	overlay, gate, base := boot(t)
+	defer shutdown(t, overlay, gate)
+
+	// Register an echo service to serve the requests
+	conn, err := overlay.Connect("echo", new(echoer))
+	if err != nil {
+		t.Fatalf("failed to register echo service: %v.", err)
+	}
+	defer conn.Close()
+
+	// Define the test cases and run each of them
+	tests := []struct {
+		path    string
+		timeout string
+		body    string
+		status  int
+		reply   string
+	}{
+		{"/request/echo", "", "hello", http.StatusOK, "hello"},
+		{"/request/echo", "1000", "world", http.StatusOK, "world"},
+		{"/request/echo", "1000", "fail", http.StatusBadGateway, `{"error":"requested failure"}`},
+		{"/request/echo", "invalid", "hello", http.StatusBadRequest, ""},
+		{"/request/echo", "-1", "hello", http.StatusBadRequest, ""},
+		{"/request/missing", "100", "hello", http.StatusGatewayTimeout, `{"error":"timeout"}`},
+		{"/request/", "100", "hello", http.StatusNotFound, ""},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("POST", base+tt.path, strings.NewReader(tt.body))
+		if tt.timeout != "" {
+			req.Header.Set(timeoutHeader, tt.timeout)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("test %d: failed to execute request: %v.", i, err)
+		}
+		reply, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("test %d: status mismatch: have %v, want %v.", i, res.StatusCode, tt.status)
+		}
+		if tt.reply != "" && strings.TrimSpace(string(reply)) != tt.reply {
+			t.Errorf("test %d: reply mismatch: have %s, want %s.", i, reply, tt.reply)
+		}
+	}
+	// Make sure the methods are enforced
+	if res, err := http.Get(base + "/request/echo"); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	} else if res.Body.Close(); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status mismatch: have %v, want %v.", res.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	overlay, gate, base := boot(t)
+	defer shutdown(t, overlay, gate)
+
+	// Open an event stream and wait for the subscription to go live
+	res, err := http.Get(base + "/subscribe/topic")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v.", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status mismatch: have %v, want %v.", res.StatusCode, http.StatusOK)
+	}
+	if kind := res.Header.Get("Content-Type"); kind != "text/event-stream" {
+		t.Fatalf("content type mismatch: have %v, want %v.", kind, "text/event-stream")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish a few events through the gateway
+	events := []string{"single line", "multi\nline", ""}
+	for i, event := range events {
+		res, err := http.Post(base+"/publish/topic", "text/plain", strings.NewReader(event))
+		if err != nil {
+			t.Fatalf("event %d: failed to publish: %v.", i, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("event %d: status mismatch: have %v, want %v.", i, res.StatusCode, http.StatusAccepted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Retrieve the events from the stream and verify them
+	stream := bufio.NewReader(res.Body)
+	for i, event := range events {
+		data := []string{}
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				t.Fatalf("event %d: failed to read stream: %v.", i, err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "data: ") {
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if have := strings.Join(data, "\n"); have != event {
+			t.Fatalf("event %d: data mismatch: have %q, want %q.", i, have, event)
+		}
+	}
+}
+
+func TestAssembleEvent(t *testing.T) {
+	tests := []struct {
+		event []byte
+		sse   string
+	}{
+		{[]byte{}, "event: publish\ndata: \n\n"},
+		{[]byte("hello"), "event: publish\ndata: hello\n\n"},
+		{[]byte("a\nb"), "event: publish\ndata: a\ndata: b\n\n"},
+	}
+	for i, tt := range tests {
+		if have := assembleEvent(tt.event); !bytes.Equal(have, []byte(tt.sse)) {
+			t.Errorf("test %d: event mismatch: have %q, want %q.", i, have, tt.sse)
+		}
+	}
+}
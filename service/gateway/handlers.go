@@ -0,0 +1,265 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// HTTP handlers of the gateway. Message bodies are passed through untouched in
+// both directions, whereas failures are reported as small JSON documents of the
+// form {"error": "reason"}. Topic events are streamed as server-sent events,
+// multi-line payloads being split into multiple data fields as per the spec.
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Header field specifying the request timeout in milliseconds.
+const timeoutHeader = "X-Iris-Timeout"
+
+// Reports a failure to the HTTP client as a JSON document.
+func fail(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
+
+// Extracts the cluster or topic name from the request path, ensuring the method
+// matches the expected one. If anything's wrong, the failure is reported to the
+// client and an empty name returned.
+func target(w http.ResponseWriter, r *http.Request, method, prefix string) string {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		fail(w, http.StatusMethodNotAllowed, fmt.Sprintf("method not allowed: have %s, want %s", r.Method, method))
+		return ""
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if name == "" || strings.Contains(name, "/") {
+		fail(w, http.StatusNotFound, fmt.Sprintf("invalid target: %s", r.URL.Path))
+		return ""
+	}
+	return name
+}
+
+// Retrieves the message body of an HTTP request, enforcing the size limit.
+func body(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.GatewayBodyLimit))
+	if err != nil {
+		fail(w, http.StatusRequestEntityTooLarge, err.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// Parses the request timeout header, falling back to the configured default if
+// none was specified.
+func timeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(timeoutHeader)
+	if value == "" {
+		return config.GatewayRequestTimeout, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid timeout: %s", value)
+	}
+	if limit := config.GatewayRequestTimeoutLimit; time.Duration(ms)*time.Millisecond > limit {
+		return 0, fmt.Errorf("timeout limit exceeded: %d ms > %d ms", ms, int64(limit/time.Millisecond))
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Maps an Iris failure of an asynchronous operation to an HTTP status code.
+func status(err error) int {
+	if err == iris.ErrSizeLimit {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadGateway
+}
+
+// Forwards an HTTP request into the Iris network and writes back the reply.
+func (g *Gateway) serveRequest(w http.ResponseWriter, r *http.Request) {
+	cluster := target(w, r, "POST", "/request/")
+	if cluster == "" {
+		return
+	}
+	limit, err := timeout(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, ok := body(w, r)
+	if !ok {
+		return
+	}
+	reply, err := g.conn.Request(cluster, req, limit)
+	switch {
+	case err == iris.ErrTimeout:
+		fail(w, http.StatusGatewayTimeout, err.Error())
+	case err == iris.ErrTerminating:
+		fail(w, http.StatusServiceUnavailable, err.Error())
+	case err == iris.ErrSizeLimit:
+		fail(w, http.StatusRequestEntityTooLarge, err.Error())
+	case err != nil:
+		fail(w, http.StatusBadGateway, err.Error())
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(reply)
+	}
+}
+
+// Forwards an HTTP request as a broadcast into the Iris network.
+func (g *Gateway) serveBroadcast(w http.ResponseWriter, r *http.Request) {
+	cluster := target(w, r, "POST", "/broadcast/")
+	if cluster == "" {
+		return
+	}
+	msg, ok := body(w, r)
+	if !ok {
+		return
+	}
+	if err := g.conn.Broadcast(cluster, msg); err != nil {
+		fail(w, status(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Forwards an HTTP request as a topic event into the Iris network.
+func (g *Gateway) servePublish(w http.ResponseWriter, r *http.Request) {
+	topic := target(w, r, "POST", "/publish/")
+	if topic == "" {
+		return
+	}
+	event, ok := body(w, r)
+	if !ok {
+		return
+	}
+	if err := g.conn.Publish(topic, event); err != nil {
+		fail(w, status(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handler for a gateway topic subscription. Buffers the arriving events until
+// the event stream can push them out to the HTTP client.
+type subscriptionHandler struct {
+	topic  string
+	events chan []byte
+}
+
+// Queues an arriving topic event for the HTTP client, dropping it if the client
+// is too slow to keep up.
+func (s *subscriptionHandler) HandleEvent(msg []byte) {
+	select {
+	case s.events <- msg:
+	default:
+		log.Printf("gateway: event buffer full, dropping event from %s.", s.topic)
+	}
+}
+
+// Subscribes to a topic on behalf of the HTTP client and streams the arriving
+// events until the client disconnects or the gateway terminates.
+func (g *Gateway) serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	topic := target(w, r, "GET", "/subscribe/")
+	if topic == "" {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fail(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	// Make sure the gateway is not terminating and register the stream
+	g.lock.Lock()
+	select {
+	case <-g.term:
+		g.lock.Unlock()
+		fail(w, http.StatusServiceUnavailable, iris.ErrTerminating.Error())
+		return
+	default:
+		g.streams.Add(1)
+		defer g.streams.Done()
+	}
+	g.lock.Unlock()
+
+	// Each stream needs a separate connection (no duplicate subscriptions)
+	conn, err := g.iris.Connect("", nil)
+	if err != nil {
+		fail(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	handler := &subscriptionHandler{
+		topic:  topic,
+		events: make(chan []byte, config.GatewayEventBuffer),
+	}
+	if err := conn.Subscribe(topic, handler); err != nil {
+		fail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	// Subscription live, start the event stream
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	alive := time.NewTicker(config.GatewayKeepAlive)
+	defer alive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-g.term:
+			return
+		case <-r.Context().Done():
+			return
+		case <-alive.C:
+			_, err = w.Write([]byte(": keep-alive\n\n"))
+		case event := <-handler.events:
+			_, err = w.Write(assembleEvent(event))
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Assembles a server-sent event from a topic event payload.
+func assembleEvent(event []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("event: publish\n")
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
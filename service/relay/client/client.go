@@ -0,0 +1,311 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package client is a reference implementation of the relay protocol, attaching
+// a Go application to a locally running Iris node. Besides being used by the
+// node's own integration tests, it serves as an executable specification that
+// third party bindings can be validated against.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
+)
+
+// Returned when an operation did not finish in the allotted time.
+var ErrTimeout = errors.New("timeout")
+
+// Returned when an operation is interrupted by the connection terminating.
+var ErrTerminating = errors.New("terminating")
+
+// Returned when an operation is attempted on a closed tunnel.
+var ErrClosed = errors.New("tunnel closed")
+
+// Returned when a message exceeds the size limit advertised by the relay.
+var ErrSizeLimit = errors.New("message size limit exceeded")
+
+// Failure reported by a remote service handler while processing a request.
+type RemoteError struct {
+	Fault string
+}
+
+// Implements the error interface, returning the remote fault message.
+func (e *RemoteError) Error() string {
+	return e.Fault
+}
+
+// Callback interface for processing inbound messages of a registered service.
+type ConnectionHandler interface {
+	// Handles a message broadcast to all members of the local cluster.
+	HandleBroadcast(msg []byte)
+
+	// Handles a request (message), returning the reply that should be forwarded
+	// back to the caller. If the method crashes, nothing is returned and the
+	// caller will eventually time out.
+	HandleRequest(req []byte, timeout time.Duration) ([]byte, error)
+
+	// Handles the request to open a direct tunnel.
+	HandleTunnel(tun *Tunnel)
+}
+
+// Subscription handler receiving events from a single subscribed topic.
+type SubscriptionHandler interface {
+	// Handles an event published to the subscribed topic.
+	HandleEvent(msg []byte)
+}
+
+// Message size limits advertised by the relay. Zero means unknown, in which case
+// the enforcement is left to the relay.
+type limits struct {
+	broadcast int // Maximum size of a broadcast message
+	request   int // Maximum size of a request message
+	reply     int // Maximum size of a reply message or failure reason
+	publish   int // Maximum size of a topic event
+	chunk     int // Maximum size of a tunnel data chunk
+}
+
+// Checks whether a message size is permitted by a limit.
+func (l *limits) permits(limit int, size int) bool {
+	return limit == 0 || size <= limit
+}
+
+// Result of a pending request, either a reply or a failure.
+type result struct {
+	reply []byte
+	err   error
+}
+
+// Client connection to a local Iris node through the relay protocol.
+type Connection struct {
+	handler ConnectionHandler // Handler for inbound service messages (nil if client only)
+	limits  limits            // Message size limits advertised by the relay
+
+	// Application layer fields
+	reqIdx  uint64                 // Index to assign the next request
+	reqPend map[uint64]chan result // Result channels for the pending requests
+	reqLock sync.Mutex             // Mutex to protect the request map
+
+	subLive map[string]SubscriptionHandler // Active topic subscriptions
+	subLock sync.RWMutex                   // Mutex to protect the subscription map
+
+	tunIdx  uint64                  // Index to assign the next tunnel
+	tunPend map[uint64]chan *Tunnel // Result channels for the pending tunnel constructions
+	tunLive map[uint64]*Tunnel      // Active tunnels
+	tunLock sync.RWMutex            // Mutex to protect the tunnel maps
+
+	// Network layer fields
+	sock     net.Conn          // Network connection to the relay
+	sockBuf  *bufio.ReadWriter // Buffered access to the network socket
+	sockLock sync.Mutex        // Mutex to atomize message sending
+
+	// Quality of service fields
+	workers *pool.ThreadPool // Concurrent threads handling the inbound messages
+
+	// Bookkeeping fields
+	term chan struct{} // Channel to signal termination to blocked go-routines
+	done chan struct{} // Channel signalling the termination of the processor
+	fail error         // Failure that terminated the connection, if any
+}
+
+// Connects to a locally running relay as a simple client, only able to send
+// messages, but not accept any.
+func Connect(port int) (*Connection, error) {
+	return Register(port, "", nil)
+}
+
+// Connects to a locally running relay, registering as a member of the given
+// service cluster, with inbound messages being passed to the handler.
+func Register(port int, cluster string, handler ConnectionHandler) (*Connection, error) {
+	sock, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return NewConnection(sock, cluster, handler)
+}
+
+// Executes the relay protocol initialization over an already established
+// network connection. If the cluster is empty, the connection is client only.
+func NewConnection(sock net.Conn, cluster string, handler ConnectionHandler) (*Connection, error) {
+	if (cluster == "") != (handler == nil) {
+		sock.Close()
+		return nil, errors.New("cluster and handler must be both set or both omitted")
+	}
+	conn := &Connection{
+		handler: handler,
+
+		reqPend: make(map[uint64]chan result),
+		subLive: make(map[string]SubscriptionHandler),
+		tunPend: make(map[uint64]chan *Tunnel),
+		tunLive: make(map[uint64]*Tunnel),
+
+		sock:    sock,
+		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
+
+		workers: pool.NewThreadPool(config.RelayHandlerThreads),
+
+		term: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	// Execute the initialization handshake
+	if err := conn.sendInit(cluster); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	if err := conn.procInit(); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	// Start processing the inbound messages
+	conn.workers.Start()
+	go conn.process()
+
+	return conn, nil
+}
+
+// Broadcasts a message to all members of a cluster.
+func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	if !c.limits.permits(c.limits.broadcast, len(msg)) {
+		return ErrSizeLimit
+	}
+	return c.sendBroadcast(cluster, msg)
+}
+
+// Executes a synchronous request to a cluster (load balanced between all active
+// members), returning the received reply.
+func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	if !c.limits.permits(c.limits.request, len(req)) {
+		return nil, ErrSizeLimit
+	}
+	// Create a result channel and register the request
+	resc := make(chan result, 1)
+
+	c.reqLock.Lock()
+	id := c.reqIdx
+	c.reqIdx++
+	c.reqPend[id] = resc
+	c.reqLock.Unlock()
+
+	defer func() {
+		c.reqLock.Lock()
+		delete(c.reqPend, id)
+		c.reqLock.Unlock()
+	}()
+	// Send the request and wait for the relay to report the result
+	if err := c.sendRequest(id, cluster, req, timeout); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.term:
+		return nil, ErrTerminating
+	case res := <-resc:
+		return res.reply, res.err
+	}
+}
+
+// Subscribes to a topic, forwarding all published events to the handler.
+func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
+	c.subLock.Lock()
+	if _, ok := c.subLive[topic]; ok {
+		c.subLock.Unlock()
+		return fmt.Errorf("already subscribed to %s", topic)
+	}
+	c.subLive[topic] = handler
+	c.subLock.Unlock()
+
+	if err := c.sendSubscribe(topic); err != nil {
+		c.subLock.Lock()
+		delete(c.subLive, topic)
+		c.subLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Publishes an event to all subscribers of a topic.
+func (c *Connection) Publish(topic string, msg []byte) error {
+	if !c.limits.permits(c.limits.publish, len(msg)) {
+		return ErrSizeLimit
+	}
+	return c.sendPublish(topic, msg)
+}
+
+// Removes a topic subscription.
+func (c *Connection) Unsubscribe(topic string) error {
+	c.subLock.Lock()
+	if _, ok := c.subLive[topic]; !ok {
+		c.subLock.Unlock()
+		return fmt.Errorf("not subscribed to %s", topic)
+	}
+	delete(c.subLive, topic)
+	c.subLock.Unlock()
+
+	return c.sendUnsubscribe(topic)
+}
+
+// Opens a direct tunnel to a member of a remote cluster.
+func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+	// Create a result channel and register the pending construction
+	resc := make(chan *Tunnel, 1)
+
+	c.tunLock.Lock()
+	id := c.tunIdx
+	c.tunIdx++
+	c.tunPend[id] = resc
+	c.tunLock.Unlock()
+
+	defer func() {
+		c.tunLock.Lock()
+		delete(c.tunPend, id)
+		c.tunLock.Unlock()
+	}()
+	// Request the tunnel construction and wait for the result
+	if err := c.sendTunnelInit(id, cluster, timeout); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.term:
+		return nil, ErrTerminating
+	case tun := <-resc:
+		if tun == nil {
+			return nil, ErrTimeout
+		}
+		return tun, nil
+	}
+}
+
+// Gracefully terminates the connection, waiting for the relay to finish all
+// pending operations and acknowledge the closure.
+func (c *Connection) Close() error {
+	// Request the tear-down, unless the connection is already down
+	select {
+	case <-c.done:
+	default:
+		if err := c.sendClose(); err != nil {
+			c.sock.Close()
+		}
+	}
+	<-c.done
+	return c.fail
+}
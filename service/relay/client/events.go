@@ -0,0 +1,174 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Event handlers for the messages arriving from the relay. Broadcasts, requests
+// and topic events are running on the connection's worker pool, whereas reply
+// and tunnel events are processed inline to retain their ordering.
+
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Forwards a broadcast arriving from the relay to the service handler.
+func (c *Connection) handleBroadcast(msg []byte) {
+	c.handler.HandleBroadcast(msg)
+}
+
+// Forwards a request arriving from the relay to the service handler and sends
+// back the generated reply.
+func (c *Connection) handleRequest(id uint64, req []byte, timeout time.Duration) {
+	reply, err := c.handler.HandleRequest(req, timeout)
+
+	fault := ""
+	if err != nil {
+		fault = err.Error()
+		if fault == "" {
+			fault = "unknown failure"
+		}
+	} else if reply == nil {
+		reply = []byte{}
+	}
+	if fault == "" && !c.limits.permits(c.limits.reply, len(reply)) {
+		reply, fault = nil, ErrSizeLimit.Error()
+	}
+	if err := c.sendReply(id, reply, fault); err != nil {
+		log.Printf("client: reply forward error: %v.", err)
+		c.sock.Close()
+	}
+}
+
+// Delivers the result of a request to the pending caller, if still alive.
+func (c *Connection) handleReply(id uint64, reply []byte, err error) {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	if resc, ok := c.reqPend[id]; ok {
+		resc <- result{reply, err}
+	}
+}
+
+// Forwards a topic event arriving from the relay to the subscription handler.
+func (c *Connection) handlePublish(topic string, event []byte) {
+	c.subLock.RLock()
+	handler, ok := c.subLive[topic]
+	c.subLock.RUnlock()
+
+	if ok {
+		handler.HandleEvent(event)
+	}
+}
+
+// Accepts an inbound tunnel, binding it to a local id and granting the initial
+// data allowance before handing it over to the service handler.
+func (c *Connection) handleTunnelInit(buildId uint64, chunkLimit int) {
+	c.tunLock.Lock()
+	id := c.tunIdx
+	c.tunIdx++
+	tun := c.newTunnel(id, chunkLimit)
+	c.tunLive[id] = tun
+	c.tunLock.Unlock()
+
+	go func() {
+		if err := c.sendTunnelConfirm(buildId, id); err != nil {
+			log.Printf("client: tunnel confirmation error: %v.", err)
+			c.sock.Close()
+			return
+		}
+		if err := c.sendTunnelAllowance(id, config.RelayTunnelBuffer); err != nil {
+			log.Printf("client: tunnel allowance grant error: %v.", err)
+			c.sock.Close()
+			return
+		}
+		c.handler.HandleTunnel(tun)
+	}()
+}
+
+// Finalizes an outbound tunnel construction, delivering the result to the
+// pending caller. A zero chunk limit signals a construction timeout.
+func (c *Connection) handleTunnelResult(id uint64, chunkLimit int) {
+	c.tunLock.Lock()
+	defer c.tunLock.Unlock()
+
+	resc, ok := c.tunPend[id]
+	if !ok {
+		// Caller already gone, discard any succeeded tunnel
+		if chunkLimit != 0 {
+			go c.sendTunnelClose(id)
+		}
+		return
+	}
+	if chunkLimit == 0 {
+		resc <- nil
+		return
+	}
+	tun := c.newTunnel(id, chunkLimit)
+	c.tunLive[id] = tun
+	resc <- tun
+
+	go func() {
+		if err := c.sendTunnelAllowance(id, config.RelayTunnelBuffer); err != nil {
+			log.Printf("client: tunnel allowance grant error: %v.", err)
+			c.sock.Close()
+		}
+	}()
+}
+
+// Grants some additional space allowance for a tunnel's sender.
+func (c *Connection) handleTunnelAllowance(id uint64, space int) {
+	c.tunLock.RLock()
+	defer c.tunLock.RUnlock()
+
+	if tun, ok := c.tunLive[id]; ok {
+		tun.grantAllowance(space)
+	}
+}
+
+// Buffers a data chunk arriving into a tunnel.
+func (c *Connection) handleTunnelTransfer(id uint64, size int, payload []byte) {
+	c.tunLock.RLock()
+	defer c.tunLock.RUnlock()
+
+	if tun, ok := c.tunLive[id]; ok {
+		if err := tun.recvChunk(size, payload); err != nil {
+			log.Printf("client: tunnel transfer error: %v.", err)
+			c.sock.Close()
+		}
+	}
+}
+
+// Removes a tunnel closed by the relay, notifying any blocked operations.
+func (c *Connection) handleTunnelClose(id uint64, reason string) {
+	c.tunLock.Lock()
+	tun, ok := c.tunLive[id]
+	delete(c.tunLive, id)
+	c.tunLock.Unlock()
+
+	if ok {
+		var err error
+		if reason != "" {
+			err = fmt.Errorf("remote close: %s", reason)
+		}
+		tun.handleClose(err)
+	}
+}
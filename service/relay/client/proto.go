@@ -0,0 +1,604 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the client side of the relay wire protocol. The packet layouts are
+// the mirror images of the ones in the relay service, with the "In" and "Out"
+// directions swapped.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Packet opcodes
+const (
+	opInit  byte = 0x00 // Out: connection initiation           | In: connection acceptance
+	opDeny       = 0x01 // Out: <never sent>                    | In: connection refusal
+	opClose      = 0x02 // Out: connection tear-down initiation | In: connection tear-down notification
+
+	opBroadcast = 0x03 // Out: application broadcast initiation | In: application broadcast delivery
+	opRequest   = 0x04 // Out: application request initiation   | In: application request delivery
+	opReply     = 0x05 // Out: application reply initiation     | In: application reply delivery
+
+	opSubscribe   = 0x06 // Out: topic subscription             | In: <never received>
+	opUnsubscribe = 0x07 // Out: topic subscription removal     | In: <never received>
+	opPublish     = 0x08 // Out: topic event publish            | In: topic event delivery
+
+	opTunInit     = 0x09 // Out: tunnel construction request    | In: tunnel initiation
+	opTunConfirm  = 0x0a // Out: tunnel confirmation            | In: tunnel construction result
+	opTunAllow    = 0x0b // Out: tunnel transfer allowance      | In: <same as out>
+	opTunTransfer = 0x0c // Out: tunnel data exchange           | In: <same as out>
+	opTunClose    = 0x0d // Out: tunnel termination request     | In: tunnel termination notification
+)
+
+// Protocol versions offered to the relay, the newest one first.
+var protoVersions = []string{"v1.0-draft3", "v1.0-draft2"}
+
+// Protocol constants
+var (
+	clientMagic = "iris-client-magic"
+	relayMagic  = "iris-relay-magic"
+)
+
+// Serializes a single byte into the relay connection.
+func (c *Connection) sendByte(data byte) error {
+	return c.sockBuf.WriteByte(data)
+}
+
+// Serializes a boolean into the relay connection.
+func (c *Connection) sendBool(data bool) error {
+	if data {
+		return c.sendByte(1)
+	}
+	return c.sendByte(0)
+}
+
+// Serializes a variable int using base 128 encoding into the relay connection.
+func (c *Connection) sendVarint(data uint64) error {
+	for data > 127 {
+		// Internal byte, set the continuation flag and send
+		if err := c.sendByte(byte(128 + data%128)); err != nil {
+			return err
+		}
+		data /= 128
+	}
+	// Final byte, send and return
+	return c.sendByte(byte(data))
+}
+
+// Serializes a length-tagged binary array into the relay connection.
+func (c *Connection) sendBinary(data []byte) error {
+	if err := c.sendVarint(uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := c.sockBuf.Write(data)
+	return err
+}
+
+// Serializes a length-tagged string into the relay connection.
+func (c *Connection) sendString(data string) error {
+	return c.sendBinary([]byte(data))
+}
+
+// Serializes a packet through a closure into the relay connection, flushing it
+// out afterwards.
+func (c *Connection) sendPacket(closure func() error) error {
+	c.sockLock.Lock()
+	defer c.sockLock.Unlock()
+
+	if err := closure(); err != nil {
+		return err
+	}
+	return c.sockBuf.Flush()
+}
+
+// Sends a connection initiation request.
+func (c *Connection) sendInit(cluster string) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opInit); err != nil {
+			return err
+		}
+		if err := c.sendString(clientMagic); err != nil {
+			return err
+		}
+		if err := c.sendString(strings.Join(protoVersions, ",")); err != nil {
+			return err
+		}
+		return c.sendString(cluster)
+	})
+}
+
+// Sends a connection tear-down initiation.
+func (c *Connection) sendClose() error {
+	return c.sendPacket(func() error {
+		return c.sendByte(opClose)
+	})
+}
+
+// Sends an application broadcast initiation.
+func (c *Connection) sendBroadcast(cluster string, message []byte) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opBroadcast); err != nil {
+			return err
+		}
+		if err := c.sendString(cluster); err != nil {
+			return err
+		}
+		return c.sendBinary(message)
+	})
+}
+
+// Sends an application request initiation.
+func (c *Connection) sendRequest(id uint64, cluster string, request []byte, timeout time.Duration) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opRequest); err != nil {
+			return err
+		}
+		if err := c.sendVarint(id); err != nil {
+			return err
+		}
+		if err := c.sendString(cluster); err != nil {
+			return err
+		}
+		if err := c.sendBinary(request); err != nil {
+			return err
+		}
+		return c.sendVarint(uint64(timeout.Nanoseconds() / 1000000))
+	})
+}
+
+// Sends an application reply initiation.
+func (c *Connection) sendReply(id uint64, reply []byte, fault string) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opReply); err != nil {
+			return err
+		}
+		if err := c.sendVarint(id); err != nil {
+			return err
+		}
+		success := (len(fault) == 0)
+		if err := c.sendBool(success); err != nil {
+			return err
+		}
+		if success {
+			return c.sendBinary(reply)
+		}
+		return c.sendString(fault)
+	})
+}
+
+// Sends a topic subscription.
+func (c *Connection) sendSubscribe(topic string) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opSubscribe); err != nil {
+			return err
+		}
+		return c.sendString(topic)
+	})
+}
+
+// Sends a topic subscription removal.
+func (c *Connection) sendUnsubscribe(topic string) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opUnsubscribe); err != nil {
+			return err
+		}
+		return c.sendString(topic)
+	})
+}
+
+// Sends a topic event publish.
+func (c *Connection) sendPublish(topic string, event []byte) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opPublish); err != nil {
+			return err
+		}
+		if err := c.sendString(topic); err != nil {
+			return err
+		}
+		return c.sendBinary(event)
+	})
+}
+
+// Sends a tunnel construction request.
+func (c *Connection) sendTunnelInit(id uint64, cluster string, timeout time.Duration) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opTunInit); err != nil {
+			return err
+		}
+		if err := c.sendVarint(id); err != nil {
+			return err
+		}
+		if err := c.sendString(cluster); err != nil {
+			return err
+		}
+		return c.sendVarint(uint64(timeout.Nanoseconds() / 1000000))
+	})
+}
+
+// Sends a tunnel confirmation, binding a relay build id to a local tunnel id.
+func (c *Connection) sendTunnelConfirm(buildId, tunId uint64) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opTunConfirm); err != nil {
+			return err
+		}
+		if err := c.sendVarint(buildId); err != nil {
+			return err
+		}
+		return c.sendVarint(tunId)
+	})
+}
+
+// Sends a tunnel transfer allowance.
+func (c *Connection) sendTunnelAllowance(id uint64, space int) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opTunAllow); err != nil {
+			return err
+		}
+		if err := c.sendVarint(id); err != nil {
+			return err
+		}
+		return c.sendVarint(uint64(space))
+	})
+}
+
+// Sends a tunnel data exchange message.
+func (c *Connection) sendTunnelTransfer(id uint64, size int, payload []byte) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opTunTransfer); err != nil {
+			return err
+		}
+		if err := c.sendVarint(id); err != nil {
+			return err
+		}
+		if err := c.sendVarint(uint64(size)); err != nil {
+			return err
+		}
+		return c.sendBinary(payload)
+	})
+}
+
+// Sends a tunnel termination request.
+func (c *Connection) sendTunnelClose(id uint64) error {
+	return c.sendPacket(func() error {
+		if err := c.sendByte(opTunClose); err != nil {
+			return err
+		}
+		return c.sendVarint(id)
+	})
+}
+
+// Retrieves a single byte from the relay connection.
+func (c *Connection) recvByte() (byte, error) {
+	return c.sockBuf.ReadByte()
+}
+
+// Retrieves a boolean from the relay connection.
+func (c *Connection) recvBool() (bool, error) {
+	b, err := c.recvByte()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, fmt.Errorf("protocol violation: invalid boolean value: %v", b)
+	}
+}
+
+// Retrieves a variable int in base 128 encoding from the relay connection.
+func (c *Connection) recvVarint() (uint64, error) {
+	var num uint64
+	for i := uint(0); ; i++ {
+		chunk, err := c.recvByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 9 && chunk > 1 {
+			return 0, errors.New("protocol violation: varint overflow")
+		}
+		num += uint64(chunk&127) << (7 * i)
+		if chunk <= 127 {
+			return num, nil
+		}
+	}
+}
+
+// Retrieves a length-tagged binary array from the relay connection.
+func (c *Connection) recvBinary() ([]byte, error) {
+	size, err := c.recvVarint()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.sockBuf, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Retrieves a length-tagged string from the relay connection.
+func (c *Connection) recvString() (string, error) {
+	data, err := c.recvBinary()
+	return string(data), err
+}
+
+// Retrieves the relay's answer to a connection initiation request.
+func (c *Connection) procInit() error {
+	op, err := c.recvByte()
+	if err != nil {
+		return err
+	}
+	// Make sure the relay magic is valid
+	if magic, err := c.recvString(); err != nil {
+		return err
+	} else if magic != relayMagic {
+		return fmt.Errorf("protocol violation: invalid relay magic: %s", magic)
+	}
+	switch op {
+	case opInit:
+		version, err := c.recvString()
+		if err != nil {
+			return err
+		}
+		switch version {
+		case "v1.0-draft3":
+			// Message size limits advertised, retrieve them
+			for _, limit := range []*int{&c.limits.broadcast, &c.limits.request, &c.limits.reply, &c.limits.publish, &c.limits.chunk} {
+				size, err := c.recvVarint()
+				if err != nil {
+					return err
+				}
+				*limit = int(size)
+			}
+		case "v1.0-draft2":
+			// No limits advertised, leave enforcement to the relay
+		default:
+			return fmt.Errorf("protocol violation: unrequested version: %s", version)
+		}
+		return nil
+	case opDeny:
+		reason, err := c.recvString()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("connection denied: %s", reason)
+	default:
+		return fmt.Errorf("protocol violation: invalid init response: %v", op)
+	}
+}
+
+// Retrieves a connection tear-down notification.
+func (c *Connection) procClose() (string, error) {
+	return c.recvString()
+}
+
+// Retrieves an application broadcast delivery.
+func (c *Connection) procBroadcast() error {
+	message, err := c.recvBinary()
+	if err != nil {
+		return err
+	}
+	c.workers.Schedule(func() { c.handleBroadcast(message) })
+	return nil
+}
+
+// Retrieves an application request delivery.
+func (c *Connection) procRequest() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	request, err := c.recvBinary()
+	if err != nil {
+		return err
+	}
+	timeout, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	c.workers.Schedule(func() { c.handleRequest(id, request, time.Duration(timeout)*time.Millisecond) })
+	return nil
+}
+
+// Retrieves an application reply delivery.
+func (c *Connection) procReply() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	timeout, err := c.recvBool()
+	if err != nil {
+		return err
+	}
+	if timeout {
+		c.handleReply(id, nil, ErrTimeout)
+		return nil
+	}
+	success, err := c.recvBool()
+	if err != nil {
+		return err
+	}
+	if success {
+		reply, err := c.recvBinary()
+		if err != nil {
+			return err
+		}
+		c.handleReply(id, reply, nil)
+	} else {
+		fault, err := c.recvString()
+		if err != nil {
+			return err
+		}
+		c.handleReply(id, nil, &RemoteError{fault})
+	}
+	return nil
+}
+
+// Retrieves a topic event delivery.
+func (c *Connection) procPublish() error {
+	topic, err := c.recvString()
+	if err != nil {
+		return err
+	}
+	event, err := c.recvBinary()
+	if err != nil {
+		return err
+	}
+	c.workers.Schedule(func() { c.handlePublish(topic, event) })
+	return nil
+}
+
+// Retrieves a tunnel initiation.
+func (c *Connection) procTunnelInit() error {
+	buildId, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	chunkLimit, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	c.handleTunnelInit(buildId, int(chunkLimit)) // Register the tunnel before any data arrives
+	return nil
+}
+
+// Retrieves a tunnel construction result.
+func (c *Connection) procTunnelResult() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	timeout, err := c.recvBool()
+	if err != nil {
+		return err
+	}
+	if timeout {
+		c.handleTunnelResult(id, 0)
+		return nil
+	}
+	chunkLimit, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	c.handleTunnelResult(id, int(chunkLimit)) // Register the tunnel before any data arrives
+	return nil
+}
+
+// Retrieves a tunnel transfer allowance.
+func (c *Connection) procTunnelAllowance() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	space, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	c.handleTunnelAllowance(id, int(space))
+	return nil
+}
+
+// Retrieves a tunnel data exchange message.
+func (c *Connection) procTunnelTransfer() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	size, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	payload, err := c.recvBinary()
+	if err != nil {
+		return err
+	}
+	c.handleTunnelTransfer(id, int(size), payload)
+	return nil
+}
+
+// Retrieves a tunnel termination notification.
+func (c *Connection) procTunnelClose() error {
+	id, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	reason, err := c.recvString()
+	if err != nil {
+		return err
+	}
+	c.handleTunnelClose(id, reason)
+	return nil
+}
+
+// Retrieves messages from the relay connection and keeps processing them until
+// either the relay closes the connection or it drops.
+func (c *Connection) process() {
+	var op byte
+	var err error
+	for closed := false; !closed && err == nil; {
+		if op, err = c.recvByte(); err == nil {
+			switch op {
+			case opBroadcast:
+				err = c.procBroadcast()
+			case opRequest:
+				err = c.procRequest()
+			case opReply:
+				err = c.procReply()
+			case opPublish:
+				err = c.procPublish()
+			case opTunInit:
+				err = c.procTunnelInit()
+			case opTunConfirm:
+				err = c.procTunnelResult()
+			case opTunAllow:
+				err = c.procTunnelAllowance()
+			case opTunTransfer:
+				err = c.procTunnelTransfer()
+			case opTunClose:
+				err = c.procTunnelClose()
+			case opClose:
+				var reason string
+				if reason, err = c.procClose(); err == nil {
+					if reason != "" {
+						err = fmt.Errorf("relay closed connection: %s", reason)
+					}
+					closed = true
+				}
+			default:
+				err = fmt.Errorf("protocol violation: unknown opcode: %v", op)
+			}
+		}
+	}
+	// Signal termination to all blocked threads and wait for the handlers
+	close(c.term)
+	c.workers.Terminate(err != nil)
+	c.sock.Close()
+
+	// Report the error (if any) to the closer
+	c.fail = err
+	close(c.done)
+}
@@ -0,0 +1,250 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Messages are split into chunks no larger than the limit imposed by the relay,
+// the first one carrying the total message size, the rest a zero size marker.
+// Outbound data is throttled by the allowance granted by the relay, whereas the
+// space consumed by inbound data is granted back once the application retrieves
+// the message.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ordered, flow controlled message stream to a single remote endpoint.
+type Tunnel struct {
+	id         uint64      // Local tunnel identifier
+	conn       *Connection // Relay connection through which to communicate
+	chunkLimit int         // Maximum chunk size permitted by the relay
+
+	// Outbound flow control
+	space     int           // Data allowance granted by the relay
+	spaceSign chan struct{} // Allowance grant signaler
+	spaceLock sync.Mutex    // Protects the allowance and signaler
+
+	// Inbound message assembly
+	partial []byte        // Partially assembled inbound message
+	size    int           // Total size of the partially assembled message
+	msgs    [][]byte      // Fully assembled messages waiting for retrieval
+	msgSign chan struct{} // Message arrival signaler
+	msgLock sync.Mutex    // Protects the inbound buffers and signaler
+
+	// Bookkeeping fields
+	term chan struct{} // Channel closed when the relay tears down the tunnel
+	fail error         // Reason of the tunnel tear-down, if any
+}
+
+// Creates a new tunnel bound to a relay connection.
+func (c *Connection) newTunnel(id uint64, chunkLimit int) *Tunnel {
+	return &Tunnel{
+		id:         id,
+		conn:       c,
+		chunkLimit: chunkLimit,
+		spaceSign:  make(chan struct{}, 1),
+		msgs:       [][]byte{},
+		msgSign:    make(chan struct{}, 1),
+		term:       make(chan struct{}),
+	}
+}
+
+// Sends a message over the tunnel to the remote endpoint, blocking until the
+// relay grants enough allowance to start the transfer.
+func (t *Tunnel) Send(msg []byte, timeout time.Duration) error {
+	if len(msg) == 0 {
+		return errors.New("empty message")
+	}
+	// Wait for enough allowance for the first chunk, force the rest through
+	first := len(msg)
+	if first > t.chunkLimit {
+		first = t.chunkLimit
+	}
+	deadline := time.After(timeout)
+	for !t.drainAllowance(first) {
+		select {
+		case <-t.conn.term:
+			return ErrTerminating
+		case <-t.term:
+			return ErrClosed
+		case <-deadline:
+			return ErrTimeout
+		case <-t.spaceSign:
+		}
+	}
+	for pos, size := 0, len(msg); pos < len(msg); pos, size = pos+t.chunkLimit, 0 {
+		end := pos + t.chunkLimit
+		if end > len(msg) {
+			end = len(msg)
+		}
+		if pos != 0 {
+			t.forceAllowance(end - pos)
+		}
+		if err := t.conn.sendTunnelTransfer(t.id, size, msg[pos:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieves a message from the tunnel, blocking until one arrives or the
+// timeout expires.
+func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
+	deadline := time.After(timeout)
+	for {
+		if msg := t.fetchMessage(); msg != nil {
+			// Grant the consumed space back to the relay
+			if err := t.conn.sendTunnelAllowance(t.id, len(msg)); err != nil {
+				return nil, err
+			}
+			return msg, nil
+		}
+		select {
+		case <-t.conn.term:
+			return nil, ErrTerminating
+		case <-t.term:
+			// Deliver any messages that arrived before the close
+			if msg := t.fetchMessage(); msg != nil {
+				return msg, nil
+			}
+			if t.fail != nil {
+				return nil, t.fail
+			}
+			return nil, ErrClosed
+		case <-deadline:
+			return nil, ErrTimeout
+		case <-t.msgSign:
+		}
+	}
+}
+
+// Closes the tunnel, waiting for the relay to acknowledge the tear-down.
+func (t *Tunnel) Close() error {
+	select {
+	case <-t.term:
+		return t.fail
+	default:
+	}
+	if err := t.conn.sendTunnelClose(t.id); err != nil {
+		return err
+	}
+	select {
+	case <-t.conn.term:
+		return ErrTerminating
+	case <-t.term:
+		return nil
+	}
+}
+
+// Grants some additional space allowance for the sender.
+func (t *Tunnel) grantAllowance(space int) {
+	t.spaceLock.Lock()
+	defer t.spaceLock.Unlock()
+
+	t.space += space
+	select {
+	case t.spaceSign <- struct{}{}:
+	default:
+	}
+}
+
+// Checks whether there is enough space allowance to send a chunk. If yes, the
+// allowance is reduced accordingly.
+func (t *Tunnel) drainAllowance(need int) bool {
+	t.spaceLock.Lock()
+	defer t.spaceLock.Unlock()
+
+	if t.space >= need {
+		t.space -= need
+		return true
+	}
+	// Not enough, reset the allowance grant flag
+	select {
+	case <-t.spaceSign:
+	default:
+	}
+	return false
+}
+
+// Reduces the allowance by a forcefully sent chunk, possibly below zero.
+func (t *Tunnel) forceAllowance(need int) {
+	t.spaceLock.Lock()
+	defer t.spaceLock.Unlock()
+
+	t.space -= need
+}
+
+// Assembles an inbound data chunk into the pending message, queuing it up for
+// retrieval if complete.
+func (t *Tunnel) recvChunk(size int, payload []byte) error {
+	t.msgLock.Lock()
+	defer t.msgLock.Unlock()
+
+	// Start a new message or continue the pending one
+	switch {
+	case size != 0 && t.partial != nil:
+		return fmt.Errorf("protocol violation: message started while another pending")
+	case size == 0 && t.partial == nil:
+		return fmt.Errorf("protocol violation: continuation without message")
+	case size != 0:
+		t.partial, t.size = make([]byte, 0, size), size
+	}
+	if len(t.partial)+len(payload) > t.size {
+		return fmt.Errorf("protocol violation: message size exceeded: %d > %d", len(t.partial)+len(payload), t.size)
+	}
+	t.partial = append(t.partial, payload...)
+
+	// If the message is complete, queue it up and signal the arrival
+	if len(t.partial) == t.size {
+		t.msgs = append(t.msgs, t.partial)
+		t.partial, t.size = nil, 0
+
+		select {
+		case t.msgSign <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Fetches the next assembled message, or nil if none is available.
+func (t *Tunnel) fetchMessage() []byte {
+	t.msgLock.Lock()
+	defer t.msgLock.Unlock()
+
+	if len(t.msgs) > 0 {
+		msg := t.msgs[0]
+		t.msgs = t.msgs[1:]
+		return msg
+	}
+	// No message, reset the arrival flag
+	select {
+	case <-t.msgSign:
+	default:
+	}
+	return nil
+}
+
+// Marks the tunnel closed by the relay, waking up all blocked operations.
+func (t *Tunnel) handleClose(err error) {
+	t.fail = err
+	close(t.term)
+}
@@ -0,0 +1,724 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Conformance harness driving the relay over an in-memory connection with
+// scripted client sequences. The relay is always attached to a real, single
+// node Iris overlay, booted once for the whole test suite.
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Iris overlay shared by all the relay tests.
+var testOverlay *iris.Overlay
+
+// Boots the shared Iris overlay, runs the tests and tears everything down.
+func TestMain(m *testing.M) {
+	config.PastryBootTimeout = 500 * time.Millisecond
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate RSA key: %v.\n", err)
+		os.Exit(1)
+	}
+	testOverlay = iris.New("relay-test", key)
+	if _, err := testOverlay.Boot(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to boot iris overlay: %v.\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+
+	if err := testOverlay.Shutdown(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to terminate iris overlay: %v.\n", err)
+	}
+	os.Exit(code)
+}
+
+// Packet sent by the relay, with its fields in wire order.
+type testPacket struct {
+	op    byte
+	ints  []uint64
+	bools []bool
+	blobs [][]byte
+}
+
+// Scripted relay client, speaking the raw wire protocol over an in-memory pipe.
+type testClient struct {
+	t    testing.TB
+	sock net.Conn
+	out  *bufio.Writer
+	in   *bufio.Reader
+
+	pkts chan *testPacket // Packets parsed from the relay
+	pend []*testPacket    // Packets skipped while awaiting others
+	term chan error       // Relay termination result (accept or process failure)
+}
+
+// Starts a new relay on one end of an in-memory pipe, returning a test client
+// attached to the other end.
+func newTestClient(t testing.TB) *testClient {
+	server, client := net.Pipe()
+
+	c := &testClient{
+		t:    t,
+		sock: client,
+		out:  bufio.NewWriter(client),
+		in:   bufio.NewReader(client),
+		pkts: make(chan *testPacket, 1024),
+		term: make(chan error, 1),
+	}
+	// Start a relay service and a supervisor collecting its termination
+	rel, _ := New(0, testOverlay)
+	go func() {
+		if _, err := rel.acceptRelay(server); err != nil {
+			c.term <- err
+			return
+		}
+		c.term <- (<-rel.done).report()
+	}()
+	// Start parsing all inbound packets
+	go func() {
+		defer close(c.pkts)
+		for {
+			pkt, err := c.recvPacket()
+			if err != nil {
+				return
+			}
+			c.pkts <- pkt
+		}
+	}()
+	return c
+}
+
+// Sends a raw chunk of bytes to the relay, flushing the stream.
+func (c *testClient) sendRaw(data []byte) error {
+	if _, err := c.out.Write(data); err != nil {
+		return err
+	}
+	return c.out.Flush()
+}
+
+// Assembles and sends a packet to the relay. Fields are encoded based on their
+// type: byte as is, bool as a byte, uint64 and int as a varint, []byte and
+// string as a length tagged binary.
+func (c *testClient) send(op byte, fields ...interface{}) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(op)
+	for _, field := range fields {
+		switch field := field.(type) {
+		case byte:
+			buf.WriteByte(field)
+		case bool:
+			if field {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		case int:
+			buf.Write(encodeVarint(uint64(field)))
+		case uint64:
+			buf.Write(encodeVarint(field))
+		case string:
+			buf.Write(encodeVarint(uint64(len(field))))
+			buf.WriteString(field)
+		case []byte:
+			buf.Write(encodeVarint(uint64(len(field))))
+			buf.Write(field)
+		default:
+			c.t.Fatalf("unknown field type: %T.", field)
+		}
+	}
+	if err := c.sendRaw(buf.Bytes()); err != nil {
+		c.t.Fatalf("failed to send packet %v: %v.", op, err)
+	}
+}
+
+// Sends a connection initiation request, either as a client or as a service.
+func (c *testClient) init(cluster string) {
+	c.send(opInit, clientMagic, protoVersions[len(protoVersions)-1].name, cluster)
+
+	pkt := c.await(opInit)
+	if magic := string(pkt.blobs[0]); magic != relayMagic {
+		c.t.Fatalf("relay magic mismatch: have %v, want %v.", magic, relayMagic)
+	}
+}
+
+// Encodes a number into its base 128 varint representation.
+func encodeVarint(num uint64) []byte {
+	buf := []byte{}
+	for num > 127 {
+		buf = append(buf, byte(128+num%128))
+		num /= 128
+	}
+	return append(buf, byte(num))
+}
+
+// Retrieves a varint from the relay.
+func (c *testClient) recvVarint() (uint64, error) {
+	var num uint64
+	for i := uint(0); ; i++ {
+		chunk, err := c.in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		num += uint64(chunk&127) << (7 * i)
+		if chunk <= 127 {
+			return num, nil
+		}
+	}
+}
+
+// Retrieves a length tagged binary from the relay.
+func (c *testClient) recvBinary() ([]byte, error) {
+	size, err := c.recvVarint()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.in, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Retrieves a boolean from the relay.
+func (c *testClient) recvBool() (bool, error) {
+	b, err := c.in.ReadByte()
+	return b == 1, err
+}
+
+// Retrieves and parses a single relay packet.
+func (c *testClient) recvPacket() (*testPacket, error) {
+	op, err := c.in.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	pkt := &testPacket{op: op}
+
+	// Define the field readers to assemble the packets with
+	varint := func() error {
+		num, err := c.recvVarint()
+		pkt.ints = append(pkt.ints, num)
+		return err
+	}
+	binary := func() error {
+		blob, err := c.recvBinary()
+		pkt.blobs = append(pkt.blobs, blob)
+		return err
+	}
+	boolean := func() (bool, error) {
+		flag, err := c.recvBool()
+		pkt.bools = append(pkt.bools, flag)
+		return flag, err
+	}
+	chain := func(readers ...func() error) error {
+		for _, reader := range readers {
+			if err := reader(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Parse the packet based on the opcode
+	switch op {
+	case opInit:
+		if err = chain(binary, binary); err == nil {
+			// Newer versions also advertise the message size limits
+			if version := negotiate(string(pkt.blobs[1])); version != nil && version.limits {
+				err = chain(varint, varint, varint, varint, varint)
+			}
+		}
+	case opDeny:
+		err = chain(binary, binary)
+	case opClose, opBroadcast:
+		err = binary()
+	case opRequest:
+		err = chain(varint, binary, varint)
+	case opReply:
+		if err = varint(); err == nil {
+			var timeout bool
+			if timeout, err = boolean(); err == nil && !timeout {
+				if _, err = boolean(); err == nil {
+					err = binary()
+				}
+			}
+		}
+	case opPublish:
+		err = chain(binary, binary)
+	case opTunInit, opTunAllow:
+		err = chain(varint, varint)
+	case opTunConfirm:
+		if err = varint(); err == nil {
+			var timeout bool
+			if timeout, err = boolean(); err == nil && !timeout {
+				err = varint()
+			}
+		}
+	case opTunTransfer:
+		err = chain(varint, varint, binary)
+	case opTunClose:
+		err = chain(varint, binary)
+	default:
+		err = fmt.Errorf("unknown opcode: %v", op)
+	}
+	return pkt, err
+}
+
+// Waits for a packet with the given opcode to arrive, buffering any others.
+func (c *testClient) await(op byte) *testPacket {
+	// Check the already buffered packets first
+	for i, pkt := range c.pend {
+		if pkt.op == op {
+			c.pend = append(c.pend[:i], c.pend[i+1:]...)
+			return pkt
+		}
+	}
+	// Wait for a new one to arrive
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pkt, ok := <-c.pkts:
+			if !ok {
+				c.t.Fatalf("relay closed while waiting for opcode %v.", op)
+			}
+			if pkt.op == op {
+				return pkt
+			}
+			c.pend = append(c.pend, pkt)
+		case <-timeout:
+			c.t.Fatalf("timeout while waiting for opcode %v, pending %v.", op, c.pend)
+		}
+	}
+}
+
+// Waits for the relay to close the connection, returning the termination error.
+func (c *testClient) closed() error {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.pkts:
+			if !ok {
+				select {
+				case err := <-c.term:
+					return err
+				case <-timeout:
+					c.t.Fatalf("timeout while waiting for relay termination.")
+				}
+			}
+		case <-timeout:
+			c.t.Fatalf("timeout while waiting for relay to close the connection.")
+		}
+	}
+}
+
+// Closes the client side of the in-memory pipe and waits for the relay to go
+// down.
+func (c *testClient) drop() error {
+	c.sock.Close()
+	return c.closed()
+}
+
+// Ensures that the number of goroutines returns to a previous level.
+func checkLeaks(t testing.TB, base int) {
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		if runtime.NumGoroutine() <= base {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	buf := make([]byte, 1024*1024)
+	t.Fatalf("goroutine leak: have %d, want %d.\n%s", runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+}
+
+func TestInitAccept(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.send(opInit, clientMagic, "v0.0-ancient,v1.0-draft2", "")
+	pkt := c.await(opInit)
+	if magic := string(pkt.blobs[0]); magic != relayMagic {
+		t.Fatalf("relay magic mismatch: have %v, want %v.", magic, relayMagic)
+	}
+	if version := string(pkt.blobs[1]); version != "v1.0-draft2" {
+		t.Fatalf("version mismatch: have %v, want %v.", version, "v1.0-draft2")
+	}
+	// Graceful tear-down should be acknowledged and error free
+	c.send(opClose)
+	if pkt := c.await(opClose); len(pkt.blobs[0]) != 0 {
+		t.Fatalf("unexpected close reason: %s.", pkt.blobs[0])
+	}
+	if err := c.drop(); err != nil {
+		t.Fatalf("graceful close failed: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestInitDeny(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	// Unsupported version should be denied with a reason
+	c := newTestClient(t)
+	c.send(opInit, clientMagic, "v0.0-ancient", "")
+	pkt := c.await(opDeny)
+	if magic := string(pkt.blobs[0]); magic != relayMagic {
+		t.Fatalf("relay magic mismatch: have %v, want %v.", magic, relayMagic)
+	}
+	if len(pkt.blobs[1]) == 0 {
+		t.Fatalf("no denial reason provided.")
+	}
+	if err := c.closed(); err == nil {
+		t.Fatalf("unsupported version accepted.")
+	}
+	// Invalid magic and invalid init codes should be silently dropped
+	c = newTestClient(t)
+	c.send(opInit, "iris-invalid-magic", "v1.0-draft2", "")
+	if err := c.closed(); err == nil {
+		t.Fatalf("invalid magic accepted.")
+	}
+	c = newTestClient(t)
+	c.send(opPublish, "topic", []byte("event"))
+	if err := c.closed(); err == nil {
+		t.Fatalf("invalid init code accepted.")
+	}
+	checkLeaks(t, base)
+}
+
+func TestPubSub(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.init("")
+
+	c.send(opSubscribe, "conformance-topic")
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		c.send(opPublish, "conformance-topic", []byte{byte(i)})
+	}
+	for i := 0; i < 10; i++ {
+		pkt := c.await(opPublish)
+		if topic := string(pkt.blobs[0]); topic != "conformance-topic" {
+			t.Fatalf("topic mismatch: have %v, want %v.", topic, "conformance-topic")
+		}
+		if len(pkt.blobs[1]) != 1 {
+			t.Fatalf("event mismatch: have %v, want 1 byte.", pkt.blobs[1])
+		}
+	}
+	c.send(opUnsubscribe, "conformance-topic")
+	c.send(opClose)
+	c.await(opClose)
+	if err := c.drop(); err != nil {
+		t.Fatalf("graceful close failed: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestReqRep(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.init("conformance-reqrep")
+	time.Sleep(100 * time.Millisecond)
+
+	// Send a request to ourselves and reply to it
+	c.send(opRequest, 1, "conformance-reqrep", []byte("ping"), 1000)
+	req := c.await(opRequest)
+	if string(req.blobs[0]) != "ping" {
+		t.Fatalf("request mismatch: have %s, want %s.", req.blobs[0], "ping")
+	}
+	c.send(opReply, req.ints[0], true, []byte("pong"))
+	rep := c.await(opReply)
+	if rep.ints[0] != 1 || rep.bools[0] || !rep.bools[1] || string(rep.blobs[0]) != "pong" {
+		t.Fatalf("reply mismatch: have %+v.", rep)
+	}
+	// Send a request and fail it
+	c.send(opRequest, 2, "conformance-reqrep", []byte("ping"), 1000)
+	req = c.await(opRequest)
+	c.send(opReply, req.ints[0], false, "failure")
+	rep = c.await(opReply)
+	if rep.ints[0] != 2 || rep.bools[0] || rep.bools[1] || string(rep.blobs[0]) != "failure" {
+		t.Fatalf("failure mismatch: have %+v.", rep)
+	}
+	// Send a request to a missing cluster and wait for the timeout
+	c.send(opRequest, 3, "conformance-missing", []byte("ping"), 100)
+	rep = c.await(opReply)
+	if rep.ints[0] != 3 || !rep.bools[0] {
+		t.Fatalf("timeout mismatch: have %+v.", rep)
+	}
+	// Broadcast to ourselves
+	c.send(opBroadcast, "conformance-reqrep", []byte("bcast"))
+	if pkt := c.await(opBroadcast); string(pkt.blobs[0]) != "bcast" {
+		t.Fatalf("broadcast mismatch: have %s, want %s.", pkt.blobs[0], "bcast")
+	}
+	// Leave a request pending and drop the connection
+	c.send(opRequest, 4, "conformance-reqrep", []byte("ping"), 60000)
+	c.await(opRequest)
+	c.drop()
+
+	checkLeaks(t, base)
+}
+
+func TestTunnel(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.init("conformance-tunnel")
+	time.Sleep(100 * time.Millisecond)
+
+	// Open a tunnel to ourselves and confirm the inbound side
+	c.send(opTunInit, 1, "conformance-tunnel", 1000)
+	init := c.await(opTunInit)
+	if init.ints[1] != uint64(config.RelayTunnelChunkLimit) {
+		t.Fatalf("chunk limit mismatch: have %v, want %v.", init.ints[1], config.RelayTunnelChunkLimit)
+	}
+	c.send(opTunConfirm, init.ints[0], 2)
+
+	res := c.await(opTunConfirm)
+	if res.ints[0] != 1 || res.bools[0] {
+		t.Fatalf("tunnel construction failed: %+v.", res)
+	}
+	// Both endpoints should be granted the initial allowance
+	for i := 0; i < 2; i++ {
+		if allow := c.await(opTunAllow); allow.ints[1] != uint64(config.RelayTunnelBuffer) {
+			t.Fatalf("allowance mismatch: have %v, want %v.", allow.ints[1], config.RelayTunnelBuffer)
+		}
+	}
+	// Grant an allowance in both directions and transfer data
+	c.send(opTunAllow, 1, 1024)
+	c.send(opTunAllow, 2, 1024)
+
+	c.send(opTunTransfer, 1, 5, []byte("hello"))
+	if pkt := c.await(opTunTransfer); pkt.ints[0] != 2 || string(pkt.blobs[0]) != "hello" {
+		t.Fatalf("transfer mismatch: have %+v.", pkt)
+	}
+	c.send(opTunTransfer, 2, 5, []byte("world"))
+	if pkt := c.await(opTunTransfer); pkt.ints[0] != 1 || string(pkt.blobs[0]) != "world" {
+		t.Fatalf("transfer mismatch: have %+v.", pkt)
+	}
+	// Oversized chunks should be rejected
+	size := encodeVarint(uint64(config.RelayTunnelChunkLimit + 1))
+	c.sendRaw(append(append([]byte{opTunTransfer, 0x01}, size...), size...))
+	if err := c.closed(); err == nil {
+		t.Fatalf("oversized chunk accepted.")
+	}
+	checkLeaks(t, base)
+}
+
+func TestTunnelClose(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.init("conformance-tunclose")
+	time.Sleep(100 * time.Millisecond)
+
+	c.send(opTunInit, 1, "conformance-tunclose", 1000)
+	init := c.await(opTunInit)
+	c.send(opTunConfirm, init.ints[0], 2)
+	c.await(opTunConfirm)
+
+	// Close one side and ensure both are torn down
+	c.send(opTunClose, 1)
+	ids := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		ids[c.await(opTunClose).ints[0]] = true
+	}
+	if !ids[1] || !ids[2] {
+		t.Fatalf("tunnel close mismatch: have %v, want both 1 and 2.", ids)
+	}
+	// Confirming a non-existent tunnel should not block the relay
+	c.send(opTunConfirm, 1000, 3)
+	c.send(opClose)
+	c.await(opClose)
+	if err := c.drop(); err != nil {
+		t.Fatalf("graceful close failed: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestTunnelTimeout(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	c := newTestClient(t)
+	c.init("")
+
+	c.send(opTunInit, 1, "conformance-missing", 100)
+	if res := c.await(opTunConfirm); res.ints[0] != 1 || !res.bools[0] {
+		t.Fatalf("tunnel timeout mismatch: have %+v.", res)
+	}
+	c.drop()
+	checkLeaks(t, base)
+}
+
+func TestMalformed(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	// Define a set of malformed packet streams sent after a valid init
+	tests := [][]byte{
+		{0xff},                                   // Unknown opcode
+		{opInit},                                 // Init after init
+		{opDeny},                                 // Client never sends denials
+		{opReply, 0x00, 0x02},                    // Invalid boolean
+		{opSubscribe, 0x05, 'a'},                 // Truncated string
+		{opBroadcast, 0x01, 'a', 0x05, 'a', 'b'}, // Truncated binary
+		append([]byte{opPublish, 0x01, 'a'}, bytes.Repeat([]byte{0xff}, 11)...),                          // Overlong varint
+		append([]byte{opPublish, 0x01, 'a'}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), // Binary size overflow
+		{opPublish, 0x01, 'a', 0xff, 0xff, 0xff, 0xff, 0x0f, 'a'},                                        // Huge, truncated binary
+	}
+	for i, stream := range tests {
+		c := newTestClient(t)
+		c.init("")
+		c.sendRaw(stream)
+		c.sock.Close()
+
+		if err := c.closed(); err == nil {
+			t.Errorf("test %d: malformed stream accepted.", i)
+		}
+	}
+	checkLeaks(t, base)
+}
+
+func TestVersionGating(t *testing.T) {
+	// Inject a newer protocol version and make the old one lack the tunnels
+	olds := protoVersions
+	defer func() { protoVersions = olds }()
+
+	protoVersions = []*protoVersion{
+		{name: "v1.0-fake1", lastOp: opPublish},
+		{name: "v1.0-fake2", lastOp: opTunClose},
+	}
+	// New version should be permitted to use tunnels
+	c := newTestClient(t)
+	c.send(opInit, clientMagic, "v1.0-fake1,v1.0-fake2", "")
+	if pkt := c.await(opInit); string(pkt.blobs[1]) != "v1.0-fake2" {
+		t.Fatalf("version mismatch: have %s, want %s.", pkt.blobs[1], "v1.0-fake2")
+	}
+	c.send(opTunInit, 1, "conformance-missing", 100)
+	c.await(opTunConfirm)
+	c.drop()
+
+	// Old version should be dropped upon sending a newer opcode
+	c = newTestClient(t)
+	c.send(opInit, clientMagic, "v1.0-fake1", "")
+	if pkt := c.await(opInit); string(pkt.blobs[1]) != "v1.0-fake1" {
+		t.Fatalf("version mismatch: have %s, want %s.", pkt.blobs[1], "v1.0-fake1")
+	}
+	c.send(opTunInit, 1, "conformance-missing", 100)
+	if err := c.closed(); err == nil {
+		t.Fatalf("newer opcode accepted on old version.")
+	}
+}
+
+// Tests that payloads opted out of compression are relayed intact, and that the
+// opt-out is only accepted directly before payload packets on draft4.
+func TestNoCompress(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 1024)
+
+	c := newTestClient(t)
+	c.init("conformance-nocompress")
+	time.Sleep(100 * time.Millisecond)
+
+	c.send(opNoCompress)
+	c.send(opBroadcast, "conformance-nocompress", payload)
+	if pkt := c.await(opBroadcast); !bytes.Equal(pkt.blobs[0], payload) {
+		t.Fatalf("broadcast mismatch: have %d bytes, want %d.", len(pkt.blobs[0]), len(payload))
+	}
+	c.send(opNoCompress)
+	c.send(opRequest, 1, "conformance-nocompress", payload, 1000)
+	req := c.await(opRequest)
+	if !bytes.Equal(req.blobs[0], payload) {
+		t.Fatalf("request mismatch: have %d bytes, want %d.", len(req.blobs[0]), len(payload))
+	}
+	c.send(opReply, req.ints[0], true, payload)
+	if rep := c.await(opReply); !bytes.Equal(rep.blobs[0], payload) {
+		t.Fatalf("reply mismatch: have %d bytes, want %d.", len(rep.blobs[0]), len(payload))
+	}
+	// An opt-out not followed by a payload packet should be dropped
+	c.send(opNoCompress)
+	c.send(opSubscribe, "conformance-topic")
+	if err := c.closed(); err == nil {
+		t.Fatalf("dangling compression opt-out accepted.")
+	}
+	// Older versions should not permit the opt-out at all
+	c = newTestClient(t)
+	c.send(opInit, clientMagic, "v1.0-draft3", "")
+	if pkt := c.await(opInit); string(pkt.blobs[1]) != "v1.0-draft3" {
+		t.Fatalf("version mismatch: have %s, want %s.", pkt.blobs[1], "v1.0-draft3")
+	}
+	c.send(opNoCompress)
+	if err := c.closed(); err == nil {
+		t.Fatalf("compression opt-out accepted on draft3.")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	// Lower the limits to make testing simpler
+	limits := []*int{&config.IrisBroadcastLimit, &config.IrisRequestLimit, &config.IrisReplyLimit, &config.IrisPublishLimit, &config.RelayTunnelChunkLimit}
+	for i, limit := range limits {
+		defer func(limit *int, old int) { *limit = old }(limit, *limit)
+		*limit = 1000 + i
+	}
+	// Ensure the limits are advertised during init
+	c := newTestClient(t)
+	c.send(opInit, clientMagic, "v1.0-draft3", "")
+	pkt := c.await(opInit)
+	for i, limit := range limits {
+		if pkt.ints[i] != uint64(*limit) {
+			t.Fatalf("limit %d mismatch: have %v, want %v.", i, pkt.ints[i], *limit)
+		}
+	}
+	// Ensure messages within limits pass, but larger ones are rejected
+	c.send(opSubscribe, "conformance-limits")
+	time.Sleep(100 * time.Millisecond)
+
+	c.send(opPublish, "conformance-limits", make([]byte, config.IrisPublishLimit))
+	if pkt := c.await(opPublish); len(pkt.blobs[1]) != config.IrisPublishLimit {
+		t.Fatalf("event size mismatch: have %v, want %v.", len(pkt.blobs[1]), config.IrisPublishLimit)
+	}
+	c.send(opPublish, "conformance-limits", make([]byte, config.IrisPublishLimit+1))
+	if err := c.closed(); err == nil {
+		t.Fatalf("oversized event accepted.")
+	}
+	// Ensure the limits are enforced on older protocol versions too
+	c = newTestClient(t)
+	c.send(opInit, clientMagic, "v1.0-draft2", "")
+	if pkt := c.await(opInit); len(pkt.ints) != 0 {
+		t.Fatalf("limits advertised on old version: %v.", pkt.ints)
+	}
+	c.sendRaw(append([]byte{opBroadcast, 0x01, 'a'}, encodeVarint(uint64(config.IrisBroadcastLimit+1))...))
+	if err := c.closed(); err == nil {
+		t.Fatalf("oversized broadcast accepted.")
+	}
+	checkLeaks(t, base)
+}
@@ -19,6 +19,9 @@
 // Event handlers for both relay and carrier side messages. Almost all methods
 // in this file are assumed to be running in a separate go routine! The only two
 // exceptions are the tunnel data transfers, which need total ordering.
+//
+// Payloads delivered by the Iris node are owned by the relay, so they are put
+// back into the buffer pool after being forwarded to the attached binding.
 
 package relay
 
@@ -28,6 +31,7 @@ import (
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto/iris"
 )
 
@@ -37,11 +41,17 @@ func (r *relay) HandleBroadcast(msg []byte) {
 		log.Printf("relay: broadcast forward error: %v.", err)
 		r.drop()
 	}
+	pool.PutBuffer(msg)
 }
 
-// Forwards a broadcast from the attached binding to the Iris network.
-func (r *relay) handleBroadcast(app string, msg []byte) {
-	if err := r.iris.Broadcast(app, msg); err != nil {
+// Forwards a broadcast from the attached binding to the Iris network, optionally
+// exempt from payload compression.
+func (r *relay) handleBroadcast(app string, msg []byte, raw bool) {
+	broadcast := r.iris.Broadcast
+	if raw {
+		broadcast = r.iris.BroadcastRaw
+	}
+	if err := broadcast(app, msg); err != nil {
 		log.Printf("relay: broadcast error: %v.", err)
 		r.drop()
 	}
@@ -72,7 +82,9 @@ func (r *relay) HandleRequest(request []byte, timeout time.Duration) ([]byte, er
 		r.reqLock.Unlock()
 	}()
 	// Send the request
-	if err := r.sendRequest(reqId, request, int(timeout.Nanoseconds()/1000000)); err != nil {
+	err := r.sendRequest(reqId, request, int(timeout.Nanoseconds()/1000000))
+	pool.PutBuffer(request)
+	if err != nil {
 		log.Printf("relay: request error: %v.", err)
 		r.drop()
 		return nil, err
@@ -91,9 +103,14 @@ func (r *relay) HandleRequest(request []byte, timeout time.Duration) ([]byte, er
 }
 
 // Forwards a request arriving from the attached binding to the Iris network, and
-// waits for a reply to arrive back which can be forwarded.
-func (r *relay) handleRequest(cluster string, id uint64, request []byte, timeout time.Duration) {
-	reply, err := r.iris.Request(cluster, request, timeout)
+// waits for a reply to arrive back which can be forwarded. The request may be
+// exempt from payload compression.
+func (r *relay) handleRequest(cluster string, id uint64, request []byte, timeout time.Duration, raw bool) {
+	req := r.iris.Request
+	if raw {
+		req = r.iris.RequestRaw
+	}
+	reply, err := req(cluster, request, timeout)
 	switch {
 	case err == iris.ErrTimeout || err == iris.ErrTerminating:
 		r.sendReply(id, nil, "")
@@ -101,6 +118,7 @@ func (r *relay) handleRequest(cluster string, id uint64, request []byte, timeout
 		r.sendReply(id, nil, err.Error())
 	default:
 		r.sendReply(id, reply, "")
+		pool.PutBuffer(reply)
 	}
 }
 
@@ -143,6 +161,7 @@ func (s *subscriptionHandler) HandleEvent(msg []byte) {
 		log.Printf("relay: publish forward error: %v.", err)
 		s.relay.drop()
 	}
+	pool.PutBuffer(msg)
 }
 
 // Forwards a topic subscription arriving from the attached binding to the Iris
@@ -169,9 +188,14 @@ func (r *relay) handleUnsubscribe(topic string) {
 	}
 }
 
-// Forwards a publish event arriving from the attached binding to the Iris node.
-func (r *relay) handlePublish(topic string, msg []byte) {
-	if err := r.iris.Publish(topic, msg); err != nil {
+// Forwards a publish event arriving from the attached binding to the Iris node,
+// optionally exempt from payload compression.
+func (r *relay) handlePublish(topic string, msg []byte, raw bool) {
+	publish := r.iris.Publish
+	if raw {
+		publish = r.iris.PublishRaw
+	}
+	if err := publish(topic, msg); err != nil {
 		log.Printf("relay: publish error: %v.", err)
 		r.drop()
 	}
@@ -202,6 +226,8 @@ func (r *relay) HandleTunnel(tun *iris.Tunnel) {
 	}
 	// Wait for the final id and save the tunnel
 	select {
+	case <-r.term:
+		// Relay terminating, the Iris connection will tear the tunnel down
 	case <-time.After(config.RelayTunnelTimeout):
 		log.Printf("relay: tunnel request timed out.")
 		r.drop()
@@ -252,6 +278,7 @@ func (r *relay) handleTunnelConfirm(buildId uint64, tunId uint64) {
 	// Create the new relay tunnel
 	tun, ok := r.tunPend[buildId]
 	if !ok {
+		r.tunLock.Unlock()
 		log.Printf("relay: non-existent tunnel confirmed: %v.", buildId)
 		return
 	}
@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Creates a relay reading its input from a fixed byte stream and writing its
+// output into a buffer.
+func newFuzzRelay(data []byte) (*relay, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+	return &relay{
+		sockBuf: bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(out)),
+	}, out
+}
+
+func FuzzRecvVarint(f *testing.F) {
+	for _, seed := range [][]byte{{0x00}, {0x7f}, {0x80, 0x01}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, {0xff}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rel, _ := newFuzzRelay(data)
+		num, err := rel.recvVarint()
+		if err != nil {
+			return
+		}
+		// Successfully parsed numbers must survive a round trip
+		enc, out := newFuzzRelay(nil)
+		if err := enc.sendVarint(num); err != nil {
+			t.Fatalf("failed to encode varint: %v.", err)
+		}
+		enc.sockBuf.Flush()
+
+		dec, _ := newFuzzRelay(out.Bytes())
+		if have, err := dec.recvVarint(); err != nil || have != num {
+			t.Fatalf("round trip mismatch: have %v/%v, want %v/nil.", have, err, num)
+		}
+	})
+}
+
+func FuzzRecvBinary(f *testing.F) {
+	for _, seed := range [][]byte{{0x00}, {0x03, 'a', 'b', 'c'}, {0x05, 'a'}, {0xff, 0xff, 0xff, 0xff, 0x0f}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rel, _ := newFuzzRelay(data)
+		blob, err := rel.recvBinary(1024 * 1024)
+		if err == nil && len(blob) > len(data) {
+			t.Fatalf("binary longer than input: have %d, input %d.", len(blob), len(data))
+		}
+	})
+}
+
+func FuzzProcess(f *testing.F) {
+	for _, seed := range [][]byte{
+		{opClose},
+		{opSubscribe, 0x01, 'a', opUnsubscribe, 0x01, 'a'},
+		{opPublish, 0x01, 'a', 0x01, 'b'},
+		{opRequest, 0x01, 0x01, 'a', 0x01, 'b', 0x01},
+		{opReply, 0x00, 0x01, 0x00},
+		{opTunInit, 0x01, 0x01, 'a', 0x01},
+		{opTunConfirm, 0x00, 0x01},
+		{opTunAllow, 0x01, 0x01, opTunTransfer, 0x01, 0x01, 0x01, 'a', opTunClose, 0x01},
+		{0xff},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := newTestClient(t)
+		c.init("")
+
+		// Feed the fuzzed data to the relay and ensure it terminates
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.sendRaw(data)
+			c.sock.Close()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("relay stuck consuming input.")
+		}
+		c.closed()
+	})
+}
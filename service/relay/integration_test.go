@@ -0,0 +1,274 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// End-to-end tests of the relay service, attaching applications through the
+// reference client over real TCP connections.
+
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/service/relay/client"
+)
+
+// Service handler for the integration tests: collects broadcasts, echoes the
+// requests and the tunnel messages.
+type testService struct {
+	bcasts chan []byte
+}
+
+func (s *testService) HandleBroadcast(msg []byte) {
+	s.bcasts <- msg
+}
+
+func (s *testService) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	if string(req) == "fail" {
+		return nil, fmt.Errorf("requested failure")
+	}
+	return req, nil
+}
+
+func (s *testService) HandleTunnel(tun *client.Tunnel) {
+	defer tun.Close()
+	for {
+		msg, err := tun.Recv(5 * time.Second)
+		if err != nil {
+			return
+		}
+		if err := tun.Send(msg, 5*time.Second); err != nil {
+			return
+		}
+	}
+}
+
+// Subscription handler collecting the topic events.
+type testTopic struct {
+	events chan []byte
+}
+
+func (t *testTopic) HandleEvent(msg []byte) {
+	t.events <- msg
+}
+
+// Boots a relay service on an ephemeral port, returning it and the port.
+func bootRelay(t *testing.T) (*Relay, int) {
+	rel, err := New(0, testOverlay)
+	if err != nil {
+		t.Fatalf("failed to create relay: %v.", err)
+	}
+	if err := rel.Boot(); err != nil {
+		t.Fatalf("failed to boot relay: %v.", err)
+	}
+	return rel, rel.listeners[0].Addr().(*net.TCPAddr).Port
+}
+
+func TestClientBroadcast(t *testing.T) {
+	base := runtime.NumGoroutine()
+	rel, port := bootRelay(t)
+
+	service := &testService{bcasts: make(chan []byte, 100)}
+	serv, err := client.Register(port, "itest-bcast", service)
+	if err != nil {
+		t.Fatalf("failed to register service: %v.", err)
+	}
+	conn, err := client.Connect(port)
+	if err != nil {
+		t.Fatalf("failed to connect client: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if err := conn.Broadcast("itest-bcast", []byte{byte(i)}); err != nil {
+			t.Fatalf("broadcast %d: failed to send: %v.", i, err)
+		}
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < 100; i++ {
+		select {
+		case msg := <-service.bcasts:
+			seen[msg[0]] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("broadcast %d: timeout.", i)
+		}
+	}
+	if len(seen) != 100 {
+		t.Fatalf("broadcast mismatch: have %d distinct, want %d.", len(seen), 100)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close client: %v.", err)
+	}
+	if err := serv.Close(); err != nil {
+		t.Fatalf("failed to close service: %v.", err)
+	}
+	if err := rel.Terminate(); err != nil {
+		t.Fatalf("failed to terminate relay: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestClientReqRep(t *testing.T) {
+	base := runtime.NumGoroutine()
+	rel, port := bootRelay(t)
+
+	serv, err := client.Register(port, "itest-reqrep", &testService{})
+	if err != nil {
+		t.Fatalf("failed to register service: %v.", err)
+	}
+	conn, err := client.Connect(port)
+	if err != nil {
+		t.Fatalf("failed to connect client: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Execute a batch of concurrent requests
+	var pend sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		pend.Add(1)
+		go func(i int) {
+			defer pend.Done()
+			req := []byte(fmt.Sprintf("request #%d", i))
+			if rep, err := conn.Request("itest-reqrep", req, time.Second); err != nil {
+				t.Errorf("request %d: failed: %v.", i, err)
+			} else if !bytes.Equal(rep, req) {
+				t.Errorf("request %d: reply mismatch: have %s, want %s.", i, rep, req)
+			}
+		}(i)
+	}
+	pend.Wait()
+
+	// Check the failure and timeout cases
+	if _, err := conn.Request("itest-reqrep", []byte("fail"), time.Second); err == nil {
+		t.Errorf("failure not reported.")
+	} else if rerr, ok := err.(*client.RemoteError); !ok || rerr.Fault != "requested failure" {
+		t.Errorf("failure mismatch: have %v, want %v.", err, "requested failure")
+	}
+	if _, err := conn.Request("itest-missing", []byte("hello"), 100*time.Millisecond); err != client.ErrTimeout {
+		t.Errorf("timeout mismatch: have %v, want %v.", err, client.ErrTimeout)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close client: %v.", err)
+	}
+	if err := serv.Close(); err != nil {
+		t.Fatalf("failed to close service: %v.", err)
+	}
+	if err := rel.Terminate(); err != nil {
+		t.Fatalf("failed to terminate relay: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestClientPubSub(t *testing.T) {
+	base := runtime.NumGoroutine()
+	rel, port := bootRelay(t)
+
+	conn, err := client.Connect(port)
+	if err != nil {
+		t.Fatalf("failed to connect client: %v.", err)
+	}
+	topic := &testTopic{events: make(chan []byte, 100)}
+	if err := conn.Subscribe("itest-topic", topic); err != nil {
+		t.Fatalf("failed to subscribe: %v.", err)
+	}
+	if err := conn.Subscribe("itest-topic", topic); err == nil {
+		t.Fatalf("duplicate subscription accepted.")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if err := conn.Publish("itest-topic", []byte{byte(i)}); err != nil {
+			t.Fatalf("event %d: failed to publish: %v.", i, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case <-topic.events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d: timeout.", i)
+		}
+	}
+	if err := conn.Unsubscribe("itest-topic"); err != nil {
+		t.Fatalf("failed to unsubscribe: %v.", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close client: %v.", err)
+	}
+	if err := rel.Terminate(); err != nil {
+		t.Fatalf("failed to terminate relay: %v.", err)
+	}
+	checkLeaks(t, base)
+}
+
+func TestClientTunnel(t *testing.T) {
+	base := runtime.NumGoroutine()
+	rel, port := bootRelay(t)
+
+	serv, err := client.Register(port, "itest-tunnel", &testService{})
+	if err != nil {
+		t.Fatalf("failed to register service: %v.", err)
+	}
+	conn, err := client.Connect(port)
+	if err != nil {
+		t.Fatalf("failed to connect client: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tun, err := conn.Tunnel("itest-tunnel", time.Second)
+	if err != nil {
+		t.Fatalf("failed to open tunnel: %v.", err)
+	}
+	// Send messages of various sizes, some needing chunking
+	sizes := []int{1, 1024, config.RelayTunnelChunkLimit, 3*config.RelayTunnelChunkLimit + 17}
+	for i, size := range sizes {
+		msg := make([]byte, size)
+		for j := range msg {
+			msg[j] = byte(i + j)
+		}
+		if err := tun.Send(msg, time.Second); err != nil {
+			t.Fatalf("message %d: failed to send: %v.", i, err)
+		}
+		if rep, err := tun.Recv(5 * time.Second); err != nil {
+			t.Fatalf("message %d: failed to receive: %v.", i, err)
+		} else if !bytes.Equal(rep, msg) {
+			t.Fatalf("message %d: echo mismatch: have %d bytes, want %d.", i, len(rep), len(msg))
+		}
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+	if _, err := conn.Tunnel("itest-missing", 100*time.Millisecond); err != client.ErrTimeout {
+		t.Fatalf("tunnel timeout mismatch: have %v, want %v.", err, client.ErrTimeout)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close client: %v.", err)
+	}
+	if err := serv.Close(); err != nil {
+		t.Fatalf("failed to close service: %v.", err)
+	}
+	if err := rel.Terminate(); err != nil {
+		t.Fatalf("failed to terminate relay: %v.", err)
+	}
+	checkLeaks(t, base)
+}
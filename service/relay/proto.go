@@ -18,16 +18,28 @@
 
 // Contains the wire protocol for communicating with an Iris binding.
 
-// The specification version implemented is v1.0-draft2, available at:
+// The baseline specification version implemented is v1.0-draft2, available at:
 // http://iris.karalabe.com/specs/relay-protocol-v1.0-draft2.pdf
+//
+// Newer versions are negotiated during connection initialization, the features
+// they introduce being permitted only on connections agreeing upon them.
+//
+//	v1.0-draft3: the connection acceptance advertises the message size limits
+//	v1.0-draft4: broadcasts, requests and publishes may be preceded by a payload
+//	             compression opt-out (for already compressed data)
 
 package relay
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
 )
 
 // Packet opcodes
@@ -49,15 +61,58 @@ const (
 	opTunAllow    = 0x0b // In: tunnel transfer allowance      | Out: <same as out>
 	opTunTransfer = 0x0c // In: tunnel data exchange           | Out: <same as out>
 	opTunClose    = 0x0d // In: tunnel termination request     | Out: tunnel termination notification
+
+	opNoCompress = 0x0e // In: payload compression opt-out    | Out: <never sent>
 )
 
 // Protocol constants
 var (
-	protoVersion = "v1.0-draft2"
-	clientMagic  = "iris-client-magic"
-	relayMagic   = "iris-relay-magic"
+	clientMagic = "iris-client-magic"
+	relayMagic  = "iris-relay-magic"
 )
 
+// Binary size above which inbound data is buffered incrementally, not allocated
+// in one go based on the (untrusted) length tag.
+const recvBinaryChunk = 64 * 1024
+
+// Relay protocol version along with the features it permits.
+type protoVersion struct {
+	name   string // Textual version identifier exchanged during init
+	lastOp byte   // Highest opcode permitted by the version
+	limits bool   // Whether the message size limits are advertised during init
+}
+
+// Protocol versions supported by the relay, ordered from oldest to newest. The
+// clients may advertise any number of comma separated versions in the init
+// packet, from which the newest common one is selected.
+var protoVersions = []*protoVersion{
+	{name: "v1.0-draft2", lastOp: opTunClose},
+	{name: "v1.0-draft3", lastOp: opTunClose, limits: true},
+	{name: "v1.0-draft4", lastOp: opNoCompress, limits: true},
+}
+
+// Selects the newest protocol version supported both by the client (comma
+// separated list) and the relay. Nil is returned if there's no common version.
+func negotiate(offered string) *protoVersion {
+	for i := len(protoVersions) - 1; i >= 0; i-- {
+		for _, version := range strings.Split(offered, ",") {
+			if strings.TrimSpace(version) == protoVersions[i].name {
+				return protoVersions[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Assembles the list of supported protocol versions for error reporting.
+func supportedVersions() string {
+	names := make([]string, len(protoVersions))
+	for i, version := range protoVersions {
+		names[i] = version.name
+	}
+	return strings.Join(names, ",")
+}
+
 // Serializes a single byte into the relay connection.
 func (r *relay) sendByte(data byte) error {
 	return r.sockBuf.WriteByte(data)
@@ -122,7 +177,9 @@ func (r *relay) sendPacket(closure func() error) error {
 	return nil
 }
 
-// Sends a connection acceptance.
+// Sends a connection acceptance along with the negotiated protocol version and,
+// if supported by it, the message size limits (broadcast, request, reply, topic
+// event and tunnel chunk, in this order).
 func (r *relay) sendInit() error {
 	if err := r.sendByte(opInit); err != nil {
 		return err
@@ -130,9 +187,16 @@ func (r *relay) sendInit() error {
 	if err := r.sendString(relayMagic); err != nil {
 		return err
 	}
-	if err := r.sendString(protoVersion); err != nil {
+	if err := r.sendString(r.version.name); err != nil {
 		return err
 	}
+	if r.version.limits {
+		for _, limit := range []int{config.IrisBroadcastLimit, config.IrisRequestLimit, config.IrisReplyLimit, config.IrisPublishLimit, config.RelayTunnelChunkLimit} {
+			if err := r.sendVarint(uint64(limit)); err != nil {
+				return err
+			}
+		}
+	}
 	return r.sockBuf.Flush()
 }
 
@@ -331,6 +395,10 @@ func (r *relay) recvVarint() (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
+		// Make sure the number fits into 64 bits (10th byte may hold only one bit)
+		if i == 9 && chunk > 1 {
+			return 0, fmt.Errorf("protocol violation: varint overflow")
+		}
 		num += uint64(chunk&127) << (7 * i)
 		if chunk <= 127 {
 			break
@@ -339,31 +407,51 @@ func (r *relay) recvVarint() (uint64, error) {
 	return num, nil
 }
 
-// Retrieves a length-tagged binary array from the relay connection.
-func (r *relay) recvBinary() ([]byte, error) {
-	// Fetch the length of the binary blob
+// Retrieves a length-tagged binary array from the relay connection, failing if
+// the length exceeds the given limit. Since the length is client supplied, the
+// memory is only allocated as the data arrives. Small blobs are pooled buffers
+// owned by the caller.
+func (r *relay) recvBinary(limit int) ([]byte, error) {
+	// Fetch the length of the binary blob and ensure it's within limits
 	size, err := r.recvVarint()
 	if err != nil {
 		return nil, err
 	}
-	// Fetch the blob itself
-	data := make([]byte, size)
-	if _, err := io.ReadFull(r.sockBuf, data); err != nil {
+	if size > uint64(limit) {
+		return nil, fmt.Errorf("protocol violation: size limit exceeded: %v > %v", size, limit)
+	}
+	// Small blobs can be read directly, larger ones should grow as the data arrives
+	if size <= recvBinaryChunk {
+		data := pool.GetBuffer(int(size))
+		if _, err := io.ReadFull(r.sockBuf, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	data := bytes.NewBuffer(make([]byte, 0, recvBinaryChunk))
+	if _, err := io.CopyN(data, r.sockBuf, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	return data, nil
+	return data.Bytes(), nil
 }
 
-// Retrieves a length-tagged string from the relay connection.
-func (r *relay) recvString() (string, error) {
-	if data, err := r.recvBinary(); err != nil {
+// Retrieves a length-tagged string from the relay connection, failing if the
+// length exceeds the given limit.
+func (r *relay) recvString(limit int) (string, error) {
+	if data, err := r.recvBinary(limit); err != nil {
 		return "", err
 	} else {
-		return string(data), nil
+		str := string(data)
+		pool.PutBuffer(data)
+		return str, nil
 	}
 }
 
-// Retrieves a connection initiation request.
+// Retrieves a connection initiation request. The returned version is the raw,
+// possibly multi-version client offer, which needs negotiating.
 func (r *relay) procInit() (string, string, error) {
 	// Retrieve the init code
 	if op, err := r.recvByte(); err != nil {
@@ -372,18 +460,18 @@ func (r *relay) procInit() (string, string, error) {
 		return "", "", fmt.Errorf("protocol violation: invalid init code: %v.", op)
 	}
 	// Retrieve and check the client side magic
-	if magic, err := r.recvString(); err != nil {
+	if magic, err := r.recvString(config.IrisNameLimit); err != nil {
 		return "", "", err
 	} else if magic != clientMagic {
 		return "", "", fmt.Errorf("protocol violation: invalid client magic: %s", magic)
 	}
 	// Retrieve the protocol version
-	version, err := r.recvString()
+	version, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return "", "", err
 	}
 	// Retrieve the cluster id
-	cluster, err := r.recvString()
+	cluster, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return "", "", err
 	}
@@ -398,29 +486,31 @@ func (r *relay) procClose() error {
 
 // Retrieves an application broadcast initiation.
 func (r *relay) procBroadcast() error {
-	cluster, err := r.recvString()
+	raw := r.rawPayload()
+	cluster, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
-	message, err := r.recvBinary()
+	message, err := r.recvBinary(config.IrisBroadcastLimit)
 	if err != nil {
 		return err
 	}
-	r.workers.Schedule(func() { r.handleBroadcast(cluster, message) })
+	r.workers.Schedule(func() { r.handleBroadcast(cluster, message, raw) })
 	return nil
 }
 
 // Retrieves an application request initiation.
 func (r *relay) procRequest() error {
+	raw := r.rawPayload()
 	id, err := r.recvVarint()
 	if err != nil {
 		return err
 	}
-	cluster, err := r.recvString()
+	cluster, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
-	request, err := r.recvBinary()
+	request, err := r.recvBinary(config.IrisRequestLimit)
 	if err != nil {
 		return err
 	}
@@ -428,7 +518,7 @@ func (r *relay) procRequest() error {
 	if err != nil {
 		return err
 	}
-	go r.handleRequest(cluster, id, request, time.Duration(timeout)*time.Millisecond)
+	go r.handleRequest(cluster, id, request, time.Duration(timeout)*time.Millisecond, raw)
 	return nil
 }
 
@@ -446,11 +536,11 @@ func (r *relay) procReply() error {
 	var reply []byte
 	var fault string
 	if success {
-		if reply, err = r.recvBinary(); err != nil {
+		if reply, err = r.recvBinary(config.IrisReplyLimit); err != nil {
 			return err
 		}
 	} else {
-		if fault, err = r.recvString(); err != nil {
+		if fault, err = r.recvString(config.IrisReplyLimit); err != nil {
 			return err
 		}
 	}
@@ -460,7 +550,7 @@ func (r *relay) procReply() error {
 
 // Retrieves a topic subscription.
 func (r *relay) procSubscribe() error {
-	topic, err := r.recvString()
+	topic, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
@@ -470,7 +560,7 @@ func (r *relay) procSubscribe() error {
 
 // Retrieves a topic subscription removal.
 func (r *relay) procUnsubscribe() error {
-	topic, err := r.recvString()
+	topic, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
@@ -480,15 +570,16 @@ func (r *relay) procUnsubscribe() error {
 
 // Retrieves a topic event publish.
 func (r *relay) procPublish() error {
-	topic, err := r.recvString()
+	raw := r.rawPayload()
+	topic, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
-	event, err := r.recvBinary()
+	event, err := r.recvBinary(config.IrisPublishLimit)
 	if err != nil {
 		return err
 	}
-	r.workers.Schedule(func() { r.handlePublish(topic, event) })
+	r.workers.Schedule(func() { r.handlePublish(topic, event, raw) })
 	return nil
 }
 
@@ -498,7 +589,7 @@ func (r *relay) procTunnelInit() error {
 	if err != nil {
 		return err
 	}
-	cluster, err := r.recvString()
+	cluster, err := r.recvString(config.IrisNameLimit)
 	if err != nil {
 		return err
 	}
@@ -548,7 +639,7 @@ func (r *relay) procTunnelTranfer() error {
 	if err != nil {
 		return err
 	}
-	payload, err := r.recvBinary()
+	payload, err := r.recvBinary(config.RelayTunnelChunkLimit)
 	if err != nil {
 		return err
 	}
@@ -566,14 +657,36 @@ func (r *relay) procTunnelClose() error {
 	return nil
 }
 
+// Retrieves a compression opt-out for the next payload packet.
+func (r *relay) procNoCompress() error {
+	r.noCompress = true
+	return nil
+}
+
+// Consumes the compression opt-out pending for the current payload packet.
+func (r *relay) rawPayload() bool {
+	raw := r.noCompress
+	r.noCompress = false
+	return raw
+}
+
 // Retrieves messages from the client connection and keeps processing them until
 // either side closes the socket or the connection drops.
 func (r *relay) process() {
 	var op byte
 	var err error
 	for closed := false; !closed && err == nil; {
-		// Retrieve the next message opcode
+		// Retrieve the next message opcode and ensure the version permits it
 		if op, err = r.recvByte(); err == nil {
+			if op > r.version.lastOp {
+				err = fmt.Errorf("protocol violation: opcode %v not supported in %s", op, r.version.name)
+				continue
+			}
+			// A compression opt-out must be directly followed by a payload packet
+			if r.noCompress && op != opBroadcast && op != opRequest && op != opPublish {
+				err = fmt.Errorf("protocol violation: opcode %v following compression opt-out", op)
+				continue
+			}
 			// Read the rest of the message and process
 			switch op {
 			case opBroadcast:
@@ -598,6 +711,8 @@ func (r *relay) process() {
 				err = r.procTunnelTranfer()
 			case opTunClose:
 				err = r.procTunnelClose()
+			case opNoCompress:
+				err = r.procNoCompress()
 			case opClose:
 				if err = r.procClose(); err == nil {
 					// Graceful close, unregister from Iris and wait for pending ops
@@ -614,17 +729,16 @@ func (r *relay) process() {
 			}
 		}
 	}
-	// If an error occurred, force stop execution
+	// Signal termination to all blocked threads and close the Iris connection
+	close(r.term)
+	r.iris.Close()
+
+	// If an error occurred, force stop execution, then close the relay connection
 	if err != nil {
 		r.workers.Terminate(true)
 	}
-	// Close both Iris and relay connections
-	r.iris.Close()
 	r.sock.Close()
 
-	// Signal termination to all blocked threads
-	close(r.term)
-
 	// Notify the supervisor and report error if any
 	r.done <- r
 	errc := <-r.quit
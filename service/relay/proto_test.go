@@ -0,0 +1,57 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package relay
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	// Inject a few fake newer versions to negotiate between
+	olds := protoVersions
+	defer func() { protoVersions = olds }()
+
+	protoVersions = append(append([]*protoVersion{}, olds...),
+		&protoVersion{name: "v1.0-fake1", lastOp: opTunClose},
+		&protoVersion{name: "v1.0-fake2", lastOp: opTunClose},
+	)
+	// Define the test cases and run each of them
+	tests := []struct {
+		offer   string
+		version string
+	}{
+		{"v1.0-draft2", "v1.0-draft2"},
+		{"v1.0-fake1", "v1.0-fake1"},
+		{"v1.0-draft2,v1.0-fake1", "v1.0-fake1"},
+		{"v1.0-fake2, v1.0-draft2", "v1.0-fake2"},
+		{"v1.0-draft2,v1.0-fake1,v1.0-fake2", "v1.0-fake2"},
+		{"v1.0-draft2,v9.9", "v1.0-draft2"},
+		{"v9.9", ""},
+		{"", ""},
+	}
+	for i, tt := range tests {
+		version := negotiate(tt.offer)
+		switch {
+		case version == nil && tt.version != "":
+			t.Errorf("test %d: no version negotiated, want %v.", i, tt.version)
+		case version != nil && version.name != tt.version:
+			t.Errorf("test %d: version mismatch: have %v, want %v.", i, version.name, tt.version)
+		}
+	}
+}
@@ -34,7 +34,9 @@ import (
 // Message relay between the local carrier and an attached binding.
 type relay struct {
 	// Application layer fields
-	iris *iris.Connection // Interface into the iris overlay
+	iris       *iris.Connection // Interface into the iris overlay
+	version    *protoVersion    // Relay protocol version negotiated with the client
+	noCompress bool             // Compression opt-out pending for the next payload packet
 
 	reqIdx  uint64                 // Index to assign the next request
 	reqReps map[uint64]chan []byte // Reply channels for active requests
@@ -89,21 +91,21 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	defer rel.sockLock.Unlock()
 
 	// Initialize the relay
-	version, cluster, err := rel.procInit()
+	versions, cluster, err := rel.procInit()
 	if err != nil {
 		rel.drop()
 		return nil, err
 	}
-	// Make sure the protocol version is compatible
-	if version != protoVersion {
+	// Negotiate the newest protocol version supported by both sides
+	if rel.version = negotiate(versions); rel.version == nil {
 		// Drop the connection in either error branch
 		defer rel.drop()
 
-		reason := fmt.Sprintf("Unsupported protocol. Client: %s. Iris: %s.", version, protoVersion)
+		reason := fmt.Sprintf("Unsupported protocol. Client: %s. Iris: %s.", versions, supportedVersions())
 		if err := rel.sendDeny(reason); err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("relay: unsupported client protocol version: have %v, want %v", version, protoVersion)
+		return nil, fmt.Errorf("relay: unsupported client protocol version: have %v, want %v", versions, supportedVersions())
 	}
 	// Connect to the Iris network either as a service or as a client
 	var handler iris.ConnectionHandler
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/project-iris/iris/proto/iris"
@@ -36,8 +37,9 @@ type Relay struct {
 	endpoint  int                // Local port on which to listen on
 	listeners []*net.TCPListener // Listener sockets for the locally joining apps
 
-	iris    *iris.Overlay       // Overlay through which connections are relayed
-	clients map[*relay]struct{} // Active client connections
+	iris       *iris.Overlay       // Overlay through which connections are relayed
+	clients    map[*relay]struct{} // Active client connections
+	clientLock sync.Mutex          // Mutex to protect the clients shared by the acceptors
 
 	done chan *relay     // Channel on which active clients signal termination
 	quit chan chan error // Quit channel to synchronize relay termination
@@ -90,6 +92,15 @@ func (r *Relay) Terminate() error {
 			errs = append(errs, err)
 		}
 	}
+	// Acceptors down, forcefully close all still active client connections
+	for rel, _ := range r.clients {
+		rel.drop()
+	}
+	for len(r.clients) > 0 {
+		rel := <-r.done
+		delete(r.clients, rel)
+		rel.report()
+	}
 	switch len(errs) {
 	case 0:
 		return nil
@@ -112,7 +123,9 @@ func (r *Relay) acceptor(listener *net.TCPListener) {
 			break
 		case client := <-r.done:
 			// A client terminated, remove from active list
+			r.clientLock.Lock()
 			delete(r.clients, client)
+			r.clientLock.Unlock()
 			if err := client.report(); err != nil {
 				log.Printf("relay: closing client error: %v.", err)
 			}
@@ -123,7 +136,9 @@ func (r *Relay) acceptor(listener *net.TCPListener) {
 				if rel, err := r.acceptRelay(sock); err != nil {
 					log.Printf("relay: accept failed: %v.", err)
 				} else {
+					r.clientLock.Lock()
 					r.clients[rel] = struct{}{}
+					r.clientLock.Unlock()
 				}
 			} else if !err.(net.Error).Timeout() {
 				log.Printf("relay: accept failed: %v, terminating.", err)
@@ -134,14 +149,6 @@ func (r *Relay) acceptor(listener *net.TCPListener) {
 	if errc == nil {
 		errc = <-r.quit
 	}
-	// Forcefully close all active client connections
-	for rel, _ := range r.clients {
-		rel.drop()
-		<-r.done
-	}
-	for rel, _ := range r.clients {
-		rel.report()
-	}
 	// Clean up and report
 	errc <- listener.Close()
 }
@@ -0,0 +1,284 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package sim contains a simulation harness running whole Iris networks within
+// a single process: the nodes communicate over a virtual network with tunable
+// latency, loss and partitions, while their heartbeats and convergence timers
+// run on a fake clock, stepped forward by the harness. This allows convergence
+// and churn scenarios of hundreds of nodes to be tested without real network
+// interfaces, LAN bootstrapping or wall clock sleeps.
+package sim
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/clock"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/transport"
+)
+
+// Port on which the simulated nodes accept the overlay sessions.
+const overlayPort = 4000
+
+// Maximum number of existing nodes a new one is seeded with.
+const seedCount = 3
+
+// Maximum number of pace periods to wait for the nodes to settle after a step.
+const maxSettle = 1000
+
+// Error returned if an operation doesn't finish within its simulated time limit.
+var ErrTimeout = errors.New("simulation timed out")
+
+// Simulated Iris network.
+type Cluster struct {
+	Clock   *clock.Fake        // Fake clock driving all the nodes
+	Network *transport.Network // Virtual network connecting the nodes
+
+	Step  time.Duration // Simulated time to advance the clock with in one step
+	Pace  time.Duration // Real time to allow for processing after each step
+	Batch int           // Maximum number of nodes to boot concurrently
+
+	overId string          // Overlay id of the simulated nodes
+	key    *rsa.PrivateKey // Authentication key of the simulated nodes
+	random *rand.Rand      // Source of the seed selections
+
+	nodes []*Node // Currently live nodes
+	hosts int     // Number of hosts allocated so far
+	lock  sync.Mutex
+}
+
+// Single simulated Iris node.
+type Node struct {
+	Host    string        // Virtual host of the node
+	Addr    string        // Address of the overlay listener
+	Overlay *iris.Overlay // Iris overlay running on the node
+	Peers   int           // Number of remote peers reported by the boot
+}
+
+// Creates a new, empty simulated network, where all nodes will join the overlay
+// overId, authenticated by key. The seed makes the link events and the joining
+// order reproducible.
+func New(overId string, key *rsa.PrivateKey, seed int64) *Cluster {
+	clk := clock.NewFake(time.Unix(0, 0))
+	return &Cluster{
+		Clock:   clk,
+		Network: transport.NewNetwork(clk, seed),
+		Step:    10 * time.Millisecond,
+		Pace:    time.Millisecond,
+		Batch:   8,
+		overId:  overId,
+		key:     key,
+		random:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Returns the currently live nodes.
+func (c *Cluster) Nodes() []*Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Boots n new nodes in batches, each joining the overlay through a few random
+// live ones, and waits until all of them converge. If the cluster is empty, a
+// first node is booted alone to seed the rest.
+func (c *Cluster) Start(n int) ([]*Node, error) {
+	started := []*Node{}
+	for n > 0 {
+		size := n
+		if size > c.Batch {
+			size = c.Batch
+		}
+		if len(c.Nodes()) == 0 {
+			size = 1
+		}
+		nodes, err := c.start(size)
+		if err != nil {
+			return started, err
+		}
+		started, n = append(started, nodes...), n-size
+	}
+	return started, nil
+}
+
+// Boots a batch of nodes concurrently, seeded from the previously live ones.
+func (c *Cluster) start(n int) ([]*Node, error) {
+	// Create and configure the new nodes
+	c.lock.Lock()
+	batch := make([]*Node, n)
+	for i := range batch {
+		c.hosts++
+		host := fmt.Sprintf("10.%d.%d.%d", (c.hosts>>16)&255, (c.hosts>>8)&255, c.hosts&255)
+
+		node := &Node{
+			Host:    host,
+			Addr:    net.JoinHostPort(host, strconv.Itoa(overlayPort)),
+			Overlay: iris.New(c.overId, c.key),
+		}
+		node.Overlay.SetTransport(c.Network.Host(host))
+		node.Overlay.SetClock(c.Clock)
+		if err := node.Overlay.SetEndpoints([]string{node.Addr}, c.seeds()); err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+		batch[i] = node
+	}
+	c.lock.Unlock()
+
+	// Boot all of them concurrently, stepping the clock until done
+	err := c.Do(10*config.PastryBootTimeout, func() error {
+		errc := make(chan error, len(batch))
+		for _, node := range batch {
+			go func(node *Node) {
+				peers, err := node.Overlay.Boot()
+				node.Peers = peers
+				errc <- err
+			}(node)
+		}
+		var failure error
+		for i := 0; i < len(batch); i++ {
+			if err := <-errc; err != nil && failure == nil {
+				failure = err
+			}
+		}
+		return failure
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.nodes = append(c.nodes, batch...)
+	c.lock.Unlock()
+
+	return batch, nil
+}
+
+// Picks the listener addresses of a few random live nodes to join through. The
+// cluster lock is assumed held.
+func (c *Cluster) seeds() []string {
+	seeds := []string{}
+	for _, idx := range c.random.Perm(len(c.nodes)) {
+		if len(seeds) == seedCount {
+			break
+		}
+		seeds = append(seeds, c.nodes[idx].Addr)
+	}
+	return seeds
+}
+
+// Gracefully terminates a live node.
+func (c *Cluster) Stop(node *Node) error {
+	c.lock.Lock()
+	for i, live := range c.nodes {
+		if live == node {
+			c.nodes = append(c.nodes[:i], c.nodes[i+1:]...)
+			break
+		}
+	}
+	c.lock.Unlock()
+
+	return c.Do(config.PastryBootTimeout, node.Overlay.Shutdown)
+}
+
+// Terminates all the live nodes concurrently.
+func (c *Cluster) Shutdown() error {
+	c.lock.Lock()
+	nodes := c.nodes
+	c.nodes = nil
+	c.lock.Unlock()
+
+	return c.Do(config.PastryBootTimeout, func() error {
+		errc := make(chan error, len(nodes))
+		for _, node := range nodes {
+			go func(node *Node) {
+				errc <- node.Overlay.Shutdown()
+			}(node)
+		}
+		var failure error
+		for i := 0; i < len(nodes); i++ {
+			if err := <-errc; err != nil && failure == nil {
+				failure = err
+			}
+		}
+		return failure
+	})
+}
+
+// Advances the simulated time by d, step by step.
+func (c *Cluster) Run(d time.Duration) {
+	c.Until(d, func() bool { return false })
+}
+
+// Advances the simulated time step by step until the condition is met, or the
+// limit is reached. Returns whether the condition was met.
+func (c *Cluster) Until(limit time.Duration, cond func() bool) bool {
+	for elapsed := time.Duration(0); !cond(); elapsed += c.Step {
+		if elapsed >= limit {
+			return false
+		}
+		c.Clock.Advance(c.Step)
+		c.settle()
+	}
+	return true
+}
+
+// Waits for the nodes to process the events of a step. As the simulation is CPU
+// bound (mostly by handshakes), a sleep overshooting the pace considerably is
+// taken as a sign of pending work, and waiting continues. This prevents the
+// simulated time from racing ahead of the nodes and expiring their timers.
+func (c *Cluster) settle() {
+	for i := 0; i < maxSettle; i++ {
+		start := time.Now()
+		time.Sleep(c.Pace)
+		if time.Since(start) < 2*c.Pace {
+			return
+		}
+	}
+}
+
+// Executes a blocking operation on the simulated network, advancing the clock
+// until it finishes or the simulated time limit is reached. In the latter case
+// the operation is left running and ErrTimeout is returned.
+func (c *Cluster) Do(limit time.Duration, op func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	var err error
+	finished := c.Until(limit, func() bool {
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	if !finished {
+		return ErrTimeout
+	}
+	return err
+}
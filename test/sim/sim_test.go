@@ -0,0 +1,302 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package sim
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/transport"
+)
+
+// Size of the network in the convergence test (raise to simulate hundreds).
+var simNodes = flag.Int("sim.nodes", 24, "number of nodes in the convergence simulation")
+
+// Connection handler replying to requests with the name of its node.
+type responder struct {
+	name string
+}
+
+func (r *responder) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (r *responder) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return []byte(r.name), nil
+}
+
+func (r *responder) HandleTunnel(tun *iris.Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+func (r *responder) HandleDrop(reason error) {
+	panic("Connection dropped on request handler")
+}
+
+// Subscription handler collecting the events arriving to a topic.
+type collector struct {
+	events map[string]int
+	lock   sync.Mutex
+}
+
+func (c *collector) HandleEvent(msg []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.events[string(msg)]++
+}
+
+// Returns the number of times an event arrived.
+func (c *collector) count(event string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.events[event]
+}
+
+// Creates a simulated cluster of n nodes over links with some latency and loss.
+func newCluster(t *testing.T, n int) *Cluster {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v.", err)
+	}
+	cluster := New("sim.test", key, 42)
+	cluster.Network.SetDefaultLink(transport.Link{
+		Latency: 5 * time.Millisecond,
+		Jitter:  5 * time.Millisecond,
+		Loss:    0.01,
+	})
+	if _, err := cluster.Start(n); err != nil {
+		t.Fatalf("failed to boot cluster: %v.", err)
+	}
+	for _, node := range cluster.Nodes()[1:] {
+		if node.Peers == 0 {
+			t.Fatalf("node %v booted without peers.", node.Host)
+		}
+	}
+	return cluster
+}
+
+// Registers a responder on every live node and checks that each of them can
+// get replies from the service cluster.
+func checkRequests(t *testing.T, c *Cluster, service string) {
+	nodes := c.Nodes()
+	conns := make([]*iris.Connection, len(nodes))
+	for i, node := range nodes {
+		conn, err := node.Overlay.Connect(service, &responder{node.Host})
+		if err != nil {
+			t.Fatalf("node %v: failed to connect: %v.", node.Host, err)
+		}
+		conns[i] = conn
+	}
+	// Let the subscriptions propagate, then issue a request from each node
+	c.Run(config.ScribeBeatPeriod)
+	for i, conn := range conns {
+		err := c.Do(config.PastryBootTimeout, func() error {
+			rep, err := conn.Request(service, []byte{0x00}, 5*time.Second)
+			if err == nil && len(rep) == 0 {
+				err = fmt.Errorf("empty reply")
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("node %v: request failed: %v.", nodes[i].Host, err)
+		}
+	}
+	for _, conn := range conns {
+		c.Do(config.PastryBootTimeout, conn.Close)
+	}
+}
+
+func TestConvergence(t *testing.T) {
+	cluster := newCluster(t, *simNodes)
+	defer cluster.Shutdown()
+
+	checkRequests(t, cluster, "convergence")
+}
+
+func TestChurn(t *testing.T) {
+	cluster := newCluster(t, 16)
+	defer cluster.Shutdown()
+
+	// Drop a quarter of the nodes and add some fresh ones
+	for _, node := range cluster.Nodes()[:4] {
+		if err := cluster.Stop(node); err != nil {
+			t.Fatalf("failed to stop node %v: %v.", node.Host, err)
+		}
+	}
+	if _, err := cluster.Start(4); err != nil {
+		t.Fatalf("failed to boot new nodes: %v.", err)
+	}
+	// Let the overlay detect any failures and ensure it still works
+	cluster.Run(time.Duration(config.PastryKillCount+1) * config.PastryBeatPeriod)
+	checkRequests(t, cluster, "churn")
+}
+
+func TestPartition(t *testing.T) {
+	cluster := newCluster(t, 16)
+	defer cluster.Shutdown()
+
+	// Split the network in two and wait for the halves to drop each other
+	nodes := cluster.Nodes()
+	half := []string{}
+	for _, node := range nodes[:len(nodes)/2] {
+		half = append(half, node.Host)
+	}
+	cluster.Network.Partition(half)
+	cluster.Run(time.Duration(config.PastryKillCount+1) * config.PastryBeatPeriod)
+
+	// Each half should still be able to serve its own requests
+	checkRequests(t, cluster, "partition")
+}
+
+func TestHeal(t *testing.T) {
+	cluster := newCluster(t, 16)
+	defer cluster.Shutdown()
+
+	// Split the network in two and wait for the halves to converge separately
+	nodes := cluster.Nodes()
+	left, right := nodes[:len(nodes)/2], nodes[len(nodes)/2:]
+
+	hosts := []string{}
+	for _, node := range left {
+		hosts = append(hosts, node.Host)
+	}
+	cluster.Network.Partition(hosts)
+	cluster.Run(time.Duration(config.PastryKillCount+1) * config.PastryBeatPeriod)
+
+	// Register a service only on the right side, forming its own topic tree
+	for _, node := range right {
+		conn, err := node.Overlay.Connect("heal", &responder{node.Host})
+		if err != nil {
+			t.Fatalf("node %v: failed to connect: %v.", node.Host, err)
+		}
+		defer cluster.Do(config.PastryBootTimeout, conn.Close)
+	}
+	cluster.Run(config.ScribeBeatPeriod)
+
+	// Restore connectivity and wait for the rings and topic trees to merge
+	cluster.Network.Heal()
+	cluster.Run(2*config.PastryHealPeriod + config.PastryBootTimeout)
+
+	// Ensure the left side can reach the service on the right
+	for _, node := range left {
+		conn, err := node.Overlay.Connect("", nil)
+		if err != nil {
+			t.Fatalf("node %v: failed to connect: %v.", node.Host, err)
+		}
+		err = cluster.Do(config.PastryBootTimeout, func() error {
+			_, err := conn.Request("heal", []byte{0x00}, 5*time.Second)
+			return err
+		})
+		if err != nil {
+			t.Errorf("node %v: request across healed partition failed: %v.", node.Host, err)
+		}
+		cluster.Do(config.PastryBootTimeout, conn.Close)
+	}
+}
+
+func TestHealTopics(t *testing.T) {
+	cluster := newCluster(t, 16)
+	defer cluster.Shutdown()
+
+	// Split the network in two and wait for the halves to converge separately
+	nodes := cluster.Nodes()
+	left := nodes[:len(nodes)/2]
+
+	hosts := []string{}
+	for _, node := range left {
+		hosts = append(hosts, node.Host)
+	}
+	cluster.Network.Partition(hosts)
+	cluster.Run(time.Duration(config.PastryKillCount+1) * config.PastryBeatPeriod)
+
+	// Subscribe to the same topic on both sides, forming a tree rooted in each
+	conns := make([]*iris.Connection, len(nodes))
+	colls := make([]*collector, len(nodes))
+	for i, node := range nodes {
+		conn, err := node.Overlay.Connect("", nil)
+		if err != nil {
+			t.Fatalf("node %v: failed to connect: %v.", node.Host, err)
+		}
+		defer cluster.Do(config.PastryBootTimeout, conn.Close)
+
+		colls[i] = &collector{events: make(map[string]int)}
+		if err := conn.Subscribe("heal", colls[i]); err != nil {
+			t.Fatalf("node %v: failed to subscribe: %v.", node.Host, err)
+		}
+		conns[i] = conn
+	}
+	cluster.Run(3 * config.ScribeBeatPeriod)
+
+	// Ensure the trees are indeed separate before healing
+	if err := conns[0].Publish("heal", []byte("split")); err != nil {
+		t.Fatalf("failed to publish during split: %v.", err)
+	}
+	cluster.Until(config.PastryBootTimeout, func() bool {
+		for _, coll := range colls[:len(left)] {
+			if coll.count("split") == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	for i, coll := range colls {
+		want := 0
+		if i < len(left) {
+			want = 1
+		}
+		if n := coll.count("split"); n != want {
+			t.Fatalf("node %v: split event count mismatch: have %v, want %v.", nodes[i].Host, n, want)
+		}
+	}
+	// Restore connectivity and wait for the rings and topic trees to merge
+	cluster.Network.Heal()
+	cluster.Run(2*config.PastryHealPeriod + config.PastryBootTimeout + 2*config.ScribeBeatPeriod)
+
+	// Publish from both sides and ensure all subscribers receive both events
+	if err := conns[0].Publish("heal", []byte("left")); err != nil {
+		t.Fatalf("failed to publish on the left: %v.", err)
+	}
+	if err := conns[len(left)].Publish("heal", []byte("right")); err != nil {
+		t.Fatalf("failed to publish on the right: %v.", err)
+	}
+	cluster.Until(config.PastryBootTimeout, func() bool {
+		for _, coll := range colls {
+			if coll.count("left") == 0 || coll.count("right") == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	for i, coll := range colls {
+		for _, event := range []string{"left", "right"} {
+			if n := coll.count(event); n != 1 {
+				t.Errorf("node %v: %s event count mismatch: have %v, want %v.", nodes[i].Host, event, n, 1)
+			}
+		}
+	}
+}